@@ -0,0 +1,69 @@
+package v1alpha1
+
+import (
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	DefaultNamespace   = "default"
+	DefaultWebhookPort = 8443
+	DefaultServicePort = 443
+	DefaultMetricsPort = 9999
+
+	DefaultCanaryNodes          = 1
+	DefaultVerifyTimeoutSeconds = 300
+
+	DefaultMaintenanceWindowDuration = time.Hour
+	DefaultMaintenanceWindowTimeZone = "UTC"
+)
+
+// Default fills unset fields with the same defaults which the API server applies from the CRD schema.
+// It is used when a resource is read without going through the API server, e.g. render subcommand.
+func (r *EKSPodIdentityWebhook) Default() {
+	if r.Spec.Namespace == "" {
+		r.Spec.Namespace = DefaultNamespace
+	}
+	if r.Spec.Provider == "" {
+		r.Spec.Provider = ProviderAWS
+	}
+	if r.Spec.Implementation == "" {
+		r.Spec.Implementation = ImplementationExternal
+	}
+	if r.Spec.Mode == "" {
+		r.Spec.Mode = ModeApply
+	}
+	if r.Spec.Webhook.Port == 0 {
+		r.Spec.Webhook.Port = DefaultWebhookPort
+	}
+	if r.Spec.Network.Service.Port == 0 {
+		r.Spec.Network.Service.Port = DefaultServicePort
+	}
+	if r.Spec.UpgradeStrategy.Type == "" {
+		r.Spec.UpgradeStrategy.Type = UpgradeRollingUpdate
+	}
+	if r.Spec.UpgradeStrategy.CanaryNodes == 0 {
+		r.Spec.UpgradeStrategy.CanaryNodes = DefaultCanaryNodes
+	}
+	if r.Spec.UpgradeStrategy.VerifyTimeoutSeconds == 0 {
+		r.Spec.UpgradeStrategy.VerifyTimeoutSeconds = DefaultVerifyTimeoutSeconds
+	}
+	for i := range r.Spec.MaintenanceWindows {
+		w := &r.Spec.MaintenanceWindows[i]
+		if w.Duration.Duration == 0 {
+			w.Duration = metav1.Duration{Duration: DefaultMaintenanceWindowDuration}
+		}
+		if w.TimeZone == "" {
+			w.TimeZone = DefaultMaintenanceWindowTimeZone
+		}
+	}
+	if m := r.Spec.Metrics; m != nil {
+		if m.Port == 0 {
+			m.Port = DefaultMetricsPort
+		}
+		if m.Monitor == "" {
+			m.Monitor = MonitorServiceMonitor
+		}
+	}
+}
@@ -1,7 +1,12 @@
 package v1alpha1
 
 import (
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
 // EKSPodIdentityWebhookSpec defines the desired state of EKSPodIdentityWebhook
@@ -14,8 +19,115 @@ type EKSPodIdentityWebhookSpec struct {
 	// +kubebuilder:validation:Type:=string
 	// +kubebuilder:default=default
 	Namespace string `json:"namespace"`
+	// CreateNamespace creates spec.namespace when it does not exist, and recreates it when it is deleted.
+	// Only the namespace created by the installer is deleted on uninstall.
+	// +optional
+	// +nullable
+	CreateNamespace *CreateNamespace `json:"createNamespace,omitempty"`
+	// AdoptExisting takes over pod-identity-webhook objects which already exist with the same names,
+	// e.g. installed by the upstream Makefile, instead of failing to create them.
+	// +optional
+	AdoptExisting bool `json:"adoptExisting,omitempty"`
+	// Provider is the workload identity webhook which is installed.
+	// +kubebuilder:validation:Enum=AWS
+	// +kubebuilder:default=AWS
+	// +optional
+	Provider string `json:"provider,omitempty"`
+	// Profile fills fields which are left unset with defaults of a Kubernetes distribution:
+	// network.mode, network.caSource and webhook.tolerations. auto detects the distribution from node labels,
+	// kubelet versions and the kube-apiserver pod. The effective values are reported in status.profile.
+	// +kubebuilder:validation:Enum=auto;kops;kubeadm;k3s;rke2
+	// +optional
+	Profile string `json:"profile,omitempty"`
+	// Implementation is External to run the webhook of the provider as a DaemonSet, or Embedded to mutate pods
+	// in the webhook server of the installer, which must be started with --embedded-webhook.
+	// +kubebuilder:validation:Enum=External;Embedded
+	// +kubebuilder:default=External
+	// +optional
+	Implementation string `json:"implementation,omitempty"`
+	// Mode is Apply to reconcile objects, or Plan to report what reconciliation would change in status.plan
+	// without changing anything. The manager flag --plan plans every resource regardless of it.
+	// +kubebuilder:validation:Enum=Apply;Plan
+	// +kubebuilder:default=Apply
+	// +optional
+	Mode string `json:"mode,omitempty"`
+	// Paused stops reconciliation, drift correction and CSR approval for this resource.
+	// Objects can be edited by hand while it is paused, and the changes are reverted after it is resumed
+	// by taking back ownership of the edited fields.
+	// +optional
+	Paused bool `json:"paused,omitempty"`
+	// Webhook configures the pod-identity-webhook process.
+	// +optional
+	Webhook WebhookConfig `json:"webhook,omitempty"`
+	// ExistingServiceAccountName is a ServiceAccount in spec.namespace which the webhook runs as.
+	// When it is set, the installer does not create the ServiceAccount, Role, RoleBinding, ClusterRole and ClusterRoleBinding,
+	// and verifies the permissions of the ServiceAccount with SubjectAccessReview instead.
+	// +optional
+	ExistingServiceAccountName string `json:"existingServiceAccountName,omitempty"`
+	// CommonLabels are added to every generated object and pod template.
+	// Labels generated by the installer take precedence.
+	// +optional
+	CommonLabels map[string]string `json:"commonLabels,omitempty"`
+	// CommonAnnotations are added to every generated object and pod template.
+	// +optional
+	CommonAnnotations map[string]string `json:"commonAnnotations,omitempty"`
+	// Overlays are patches applied to generated objects before they are written.
+	// +optional
+	Overlays []Overlay `json:"overlays,omitempty"`
+	// Network configures how the API server reaches the webhook.
+	// +optional
+	Network NetworkConfig `json:"network,omitempty"`
+	// Metrics exposes Prometheus metrics of the webhook with a Service, and a ServiceMonitor or PodMonitor
+	// when the CRD of Prometheus Operator is installed.
+	// +optional
+	// +nullable
+	Metrics *MetricsConfig `json:"metrics,omitempty"`
+	// UpgradeStrategy configures how a new pod template of the webhook is rolled out.
+	// +optional
+	UpgradeStrategy UpgradeStrategy `json:"upgradeStrategy,omitempty"`
+	// NetworkPolicy generates a NetworkPolicy which restricts traffic of webhook pods to the API server.
+	// +optional
+	// +nullable
+	NetworkPolicy *NetworkPolicyConfig `json:"networkPolicy,omitempty"`
+	// MaintenanceWindows restrict when changes which restart webhook pods or change the MutatingWebhookConfiguration are applied.
+	// Such changes are held until the next window, and reported in PendingChanges condition.
+	// Changes are applied at any time when it is empty.
+	// +optional
+	MaintenanceWindows []MaintenanceWindow `json:"maintenanceWindows,omitempty"`
 }
 
+const (
+	// ProviderAWS installs amazon-eks-pod-identity-webhook.
+	ProviderAWS = "AWS"
+)
+
+const (
+	// ProfileAuto detects the distribution of the cluster.
+	ProfileAuto    = "auto"
+	ProfileKops    = "kops"
+	ProfileKubeadm = "kubeadm"
+	ProfileK3s     = "k3s"
+	ProfileRKE2    = "rke2"
+)
+
+const (
+	// ImplementationExternal runs the webhook of the provider.
+	ImplementationExternal = "External"
+	// ImplementationEmbedded mutates pods in the webhook server of the installer.
+	ImplementationEmbedded = "Embedded"
+)
+
+const (
+	// ModeApply reconciles generated objects.
+	ModeApply = "Apply"
+	// ModePlan computes the changes with server-side dry-run, and only writes status.
+	ModePlan = "Plan"
+)
+
+// ForceApplyAnnotation applies changes held for a maintenance window right away.
+// The installer removes it after the changes are applied.
+const ForceApplyAnnotation = "installer.h3poteto.dev/force-apply"
+
 // EKSPodIdentityWebhookStatus defines the observed state of EKSPodIdentityWebhook
 type EKSPodIdentityWebhookStatus struct {
 	// +nullable
@@ -28,10 +140,162 @@ type EKSPodIdentityWebhookStatus struct {
 	PodIdentityWebhookConfiguration *MutatingWebhookConfigurationRef `json:"podIdentityWebhookConfiguration,omitempty"`
 	// +nullable
 	PodIdentityWebhookServiceAccount *ServiceAccountRef `json:"podIdentityWebhookServiceAccount,omitempty"`
+	// Migration is the progress of moving the webhook to a new spec.namespace.
+	// +nullable
+	Migration *NamespaceMigration `json:"migration,omitempty"`
+	// Workload summarizes webhook pods.
+	// +nullable
+	Workload *WorkloadStatus `json:"workload,omitempty"`
+	// Upgrade is the progress of a canary upgrade.
+	// +nullable
+	Upgrade *UpgradeStatus `json:"upgrade,omitempty"`
+	// LastGoodTemplate is the latest pod template which was rolled out to every node and became ready.
+	// A failed canary upgrade is rolled back to it.
+	// It is a PodTemplateSpec, which is kept without schema to keep the CRD small.
+	// +optional
+	// +nullable
+	// +kubebuilder:pruning:PreserveUnknownFields
+	LastGoodTemplate *runtime.RawExtension `json:"lastGoodTemplate,omitempty"`
+	// LastGoodRevision is the revision of LastGoodTemplate.
+	// +optional
+	LastGoodRevision string `json:"lastGoodRevision,omitempty"`
+	// Inventory lists objects which the installer applied. Objects which the current spec no longer generates
+	// are pruned from it.
+	// +optional
+	Inventory []InventoryEntry `json:"inventory,omitempty"`
+	// Plan is what reconciliation would change, which is computed in Plan mode.
+	// +nullable
+	Plan *PlanStatus `json:"plan,omitempty"`
+	// Profile is the profile applied to the spec, and the effective values of the fields which it fills.
+	// +nullable
+	Profile *ProfileStatus `json:"profile,omitempty"`
+	// Steps records the outcome of each reconciliation step in the last reconcile.
+	// +optional
+	// +listType=map
+	// +listMapKey=name
+	Steps []StepStatus `json:"steps,omitempty"`
 	// +kubebuilder:default=init
 	Phase string `json:"phase"`
+	// +optional
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+const (
+	// ConditionPreflightPassed reports whether the cluster satisfies the requirements of pod-identity-webhook.
+	ConditionPreflightPassed = "PreflightPassed"
+	// ConditionPaused reports whether reconciliation is suspended by spec.paused.
+	ConditionPaused = "Paused"
+	// ConditionOverlaysValid reports whether every overlay in spec.overlays can be applied.
+	ConditionOverlaysValid = "OverlaysValid"
+	// ConditionServiceAccountAuthorized reports whether spec.existingServiceAccountName has the permissions the webhook needs.
+	ConditionServiceAccountAuthorized = "ServiceAccountAuthorized"
+	// ConditionPodSecurityCompliant reports whether the webhook pod template satisfies the Pod Security Standard
+	// which the namespace enforces.
+	ConditionPodSecurityCompliant = "PodSecurityCompliant"
+	// ConditionPendingChanges reports changes which are held until the next maintenance window.
+	ConditionPendingChanges = "PendingChanges"
+)
+
+// CreateNamespace defines metadata of the namespace which is created by the installer.
+type CreateNamespace struct {
+	// +optional
+	Labels map[string]string `json:"labels,omitempty"`
+	// +optional
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// PodSecurity sets Pod Security Admission labels of the namespace.
+	// +optional
+	// +nullable
+	PodSecurity *PodSecurityLabels `json:"podSecurity,omitempty"`
 }
 
+// PodSecurityLabels are the levels of Pod Security Standards for each Pod Security Admission mode.
+type PodSecurityLabels struct {
+	// +optional
+	// +kubebuilder:validation:Enum=privileged;baseline;restricted
+	Enforce string `json:"enforce,omitempty"`
+	// +optional
+	// +kubebuilder:validation:Enum=privileged;baseline;restricted
+	Audit string `json:"audit,omitempty"`
+	// +optional
+	// +kubebuilder:validation:Enum=privileged;baseline;restricted
+	Warn string `json:"warn,omitempty"`
+	// Version pins the version of Pod Security Standards, e.g. v1.25. latest is used when it is empty.
+	// +optional
+	Version string `json:"version,omitempty"`
+}
+
+// WorkloadStatus summarizes the workload which runs webhook pods.
+type WorkloadStatus struct {
+	// Kind of the workload, e.g. DaemonSet.
+	Kind string `json:"kind"`
+	// Desired is the number of nodes which should run a webhook pod.
+	Desired int32 `json:"desired"`
+	// ReadyReplicas is the number of nodes which run a ready webhook pod.
+	ReadyReplicas int32 `json:"readyReplicas"`
+	// Updated is the number of nodes which run the latest pod template.
+	Updated int32 `json:"updated"`
+	// Unavailable is the number of nodes which should run a webhook pod but have no available one.
+	Unavailable int32 `json:"unavailable"`
+	// Ready is ReadyReplicas/Desired, e.g. 3/3.
+	// +optional
+	Ready string `json:"ready,omitempty"`
+	// Version is the image tag of the webhook in the pod template.
+	// +optional
+	Version string `json:"version,omitempty"`
+	// ImageDigests are image IDs which webhook containers are actually running.
+	// +optional
+	ImageDigests []string `json:"imageDigests,omitempty"`
+	// NotReadyPods lists webhook pods which are not ready.
+	// +optional
+	NotReadyPods []PodHealth `json:"notReadyPods,omitempty"`
+	// CertificateExpiry is when the serving certificate of the webhook expires.
+	// +optional
+	// +nullable
+	CertificateExpiry *metav1.Time `json:"certificateExpiry,omitempty"`
+}
+
+// PodHealth is the reason why a webhook pod is not ready.
+type PodHealth struct {
+	// +optional
+	Node string `json:"node,omitempty"`
+	Pod  string `json:"pod"`
+	// Reason is the waiting or terminated reason of the webhook container, e.g. CrashLoopBackOff or ImagePullBackOff,
+	// or the phase of the pod when the container has not been created.
+	// +optional
+	Reason string `json:"reason,omitempty"`
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// NamespaceMigration tracks moving the webhook from a namespace to another one.
+// It is recorded in status, so the migration resumes after the installer restarts.
+type NamespaceMigration struct {
+	// From is the namespace where the webhook was running before the migration.
+	// +kubebuilder:validation:Required
+	From string `json:"from"`
+	// To is the namespace where the webhook is migrated to.
+	// +kubebuilder:validation:Required
+	To string `json:"to"`
+	// +kubebuilder:validation:Enum=Provisioning;Switching;CleaningUp
+	Phase string `json:"phase"`
+	// Abandoned is a namespace which was a target of this migration before spec.namespace changed again.
+	// Objects in it are deleted.
+	// +optional
+	Abandoned string      `json:"abandoned,omitempty"`
+	StartedAt metav1.Time `json:"startedAt"`
+}
+
+const (
+	// MigrationPhaseProvisioning brings up the webhook in the new namespace and waits for it to be ready.
+	MigrationPhaseProvisioning = "Provisioning"
+	// MigrationPhaseSwitching points the MutatingWebhookConfiguration at the Service in the new namespace.
+	MigrationPhaseSwitching = "Switching"
+	// MigrationPhaseCleaningUp deletes the objects and the TLS secret in the old namespace.
+	MigrationPhaseCleaningUp = "CleaningUp"
+)
+
 type SecretRef Ref
 type ServiceRef Ref
 type DaemonsetRef Ref
@@ -40,6 +304,9 @@ type MutatingWebhookConfigurationRef struct {
 	// +kubebuilder:validation:Required
 	// +kubebuilder:validation:Type=string
 	Name string `json:"name"`
+	// Adopted is true when the object existed before the installer and was adopted.
+	// +optional
+	Adopted bool `json:"adopted,omitempty"`
 }
 
 type Ref struct {
@@ -49,12 +316,379 @@ type Ref struct {
 	// +kubebuilder:validation:Required
 	// +kubebuilder:validation:Type=string
 	Name string `json:"name"`
+	// Adopted is true when the object existed before the installer and was adopted.
+	// +optional
+	Adopted bool `json:"adopted,omitempty"`
+}
+
+// WebhookConfig configures the pod-identity-webhook process.
+type WebhookConfig struct {
+	// Port is the HTTPS port which the webhook listens on. Probes and the Service target it.
+	// It is not a privileged port by default, because the webhook runs as non-root.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	// +kubebuilder:default=8443
+	// +optional
+	Port int32 `json:"port,omitempty"`
+	// AWSDefaultRegion sets AWS_DEFAULT_REGION and AWS_REGION in mutated pods.
+	// +optional
+	AWSDefaultRegion string `json:"awsDefaultRegion,omitempty"`
+	// STSRegionalEndpoints sets AWS_STS_REGIONAL_ENDPOINTS=regional in every mutated pod.
+	// It can also be enabled per ServiceAccount with the eks.amazonaws.com/sts-regional-endpoints annotation.
+	// +optional
+	STSRegionalEndpoints bool `json:"stsRegionalEndpoints,omitempty"`
+	// LivenessProbe overrides thresholds of the liveness probe against /healthz.
+	// +optional
+	LivenessProbe *ProbeConfig `json:"livenessProbe,omitempty"`
+	// ReadinessProbe overrides thresholds of the readiness probe against /healthz.
+	// +optional
+	ReadinessProbe *ProbeConfig `json:"readinessProbe,omitempty"`
+	// PodSecurityContext is merged into the hardened pod security context generated by the installer.
+	// +optional
+	PodSecurityContext *corev1.PodSecurityContext `json:"podSecurityContext,omitempty"`
+	// SecurityContext is merged into the hardened security context of the webhook container,
+	// e.g. set readOnlyRootFilesystem to false.
+	// +optional
+	SecurityContext *corev1.SecurityContext `json:"securityContext,omitempty"`
+	// Tolerations of webhook pods, e.g. to run them on control plane nodes. spec.profile sets them when it is empty.
+	// +optional
+	Tolerations []corev1.Toleration `json:"tolerations,omitempty"`
+}
+
+const (
+	// NetworkModeService points the MutatingWebhookConfiguration at the Service, whose endpoints are pod IPs.
+	NetworkModeService = "Service"
+	// NetworkModeHostNetwork runs webhook pods in the host network, so endpoints of the Service are node IPs.
+	NetworkModeHostNetwork = "HostNetwork"
+	// NetworkModeNodePort exposes the Service on a node port, and the MutatingWebhookConfiguration uses network.url.
+	NetworkModeNodePort = "NodePort"
+	// NetworkModeURL points the MutatingWebhookConfiguration at network.url, e.g. a load balancer in front of the Service.
+	NetworkModeURL = "URL"
+)
+
+const (
+	// CASourceServiceAccountToken reads ca.crt of the token Secret of the default ServiceAccount.
+	CASourceServiceAccountToken = "ServiceAccountToken"
+	// CASourceRootCAConfigMap reads ca.crt of the kube-root-ca.crt ConfigMap.
+	CASourceRootCAConfigMap = "RootCAConfigMap"
+)
+
+// NetworkConfig configures how the API server reaches the webhook.
+type NetworkConfig struct {
+	// Mode is the topology between the API server and webhook pods.
+	// Use HostNetwork, NodePort or URL when the API server can not route to pod IPs.
+	// It is Service unless spec.profile sets it.
+	// +kubebuilder:validation:Enum=Service;HostNetwork;NodePort;URL
+	// +optional
+	Mode string `json:"mode,omitempty"`
+	// CASource is where the CA which signs certificates issued from CertificateSigningRequests is read,
+	// which is caBundle of the MutatingWebhookConfiguration in Service and HostNetwork modes.
+	// ServiceAccountToken reads ca.crt of the token Secret of the default ServiceAccount, and RootCAConfigMap reads
+	// the kube-root-ca.crt ConfigMap, which exists on clusters that no longer create token Secrets.
+	// It is ServiceAccountToken unless spec.profile sets it.
+	// +kubebuilder:validation:Enum=ServiceAccountToken;RootCAConfigMap
+	// +optional
+	CASource string `json:"caSource,omitempty"`
+	// URL is clientConfig.url of the MutatingWebhookConfiguration in NodePort and URL modes,
+	// e.g. https://pod-identity-webhook.example.com:30443/mutate.
+	// +kubebuilder:validation:Pattern=`^https://`
+	// +optional
+	URL string `json:"url,omitempty"`
+	// TLSSecretName is a kubernetes.io/tls Secret in spec.namespace which has tls.crt, tls.key and ca.crt.
+	// It is required in NodePort and URL modes, because the certificate issued from a CertificateSigningRequest
+	// covers only the DNS names of the Service. The host of url must be a SAN of tls.crt,
+	// and ca.crt is used as caBundle of the MutatingWebhookConfiguration.
+	// +optional
+	TLSSecretName string `json:"tlsSecretName,omitempty"`
+	// Service configures the generated Service.
+	// +optional
+	Service ServiceConfig `json:"service,omitempty"`
+}
+
+// ServiceConfig configures the Service of the webhook.
+type ServiceConfig struct {
+	// Port is the port of the Service.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	// +kubebuilder:default=443
+	// +optional
+	Port int32 `json:"port,omitempty"`
+	// TargetPort is the port of pods which the Service sends requests to. webhook.port is used when it is empty.
+	// +optional
+	TargetPort *intstr.IntOrString `json:"targetPort,omitempty"`
+	// NodePort is the node port in NodePort mode. It is allocated by the API server when it is empty.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	// +optional
+	NodePort int32 `json:"nodePort,omitempty"`
+	// +kubebuilder:validation:Enum=SingleStack;PreferDualStack;RequireDualStack
+	// +optional
+	IPFamilyPolicy *corev1.IPFamilyPolicyType `json:"ipFamilyPolicy,omitempty"`
+	// InternalTrafficPolicy requires Kubernetes 1.22 or later.
+	// +kubebuilder:validation:Enum=Cluster;Local
+	// +optional
+	InternalTrafficPolicy string `json:"internalTrafficPolicy,omitempty"`
+}
+
+const (
+	MonitorServiceMonitor = "ServiceMonitor"
+	MonitorPodMonitor     = "PodMonitor"
+)
+
+// MetricsConfig configures Prometheus metrics of the webhook.
+type MetricsConfig struct {
+	// Port is the HTTP port which the webhook serves /metrics on.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	// +kubebuilder:default=9999
+	// +optional
+	Port int32 `json:"port,omitempty"`
+	// Monitor is the kind of monitoring.coreos.com/v1 object which scrapes the metrics.
+	// +kubebuilder:validation:Enum=ServiceMonitor;PodMonitor
+	// +kubebuilder:default=ServiceMonitor
+	// +optional
+	Monitor string `json:"monitor,omitempty"`
+	// Interval is the scrape interval, e.g. 30s. The interval of Prometheus is used when it is empty.
+	// +optional
+	Interval string `json:"interval,omitempty"`
+	// Labels are added to the ServiceMonitor or PodMonitor, e.g. to match serviceMonitorSelector of Prometheus.
+	// +optional
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+const (
+	// UpgradeRollingUpdate rolls a new pod template out to every node with the RollingUpdate strategy of DaemonSet.
+	UpgradeRollingUpdate = "RollingUpdate"
+	// UpgradeCanary rolls a new pod template out to canary nodes first, and promotes it after they are verified.
+	UpgradeCanary = "Canary"
+)
+
+// UpgradeStrategy configures how a new pod template of the webhook is rolled out.
+type UpgradeStrategy struct {
+	// +kubebuilder:validation:Enum=RollingUpdate;Canary
+	// +kubebuilder:default=RollingUpdate
+	// +optional
+	Type string `json:"type,omitempty"`
+	// CanaryNodes is the number of nodes which run the new pod template first.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:default=1
+	// +optional
+	CanaryNodes int32 `json:"canaryNodes,omitempty"`
+	// VerifyTimeoutSeconds is how long canary pods can take to become ready and pass the mutation probe.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:default=300
+	// +optional
+	VerifyTimeoutSeconds int32 `json:"verifyTimeoutSeconds,omitempty"`
+	// SkipMutationProbe verifies canary pods by readiness only. The mutation probe sends an AdmissionReview
+	// from the installer to canary pods, so set it when a NetworkPolicy blocks the installer.
+	// +optional
+	SkipMutationProbe bool `json:"skipMutationProbe,omitempty"`
+}
+
+const (
+	// UpgradePhaseCanary runs the new pod template on canary nodes and verifies it.
+	UpgradePhaseCanary = "Canary"
+	// UpgradePhasePromoting rolls the verified pod template out to the rest of nodes.
+	UpgradePhasePromoting = "Promoting"
+	// UpgradePhaseRolledBack means the new pod template failed and the last good template was restored.
+	// The upgrade is not retried until the pod template changes again.
+	UpgradePhaseRolledBack = "RolledBack"
+)
+
+// UpgradeStatus is the progress of a canary upgrade.
+type UpgradeStatus struct {
+	// Revision is the hash of the pod template which is being rolled out.
+	Revision string `json:"revision"`
+	// +kubebuilder:validation:Enum=Canary;Promoting;RolledBack
+	Phase string `json:"phase"`
+	// CanaryNodes are nodes which run the new pod template first.
+	// +optional
+	CanaryNodes []string `json:"canaryNodes,omitempty"`
+	// LastTransitionTime is when the phase changed.
+	LastTransitionTime metav1.Time `json:"lastTransitionTime"`
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// ProfileStatus is the profile applied to the spec.
+type ProfileStatus struct {
+	// Name is the applied profile. It is empty when spec.profile is auto and no distribution is detected.
+	// +optional
+	Name string `json:"name,omitempty"`
+	// DetectedBy explains how the distribution was detected when spec.profile is auto.
+	// +optional
+	DetectedBy string `json:"detectedBy,omitempty"`
+	// ObservedGeneration is the generation of the resource when the profile was resolved.
+	// The distribution is detected again only after the spec changes.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// NetworkMode is the effective spec.network.mode.
+	NetworkMode string `json:"networkMode"`
+	// CASource is the effective spec.network.caSource.
+	CASource string `json:"caSource"`
+	// Tolerations are the effective spec.webhook.tolerations.
+	// +optional
+	Tolerations []corev1.Toleration `json:"tolerations,omitempty"`
+	// Issuer is the service account issuer of the cluster, which is the URL of the OIDC identity provider
+	// to register in IAM. It is read from the kube-apiserver pod, or from a token issued by TokenRequest.
+	// +optional
+	Issuer string `json:"issuer,omitempty"`
+}
+
+// PlanStatus is the result of the last plan.
+type PlanStatus struct {
+	// PlannedAt is when the plan was computed. It is kept while the plan is not changed.
+	PlannedAt metav1.Time `json:"plannedAt"`
+	// Summary counts the actions, e.g. "2 to create, 1 to update, 0 to adopt, 0 to delete".
+	Summary string `json:"summary"`
+	// +optional
+	Actions []PlannedAction `json:"actions,omitempty"`
+}
+
+const (
+	PlanActionCreate    = "Create"
+	PlanActionUpdate    = "Update"
+	PlanActionAdopt     = "Adopt"
+	PlanActionDelete    = "Delete"
+	PlanActionUnchanged = "Unchanged"
+	// PlanActionConflict is an object which reconciliation can not write, e.g. it is not owned by the installer.
+	PlanActionConflict = "Conflict"
+)
+
+// PlannedAction is a change of an object which reconciliation would make.
+type PlannedAction struct {
+	// +kubebuilder:validation:Enum=Create;Update;Adopt;Delete;Unchanged;Conflict
+	Action string `json:"action"`
+	Kind   string `json:"kind"`
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+	// Diff lists changed fields as "path: live -> planned".
+	// +optional
+	Diff []string `json:"diff,omitempty"`
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// MaintenanceWindow is a period which starts on a cron schedule.
+type MaintenanceWindow struct {
+	// Schedule is a cron expression with five fields, minute hour day-of-month month day-of-week, e.g. "0 2 * * 1-5".
+	// @hourly, @daily, @weekly and @monthly are also accepted.
+	// +kubebuilder:validation:MinLength=1
+	Schedule string `json:"schedule"`
+	// Duration is how long the window stays open after it starts, e.g. "2h".
+	// +kubebuilder:default="1h"
+	// +optional
+	Duration metav1.Duration `json:"duration,omitempty"`
+	// TimeZone is an IANA time zone which Schedule is evaluated in, e.g. "Asia/Tokyo".
+	// +kubebuilder:default=UTC
+	// +optional
+	TimeZone string `json:"timeZone,omitempty"`
+}
+
+// NetworkPolicyConfig configures the NetworkPolicy of webhook pods.
+// Ingress is allowed only on the webhook port, and egress only to the API server.
+type NetworkPolicyConfig struct {
+	// APIServerCIDRs are addresses of the API server, e.g. subnets of the control plane ENIs on EKS.
+	// Ingress is allowed from them and egress is allowed to them.
+	// +kubebuilder:validation:MinItems=1
+	APIServerCIDRs []string `json:"apiServerCIDRs"`
+	// From are additional peers which can send requests to the webhook port.
+	// The installer pods are always allowed, because they send the mutation probe of canary upgrades.
+	// They can also scrape the metrics port when spec.metrics is set.
+	// +optional
+	From []networkingv1.NetworkPolicyPeer `json:"from,omitempty"`
+}
+
+// ProbeConfig is thresholds of a probe. Unset fields use the defaults of the installer.
+type ProbeConfig struct {
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	InitialDelaySeconds *int32 `json:"initialDelaySeconds,omitempty"`
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	PeriodSeconds *int32 `json:"periodSeconds,omitempty"`
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	TimeoutSeconds *int32 `json:"timeoutSeconds,omitempty"`
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	SuccessThreshold *int32 `json:"successThreshold,omitempty"`
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	FailureThreshold *int32 `json:"failureThreshold,omitempty"`
+}
+
+const (
+	// OverlayStrategicMerge is a strategic merge patch.
+	OverlayStrategicMerge = "StrategicMerge"
+	// OverlayJSON6902 is a list of RFC 6902 JSON patch operations.
+	OverlayJSON6902 = "JSON6902"
+)
+
+// Overlay is a patch applied to generated objects.
+type Overlay struct {
+	// +kubebuilder:validation:Required
+	Target OverlayTarget `json:"target"`
+	// +kubebuilder:validation:Enum=StrategicMerge;JSON6902
+	// +kubebuilder:default=StrategicMerge
+	// +optional
+	Type string `json:"type,omitempty"`
+	// Patch is a strategic merge patch, or a list of RFC 6902 operations, in YAML or JSON.
+	// +kubebuilder:validation:Required
+	Patch string `json:"patch"`
+}
+
+// OverlayTarget selects generated objects which an overlay is applied to.
+type OverlayTarget struct {
+	// +kubebuilder:validation:Enum=Namespace;ServiceAccount;Role;RoleBinding;ClusterRole;ClusterRoleBinding;Service;NetworkPolicy;DaemonSet;MutatingWebhookConfiguration;ServiceMonitor;PodMonitor
+	Kind string `json:"kind"`
+	// Name of the object. All objects of the kind are selected when it is empty.
+	// +optional
+	Name string `json:"name,omitempty"`
+}
+
+const (
+	// StepSucceeded means the step finished and the objects it manages are ready.
+	StepSucceeded = "Succeeded"
+	// StepWaiting means the step is waiting for something, e.g. pods to become ready.
+	StepWaiting = "Waiting"
+	// StepFailed means the step returned an error.
+	StepFailed = "Failed"
+	// StepBlocked means the step did not run because a step it depends on is not succeeded.
+	StepBlocked = "Blocked"
+)
+
+// InventoryEntry is an object which the installer applied.
+type InventoryEntry struct {
+	// +optional
+	Group   string `json:"group,omitempty"`
+	Version string `json:"version"`
+	Kind    string `json:"kind"`
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+	// UID identifies the object, so an object which is recreated by someone else is not pruned.
+	UID types.UID `json:"uid"`
+}
+
+// StepStatus is the outcome of a reconciliation step.
+type StepStatus struct {
+	// +kubebuilder:validation:Required
+	Name string `json:"name"`
+	// +kubebuilder:validation:Enum=Succeeded;Waiting;Failed;Blocked
+	Outcome string `json:"outcome"`
+	// +optional
+	Message string `json:"message,omitempty"`
 }
 
 //+kubebuilder:object:root=true
 //+kubebuilder:resource:scope=Cluster
 //+kubebuilder:subresource:status
 //+kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+//+kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.workload.ready`
+//+kubebuilder:printcolumn:name="Version",type=string,JSONPath=`.status.workload.version`
+//+kubebuilder:printcolumn:name="CertExpiry",type=string,JSONPath=`.status.workload.certificateExpiry`
 
 // EKSPodIdentityWebhook is the Schema for the ekspodidentitywebhooks API
 type EKSPodIdentityWebhook struct {
@@ -18,7 +18,12 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
+	// Embed the time zone database, which spec.maintenanceWindows are evaluated with.
+	_ "time/tzdata"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
@@ -26,14 +31,20 @@ import (
 
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/kubernetes"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
 
 	installerv1alpha1 "github.com/h3poteto/eks-pod-identity-webhook-installer/api/v1alpha1"
 	"github.com/h3poteto/eks-pod-identity-webhook-installer/pkg/controllers/csr"
 	"github.com/h3poteto/eks-pod-identity-webhook-installer/pkg/controllers/ekspodidentitywebhook"
+	"github.com/h3poteto/eks-pod-identity-webhook-installer/pkg/doctor"
+	"github.com/h3poteto/eks-pod-identity-webhook-installer/pkg/generator"
+	"github.com/h3poteto/eks-pod-identity-webhook-installer/pkg/mutation"
+	"github.com/h3poteto/eks-pod-identity-webhook-installer/pkg/render"
 	//+kubebuilder:scaffold:imports
 )
 
@@ -50,14 +61,48 @@ func init() {
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "render":
+			if err := render.Run(os.Args[2:], os.Stdout); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			return
+		case "doctor":
+			ok, err := doctor.Run(os.Args[2:], os.Stdout)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			if !ok {
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var plan bool
+	var embeddedWebhook bool
+	var embeddedWebhookService string
+	var webhookCertDir string
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.BoolVar(&plan, "plan", false,
+		"Report what reconciliation would change in status.plan of every EKSPodIdentityWebhook, without changing anything. "+
+			"It is the same as spec.mode: Plan.")
+	flag.BoolVar(&embeddedWebhook, "embedded-webhook", false,
+		"Serve the mutation of spec.implementation: Embedded in the webhook server of the installer.")
+	flag.StringVar(&embeddedWebhookService, "embedded-webhook-service", generator.EmbeddedService.String(),
+		"namespace/name of the Service in front of the webhook server of the installer.")
+	flag.StringVar(&webhookCertDir, "webhook-cert-dir", filepath.Join(os.TempDir(), "k8s-webhook-server", "serving-certs"),
+		"The directory which has tls.crt, tls.key and ca.crt of the webhook server.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -66,10 +111,19 @@ func main() {
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
+	if namespace, name := splitNamespacedName(embeddedWebhookService); namespace != "" && name != "" {
+		generator.EmbeddedService.Namespace = namespace
+		generator.EmbeddedService.Name = name
+	} else {
+		setupLog.Error(fmt.Errorf("%q is not namespace/name", embeddedWebhookService), "invalid --embedded-webhook-service")
+		os.Exit(1)
+	}
+
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme:                 scheme,
 		MetricsBindAddress:     metricsAddr,
 		Port:                   9443,
+		CertDir:                webhookCertDir,
 		HealthProbeBindAddress: probeAddr,
 		LeaderElection:         enableLeaderElection,
 		LeaderElectionID:       "0675da30.h3poteto.dev",
@@ -78,27 +132,47 @@ func main() {
 		setupLog.Error(err, "unable to start manager")
 		os.Exit(1)
 	}
+	clientset, err := kubernetes.NewForConfig(mgr.GetConfig())
+	if err != nil {
+		setupLog.Error(err, "unable to create clientset")
+		os.Exit(1)
+	}
 
 	if err = (&ekspodidentitywebhook.EKSPodIdentityWebhookReconciler{
-		Client:   mgr.GetClient(),
-		Scheme:   mgr.GetScheme(),
-		Logger:   ctrl.Log.WithName("controllers").WithName("EKSPodIdentityWebhook"),
-		Recorder: mgr.GetEventRecorderFor("EKSPodIdentityWebhook"),
+		Client:    mgr.GetClient(),
+		Scheme:    mgr.GetScheme(),
+		Logger:    ctrl.Log.WithName("controllers").WithName("EKSPodIdentityWebhook"),
+		Recorder:  mgr.GetEventRecorderFor("EKSPodIdentityWebhook"),
+		APIReader: mgr.GetAPIReader(),
+		Clientset: clientset,
+		Plan:      plan,
+
+		EmbeddedWebhook: embeddedWebhook,
+		WebhookCertDir:  webhookCertDir,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "EKSPodIdentityWebhook")
 		os.Exit(1)
 	}
 	if err = (&csr.CSRReconciler{
-		Client:   mgr.GetClient(),
-		Scheme:   mgr.GetScheme(),
-		Logger:   ctrl.Log.WithName("controllers").WithName("CSR"),
-		Recorder: mgr.GetEventRecorderFor("CSR"),
+		Client:    mgr.GetClient(),
+		Scheme:    mgr.GetScheme(),
+		Logger:    ctrl.Log.WithName("controllers").WithName("CSR"),
+		Recorder:  mgr.GetEventRecorderFor("CSR"),
+		Clientset: clientset,
+		Plan:      plan,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "CSR")
 		os.Exit(1)
 	}
 	//+kubebuilder:scaffold:builder
 
+	if embeddedWebhook {
+		mgr.GetWebhookServer().Register(generator.EmbeddedWebhookPath, &webhook.Admission{Handler: &mutation.Handler{
+			Client: mgr.GetClient(),
+			Logger: ctrl.Log.WithName("webhooks").WithName("Pod"),
+		}})
+	}
+
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
 		setupLog.Error(err, "unable to set up health check")
 		os.Exit(1)
@@ -114,3 +188,11 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+func splitNamespacedName(s string) (string, string) {
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		return "", ""
+	}
+	return parts[0], parts[1]
+}
@@ -4,7 +4,10 @@ import (
 	"context"
 
 	"github.com/go-logr/logr"
+	installerv1alpha1 "github.com/h3poteto/eks-pod-identity-webhook-installer/api/v1alpha1"
 	"github.com/h3poteto/eks-pod-identity-webhook-installer/pkg/generator"
+	"github.com/h3poteto/eks-pod-identity-webhook-installer/pkg/profile"
+	"github.com/h3poteto/eks-pod-identity-webhook-installer/pkg/provider"
 	certificatesv1 "k8s.io/api/certificates/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -21,11 +24,16 @@ type CSRReconciler struct {
 	Scheme   *runtime.Scheme
 	Logger   logr.Logger
 	Recorder record.EventRecorder
+	// Clientset approves CSRs, because the controller-runtime client does not serve the approval subresource.
+	Clientset clientset.Interface
+	// Plan skips approval for every resource as spec.mode: Plan does.
+	Plan bool
 }
 
 //+kubebuilder:rbac:groups=certificates.k8s.io,resources=certificatesigningrequests,verbs=get;list;watch;update;patch
 //+kubebuilder:rbac:groups=certificates.k8s.io,resources=certificatesigningrequests/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
+//+kubebuilder:rbac:groups=installer.h3poteto.dev,resources=ekspodidentitywebhooks,verbs=get;list;watch
 
 func (r *CSRReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	_ = log.FromContext(ctx)
@@ -53,12 +61,26 @@ func (r *CSRReconciler) SetupWithManager(mgr ctrl.Manager) error {
 }
 
 func (r *CSRReconciler) approveCSR(ctx context.Context, resource *certificatesv1.CertificateSigningRequest) error {
-	if generator.Namespace == "" {
-		r.Logger.Info("Namespace is not set, so waiting for namespace")
+	owner, namespace, err := r.findOwner(ctx, resource)
+	if err != nil {
+		return err
+	}
+	if owner == nil {
+		r.Logger.Info("CSR is not owned", "Name", resource.Name)
+		return nil
+	}
+	if owner.Spec.Paused {
+		r.Logger.Info("EKSPodIdentityWebhook is paused, so skip approval", "Name", resource.Name, "EKSPodIdentityWebhook", owner.Name)
+		return nil
+	}
+	if r.Plan || owner.Spec.Mode == installerv1alpha1.ModePlan {
+		r.Logger.Info("EKSPodIdentityWebhook is in Plan mode, so skip approval", "Name", resource.Name, "EKSPodIdentityWebhook", owner.Name)
 		return nil
 	}
-	if resource.Spec.Username != "system:serviceaccount:"+generator.Namespace+":"+generator.ServiceAccountName {
-		r.Logger.Info("CSR is not owned", resource.Namespace, resource.Name)
+	// The stored spec leaves fields which the profile fills unset, so the network mode is read from the effective spec.
+	owner = profile.Effective(owner)
+	if generator.UsesURL(owner) {
+		r.Logger.Info("EKSPodIdentityWebhook serves spec.network.tlsSecretName, so skip approval", "Name", resource.Name, "EKSPodIdentityWebhook", owner.Name, "networkMode", generator.NetworkMode(owner))
 		return nil
 	}
 
@@ -77,10 +99,11 @@ func (r *CSRReconciler) approveCSR(ctx context.Context, resource *certificatesv1
 		}
 	}
 
-	rest := ctrl.GetConfigOrDie()
-	client, err := clientset.NewForConfig(rest)
-	if err != nil {
-		return err
+	p := provider.For(owner)
+	if err := p.ValidateCSR(resource, namespace, generator.ServiceName); err != nil {
+		r.Logger.Info("CSR is not a serving certificate of the webhook, so skip approval", "Name", resource.Name, "Provider", p.Name(), "reason", err.Error())
+		r.Recorder.Eventf(resource, corev1.EventTypeWarning, "ApprovalSkipped", "CertificateSigningRequest %s is not approved: %v", resource.Name, err)
+		return nil
 	}
 
 	resource.Status.Conditions = append(resource.Status.Conditions, certificatesv1.CertificateSigningRequestCondition{
@@ -90,7 +113,7 @@ func (r *CSRReconciler) approveCSR(ctx context.Context, resource *certificatesv1
 		Message:        "This CSR was approved by eks-pod-identity-webhook-installer",
 		LastUpdateTime: metav1.Now(),
 	})
-	_, err = client.CertificatesV1().CertificateSigningRequests().UpdateApproval(ctx, resource.Name, resource, metav1.UpdateOptions{})
+	_, err = r.Clientset.CertificatesV1().CertificateSigningRequests().UpdateApproval(ctx, resource.Name, resource, metav1.UpdateOptions{})
 	if err != nil {
 		r.Logger.Error(err, "Failed to update", "CSR", resource.Name)
 		r.Recorder.Eventf(resource, corev1.EventTypeWarning, "ApproveFailed", "Failed to approve CertificateSigningRequest %s", resource.Name)
@@ -101,3 +124,24 @@ func (r *CSRReconciler) approveCSR(ctx context.Context, resource *certificatesv1
 
 	return nil
 }
+
+// findOwner returns the EKSPodIdentityWebhook whose webhook ServiceAccount requested the CSR, and the namespace of the ServiceAccount.
+func (r *CSRReconciler) findOwner(ctx context.Context, resource *certificatesv1.CertificateSigningRequest) (*installerv1alpha1.EKSPodIdentityWebhook, string, error) {
+	list := installerv1alpha1.EKSPodIdentityWebhookList{}
+	if err := r.Client.List(ctx, &list); err != nil {
+		r.Logger.Error(err, "Failed to list EKSPodIdentityWebhook")
+		return nil, "", err
+	}
+	for i := range list.Items {
+		owner := &list.Items[i]
+		name := generator.WebhookServiceAccountName(owner)
+		if resource.Spec.Username == "system:serviceaccount:"+owner.Spec.Namespace+":"+name {
+			return owner, owner.Spec.Namespace, nil
+		}
+		// The webhook in the old namespace keeps running until the migration finishes.
+		if m := owner.Status.Migration; m != nil && resource.Spec.Username == "system:serviceaccount:"+m.From+":"+name {
+			return owner, m.From, nil
+		}
+	}
+	return nil, "", nil
+}
@@ -0,0 +1,228 @@
+package csr
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"strings"
+	"testing"
+
+	certificatesv1 "k8s.io/api/certificates/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	fakeclientset "k8s.io/client-go/kubernetes/fake"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	installerv1alpha1 "github.com/h3poteto/eks-pod-identity-webhook-installer/api/v1alpha1"
+	"github.com/h3poteto/eks-pod-identity-webhook-installer/pkg/generator"
+)
+
+func testReconciler(t *testing.T, objects ...client.Object) *CSRReconciler {
+	t.Helper()
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := installerv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	return &CSRReconciler{
+		Client:    fake.NewClientBuilder().WithScheme(scheme).WithObjects(objects...).Build(),
+		Scheme:    scheme,
+		Logger:    logf.NullLogger{},
+		Recorder:  record.NewFakeRecorder(100),
+		Clientset: fakeclientset.NewSimpleClientset(),
+	}
+}
+
+func webhook(name, namespace string, migration *installerv1alpha1.NamespaceMigration) *installerv1alpha1.EKSPodIdentityWebhook {
+	resource := &installerv1alpha1.EKSPodIdentityWebhook{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       installerv1alpha1.EKSPodIdentityWebhookSpec{Namespace: namespace, TokenAudience: "sts.amazonaws.com"},
+	}
+	resource.Status.Migration = migration
+	return resource
+}
+
+func requestedBy(namespace string) *certificatesv1.CertificateSigningRequest {
+	return &certificatesv1.CertificateSigningRequest{
+		ObjectMeta: metav1.ObjectMeta{Name: "csr"},
+		Spec:       certificatesv1.CertificateSigningRequestSpec{Username: "system:serviceaccount:" + namespace + ":" + generator.ServiceAccountName},
+	}
+}
+
+func TestFindOwner(t *testing.T) {
+	migrating := webhook("migrating", "new", &installerv1alpha1.NamespaceMigration{From: "old", To: "new", Phase: installerv1alpha1.MigrationPhaseSwitching})
+	other := webhook("other", "other", nil)
+
+	cases := []struct {
+		name      string
+		requester string
+		owner     string
+		namespace string
+	}{
+		{name: "new namespace", requester: "new", owner: "migrating", namespace: "new"},
+		// The webhook in the old namespace keeps running, and renews its certificate, until the migration finishes.
+		{name: "old namespace during the migration", requester: "old", owner: "migrating", namespace: "old"},
+		{name: "another resource", requester: "other", owner: "other", namespace: "other"},
+		{name: "unknown namespace", requester: "unknown"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := testReconciler(t, migrating, other)
+			owner, namespace, err := r.findOwner(context.Background(), requestedBy(c.requester))
+			if err != nil {
+				t.Fatal(err)
+			}
+			name := ""
+			if owner != nil {
+				name = owner.Name
+			}
+			if name != c.owner || namespace != c.namespace {
+				t.Errorf("owner is %q in %q, want %q in %q", name, namespace, c.owner, c.namespace)
+			}
+		})
+	}
+
+	// The old namespace is not matched once the migration finishes.
+	finished := webhook("migrating", "new", nil)
+	owner, _, err := testReconciler(t, finished).findOwner(context.Background(), requestedBy("old"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner != nil {
+		t.Errorf("owner is %s after the migration", owner.Name)
+	}
+}
+
+// servingRequest returns a CSR of the serving certificate of the webhook in namespace, as the webhook requests it.
+func servingRequest(t *testing.T, namespace string) *certificatesv1.CertificateSigningRequest {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commonName := generator.ServiceName + "." + namespace + ".svc"
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: commonName},
+		DNSNames: []string{generator.ServiceName, generator.ServiceName + "." + namespace, commonName},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr := requestedBy(namespace)
+	csr.Spec.Request = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+	csr.Spec.Usages = []certificatesv1.KeyUsage{certificatesv1.UsageDigitalSignature, certificatesv1.UsageKeyEncipherment, certificatesv1.UsageServerAuth}
+	return csr
+}
+
+func TestApproveCSR(t *testing.T) {
+	ctx := context.Background()
+	condition := func(conditionType certificatesv1.RequestConditionType) func(*certificatesv1.CertificateSigningRequest) {
+		return func(csr *certificatesv1.CertificateSigningRequest) {
+			csr.Status.Conditions = []certificatesv1.CertificateSigningRequestCondition{{Type: conditionType, Status: corev1.ConditionTrue}}
+		}
+	}
+
+	cases := []struct {
+		name      string
+		owner     func(*installerv1alpha1.EKSPodIdentityWebhook)
+		plan      bool
+		requester string
+		csr       func(*certificatesv1.CertificateSigningRequest)
+		approved  bool
+		// event is the reason of the recorded event.
+		event string
+	}{
+		{name: "serving certificate", approved: true, event: "Approved"},
+		{name: "not owned", requester: "other"},
+		{name: "paused", owner: func(o *installerv1alpha1.EKSPodIdentityWebhook) { o.Spec.Paused = true }},
+		{name: "Plan mode", owner: func(o *installerv1alpha1.EKSPodIdentityWebhook) { o.Spec.Mode = installerv1alpha1.ModePlan }},
+		{name: "--plan", plan: true},
+		{
+			// The webhook serves spec.network.tlsSecretName, so nothing should request a certificate.
+			name: "URL mode",
+			owner: func(o *installerv1alpha1.EKSPodIdentityWebhook) {
+				o.Spec.Network = installerv1alpha1.NetworkConfig{Mode: installerv1alpha1.NetworkModeURL, URL: "https://webhook.example.com/mutate", TLSSecretName: "tls"}
+			},
+		},
+		{
+			name: "NodePort mode",
+			owner: func(o *installerv1alpha1.EKSPodIdentityWebhook) {
+				o.Spec.Network = installerv1alpha1.NetworkConfig{Mode: installerv1alpha1.NetworkModeNodePort, URL: "https://node.example.com:30443/mutate", TLSSecretName: "tls"}
+			},
+		},
+		{name: "already approved", csr: condition(certificatesv1.CertificateApproved)},
+		{name: "already denied", csr: condition(certificatesv1.CertificateDenied)},
+		{name: "already failed", csr: condition(certificatesv1.CertificateFailed)},
+		{
+			name: "not a serving certificate",
+			csr: func(csr *certificatesv1.CertificateSigningRequest) {
+				csr.Spec.Usages = append(csr.Spec.Usages, certificatesv1.UsageClientAuth)
+			},
+			event: "ApprovalSkipped",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			owner := webhook("cluster", "kube-system", nil)
+			if c.owner != nil {
+				c.owner(owner)
+			}
+			requester := c.requester
+			if requester == "" {
+				requester = "kube-system"
+			}
+			csr := servingRequest(t, requester)
+			if c.csr != nil {
+				c.csr(csr)
+			}
+			r := testReconciler(t, owner)
+			r.Plan = c.plan
+			clientset := fakeclientset.NewSimpleClientset(csr.DeepCopy())
+			r.Clientset = clientset
+
+			if err := r.approveCSR(ctx, csr); err != nil {
+				t.Fatal(err)
+			}
+			approved := false
+			for _, action := range clientset.Actions() {
+				if action.GetVerb() == "update" && action.GetSubresource() == "approval" {
+					approved = true
+				}
+			}
+			if approved != c.approved {
+				t.Fatalf("approved is %v, want %v", approved, c.approved)
+			}
+			if c.approved {
+				live, err := clientset.CertificatesV1().CertificateSigningRequests().Get(ctx, csr.Name, metav1.GetOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(live.Status.Conditions) != 1 || live.Status.Conditions[0].Type != certificatesv1.CertificateApproved || live.Status.Conditions[0].Status != corev1.ConditionTrue {
+					t.Errorf("conditions are %+v", live.Status.Conditions)
+				}
+			}
+			events := r.Recorder.(*record.FakeRecorder).Events
+			select {
+			case event := <-events:
+				if c.event == "" || !strings.Contains(event, c.event) {
+					t.Errorf("event is %q, want %q", event, c.event)
+				}
+			default:
+				if c.event != "" {
+					t.Errorf("event %s is not recorded", c.event)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package ekspodidentitywebhook
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	installerv1alpha1 "github.com/h3poteto/eks-pod-identity-webhook-installer/api/v1alpha1"
+	"github.com/h3poteto/eks-pod-identity-webhook-installer/pkg/provider"
+)
+
+// adopt checks whether an object which was not created by the installer, e.g. installed by the upstream Makefile, can be taken over.
+// The caller applies the generated object with forced ownership, which sets the resource as the controller of the object.
+func (r *EKSPodIdentityWebhookReconciler) adopt(resource *installerv1alpha1.EKSPodIdentityWebhook, obj client.Object, kind string, incompatible error) error {
+	key := obj.GetName()
+	if obj.GetNamespace() != "" {
+		key = obj.GetNamespace() + "/" + obj.GetName()
+	}
+	if !resource.Spec.AdoptExisting {
+		err := fmt.Errorf("%s %s already exists and is not owned by %s, set spec.adoptExisting to adopt it", kind, key, resource.Name)
+		r.Logger.Error(err, "Failed to adopt", "Kind", kind, "Name", key)
+		r.Recorder.Eventf(resource, corev1.EventTypeWarning, kind+"AlreadyExists", "%s already exists, set spec.adoptExisting to adopt it", key)
+		return err
+	}
+	if owner := metav1.GetControllerOf(obj); owner != nil {
+		err := fmt.Errorf("%s %s is controlled by %s %s", kind, key, owner.Kind, owner.Name)
+		r.Logger.Error(err, "Failed to adopt", "Kind", kind, "Name", key)
+		r.Recorder.Eventf(resource, corev1.EventTypeWarning, kind+"AdoptionFailed", "Failed to adopt %s: %v", key, err)
+		return err
+	}
+	if incompatible != nil {
+		r.Logger.Error(incompatible, "Failed to adopt", "Kind", kind, "Name", key)
+		r.Recorder.Eventf(resource, corev1.EventTypeWarning, kind+"AdoptionFailed", "Failed to adopt %s: %v", key, incompatible)
+		return incompatible
+	}
+	r.Logger.Info("Adopting", "Kind", kind, "Name", key)
+	return nil
+}
+
+// replaceAdopted updates an adopted object whose generated fields are replaced.
+// Server-side apply keeps list entries owned by other managers, e.g. a webhook with another name,
+// so they are removed with an update once before the installer applies the object.
+func (r *EKSPodIdentityWebhookReconciler) replaceAdopted(ctx context.Context, resource *installerv1alpha1.EKSPodIdentityWebhook, obj client.Object, kind string) error {
+	if err := r.Client.Update(ctx, obj, client.FieldOwner(FieldManager)); err != nil {
+		key := obj.GetName()
+		if obj.GetNamespace() != "" {
+			key = obj.GetNamespace() + "/" + obj.GetName()
+		}
+		r.Logger.Error(err, "Failed to adopt", "Kind", kind, "Name", key)
+		r.Recorder.Eventf(resource, corev1.EventTypeWarning, kind+"AdoptionFailed", "Failed to adopt %s: %v", key, err)
+		return err
+	}
+	return nil
+}
+
+func validateAdoptedDaemonset(resource *installerv1alpha1.EKSPodIdentityWebhook, daemonset *appsv1.DaemonSet) error {
+	if daemonset.Spec.Selector == nil || len(daemonset.Spec.Selector.MatchExpressions) > 0 {
+		return fmt.Errorf("selector of %s/%s must consist of matchLabels only", daemonset.Namespace, daemonset.Name)
+	}
+	image := provider.For(resource).ImageName()
+	for _, c := range daemonset.Spec.Template.Spec.Containers {
+		if imageName(c.Image) == image {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s/%s does not run %s", daemonset.Namespace, daemonset.Name, image)
+}
+
+// imageName returns the last component of the repository of an image reference, without the registry, the path, the tag and the digest,
+// e.g. amazon-eks-pod-identity-webhook of 111122223333.dkr.ecr.us-east-1.amazonaws.com/mirror/amazon-eks-pod-identity-webhook:v0.3.0,
+// so that the image is matched in any registry which mirrors it.
+func imageName(image string) string {
+	if i := strings.Index(image, "@"); i >= 0 {
+		image = image[:i]
+	}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image = image[:i]
+	}
+	return image[strings.LastIndex(image, "/")+1:]
+}
+
+func validateAdoptedService(service, generated *corev1.Service) error {
+	expected := generated.Spec.Type
+	if expected == "" {
+		expected = corev1.ServiceTypeClusterIP
+	}
+	if actual := service.Spec.Type; actual != expected && !(actual == "" && expected == corev1.ServiceTypeClusterIP) {
+		return fmt.Errorf("%s/%s is %s, but %s is required", service.Namespace, service.Name, actual, expected)
+	}
+	if service.Spec.ClusterIP == corev1.ClusterIPNone {
+		return fmt.Errorf("%s/%s is a headless service", service.Namespace, service.Name)
+	}
+	return nil
+}
+
+func validateAdoptedMutatingWebhookConfiguration(mutating, generated *admissionregistrationv1.MutatingWebhookConfiguration, service *corev1.Service) error {
+	if len(generated.Webhooks) > 0 && generated.Webhooks[0].ClientConfig.URL != nil {
+		// The generated webhook points at a URL, so the existing webhooks are replaced whichever they point at.
+		return nil
+	}
+	for _, w := range mutating.Webhooks {
+		ref := w.ClientConfig.Service
+		if ref == nil {
+			return fmt.Errorf("webhook %s of %s does not use a service", w.Name, mutating.Name)
+		}
+		if ref.Namespace != service.Namespace || ref.Name != service.Name {
+			return fmt.Errorf("webhook %s of %s points to %s/%s instead of %s/%s", w.Name, mutating.Name, ref.Namespace, ref.Name, service.Namespace, service.Name)
+		}
+	}
+	return nil
+}
+
+func containsLabels(labels, expected map[string]string) bool {
+	for k, v := range expected {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,246 @@
+package ekspodidentitywebhook
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/h3poteto/eks-pod-identity-webhook-installer/pkg/generator"
+)
+
+func TestImageName(t *testing.T) {
+	cases := map[string]string{
+		"amazon-eks-pod-identity-webhook":                                                       "amazon-eks-pod-identity-webhook",
+		"amazon/amazon-eks-pod-identity-webhook:v0.3.0":                                         "amazon-eks-pod-identity-webhook",
+		"localhost:5000/amazon-eks-pod-identity-webhook":                                        "amazon-eks-pod-identity-webhook",
+		"111122223333.dkr.ecr.us-east-1.amazonaws.com/mirror/amazon-eks-pod-identity-webhook:1": "amazon-eks-pod-identity-webhook",
+		"amazon/amazon-eks-pod-identity-webhook@sha256:0123":                                    "amazon-eks-pod-identity-webhook",
+		"amazon/amazon-eks-pod-identity-webhook:v0.3.0@sha256:0123":                             "amazon-eks-pod-identity-webhook",
+		"example/amazon-eks-pod-identity-webhook-fork:v1":                                       "amazon-eks-pod-identity-webhook-fork",
+	}
+	for image, want := range cases {
+		if got := imageName(image); got != want {
+			t.Errorf("name of %s is %q, want %q", image, got, want)
+		}
+	}
+}
+
+func TestValidateAdoptedDaemonset(t *testing.T) {
+	daemonset := func(selector *metav1.LabelSelector, images ...string) *appsv1.DaemonSet {
+		d := &appsv1.DaemonSet{ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: generator.DaemonsetName}}
+		d.Spec.Selector = selector
+		for _, image := range images {
+			d.Spec.Template.Spec.Containers = append(d.Spec.Template.Spec.Containers, corev1.Container{Name: "c", Image: image})
+		}
+		return d
+	}
+	labels := &metav1.LabelSelector{MatchLabels: map[string]string{"app": "pod-identity-webhook"}}
+
+	cases := []struct {
+		name      string
+		daemonset *appsv1.DaemonSet
+		wantErr   string
+	}{
+		{name: "upstream", daemonset: daemonset(labels, "amazon/amazon-eks-pod-identity-webhook:latest")},
+		{name: "mirror", daemonset: daemonset(labels, "registry.example.com/amazon-eks-pod-identity-webhook@sha256:0123")},
+		{name: "sidecar", daemonset: daemonset(labels, "busybox", "amazon/amazon-eks-pod-identity-webhook:v0.3.0")},
+		{
+			// The name contains the webhook image, but it is another image.
+			name:      "image which contains the name",
+			daemonset: daemonset(labels, "example/amazon-eks-pod-identity-webhook-fork:v1"),
+			wantErr:   "does not run amazon-eks-pod-identity-webhook",
+		},
+		{name: "other image", daemonset: daemonset(labels, "nginx"), wantErr: "does not run"},
+		{name: "no selector", daemonset: daemonset(nil, "amazon/amazon-eks-pod-identity-webhook"), wantErr: "matchLabels only"},
+		{
+			name: "match expressions",
+			daemonset: daemonset(&metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{
+				{Key: "app", Operator: metav1.LabelSelectorOpExists},
+			}}, "amazon/amazon-eks-pod-identity-webhook"),
+			wantErr: "matchLabels only",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			checkError(t, validateAdoptedDaemonset(testResource(), c.daemonset), c.wantErr)
+		})
+	}
+}
+
+func TestValidateAdoptedService(t *testing.T) {
+	service := func(serviceType corev1.ServiceType, clusterIP string) *corev1.Service {
+		return &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: generator.ServiceName},
+			Spec:       corev1.ServiceSpec{Type: serviceType, ClusterIP: clusterIP},
+		}
+	}
+	cases := []struct {
+		name      string
+		service   *corev1.Service
+		generated *corev1.Service
+		wantErr   string
+	}{
+		{name: "ClusterIP", service: service(corev1.ServiceTypeClusterIP, "10.0.0.1"), generated: service("", "")},
+		{name: "type is unset", service: service("", "10.0.0.1"), generated: service(corev1.ServiceTypeClusterIP, "")},
+		{name: "NodePort", service: service(corev1.ServiceTypeNodePort, ""), generated: service(corev1.ServiceTypeNodePort, "")},
+		{name: "type differs", service: service(corev1.ServiceTypeNodePort, "10.0.0.1"), generated: service("", ""), wantErr: "ClusterIP is required"},
+		{name: "headless", service: service(corev1.ServiceTypeClusterIP, corev1.ClusterIPNone), generated: service("", ""), wantErr: "headless"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			checkError(t, validateAdoptedService(c.service, c.generated), c.wantErr)
+		})
+	}
+}
+
+func TestValidateAdoptedMutatingWebhookConfiguration(t *testing.T) {
+	service := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: generator.ServiceName}}
+	mutating := func(configs ...admissionregistrationv1.WebhookClientConfig) *admissionregistrationv1.MutatingWebhookConfiguration {
+		m := &admissionregistrationv1.MutatingWebhookConfiguration{ObjectMeta: metav1.ObjectMeta{Name: "pod-identity-webhook"}}
+		for _, config := range configs {
+			m.Webhooks = append(m.Webhooks, admissionregistrationv1.MutatingWebhook{Name: "pod-identity-webhook.amazonaws.com", ClientConfig: config})
+		}
+		return m
+	}
+	toService := func(namespace, name string) admissionregistrationv1.WebhookClientConfig {
+		return admissionregistrationv1.WebhookClientConfig{Service: &admissionregistrationv1.ServiceReference{Namespace: namespace, Name: name}}
+	}
+	toURL := admissionregistrationv1.WebhookClientConfig{URL: pointer.StringPtr("https://webhook.example.com/mutate")}
+
+	cases := []struct {
+		name      string
+		mutating  *admissionregistrationv1.MutatingWebhookConfiguration
+		generated *admissionregistrationv1.MutatingWebhookConfiguration
+		wantErr   string
+	}{
+		{name: "same service", mutating: mutating(toService("kube-system", generator.ServiceName)), generated: mutating(toService("kube-system", generator.ServiceName))},
+		{name: "no webhooks", mutating: mutating(), generated: mutating(toService("kube-system", generator.ServiceName))},
+		{
+			name:      "other service",
+			mutating:  mutating(toService("kube-system", generator.ServiceName), toService("default", "other")),
+			generated: mutating(toService("kube-system", generator.ServiceName)),
+			wantErr:   "points to default/other",
+		},
+		{name: "URL", mutating: mutating(toURL), generated: mutating(toService("kube-system", generator.ServiceName)), wantErr: "does not use a service"},
+		{
+			// The generated webhook replaces the existing webhooks wherever they point at.
+			name:      "generated URL",
+			mutating:  mutating(toService("default", "other")),
+			generated: mutating(toURL),
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			checkError(t, validateAdoptedMutatingWebhookConfiguration(c.mutating, c.generated, service), c.wantErr)
+		})
+	}
+}
+
+func TestAdopt(t *testing.T) {
+	resource := testResource()
+	resource.UID = "resource-uid"
+	other := testResource()
+	other.Name = "other"
+	other.UID = "other-uid"
+	service := func(owners []metav1.OwnerReference) *corev1.Service {
+		return &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: generator.ServiceName, OwnerReferences: owners}}
+	}
+
+	cases := []struct {
+		name         string
+		adopt        bool
+		obj          client.Object
+		incompatible error
+		wantErr      string
+	}{
+		{name: "adopted", adopt: true, obj: service(nil)},
+		{name: "adoptExisting is not set", obj: service(nil), wantErr: "set spec.adoptExisting"},
+		{name: "controlled by another", adopt: true, obj: service(ownedBy(other)), wantErr: "is controlled by EKSPodIdentityWebhook other"},
+		{name: "incompatible", adopt: true, obj: service(nil), incompatible: errors.New("incompatible"), wantErr: "incompatible"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := testReconciler(t)
+			res := resource.DeepCopy()
+			res.Spec.AdoptExisting = c.adopt
+			checkError(t, r.adopt(res, c.obj, "Service", c.incompatible), c.wantErr)
+			if events := len(r.Recorder.(*record.FakeRecorder).Events); (events > 0) != (c.wantErr != "") {
+				t.Errorf("%d events are recorded", events)
+			}
+		})
+	}
+}
+
+// failingUpdateClient fails every update.
+type failingUpdateClient struct {
+	client.Client
+}
+
+func (c *failingUpdateClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	return errors.New("injected error")
+}
+
+func TestReplaceAdopted(t *testing.T) {
+	ctx := context.Background()
+	resource := testResource()
+	live := &admissionregistrationv1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "pod-identity-webhook"},
+		Webhooks: []admissionregistrationv1.MutatingWebhook{
+			{Name: "pod-identity-webhook.amazonaws.com"},
+			{Name: "stale.example.com"},
+		},
+	}
+
+	r := testReconciler(t, live)
+	replaced := &admissionregistrationv1.MutatingWebhookConfiguration{}
+	if err := r.Client.Get(ctx, client.ObjectKeyFromObject(live), replaced); err != nil {
+		t.Fatal(err)
+	}
+	replaced.Webhooks = replaced.Webhooks[:1]
+	if err := r.replaceAdopted(ctx, resource, replaced, "MutatingWebhookConfiguration"); err != nil {
+		t.Fatal(err)
+	}
+	got := &admissionregistrationv1.MutatingWebhookConfiguration{}
+	if err := r.Client.Get(ctx, client.ObjectKeyFromObject(live), got); err != nil {
+		t.Fatal(err)
+	}
+	// The webhook which is not generated is removed, because apply would keep it.
+	if len(got.Webhooks) != 1 || got.Webhooks[0].Name != "pod-identity-webhook.amazonaws.com" {
+		t.Errorf("webhooks are %+v", got.Webhooks)
+	}
+
+	r.Client = &failingUpdateClient{Client: r.Client}
+	if err := r.replaceAdopted(ctx, resource, got, "MutatingWebhookConfiguration"); err == nil {
+		t.Error("error of the update is not returned")
+	}
+	select {
+	case event := <-r.Recorder.(*record.FakeRecorder).Events:
+		if !strings.Contains(event, "MutatingWebhookConfigurationAdoptionFailed") {
+			t.Errorf("event is %q", event)
+		}
+	default:
+		t.Error("failure is not recorded")
+	}
+}
+
+func checkError(t *testing.T, err error, want string) {
+	t.Helper()
+	if want == "" {
+		if err != nil {
+			t.Errorf("error is returned: %v", err)
+		}
+		return
+	}
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("error is %v, want %q", err, want)
+	}
+}
@@ -0,0 +1,173 @@
+package ekspodidentitywebhook
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+
+	installerv1alpha1 "github.com/h3poteto/eks-pod-identity-webhook-installer/api/v1alpha1"
+)
+
+// FieldManager is the field manager of server-side apply for generated objects.
+const FieldManager = "eks-pod-identity-webhook-installer"
+
+// legacyFieldManagers wrote generated objects with Create and Update before server-side apply.
+// Their fields are taken over without reporting a conflict.
+var legacyFieldManagers = map[string]bool{
+	"manager": true,
+}
+
+var conflictManagerPattern = regexp.MustCompile(`conflict with "([^"]+)"`)
+
+// errApplyConflict is returned when other managers own fields which the installer generates with other values.
+var errApplyConflict = errors.New("fields are managed by other field managers")
+
+// applyObject creates or updates obj with server-side apply, and records an event.
+// Fields owned by other managers are not overwritten unless force is true, e.g. when the object is adopted,
+// or changes made while the resource was paused are reverted.
+// On success obj is updated with the response.
+func (r *EKSPodIdentityWebhookReconciler) applyObject(ctx context.Context, resource *installerv1alpha1.EKSPodIdentityWebhook, obj client.Object, kind string, force bool) error {
+	return r.applyObjectWithSpec(ctx, resource, obj, kind, force, nil)
+}
+
+// applyObjectWithSpec is applyObject which also applies fields of spec, which the typed obj can not carry.
+func (r *EKSPodIdentityWebhookReconciler) applyObjectWithSpec(ctx context.Context, resource *installerv1alpha1.EKSPodIdentityWebhook, obj client.Object, kind string, force bool, spec map[string]interface{}) error {
+	key := obj.GetName()
+	if obj.GetNamespace() != "" {
+		key = obj.GetNamespace() + "/" + obj.GetName()
+	}
+
+	exists := obj.DeepCopyObject().(client.Object)
+	err := r.Client.Get(ctx, client.ObjectKeyFromObject(obj), exists)
+	if err != nil && !kerrors.IsNotFound(err) {
+		r.Logger.Error(err, "Failed to get object", "Kind", kind, "Name", key)
+		return err
+	}
+	created := kerrors.IsNotFound(err)
+
+	u, err := r.toApplyConfiguration(obj, spec)
+	if err != nil {
+		return err
+	}
+	force = force || reverting(resource)
+	opts := []client.PatchOption{client.FieldOwner(FieldManager)}
+	if force {
+		opts = append(opts, client.ForceOwnership)
+	}
+	err = r.Client.Patch(ctx, u, client.Apply, opts...)
+	if kerrors.IsConflict(err) && !force {
+		managers, fields := applyConflicts(err)
+		if legacy(managers) {
+			r.Logger.Info("Taking over fields from the legacy field manager", "Kind", kind, "Name", key, "Managers", managers)
+			u, err = r.toApplyConfiguration(obj, spec)
+			if err != nil {
+				return err
+			}
+			err = r.Client.Patch(ctx, u, client.Apply, client.FieldOwner(FieldManager), client.ForceOwnership)
+		} else {
+			r.Logger.Error(err, "Conflict on apply", "Kind", kind, "Name", key, "Managers", managers)
+			r.Recorder.Eventf(resource, corev1.EventTypeWarning, kind+"ApplyConflict", "%s has fields managed by %s: %s", key, strings.Join(managers, ", "), strings.Join(fields, ", "))
+			return fmt.Errorf("%s %s: %w", kind, key, errApplyConflict)
+		}
+	}
+	if err != nil {
+		if created {
+			r.Logger.Error(err, "Failed to create", "Kind", kind, "Name", key)
+			r.Recorder.Eventf(resource, corev1.EventTypeWarning, kind+"CreationFailed", "Failed to create %s", key)
+		} else {
+			r.Logger.Error(err, "Failed to update", "Kind", kind, "Name", key)
+			r.Recorder.Eventf(resource, corev1.EventTypeWarning, kind+"UpdateFailed", "Failed to update %s", key)
+		}
+		return err
+	}
+
+	switch {
+	case created:
+		r.Recorder.Eventf(resource, corev1.EventTypeNormal, kind+"Created", "Success to create %s", key)
+		r.Logger.Info("Success to create", "Kind", kind, "Name", key)
+	case u.GetResourceVersion() != exists.GetResourceVersion():
+		r.Recorder.Eventf(resource, corev1.EventTypeNormal, kind+"Updated", "Success to update %s", key)
+		r.Logger.Info("Success to update", "Kind", kind, "Name", key)
+	}
+	if uobj, ok := obj.(*unstructured.Unstructured); ok {
+		uobj.Object = u.Object
+		return nil
+	}
+	return runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, obj)
+}
+
+// toApplyConfiguration converts a generated object into an apply configuration.
+// Fields which the installer does not generate, e.g. status and creationTimestamp, are removed,
+// so that the installer does not own them. Fields in spec are merged into spec of the object.
+func (r *EKSPodIdentityWebhookReconciler) toApplyConfiguration(obj client.Object, spec map[string]interface{}) (*unstructured.Unstructured, error) {
+	gvk, err := apiutil.GVKForObject(obj, r.Scheme)
+	if err != nil {
+		return nil, err
+	}
+	// Unstructured objects are converted without copy, so copy them not to modify obj.
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj.DeepCopyObject())
+	if err != nil {
+		return nil, err
+	}
+	u := &unstructured.Unstructured{Object: content}
+	u.SetGroupVersionKind(gvk)
+	u.SetResourceVersion("")
+	u.SetManagedFields(nil)
+	unstructured.RemoveNestedField(u.Object, "status")
+	unstructured.RemoveNestedField(u.Object, "metadata", "creationTimestamp")
+	unstructured.RemoveNestedField(u.Object, "spec", "template", "metadata", "creationTimestamp")
+	for field, value := range spec {
+		if err := unstructured.SetNestedField(u.Object, value, "spec", field); err != nil {
+			return nil, err
+		}
+	}
+	return u, nil
+}
+
+// applyConflicts returns the conflicting managers and fields in a conflict error of server-side apply.
+func applyConflicts(err error) ([]string, []string) {
+	status, ok := err.(kerrors.APIStatus)
+	if !ok || status.Status().Details == nil {
+		return nil, nil
+	}
+	managers := map[string]bool{}
+	fields := []string{}
+	for _, cause := range status.Status().Details.Causes {
+		if cause.Type != metav1.CauseTypeFieldManagerConflict {
+			continue
+		}
+		if m := conflictManagerPattern.FindStringSubmatch(cause.Message); m != nil {
+			managers[m[1]] = true
+		}
+		fields = append(fields, cause.Field)
+	}
+	names := make([]string, 0, len(managers))
+	for m := range managers {
+		names = append(names, m)
+	}
+	sort.Strings(names)
+	return names, fields
+}
+
+func legacy(managers []string) bool {
+	if len(managers) == 0 {
+		return false
+	}
+	for _, m := range managers {
+		if !legacyFieldManagers[m] {
+			return false
+		}
+	}
+	return true
+}
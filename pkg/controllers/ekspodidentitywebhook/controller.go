@@ -19,16 +19,21 @@ package ekspodidentitywebhook
 import (
 	"context"
 	"fmt"
-	"reflect"
+	"time"
 
 	"github.com/go-logr/logr"
 	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	clientset "k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -36,14 +41,31 @@ import (
 
 	installerv1alpha1 "github.com/h3poteto/eks-pod-identity-webhook-installer/api/v1alpha1"
 	"github.com/h3poteto/eks-pod-identity-webhook-installer/pkg/generator"
+	"github.com/h3poteto/eks-pod-identity-webhook-installer/pkg/preflight"
 )
 
+// preflightRetryInterval is how long we wait before running failed preflight checks again.
+const preflightRetryInterval = 1 * time.Minute
+
+// rootCAConfigMapName is the ConfigMap which has the CA of the cluster in every namespace.
+const rootCAConfigMapName = "kube-root-ca.crt"
+
 // EKSPodIdentityWebhookReconciler reconciles a EKSPodIdentityWebhook object
 type EKSPodIdentityWebhookReconciler struct {
 	client.Client
 	Scheme   *runtime.Scheme
 	Logger   logr.Logger
 	Recorder record.EventRecorder
+	// APIReader reads objects which are not cached, e.g. webhook pods. Client is used when it is nil.
+	APIReader client.Reader
+	// Clientset calls APIs which the controller-runtime client does not serve, e.g. discovery and TokenRequest.
+	Clientset clientset.Interface
+	// Plan plans every resource as spec.mode: Plan does.
+	Plan bool
+	// EmbeddedWebhook is true when the webhook server of the installer serves the mutation of Embedded implementation.
+	EmbeddedWebhook bool
+	// WebhookCertDir is the certificate directory of the webhook server, which has ca.crt.
+	WebhookCertDir string
 }
 
 //+kubebuilder:rbac:groups=installer.h3poteto.dev,resources=ekspodidentitywebhooks,verbs=get;list;watch;create;update;patch;delete
@@ -51,11 +73,19 @@ type EKSPodIdentityWebhookReconciler struct {
 //+kubebuilder:rbac:groups=installer.h3poteto.dev,resources=ekspodidentitywebhooks/finalizers,verbs=update
 //+kubebuilder:rbac:groups=apps,resources=daemonsets,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=core,resources=services;serviceaccounts,verbs=get;list;watch;create;update;patch;delete
-//+kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch
+//+kubebuilder:rbac:groups=networking.k8s.io,resources=networkpolicies,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=monitoring.coreos.com,resources=servicemonitors;podmonitors,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;delete
+//+kubebuilder:rbac:groups=core,resources=nodes,verbs=list
+//+kubebuilder:rbac:groups=core,resources=configmaps,verbs=get
+//+kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch;delete
+//+kubebuilder:rbac:groups=core,resources=namespaces,verbs=get;list;watch;create;update;patch
+//+kubebuilder:rbac:groups=core,resources=serviceaccounts/token,verbs=create
 //+kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=roles;clusterroles,verbs=get;list;watch;create;update;patch;delete;escalate;bind
 //+kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=rolebindings;clusterrolebindings,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups="admissionregistration.k8s.io",resources=mutatingwebhookconfigurations,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
+//+kubebuilder:rbac:groups=authorization.k8s.io,resources=subjectaccessreviews,verbs=create
 
 func (r *EKSPodIdentityWebhookReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	_ = log.FromContext(ctx)
@@ -67,288 +97,392 @@ func (r *EKSPodIdentityWebhookReconciler) Reconcile(ctx context.Context, req ctr
 		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
 
-	if err := r.syncEKSPodIdentityWebhook(ctx, &resource); err != nil {
+	original := resource.DeepCopy()
+
+	if err := r.syncProfile(ctx, &resource); err != nil {
+		r.Logger.Error(err, "Failed to sync profile", "Namespace", req.Namespace, "Name", req.Name)
+		return ctrl.Result{}, err
+	}
+
+	paused, err := r.syncPaused(ctx, &resource)
+	if err != nil {
+		r.Logger.Error(err, "Failed to sync paused", "Namespace", req.Namespace, "Name", req.Name)
+		return ctrl.Result{}, err
+	}
+	if paused {
+		return ctrl.Result{}, r.patchStatus(ctx, original, &resource)
+	}
+
+	generator.Namespace = resource.Spec.Namespace
+	if r.planning(&resource) {
+		err := r.syncPlan(ctx, &resource)
+		if err := r.patchStatus(ctx, original, &resource); err != nil {
+			return ctrl.Result{}, err
+		}
+		if err != nil {
+			r.Logger.Error(err, "Failed to plan EKSPodIdentityWebhook", "Namespace", req.Namespace, "Name", req.Name)
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{RequeueAfter: planInterval}, nil
+	}
+	resource.Status.Plan = nil
+
+	r.Logger.Info("Syncing", "Namespace", resource.Namespace, "Name", resource.Name)
+	state := &syncState{resource: &resource}
+	result, err := r.runSteps(ctx, state, r.steps(&resource))
+	result.RequeueAfter = sooner(result.RequeueAfter, r.syncPendingChanges(state))
+	r.finishRevert(state, err)
+	if err := r.patchStatus(ctx, original, &resource); err != nil {
+		return ctrl.Result{}, err
+	}
+	if err != nil {
 		r.Logger.Error(err, "Failed to sync EKSPodIdentityWebhook", "Namespace", req.Namespace, "Name", req.Name)
 		return ctrl.Result{}, err
 	}
+	if err := r.finishForceApply(ctx, state); err != nil {
+		return ctrl.Result{}, err
+	}
+	return result, nil
+}
 
-	return ctrl.Result{}, nil
+// reader returns APIReader, or Client when it is nil.
+func (r *EKSPodIdentityWebhookReconciler) reader() client.Reader {
+	if r.APIReader != nil {
+		return r.APIReader
+	}
+	return r.Client
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *EKSPodIdentityWebhookReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&installerv1alpha1.EKSPodIdentityWebhook{}).
+		Owns(&appsv1.DaemonSet{}).
+		Owns(&corev1.Namespace{}).
 		Complete(r)
 }
 
-func (r *EKSPodIdentityWebhookReconciler) syncEKSPodIdentityWebhook(ctx context.Context, resource *installerv1alpha1.EKSPodIdentityWebhook) error {
-	r.Logger.Info("Syncing", "Namespace", resource.Namespace, "Name", resource.Name)
+// preflight checks the cluster before we create anything, and records the result in PreflightPassed condition.
+// Checks are skipped once they passed for the current generation.
+func (r *EKSPodIdentityWebhookReconciler) preflight(ctx context.Context, resource *installerv1alpha1.EKSPodIdentityWebhook) bool {
+	current := meta.FindStatusCondition(resource.Status.Conditions, installerv1alpha1.ConditionPreflightPassed)
+	if current != nil && current.Status == metav1.ConditionTrue && current.ObservedGeneration == resource.Generation {
+		return true
+	}
+
+	checker := &preflight.Checker{
+		Client:    r.Client,
+		Clientset: r.Clientset,
+	}
+	results := checker.Run(ctx, resource)
+	passed := preflight.Passed(results)
+
+	condition := metav1.Condition{
+		Type:               installerv1alpha1.ConditionPreflightPassed,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: resource.Generation,
+		Reason:             "PreflightSucceeded",
+		Message:            preflight.Summary(results),
+	}
+	if !passed {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "PreflightFailed"
+		r.Logger.Info("Preflight checks failed", "Name", resource.Name, "message", condition.Message)
+		r.Recorder.Eventf(resource, corev1.EventTypeWarning, "PreflightFailed", "Preflight checks failed: %s", condition.Message)
+	} else {
+		r.Recorder.Event(resource, corev1.EventTypeNormal, "PreflightSucceeded", "Preflight checks passed")
+	}
+	meta.SetStatusCondition(&resource.Status.Conditions, condition)
+	return passed
+}
 
-	generator.Namespace = resource.Spec.Namespace
+func (r *EKSPodIdentityWebhookReconciler) createServiceAccount(ctx context.Context, resource *installerv1alpha1.EKSPodIdentityWebhook) (*corev1.ServiceAccount, error) {
+	serviceAccount := generator.GenerateServiceAccount(resource)
+	if err := generator.ApplyOverlays(resource, serviceAccount); err != nil {
+		return nil, err
+	}
+	if err := r.applyObject(ctx, resource, serviceAccount, "ServiceAccount", false); err != nil {
+		return nil, err
+	}
 
-	newResource := resource.DeepCopy()
+	role := generator.GenerateRole(resource)
+	if err := generator.ApplyOverlays(resource, role); err != nil {
+		return nil, err
+	}
+	if err := r.applyObject(ctx, resource, role, "Role", false); err != nil {
+		return nil, err
+	}
 
-	create, serviceAccount, err := r.serviceAccountShouldCreate(ctx, newResource.Status.PodIdentityWebhookServiceAccount)
-	if err != nil {
-		return err
+	roleBinding := generator.GenerateRoleBinding(resource, role, serviceAccount)
+	if err := generator.ApplyOverlays(resource, roleBinding); err != nil {
+		return nil, err
 	}
-	if create {
-		serviceAccount, err = r.createServiceAccount(ctx, newResource)
-		if err != nil {
-			return err
-		}
+	if err := r.applyObject(ctx, resource, roleBinding, "RoleBinding", false); err != nil {
+		return nil, err
 	}
-	{
-		newResource.Status.PodIdentityWebhookServiceAccount = &installerv1alpha1.ServiceAccountRef{
-			Namespace: serviceAccount.Namespace,
-			Name:      serviceAccount.Name,
-		}
-		if !reflect.DeepEqual(resource.Status, newResource.Status) {
-			if err := r.Client.Status().Update(ctx, newResource); err != nil {
-				r.Logger.Error(err, "Failed to update EKSPodIdentityWebhook")
-				return err
-			}
-			r.Logger.Info("Success to update")
-			return nil
-		}
+
+	clusterRole := generator.GenerateClusterRole(resource)
+	if err := generator.ApplyOverlays(resource, clusterRole); err != nil {
+		return nil, err
+	}
+	if err := r.applyObject(ctx, resource, clusterRole, "ClusterRole", false); err != nil {
+		return nil, err
 	}
 
-	create, service, err := r.serviceShouldCreate(ctx, newResource.Status.PodIdentityWebhookService)
-	if err != nil {
-		return err
+	clusterRoleBinding := generator.GenerateClusterRoleBinding(resource, clusterRole, serviceAccount)
+	if m := resource.Status.Migration; m != nil && m.From != serviceAccount.Namespace {
+		// Keep the webhook in the old namespace working until the migration finishes.
+		clusterRoleBinding.Subjects = append(clusterRoleBinding.Subjects, rbacv1.Subject{
+			Kind:      "ServiceAccount",
+			Name:      serviceAccount.Name,
+			Namespace: m.From,
+		})
 	}
-	if create {
-		service, err = r.createService(ctx, newResource)
-		if err != nil {
-			return err
-		}
+	if err := generator.ApplyOverlays(resource, clusterRoleBinding); err != nil {
+		return nil, err
 	}
-	{
-		newResource.Status.PodIdentityWebhookService = &installerv1alpha1.ServiceRef{
-			Namespace: service.Namespace,
-			Name:      service.Name,
-		}
-		if !reflect.DeepEqual(resource.Status, newResource.Status) {
-			if err := r.Client.Status().Update(ctx, newResource); err != nil {
-				r.Logger.Error(err, "Failed to update EKSPodIdentityWebhook")
-				return err
-			}
-			r.Logger.Info("Success to update")
-			return nil
-		}
+	if err := r.applyObject(ctx, resource, clusterRoleBinding, "ClusterRoleBinding", false); err != nil {
+		return nil, err
 	}
+	return serviceAccount, nil
+}
 
-	create, daemonset, err := r.daemonsetShouldCreate(ctx, newResource.Status.PodIdentityWebhookDaemonset)
+// ensureDaemonset applies the DaemonSet when the existing one differs from the generated one.
+// It returns true when the existing DaemonSet was adopted.
+// mutate, if it is not nil, can change the generated DaemonSet before it is compared, e.g. the pod template during an upgrade.
+// exists is nil when the DaemonSet does not exist.
+// A new pod template restarts webhook pods, so it is held by gate outside of maintenance windows.
+func (r *EKSPodIdentityWebhookReconciler) ensureDaemonset(
+	ctx context.Context,
+	resource *installerv1alpha1.EKSPodIdentityWebhook,
+	gate *maintenanceGate,
+	mutate func(desired, exists *appsv1.DaemonSet),
+) (*appsv1.DaemonSet, bool, error) {
+	daemonset, err := generator.GenerateDaemonset(resource)
 	if err != nil {
-		return err
+		return nil, false, err
 	}
-	if create {
-		daemonset, err = r.createDaemonset(ctx, newResource)
-		if err != nil {
-			return err
-		}
+
+	exists := appsv1.DaemonSet{}
+	err = r.Client.Get(ctx, types.NamespacedName{Namespace: daemonset.Namespace, Name: daemonset.Name}, &exists)
+	if err != nil && !kerrors.IsNotFound(err) {
+		r.Logger.Error(err, "Failed to get daemonset", "Namespace", daemonset.Namespace, "Name", daemonset.Name)
+		return nil, false, err
 	}
-	{
-		newResource.Status.PodIdentityWebhookDaemonset = &installerv1alpha1.DaemonsetRef{
-			Namespace: daemonset.Namespace,
-			Name:      daemonset.Name,
-		}
-		if !reflect.DeepEqual(resource.Status, newResource.Status) {
-			if err := r.Client.Status().Update(ctx, newResource); err != nil {
-				r.Logger.Error(err, "Failed to update EKSPodIdentityWebhook")
-				return err
+
+	found := err == nil
+	adopted := false
+	if found {
+		if !metav1.IsControlledBy(&exists, resource) {
+			if err := r.adopt(resource, &exists, "DaemonSet", validateAdoptedDaemonset(resource, &exists)); err != nil {
+				return nil, false, err
 			}
-			r.Logger.Info("Success to update")
-			return nil
+			adopted = true
+		}
+		if exists.Spec.Selector != nil {
+			generator.InheritSelector(exists.Spec.Selector.MatchLabels, daemonset, nil)
 		}
 	}
-
-	create, mutating, err := r.mutatingWebhookConfigurationShouldCreate(ctx, newResource.Status.PodIdentityWebhookConfiguration)
-	if err != nil {
-		return err
+	if err := generator.ApplyOverlays(resource, daemonset); err != nil {
+		return nil, false, err
 	}
-	if create {
-		mutating, err = r.createMutatingWebhookConfiguration(ctx, newResource, service)
-		if err != nil {
-			return err
+	if found && !adopted && !equality.Semantic.DeepDerivative(daemonset.Spec.Template, exists.Spec.Template) && !upgrading(resource, &daemonset.Spec.Template) {
+		diff := derivativeDiff("DaemonSet "+daemonset.Namespace+"/"+daemonset.Name+" spec.template", daemonset.Spec.Template, exists.Spec.Template)
+		if !gate.allow("DaemonSet", diff) {
+			daemonset.Spec.Template = *exists.Spec.Template.DeepCopy()
 		}
 	}
-	{
-		newResource.Status.PodIdentityWebhookConfiguration = &installerv1alpha1.MutatingWebhookConfigurationRef{
-			Name: mutating.Name,
+	if mutate != nil {
+		if found {
+			mutate(daemonset, &exists)
+		} else {
+			mutate(daemonset, nil)
 		}
-		if !reflect.DeepEqual(resource.Status, newResource.Status) {
-			if err := r.Client.Status().Update(ctx, newResource); err != nil {
-				r.Logger.Error(err, "Failed to update EKSPodIdentityWebhook")
-				return err
-			}
-			r.Logger.Info("Success to update")
-			return nil
+	}
+	if found && !adopted &&
+		containsLabels(exists.Labels, daemonset.Labels) &&
+		containsLabels(exists.Annotations, daemonset.Annotations) &&
+		equality.Semantic.DeepDerivative(daemonset.Spec.Template, exists.Spec.Template) &&
+		equality.Semantic.DeepDerivative(daemonset.Spec.UpdateStrategy, exists.Spec.UpdateStrategy) {
+		return &exists, false, nil
+	}
+
+	if adopted {
+		exists.Spec.Template = daemonset.Spec.Template
+		if err := r.replaceAdopted(ctx, resource, &exists, "DaemonSet"); err != nil {
+			return nil, false, err
 		}
 	}
-	r.Logger.Info("Already synced")
-	return nil
+	if err := r.applyObject(ctx, resource, daemonset, "DaemonSet", adopted); err != nil {
+		return nil, false, err
+	}
+	if adopted {
+		r.Recorder.Eventf(resource, corev1.EventTypeNormal, "DaemonSetAdopted", "Success to adopt %s/%s", daemonset.Namespace, daemonset.Name)
+		r.Logger.Info("Success to adopt DaemonSet")
+	}
+	return daemonset, adopted, nil
 }
 
-func (r *EKSPodIdentityWebhookReconciler) createServiceAccount(ctx context.Context, resource *installerv1alpha1.EKSPodIdentityWebhook) (*corev1.ServiceAccount, error) {
-	serviceAccount := generator.GenerateServiceAccount(resource)
+// ensureService applies the Service when the existing one differs from the generated one.
+// It returns true when the existing Service was adopted.
+func (r *EKSPodIdentityWebhookReconciler) ensureService(ctx context.Context, resource *installerv1alpha1.EKSPodIdentityWebhook) (*corev1.Service, bool, error) {
+	service := generator.GenerateService(resource)
+	selector, err := r.daemonsetSelector(ctx, resource)
+	if err != nil {
+		return nil, false, err
+	}
+	generator.InheritSelector(selector, nil, service)
+	extensions, err := generator.ApplyOverlaysWithSpec(resource, service, generator.ServiceSpecExtensions(resource))
+	if err != nil {
+		return nil, false, err
+	}
 
-	{
-		exists := corev1.ServiceAccount{}
-		err := r.Client.Get(ctx, types.NamespacedName{Namespace: serviceAccount.Namespace, Name: serviceAccount.Name}, &exists)
-		if kerrors.IsNotFound(err) {
-			if err := r.Client.Create(ctx, serviceAccount); err != nil {
-				r.Logger.Error(err, "Failed to create ServiceAccount", "Namespace", serviceAccount.Namespace, "Name", serviceAccount.Name)
-				r.Recorder.Eventf(resource, corev1.EventTypeWarning, "ServiceAccountCreationFailed", "Failed to create %s/%s", serviceAccount.Namespace, serviceAccount.Name)
-				return nil, err
-			}
-			r.Recorder.Eventf(resource, corev1.EventTypeNormal, "ServiceAccountCreated", "Success to create %s/%s", serviceAccount.Namespace, serviceAccount.Name)
-			r.Logger.Info("Success to create ServiceAccount")
-		} else {
-			exists.SetOwnerReferences(serviceAccount.OwnerReferences)
-			if err := r.Client.Update(ctx, &exists); err != nil {
-				r.Logger.Error(err, "Failed to update ServiceAccount", "Namespace", exists.Namespace, "Name", exists.Name)
-				r.Recorder.Eventf(resource, corev1.EventTypeWarning, "ServiceAccountUpdateFailed", "Failed to update %s/%s", exists.Namespace, exists.Name)
-				return nil, err
-			}
-			r.Recorder.Eventf(resource, corev1.EventTypeNormal, "ServiceAccountUpdated", "Success to update %s/%s", exists.Namespace, exists.Name)
-			r.Logger.Info("Success to update ServiceAccount")
-		}
+	exists := corev1.Service{}
+	err = r.Client.Get(ctx, types.NamespacedName{Namespace: service.Namespace, Name: service.Name}, &exists)
+	if err != nil && !kerrors.IsNotFound(err) {
+		r.Logger.Error(err, "Failed to get service", "Namespace", service.Namespace, "Name", service.Name)
+		return nil, false, err
 	}
 
-	role := generator.GenerateRole(resource)
-	{
-		exists := rbacv1.Role{}
-		err := r.Client.Get(ctx, types.NamespacedName{Namespace: role.Namespace, Name: role.Name}, &exists)
-		if kerrors.IsNotFound(err) {
-			if err := r.Client.Create(ctx, role); err != nil {
-				r.Logger.Error(err, "Failed to create Role", "Namespace", role.Namespace, "Name", role.Name)
-				r.Recorder.Eventf(resource, corev1.EventTypeWarning, "RoleCreationFailed", "Failed to create %s/%s", role.Namespace, role.Name)
-				return nil, err
-			}
-			r.Recorder.Eventf(resource, corev1.EventTypeNormal, "RoleCreated", "Success to create %s/%s", role.Namespace, role.Name)
-			r.Logger.Info("Success to create Role")
-		} else {
-			exists.SetOwnerReferences(role.OwnerReferences)
-			exists.Rules = role.Rules
-			if err := r.Client.Update(ctx, &exists); err != nil {
-				r.Logger.Error(err, "Failed to update Role", "Namespace", exists.Namespace, "Name", exists.Name)
-				r.Recorder.Eventf(resource, corev1.EventTypeWarning, "RoleUpdateFailed", "Failed to update %s/%s", exists.Namespace, exists.Name)
-				return nil, err
+	adopted := false
+	if err == nil {
+		if !metav1.IsControlledBy(&exists, resource) {
+			if err := r.adopt(resource, &exists, "Service", validateAdoptedService(&exists, service)); err != nil {
+				return nil, false, err
 			}
-			r.Logger.Info("Success to update Role")
-			r.Recorder.Eventf(resource, corev1.EventTypeNormal, "RoleUpdated", "Success to update %s/%s", exists.Namespace, exists.Name)
+			adopted = true
 		}
-	}
-
-	roleBinding := generator.GenerateRoleBinding(resource, role, serviceAccount)
-	{
-		exists := rbacv1.RoleBinding{}
-		err := r.Client.Get(ctx, types.NamespacedName{Namespace: roleBinding.Namespace, Name: roleBinding.Name}, &exists)
-		if kerrors.IsNotFound(err) {
-			if err := r.Client.Create(ctx, roleBinding); err != nil {
-				r.Logger.Error(err, "Failed to create RoleBinding", "Namepsace", roleBinding.Namespace, "Name", roleBinding.Name)
-				r.Recorder.Eventf(resource, corev1.EventTypeWarning, "RoleBindingCreationFailed", "Failed to create %s/%s", roleBinding.Namespace, roleBinding.Name)
-				return nil, err
+		if !adopted &&
+			containsLabels(exists.Labels, service.Labels) &&
+			containsLabels(exists.Annotations, service.Annotations) &&
+			equality.Semantic.DeepDerivative(service.Spec.Ports, exists.Spec.Ports) &&
+			equality.Semantic.DeepEqual(service.Spec.Selector, exists.Spec.Selector) &&
+			service.Spec.Type == exists.Spec.Type &&
+			equality.Semantic.DeepDerivative(service.Spec.IPFamilyPolicy, exists.Spec.IPFamilyPolicy) {
+			live := &unstructured.Unstructured{}
+			live.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("Service"))
+			live.SetNamespace(service.Namespace)
+			live.SetName(service.Name)
+			applied, err := r.hasSpecFields(ctx, live, extensions)
+			if err != nil {
+				return nil, false, err
 			}
-			r.Recorder.Eventf(resource, corev1.EventTypeNormal, "RoleBindingCreated", "Success to create %s/%s", roleBinding.Namespace, roleBinding.Name)
-			r.Logger.Info("Success to create RoleBinding")
-		} else {
-			exists.SetOwnerReferences(roleBinding.OwnerReferences)
-			exists.Subjects = roleBinding.Subjects
-			exists.RoleRef = roleBinding.RoleRef
-			if err := r.Client.Update(ctx, &exists); err != nil {
-				r.Logger.Error(err, "Failed to update RoleBinding", "Namespace", exists.Namespace, "Name", exists.Name)
-				r.Recorder.Eventf(resource, corev1.EventTypeWarning, "RoleBindingUpdateFailed", "Failed to update %s/%s", exists.Namespace, exists.Name)
-				return nil, err
+			if applied {
+				return &exists, false, nil
 			}
-			r.Logger.Info("Success to update RoleBinding")
-			r.Recorder.Eventf(resource, corev1.EventTypeNormal, "RoleBindingUpdated", "Success to update %s/%s", exists.Namespace, exists.Name)
 		}
-
 	}
 
-	clusterRole := generator.GenerateClusterRole(resource)
-	{
-		exists := rbacv1.ClusterRole{}
-		err := r.Client.Get(ctx, types.NamespacedName{Name: clusterRole.Name}, &exists)
-		if kerrors.IsNotFound(err) {
-			if err := r.Client.Create(ctx, clusterRole); err != nil {
-				r.Logger.Error(err, "Failed to create ClusterRole", "Name", clusterRole.Name)
-				r.Recorder.Eventf(resource, corev1.EventTypeWarning, "ClusterRoleCreationFailed", "Failed to create %s", clusterRole.Name)
-				return nil, err
-			}
-			r.Recorder.Eventf(resource, corev1.EventTypeNormal, "ClusterRoleCreated", "Success to create %s", clusterRole.Name)
-			r.Logger.Info("Success to create ClusterRole")
-		} else {
-			exists.SetOwnerReferences(clusterRole.OwnerReferences)
-			exists.Rules = clusterRole.Rules
-			if err := r.Client.Update(ctx, &exists); err != nil {
-				r.Logger.Error(err, "Failed to update ClusterRole", "Name", exists.Name)
-				r.Recorder.Eventf(resource, corev1.EventTypeWarning, "ClusterRoleUpdateFailed", "Failed to update %s", exists.Name)
-				return nil, err
-			}
-			r.Recorder.Eventf(resource, corev1.EventTypeNormal, "ClusterRoleUpdated", "Success to update %s", exists.Name)
-			r.Logger.Info("Success to update ClusterRole")
+	if adopted {
+		exists.Spec.Ports = service.Spec.Ports
+		exists.Spec.Selector = service.Spec.Selector
+		if err := r.replaceAdopted(ctx, resource, &exists, "Service"); err != nil {
+			return nil, false, err
 		}
+	}
+	if err := r.applyObjectWithSpec(ctx, resource, service, "Service", adopted, extensions); err != nil {
+		return nil, false, err
+	}
+	if adopted {
+		r.Recorder.Eventf(resource, corev1.EventTypeNormal, "ServiceAdopted", "Success to adopt %s/%s", service.Namespace, service.Name)
+		r.Logger.Info("Success to adopt Service")
+	}
+	return service, adopted, nil
+}
 
+// ensureMutatingWebhookConfiguration applies the MutatingWebhookConfiguration when the existing one differs from the generated one.
+// It returns true when the existing MutatingWebhookConfiguration was adopted.
+// Changes of webhooks are held by gate outside of maintenance windows, except caBundle, which must follow the certificate.
+func (r *EKSPodIdentityWebhookReconciler) ensureMutatingWebhookConfiguration(
+	ctx context.Context,
+	resource *installerv1alpha1.EKSPodIdentityWebhook,
+	service *corev1.Service,
+	gate *maintenanceGate,
+) (*admissionregistrationv1.MutatingWebhookConfiguration, bool, error) {
+	CA, err := r.webhookCA(ctx, resource)
+	if err != nil {
+		return nil, false, err
+	}
+	mutating := generator.GenerateMutatingWebhookConfiguration(resource, service, CA)
+	if err := generator.ApplyOverlays(resource, mutating); err != nil {
+		return nil, false, err
 	}
 
-	clusterRoleBinding := generator.GenerateClusterRoleBinding(resource, clusterRole, serviceAccount)
-	{
-		exists := rbacv1.ClusterRoleBinding{}
-		err := r.Client.Get(ctx, types.NamespacedName{Name: clusterRoleBinding.Name}, &exists)
-		if kerrors.IsNotFound(err) {
-			if err := r.Client.Create(ctx, clusterRoleBinding); err != nil {
-				r.Logger.Error(err, "Failed to create ClusterRoleBinding", "Name", clusterRoleBinding.Name)
-				r.Recorder.Eventf(resource, corev1.EventTypeWarning, "ClusterRoleBindingCreationFailed", "Failed to create %s", clusterRoleBinding.Name)
-				return nil, err
+	exists := admissionregistrationv1.MutatingWebhookConfiguration{}
+	err = r.Client.Get(ctx, types.NamespacedName{Name: mutating.Name}, &exists)
+	if err != nil && !kerrors.IsNotFound(err) {
+		r.Logger.Error(err, "Failed to get mutating", "Name", mutating.Name)
+		return nil, false, err
+	}
+
+	adopted := false
+	if err == nil {
+		if !metav1.IsControlledBy(&exists, resource) {
+			if err := r.adopt(resource, &exists, "MutatingWebhookConfiguration", validateAdoptedMutatingWebhookConfiguration(&exists, mutating, service)); err != nil {
+				return nil, false, err
 			}
-			r.Recorder.Eventf(resource, corev1.EventTypeNormal, "ClusterRoleBindingCreated", "Success to create %s", clusterRoleBinding.Name)
-			r.Logger.Info("Success to create ClusterRoleBinding")
-		} else {
-			exists.SetOwnerReferences(clusterRoleBinding.OwnerReferences)
-			exists.Subjects = clusterRoleBinding.Subjects
-			exists.RoleRef = clusterRoleBinding.RoleRef
-			if err := r.Client.Update(ctx, &exists); err != nil {
-				r.Logger.Error(err, "failed to update ClusterRoleBinding", "Name", exists.Name)
-				r.Recorder.Eventf(resource, corev1.EventTypeWarning, "ClusterRoleBindingUpdateFailed", "Failed to update %s", exists.Name)
-				return nil, err
+			adopted = true
+		}
+		if !adopted {
+			held := heldWebhooks(exists.Webhooks, mutating.Webhooks)
+			if !equality.Semantic.DeepDerivative(mutating.Webhooks, held) {
+				diff := derivativeDiff("MutatingWebhookConfiguration "+mutating.Name+" webhooks", mutating.Webhooks, exists.Webhooks)
+				if !gate.allow("MutatingWebhookConfiguration", diff) {
+					mutating.Webhooks = held
+				}
 			}
-			r.Recorder.Eventf(resource, corev1.EventTypeNormal, "ClusterRoleBindingUpdated", "Success to update %s", exists.Name)
-			r.Logger.Info("Success to update ClusterRoleBinding")
 		}
-
+		if !adopted &&
+			containsLabels(exists.Labels, mutating.Labels) &&
+			containsLabels(exists.Annotations, mutating.Annotations) &&
+			equality.Semantic.DeepDerivative(mutating.Webhooks, exists.Webhooks) {
+			return &exists, false, nil
+		}
 	}
-	return serviceAccount, nil
-}
 
-func (r *EKSPodIdentityWebhookReconciler) createDaemonset(ctx context.Context, resource *installerv1alpha1.EKSPodIdentityWebhook) (*appsv1.DaemonSet, error) {
-	daemonset := generator.GenerateDaemonset(resource)
-	if err := r.Client.Create(ctx, daemonset); err != nil {
-		r.Logger.Error(err, "failed to create DaemonSet", "Namespace", daemonset.Namespace, "Name", daemonset.Name)
-		r.Recorder.Eventf(resource, corev1.EventTypeWarning, "DaemonSetCreationFailed", "Failed to create %s/%s", daemonset.Namespace, daemonset.Name)
-		return nil, err
+	if adopted {
+		exists.Webhooks = mutating.Webhooks
+		if err := r.replaceAdopted(ctx, resource, &exists, "MutatingWebhookConfiguration"); err != nil {
+			return nil, false, err
+		}
 	}
-	r.Recorder.Eventf(resource, corev1.EventTypeNormal, "DaemonSetCreated", "Success to create %s/%s", daemonset.Namespace, daemonset.Name)
-	r.Logger.Info("Success to create DaemonSet")
-	return daemonset, nil
+	if err := r.applyObject(ctx, resource, mutating, "MutatingWebhookConfiguration", adopted); err != nil {
+		return nil, false, err
+	}
+	if adopted {
+		r.Recorder.Eventf(resource, corev1.EventTypeNormal, "MutatingWebhookConfigurationAdopted", "Success to adopt %s", mutating.Name)
+		r.Logger.Info("Success to adopt MutatingWebhookConfiguration")
+	}
+	return mutating, adopted, nil
 }
 
-func (r *EKSPodIdentityWebhookReconciler) createService(ctx context.Context, resource *installerv1alpha1.EKSPodIdentityWebhook) (*corev1.Service, error) {
-	service := generator.GenerateService(resource)
-	if err := r.Client.Create(ctx, service); err != nil {
-		r.Logger.Error(err, "Failed to create Service", "Namespace", service.Namespace, "Name", service.Name)
-		r.Recorder.Eventf(resource, corev1.EventTypeWarning, "ServiceCreationFailed", "Failed to create %s/%s", service.Namespace, service.Name)
-		return nil, err
+// heldWebhooks returns live webhooks with caBundle of generated ones, which are applied while other changes are held.
+func heldWebhooks(live, generated []admissionregistrationv1.MutatingWebhook) []admissionregistrationv1.MutatingWebhook {
+	held := make([]admissionregistrationv1.MutatingWebhook, 0, len(live))
+	for _, webhook := range live {
+		w := *webhook.DeepCopy()
+		for _, g := range generated {
+			if g.Name == w.Name {
+				w.ClientConfig.CABundle = g.ClientConfig.CABundle
+			}
+		}
+		held = append(held, w)
 	}
-	r.Recorder.Eventf(resource, corev1.EventTypeNormal, "ServiceCreated", "Success to create %s/%s", service.Namespace, service.Name)
-	r.Logger.Info("Success to create Service")
-	return service, nil
+	return held
 }
 
-func (r *EKSPodIdentityWebhookReconciler) createMutatingWebhookConfiguration(ctx context.Context, resource *installerv1alpha1.EKSPodIdentityWebhook, service *corev1.Service) (*admissionregistrationv1.MutatingWebhookConfiguration, error) {
+// clusterCA returns the CA of the cluster, which signs certificates issued from CertificateSigningRequests.
+func (r *EKSPodIdentityWebhookReconciler) clusterCA(ctx context.Context, resource *installerv1alpha1.EKSPodIdentityWebhook) ([]byte, error) {
+	if generator.CASource(resource) == installerv1alpha1.CASourceRootCAConfigMap {
+		// kube-controller-manager publishes the CA in every namespace. It is read from the API server,
+		// so that the installer does not cache every ConfigMap in the cluster.
+		rootCA := corev1.ConfigMap{}
+		if err := r.reader().Get(ctx, types.NamespacedName{Name: rootCAConfigMapName, Namespace: resource.Spec.Namespace}, &rootCA); err != nil {
+			r.Logger.Error(err, "Failed to get root CA configmap", "Namespace", resource.Spec.Namespace, "Name", rootCAConfigMapName)
+			return nil, err
+		}
+		return []byte(rootCA.Data["ca.crt"]), nil
+	}
 	// Get default service account token, and use the CA.
 	// https://github.com/aws/amazon-eks-pod-identity-webhook/blob/35a57cc479ae760760bfa9b5a628a488a46adad2/hack/webhook-patch-ca-bundle.sh#L10-L19
 	defaultSA := corev1.ServiceAccount{}
@@ -366,78 +500,46 @@ func (r *EKSPodIdentityWebhookReconciler) createMutatingWebhookConfiguration(ctx
 		r.Logger.Error(err, "Failed to get default service account token")
 		return nil, err
 	}
-	CA := defaultSAToken.Data["ca.crt"]
-
-	mutating := generator.GenerateMutatingWebhookConfiguration(resource, service, CA)
-	if err := r.Client.Create(ctx, mutating); err != nil {
-		r.Logger.Error(err, "Failed to create MutatingWebhookConfiguration", "Name", mutating.Name)
-		r.Recorder.Eventf(resource, corev1.EventTypeWarning, "MutatingWebhookConfigurationCreationFailed", "Failed to create %s", mutating.Name)
-		return nil, err
-	}
-	r.Recorder.Eventf(resource, corev1.EventTypeNormal, "MutatingWebhookConfigurationCreated", "Success to create %s", mutating.Name)
-	r.Logger.Info("Success to create MutatingWebhookConfiguration")
-	return mutating, nil
+	return defaultSAToken.Data["ca.crt"], nil
 }
 
-func (r *EKSPodIdentityWebhookReconciler) serviceAccountShouldCreate(ctx context.Context, ref *installerv1alpha1.ServiceAccountRef) (bool, *corev1.ServiceAccount, error) {
-	if ref == nil {
-		return true, nil, nil
-	}
-	serviceAccount := corev1.ServiceAccount{}
-	err := r.Client.Get(ctx, types.NamespacedName{Name: ref.Name, Namespace: ref.Namespace}, &serviceAccount)
-	if kerrors.IsNotFound(err) {
-		return true, nil, nil
-	} else if err != nil {
-		r.Logger.Error(err, "Failed to get serviceaccount")
-		return false, nil, err
-	}
-	return false, &serviceAccount, nil
-}
-
-func (r *EKSPodIdentityWebhookReconciler) daemonsetShouldCreate(ctx context.Context, ref *installerv1alpha1.DaemonsetRef) (bool, *appsv1.DaemonSet, error) {
-	if ref == nil {
-		return true, nil, nil
-	}
+// daemonsetSelector returns the selector of the existing DaemonSet, so that the Service keeps selecting its pods.
+func (r *EKSPodIdentityWebhookReconciler) daemonsetSelector(ctx context.Context, resource *installerv1alpha1.EKSPodIdentityWebhook) (map[string]string, error) {
 	daemonset := appsv1.DaemonSet{}
-	err := r.Client.Get(ctx, types.NamespacedName{Name: ref.Name, Namespace: ref.Namespace}, &daemonset)
+	err := r.Client.Get(ctx, types.NamespacedName{Namespace: resource.Spec.Namespace, Name: generator.DaemonsetName}, &daemonset)
 	if kerrors.IsNotFound(err) {
-		return true, nil, nil
+		return nil, nil
 	} else if err != nil {
-		r.Logger.Error(err, "Failed to get daemonset", "Namespace", ref.Namespace, "Name", ref.Name)
-		return false, nil, err
+		r.Logger.Error(err, "Failed to get daemonset", "Namespace", resource.Spec.Namespace, "Name", generator.DaemonsetName)
+		return nil, err
+	}
+	if daemonset.Spec.Selector == nil {
+		return nil, nil
 	}
-	return false, &daemonset, nil
+	return daemonset.Spec.Selector.MatchLabels, nil
 }
 
-func (r *EKSPodIdentityWebhookReconciler) serviceShouldCreate(ctx context.Context, ref *installerv1alpha1.ServiceRef) (bool, *corev1.Service, error) {
-	if ref == nil {
+// serviceAccountShouldCreate returns true when the ServiceAccount and RBAC have to be applied,
+// because the ServiceAccount does not exist in the namespace or lacks generated metadata.
+func (r *EKSPodIdentityWebhookReconciler) serviceAccountShouldCreate(ctx context.Context, resource *installerv1alpha1.EKSPodIdentityWebhook) (bool, *corev1.ServiceAccount, error) {
+	ref := resource.Status.PodIdentityWebhookServiceAccount
+	if ref == nil || ref.Namespace != resource.Spec.Namespace {
 		return true, nil, nil
 	}
-	service := corev1.Service{}
-	err := r.Client.Get(ctx, types.NamespacedName{Name: ref.Name, Namespace: ref.Namespace}, &service)
+	serviceAccount := corev1.ServiceAccount{}
+	err := r.Client.Get(ctx, types.NamespacedName{Name: ref.Name, Namespace: ref.Namespace}, &serviceAccount)
 	if kerrors.IsNotFound(err) {
 		return true, nil, nil
 	} else if err != nil {
-		r.Logger.Error(err, "Failed to get service")
+		r.Logger.Error(err, "Failed to get serviceaccount")
 		return false, nil, err
 	}
-	return false, &service, nil
-}
-
-func (r *EKSPodIdentityWebhookReconciler) mutatingWebhookConfigurationShouldCreate(
-	ctx context.Context,
-	ref *installerv1alpha1.MutatingWebhookConfigurationRef,
-) (bool, *admissionregistrationv1.MutatingWebhookConfiguration, error) {
-	if ref == nil {
+	generated := generator.GenerateServiceAccount(resource)
+	if err := generator.ApplyOverlays(resource, generated); err != nil {
 		return true, nil, nil
 	}
-	mutating := admissionregistrationv1.MutatingWebhookConfiguration{}
-	err := r.Client.Get(ctx, types.NamespacedName{Name: ref.Name}, &mutating)
-	if kerrors.IsNotFound(err) {
+	if !containsLabels(serviceAccount.Labels, generated.Labels) || !containsLabels(serviceAccount.Annotations, generated.Annotations) {
 		return true, nil, nil
-	} else if err != nil {
-		r.Logger.Error(err, "Failed to get mutating")
-		return false, nil, err
 	}
-	return false, &mutating, nil
+	return false, &serviceAccount, nil
 }
@@ -0,0 +1,59 @@
+package ekspodidentitywebhook
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	"github.com/h3poteto/eks-pod-identity-webhook-installer/pkg/generator"
+)
+
+// embeddedRetryInterval is how long we wait for the webhook server of the installer to be configured.
+const embeddedRetryInterval = 1 * time.Minute
+
+// embeddedSteps returns the reconciliation steps in Embedded implementation.
+// Only the MutatingWebhookConfiguration is applied, and objects of External implementation are pruned by Inventory
+// after it points at the installer.
+func (r *EKSPodIdentityWebhookReconciler) embeddedSteps() []step {
+	return []step{
+		{name: "Overlays", run: r.overlaysStep},
+		{name: "MaintenanceWindows", run: r.maintenanceWindowsStep},
+		{name: "Namespace", dependsOn: []string{"Overlays"}, run: r.namespaceStep},
+		{name: "Preflight", dependsOn: []string{"Namespace"}, run: r.preflightStep},
+		{name: "EmbeddedWebhook", dependsOn: []string{"Preflight"}, run: r.embeddedWebhookStep},
+		{name: "MutatingWebhookConfiguration", dependsOn: []string{"EmbeddedWebhook", "MaintenanceWindows"}, run: r.mutatingWebhookConfigurationStep},
+		{name: "Inventory", dependsOn: []string{"MutatingWebhookConfiguration"}, run: r.inventoryStep},
+	}
+}
+
+// embeddedWebhookStep verifies that the webhook server of the installer serves the mutation,
+// and points the MutatingWebhookConfiguration at it.
+func (r *EKSPodIdentityWebhookReconciler) embeddedWebhookStep(ctx context.Context, state *syncState) (stepResult, error) {
+	resource := state.resource
+	if !r.EmbeddedWebhook {
+		return wait("the installer is not started with --embedded-webhook", embeddedRetryInterval), nil
+	}
+	if _, err := r.webhookCA(ctx, resource); err != nil {
+		return wait(fmt.Sprintf("failed to read the CA of the webhook server: %v", err), embeddedRetryInterval), nil
+	}
+	state.service = generator.EmbeddedWebhookService()
+
+	// These are pruned with the inventory, so they are no longer reported.
+	resource.Status.PodIdentityWebhookServiceAccount = nil
+	resource.Status.PodIdentityWebhookService = nil
+	resource.Status.PodIdentityWebhookDaemonset = nil
+	resource.Status.Workload = nil
+	return done(fmt.Sprintf("served by %s/%s", state.service.Namespace, state.service.Name)), nil
+}
+
+// embeddedCA returns ca.crt in the certificate directory of the webhook server, which cert-manager writes.
+func (r *EKSPodIdentityWebhookReconciler) embeddedCA() ([]byte, error) {
+	CA, err := ioutil.ReadFile(filepath.Join(r.WebhookCertDir, "ca.crt"))
+	if err != nil {
+		r.Logger.Error(err, "Failed to read CA of the webhook server", "Dir", r.WebhookCertDir)
+		return nil, err
+	}
+	return CA, nil
+}
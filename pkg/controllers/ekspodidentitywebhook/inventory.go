@@ -0,0 +1,152 @@
+package ekspodidentitywebhook
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+
+	installerv1alpha1 "github.com/h3poteto/eks-pod-identity-webhook-installer/api/v1alpha1"
+	"github.com/h3poteto/eks-pod-identity-webhook-installer/pkg/generator"
+)
+
+// inventoryStep records owned objects which the current spec generates in status.inventory,
+// and prunes objects in the previous inventory which it no longer generates.
+// It runs after every other step succeeded, so objects which are still in use, e.g. during a migration, are not pruned.
+func (r *EKSPodIdentityWebhookReconciler) inventoryStep(ctx context.Context, state *syncState) (stepResult, error) {
+	resource := state.resource
+	inventory, err := r.generatedInventory(ctx, resource)
+	if err != nil {
+		return stepResult{}, err
+	}
+	generated := map[string]bool{}
+	for _, entry := range inventory {
+		generated[inventoryKey(entry)] = true
+	}
+
+	pruned := 0
+	errs := []error{}
+	for _, entry := range resource.Status.Inventory {
+		if generated[inventoryKey(entry)] {
+			continue
+		}
+		if err := r.prune(ctx, resource, entry); err != nil {
+			// Keep the entry, so that it is pruned in the next reconcile.
+			inventory = append(inventory, entry)
+			errs = append(errs, err)
+			continue
+		}
+		pruned++
+	}
+	sortInventory(inventory)
+	resource.Status.Inventory = inventory
+	if len(errs) > 0 {
+		return stepResult{}, utilerrors.NewAggregate(errs)
+	}
+	return done(fmt.Sprintf("%d objects, %d pruned", len(inventory), pruned)), nil
+}
+
+// generatedObjects returns objects which the current spec generates.
+func (r *EKSPodIdentityWebhookReconciler) generatedObjects(resource *installerv1alpha1.EKSPodIdentityWebhook) ([]client.Object, error) {
+	objects, err := generator.GenerateObjects(resource, nil)
+	if err != nil {
+		return nil, err
+	}
+	if !generator.Embedded(resource) && resource.Spec.UpgradeStrategy.Type == installerv1alpha1.UpgradeCanary && !resource.Spec.UpgradeStrategy.SkipMutationProbe {
+		objects = append(objects, &corev1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{Namespace: resource.Spec.Namespace, Name: probeServiceAccountName},
+		})
+	}
+	return objects, nil
+}
+
+// generatedInventory returns live objects which the current spec generates and the resource owns.
+func (r *EKSPodIdentityWebhookReconciler) generatedInventory(ctx context.Context, resource *installerv1alpha1.EKSPodIdentityWebhook) ([]installerv1alpha1.InventoryEntry, error) {
+	objects, err := r.generatedObjects(resource)
+	if err != nil {
+		return nil, err
+	}
+	inventory := []installerv1alpha1.InventoryEntry{}
+	for _, obj := range objects {
+		gvk, err := apiutil.GVKForObject(obj, r.Scheme)
+		if err != nil {
+			return nil, err
+		}
+		live := &unstructured.Unstructured{}
+		live.SetGroupVersionKind(gvk)
+		err = r.Client.Get(ctx, client.ObjectKeyFromObject(obj), live)
+		if kerrors.IsNotFound(err) || meta.IsNoMatchError(err) {
+			continue
+		} else if err != nil {
+			r.Logger.Error(err, "Failed to get object", "Kind", gvk.Kind, "Namespace", obj.GetNamespace(), "Name", obj.GetName())
+			return nil, err
+		}
+		if !metav1.IsControlledBy(live, resource) {
+			continue
+		}
+		inventory = append(inventory, installerv1alpha1.InventoryEntry{
+			Group:     gvk.Group,
+			Version:   gvk.Version,
+			Kind:      gvk.Kind,
+			Namespace: live.GetNamespace(),
+			Name:      live.GetName(),
+			UID:       live.GetUID(),
+		})
+	}
+	return inventory, nil
+}
+
+// prune deletes an object in the inventory when it still is the same object and owned by the resource.
+// A namespace is never pruned, because it can contain objects which the installer does not manage.
+// It is deleted by the garbage collector on uninstall.
+func (r *EKSPodIdentityWebhookReconciler) prune(ctx context.Context, resource *installerv1alpha1.EKSPodIdentityWebhook, entry installerv1alpha1.InventoryEntry) error {
+	key := entry.Name
+	if entry.Namespace != "" {
+		key = entry.Namespace + "/" + entry.Name
+	}
+	if entry.Group == "" && entry.Kind == "Namespace" {
+		r.Logger.Info("Namespace is not generated anymore, but it is not pruned", "Name", key)
+		return nil
+	}
+
+	live := &unstructured.Unstructured{}
+	live.SetGroupVersionKind(schema.GroupVersionKind{Group: entry.Group, Version: entry.Version, Kind: entry.Kind})
+	err := r.Client.Get(ctx, client.ObjectKey{Namespace: entry.Namespace, Name: entry.Name}, live)
+	if kerrors.IsNotFound(err) || meta.IsNoMatchError(err) {
+		return nil
+	} else if err != nil {
+		r.Logger.Error(err, "Failed to get object", "Kind", entry.Kind, "Name", key)
+		return err
+	}
+	if live.GetUID() != entry.UID || !metav1.IsControlledBy(live, resource) {
+		r.Logger.Info("Object is replaced or not owned, so skip pruning", "Kind", entry.Kind, "Name", key)
+		return nil
+	}
+	if err := r.Client.Delete(ctx, live, client.Preconditions{UID: &entry.UID}); client.IgnoreNotFound(err) != nil {
+		r.Logger.Error(err, "Failed to prune", "Kind", entry.Kind, "Name", key)
+		r.Recorder.Eventf(resource, corev1.EventTypeWarning, entry.Kind+"PruneFailed", "Failed to prune %s", key)
+		return err
+	}
+	r.Recorder.Eventf(resource, corev1.EventTypeNormal, entry.Kind+"Pruned", "Success to prune %s", key)
+	r.Logger.Info("Success to prune", "Kind", entry.Kind, "Name", key)
+	return nil
+}
+
+func inventoryKey(entry installerv1alpha1.InventoryEntry) string {
+	return entry.Group + "/" + entry.Kind + "/" + entry.Namespace + "/" + entry.Name
+}
+
+func sortInventory(inventory []installerv1alpha1.InventoryEntry) {
+	sort.Slice(inventory, func(i, j int) bool {
+		return inventoryKey(inventory[i]) < inventoryKey(inventory[j])
+	})
+}
@@ -0,0 +1,142 @@
+package ekspodidentitywebhook
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	installerv1alpha1 "github.com/h3poteto/eks-pod-identity-webhook-installer/api/v1alpha1"
+)
+
+// failingDeleteClient fails to delete objects whose names are in names.
+type failingDeleteClient struct {
+	client.Client
+	names map[string]bool
+}
+
+func (c *failingDeleteClient) Delete(ctx context.Context, obj client.Object, opts ...client.DeleteOption) error {
+	if c.names[obj.GetName()] {
+		return errors.New("injected error")
+	}
+	return c.Client.Delete(ctx, obj, opts...)
+}
+
+func configMapEntry(configMap *corev1.ConfigMap) installerv1alpha1.InventoryEntry {
+	return installerv1alpha1.InventoryEntry{Version: "v1", Kind: "ConfigMap", Namespace: configMap.Namespace, Name: configMap.Name, UID: configMap.UID}
+}
+
+func TestInventoryStep(t *testing.T) {
+	ctx := context.Background()
+	resource := testResource()
+	resource.UID = "resource-uid"
+
+	configMap := func(name string, owners []metav1.OwnerReference) *corev1.ConfigMap {
+		return &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{
+			Namespace:       resource.Spec.Namespace,
+			Name:            name,
+			UID:             types.UID("uid-" + name),
+			OwnerReferences: owners,
+		}}
+	}
+	owned := configMap("owned", ownedBy(resource))
+	replaced := configMap("replaced", ownedBy(resource))
+	foreign := configMap("foreign", nil)
+	other := testResource()
+	other.Name = "other"
+	other.UID = "other-uid"
+	controlledByOther := configMap("controlled-by-other", ownedBy(other))
+	failing := configMap("failing", ownedBy(resource))
+	namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "webhook", UID: "uid-namespace", OwnerReferences: ownedBy(resource)}}
+
+	replacedEntry := configMapEntry(replaced)
+	// The object was deleted and created again after the entry was recorded.
+	replacedEntry.UID = "uid-before-replaced"
+	gone := configMapEntry(configMap("gone", nil))
+	namespaceEntry := installerv1alpha1.InventoryEntry{Version: "v1", Kind: "Namespace", Name: namespace.Name, UID: namespace.UID}
+	resource.Status.Inventory = []installerv1alpha1.InventoryEntry{
+		configMapEntry(owned),
+		replacedEntry,
+		configMapEntry(foreign),
+		configMapEntry(controlledByOther),
+		configMapEntry(failing),
+		gone,
+		namespaceEntry,
+	}
+
+	r := testReconciler(t, owned, replaced, foreign, controlledByOther, failing, namespace)
+	r.Client = &failingDeleteClient{Client: r.Client, names: map[string]bool{failing.Name: true}}
+
+	if _, err := r.inventoryStep(ctx, &syncState{resource: resource}); err == nil {
+		t.Fatal("error of the failed delete is not returned")
+	}
+
+	if err := r.Client.Get(ctx, client.ObjectKeyFromObject(owned), &corev1.ConfigMap{}); !kerrors.IsNotFound(err) {
+		t.Errorf("owned object is not pruned: %v", err)
+	}
+	for _, obj := range []client.Object{replaced, foreign, controlledByOther, failing, namespace} {
+		if err := r.Client.Get(ctx, client.ObjectKeyFromObject(obj), obj.DeepCopyObject().(client.Object)); err != nil {
+			t.Errorf("%s is deleted: %v", obj.GetName(), err)
+		}
+	}
+
+	// Only the entry which failed to be pruned is kept for retry, because nothing is generated in the fake cluster.
+	if len(resource.Status.Inventory) != 1 || resource.Status.Inventory[0] != configMapEntry(failing) {
+		t.Errorf("inventory is %+v", resource.Status.Inventory)
+	}
+
+	// The next reconcile prunes it once the delete succeeds.
+	r.Client = r.Client.(*failingDeleteClient).Client
+	if _, err := r.inventoryStep(ctx, &syncState{resource: resource}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Client.Get(ctx, client.ObjectKeyFromObject(failing), &corev1.ConfigMap{}); !kerrors.IsNotFound(err) {
+		t.Errorf("object is not pruned in retry: %v", err)
+	}
+	if len(resource.Status.Inventory) != 0 {
+		t.Errorf("inventory is %+v", resource.Status.Inventory)
+	}
+}
+
+func TestInventoryStepRecordsGenerated(t *testing.T) {
+	ctx := context.Background()
+	resource := testResource()
+	resource.UID = "resource-uid"
+
+	r := testReconciler(t)
+	objects, err := r.generatedObjects(resource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) == 0 {
+		t.Fatal("nothing is generated")
+	}
+	// The first generated object is owned by the resource, and the second is not.
+	owned := objects[0]
+	owned.SetUID("uid-owned")
+	owned.SetOwnerReferences(ownedBy(resource))
+	objs := []client.Object{owned}
+	if len(objects) > 1 {
+		objects[1].SetUID("uid-foreign")
+		objects[1].SetOwnerReferences(nil)
+		objs = append(objs, objects[1])
+	}
+	r = testReconciler(t, objs...)
+
+	stale := installerv1alpha1.InventoryEntry{Version: "v1", Kind: "ConfigMap", Namespace: resource.Spec.Namespace, Name: "stale", UID: "uid-stale"}
+	resource.Status.Inventory = []installerv1alpha1.InventoryEntry{stale}
+	if _, err := r.inventoryStep(ctx, &syncState{resource: resource}); err != nil {
+		t.Fatal(err)
+	}
+	if len(resource.Status.Inventory) != 1 {
+		t.Fatalf("inventory is %+v", resource.Status.Inventory)
+	}
+	if got := resource.Status.Inventory[0]; got.Name != owned.GetName() || got.UID != owned.GetUID() {
+		t.Errorf("inventory is %+v, want %s", resource.Status.Inventory, owned.GetName())
+	}
+}
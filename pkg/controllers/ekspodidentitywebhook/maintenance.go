@@ -0,0 +1,219 @@
+package ekspodidentitywebhook
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	installerv1alpha1 "github.com/h3poteto/eks-pod-identity-webhook-installer/api/v1alpha1"
+	"github.com/h3poteto/eks-pod-identity-webhook-installer/pkg/cron"
+)
+
+// gatedSteps apply changes which are held outside of maintenance windows.
+var gatedSteps = []string{"DaemonSet", "MutatingWebhookConfiguration"}
+
+// maintenanceGate decides whether changes which restart webhook pods or change the MutatingWebhookConfiguration
+// are applied in this reconcile.
+type maintenanceGate struct {
+	// open is true when no window is configured or a window is open.
+	open bool
+	// force is true when ForceApplyAnnotation is set.
+	force bool
+	// next is the start of the next window when it is not open.
+	next time.Time
+	// held are changes which are not applied until the next window.
+	held []pendingChange
+	// forced are changes which are applied outside of windows by ForceApplyAnnotation.
+	forced []pendingChange
+}
+
+type pendingChange struct {
+	kind string
+	diff []string
+}
+
+// newMaintenanceGate evaluates spec.maintenanceWindows at now.
+func newMaintenanceGate(resource *installerv1alpha1.EKSPodIdentityWebhook, now time.Time) (*maintenanceGate, error) {
+	_, force := resource.Annotations[installerv1alpha1.ForceApplyAnnotation]
+	gate := &maintenanceGate{
+		open:  len(resource.Spec.MaintenanceWindows) == 0,
+		force: force,
+	}
+	for i, w := range resource.Spec.MaintenanceWindows {
+		schedule, err := cron.Parse(w.Schedule)
+		if err != nil {
+			return nil, fmt.Errorf("maintenanceWindows[%d] has invalid schedule: %w", i, err)
+		}
+		loc, err := time.LoadLocation(w.TimeZone)
+		if err != nil {
+			return nil, fmt.Errorf("maintenanceWindows[%d] has invalid timeZone: %w", i, err)
+		}
+		if w.Duration.Duration <= 0 {
+			return nil, fmt.Errorf("maintenanceWindows[%d] has invalid duration %s", i, w.Duration.Duration)
+		}
+		// The first start after now-duration is the window which is open now, or the next one.
+		start := schedule.Next(now.In(loc).Add(-w.Duration.Duration))
+		if start.IsZero() {
+			continue
+		}
+		if !start.After(now) {
+			gate.open = true
+			continue
+		}
+		if gate.next.IsZero() || start.Before(gate.next) {
+			gate.next = start
+		}
+	}
+	if !gate.open && gate.next.IsZero() {
+		return nil, fmt.Errorf("no maintenance window starts in the next few years")
+	}
+	return gate, nil
+}
+
+// allow returns true when the change can be applied now. Otherwise it is recorded as held.
+func (g *maintenanceGate) allow(kind string, diff []string) bool {
+	if g == nil || g.open {
+		return true
+	}
+	if g.force {
+		g.forced = append(g.forced, pendingChange{kind: kind, diff: diff})
+		return true
+	}
+	g.held = append(g.held, pendingChange{kind: kind, diff: diff})
+	return false
+}
+
+// holds returns true when a change of the kind is held.
+func (g *maintenanceGate) holds(kind string) bool {
+	if g == nil {
+		return false
+	}
+	for _, c := range g.held {
+		if c.kind == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// holdsAny returns true when any change is held.
+func (g *maintenanceGate) holdsAny() bool {
+	return g != nil && len(g.held) > 0
+}
+
+// heldMessage describes the held changes for the PendingChanges condition.
+func (g *maintenanceGate) heldMessage() string {
+	lines := []string{}
+	for _, c := range g.held {
+		lines = append(lines, c.diff...)
+	}
+	if len(lines) > maxEventDiffLines {
+		lines = append(lines[:maxEventDiffLines:maxEventDiffLines], fmt.Sprintf("and %d more", len(lines)-maxEventDiffLines))
+	}
+	return fmt.Sprintf("Held until the maintenance window at %s: %s", g.next.Format(time.RFC3339), strings.Join(lines, "; "))
+}
+
+func (r *EKSPodIdentityWebhookReconciler) maintenanceWindowsStep(ctx context.Context, state *syncState) (stepResult, error) {
+	resource := state.resource
+	gate, err := newMaintenanceGate(resource, time.Now())
+	if err != nil {
+		r.Recorder.Eventf(resource, corev1.EventTypeWarning, "InvalidMaintenanceWindow", "Invalid maintenance windows: %v", err)
+		return fail(err.Error()), nil
+	}
+	state.gate = gate
+	switch {
+	case len(resource.Spec.MaintenanceWindows) == 0:
+		return done(""), nil
+	case gate.open:
+		return done("maintenance window is open"), nil
+	case gate.force:
+		return done(fmt.Sprintf("changes are forced by %s annotation", installerv1alpha1.ForceApplyAnnotation)), nil
+	default:
+		return done(fmt.Sprintf("next maintenance window starts at %s", gate.next.Format(time.RFC3339))), nil
+	}
+}
+
+// gatedStepsRan returns true when every step which consults the maintenance gate ran in this reconcile,
+// so the held changes are complete.
+func gatedStepsRan(resource *installerv1alpha1.EKSPodIdentityWebhook) bool {
+	for _, s := range resource.Status.Steps {
+		for _, name := range gatedSteps {
+			if s.Name == name && (s.Outcome == installerv1alpha1.StepBlocked || s.Outcome == installerv1alpha1.StepFailed) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// syncPendingChanges records held changes in PendingChanges condition, and returns when the next window starts.
+func (r *EKSPodIdentityWebhookReconciler) syncPendingChanges(state *syncState) time.Duration {
+	resource := state.resource
+	gate := state.gate
+	if len(resource.Spec.MaintenanceWindows) == 0 {
+		meta.RemoveStatusCondition(&resource.Status.Conditions, installerv1alpha1.ConditionPendingChanges)
+		return 0
+	}
+	if gate == nil || !gatedStepsRan(resource) {
+		return 0
+	}
+
+	current := meta.FindStatusCondition(resource.Status.Conditions, installerv1alpha1.ConditionPendingChanges)
+	if len(gate.held) == 0 {
+		if current != nil && current.Status == metav1.ConditionTrue {
+			r.Recorder.Event(resource, corev1.EventTypeNormal, "PendingChangesApplied", "Changes held for the maintenance window are applied")
+		}
+		meta.SetStatusCondition(&resource.Status.Conditions, metav1.Condition{
+			Type:               installerv1alpha1.ConditionPendingChanges,
+			Status:             metav1.ConditionFalse,
+			ObservedGeneration: resource.Generation,
+			Reason:             "NoPendingChanges",
+			Message:            "No changes are held",
+		})
+		return 0
+	}
+
+	message := gate.heldMessage()
+	if current == nil || current.Status != metav1.ConditionTrue || current.Message != message {
+		r.Recorder.Event(resource, corev1.EventTypeNormal, "ChangesHeld", message)
+		r.Logger.Info("Changes are held until the maintenance window", "Name", resource.Name, "Next", gate.next)
+	}
+	meta.SetStatusCondition(&resource.Status.Conditions, metav1.Condition{
+		Type:               installerv1alpha1.ConditionPendingChanges,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: resource.Generation,
+		Reason:             "HeldForMaintenanceWindow",
+		Message:            message,
+	})
+	// The window opens at a whole minute, so reconcile just after it.
+	return time.Until(gate.next) + time.Second
+}
+
+// finishForceApply removes ForceApplyAnnotation once the forced changes are applied.
+func (r *EKSPodIdentityWebhookReconciler) finishForceApply(ctx context.Context, state *syncState) error {
+	resource := state.resource
+	if state.gate == nil || !state.gate.force || !gatedStepsRan(resource) {
+		return nil
+	}
+	base := resource.DeepCopy()
+	delete(resource.Annotations, installerv1alpha1.ForceApplyAnnotation)
+	if err := r.Client.Patch(ctx, resource, client.MergeFrom(base)); err != nil {
+		r.Logger.Error(err, "Failed to remove annotation", "Name", resource.Name, "Annotation", installerv1alpha1.ForceApplyAnnotation)
+		return err
+	}
+	if len(state.gate.forced) > 0 {
+		kinds := []string{}
+		for _, c := range state.gate.forced {
+			kinds = append(kinds, c.kind)
+		}
+		r.Recorder.Eventf(resource, corev1.EventTypeNormal, "PendingChangesForceApplied", "Changes of %s are applied outside of maintenance windows", strings.Join(kinds, ", "))
+	}
+	r.Logger.Info("Success to force apply", "Name", resource.Name)
+	return nil
+}
@@ -0,0 +1,196 @@
+package ekspodidentitywebhook
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	installerv1alpha1 "github.com/h3poteto/eks-pod-identity-webhook-installer/api/v1alpha1"
+)
+
+func window(schedule string, duration time.Duration, timeZone string) installerv1alpha1.MaintenanceWindow {
+	return installerv1alpha1.MaintenanceWindow{Schedule: schedule, Duration: metav1.Duration{Duration: duration}, TimeZone: timeZone}
+}
+
+func TestNewMaintenanceGate(t *testing.T) {
+	at := func(s string) time.Time {
+		v, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	cases := []struct {
+		name    string
+		windows []installerv1alpha1.MaintenanceWindow
+		force   bool
+		now     time.Time
+		open    bool
+		next    time.Time
+		wantErr string
+	}{
+		{
+			name: "no windows",
+			now:  at("2021-01-01T05:00:00Z"),
+			open: true,
+		},
+		{
+			name:    "open",
+			windows: []installerv1alpha1.MaintenanceWindow{window("0 2 * * *", 2*time.Hour, "UTC")},
+			now:     at("2021-01-01T03:59:00Z"),
+			open:    true,
+		},
+		{
+			name:    "open at the start",
+			windows: []installerv1alpha1.MaintenanceWindow{window("0 2 * * *", 2*time.Hour, "UTC")},
+			now:     at("2021-01-01T02:00:00Z"),
+			open:    true,
+		},
+		{
+			name:    "closed at the end",
+			windows: []installerv1alpha1.MaintenanceWindow{window("0 2 * * *", 2*time.Hour, "UTC")},
+			now:     at("2021-01-01T04:00:00Z"),
+			next:    at("2021-01-02T02:00:00Z"),
+		},
+		{
+			name:    "closed before the start",
+			windows: []installerv1alpha1.MaintenanceWindow{window("0 2 * * *", 2*time.Hour, "UTC")},
+			now:     at("2021-01-01T01:00:00Z"),
+			next:    at("2021-01-01T02:00:00Z"),
+		},
+		{
+			name:    "forced while closed",
+			windows: []installerv1alpha1.MaintenanceWindow{window("0 2 * * *", 2*time.Hour, "UTC")},
+			force:   true,
+			now:     at("2021-01-01T05:00:00Z"),
+			next:    at("2021-01-02T02:00:00Z"),
+		},
+		{
+			// 2:00 in Tokyo is 17:00 UTC of the previous day.
+			name:    "open in a time zone",
+			windows: []installerv1alpha1.MaintenanceWindow{window("0 2 * * *", time.Hour, "Asia/Tokyo")},
+			now:     at("2021-01-01T17:30:00Z"),
+			open:    true,
+		},
+		{
+			// Saturday 22:00 in New York is 03:00 UTC on Sunday in winter and 02:00 UTC in summer.
+			name:    "closed across daylight saving time",
+			windows: []installerv1alpha1.MaintenanceWindow{window("0 22 * * SAT", 3*time.Hour, "America/New_York")},
+			now:     at("2021-03-09T00:00:00Z"),
+			next:    at("2021-03-14T03:00:00Z"),
+		},
+		{
+			name:    "open across daylight saving time",
+			windows: []installerv1alpha1.MaintenanceWindow{window("0 22 * * SAT", 3*time.Hour, "America/New_York")},
+			now:     at("2021-03-21T04:30:00Z"),
+			open:    true,
+		},
+		{
+			name: "next is the earliest window",
+			windows: []installerv1alpha1.MaintenanceWindow{
+				window("0 2 * * SUN", time.Hour, "UTC"),
+				window("0 20 * * *", time.Hour, "UTC"),
+			},
+			now:  at("2021-01-01T05:00:00Z"),
+			next: at("2021-01-01T20:00:00Z"),
+		},
+		{
+			name: "one of windows is open",
+			windows: []installerv1alpha1.MaintenanceWindow{
+				window("0 2 * * SUN", time.Hour, "UTC"),
+				window("0 4 * * *", 2*time.Hour, "UTC"),
+			},
+			now:  at("2021-01-01T05:00:00Z"),
+			open: true,
+			// The start of the other window is still recorded.
+			next: at("2021-01-03T02:00:00Z"),
+		},
+		{
+			name:    "invalid schedule",
+			windows: []installerv1alpha1.MaintenanceWindow{window("0 2 * *", time.Hour, "UTC")},
+			wantErr: "maintenanceWindows[0] has invalid schedule",
+		},
+		{
+			name:    "invalid time zone",
+			windows: []installerv1alpha1.MaintenanceWindow{window("0 2 * * *", time.Hour, "Mars/Olympus")},
+			wantErr: "maintenanceWindows[0] has invalid timeZone",
+		},
+		{
+			name:    "invalid duration",
+			windows: []installerv1alpha1.MaintenanceWindow{window("0 2 * * *", 0, "UTC")},
+			wantErr: "maintenanceWindows[0] has invalid duration",
+		},
+		{
+			name:    "never",
+			windows: []installerv1alpha1.MaintenanceWindow{window("0 0 30 2 *", time.Hour, "UTC")},
+			now:     at("2021-01-01T05:00:00Z"),
+			wantErr: "no maintenance window starts",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			resource := testResource()
+			resource.Spec.MaintenanceWindows = c.windows
+			if c.force {
+				resource.Annotations = map[string]string{installerv1alpha1.ForceApplyAnnotation: ""}
+			}
+
+			gate, err := newMaintenanceGate(resource, c.now)
+			if c.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+					t.Fatalf("error is %v, want %q", err, c.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if gate.open != c.open {
+				t.Errorf("open is %v, want %v", gate.open, c.open)
+			}
+			if gate.force != c.force {
+				t.Errorf("force is %v, want %v", gate.force, c.force)
+			}
+			if !gate.next.Equal(c.next) {
+				t.Errorf("next is %s, want %s", gate.next, c.next)
+			}
+		})
+	}
+}
+
+func TestMaintenanceGateAllow(t *testing.T) {
+	cases := []struct {
+		name   string
+		gate   *maintenanceGate
+		allow  bool
+		held   bool
+		forced bool
+	}{
+		{name: "without gate", allow: true},
+		{name: "open", gate: &maintenanceGate{open: true}, allow: true},
+		{name: "closed", gate: &maintenanceGate{}, held: true},
+		{name: "forced", gate: &maintenanceGate{force: true}, allow: true, forced: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := c.gate.allow("DaemonSet", []string{"image is changed"}); got != c.allow {
+				t.Errorf("allow is %v, want %v", got, c.allow)
+			}
+			if got := c.gate.holds("DaemonSet"); got != c.held {
+				t.Errorf("holds is %v, want %v", got, c.held)
+			}
+			if c.gate.holds("MutatingWebhookConfiguration") {
+				t.Error("other kinds must not be held")
+			}
+			if got := c.gate.holdsAny(); got != c.held {
+				t.Errorf("holdsAny is %v, want %v", got, c.held)
+			}
+			if c.gate != nil && (len(c.gate.forced) > 0) != c.forced {
+				t.Errorf("forced changes are %+v", c.gate.forced)
+			}
+		})
+	}
+}
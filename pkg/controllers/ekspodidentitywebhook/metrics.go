@@ -0,0 +1,129 @@
+package ekspodidentitywebhook
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+
+	installerv1alpha1 "github.com/h3poteto/eks-pod-identity-webhook-installer/api/v1alpha1"
+	"github.com/h3poteto/eks-pod-identity-webhook-installer/pkg/generator"
+)
+
+// monitorRetryInterval is how often we check whether the CRD of Prometheus Operator is installed.
+const monitorRetryInterval = 10 * time.Minute
+
+// metricsStep applies the metrics Service, and a ServiceMonitor or PodMonitor when the CRD is installed.
+// They are deleted when spec.metrics is unset.
+func (r *EKSPodIdentityWebhookReconciler) metricsStep(ctx context.Context, state *syncState) (stepResult, error) {
+	resource := state.resource
+	if resource.Spec.Metrics == nil {
+		if err := r.deleteObject(ctx, resource, &corev1.Service{}, resource.Spec.Namespace, generator.MetricsServiceName, true); err != nil {
+			return stepResult{}, err
+		}
+		if err := r.deleteMonitors(ctx, resource, resource.Spec.Namespace, ""); err != nil {
+			return stepResult{}, err
+		}
+		return done(""), nil
+	}
+
+	if err := r.ensureMetricsService(ctx, resource); err != nil {
+		return stepResult{}, err
+	}
+
+	kind := generator.MonitorKind(resource)
+	installed, err := r.monitorInstalled(kind)
+	if err != nil {
+		return stepResult{}, err
+	}
+	if !installed {
+		result := done(fmt.Sprintf("%s CRD is not installed, so only the metrics Service is created", kind))
+		result.requeueAfter = monitorRetryInterval
+		return result, nil
+	}
+	if err := r.deleteMonitors(ctx, resource, resource.Spec.Namespace, kind); err != nil {
+		return stepResult{}, err
+	}
+	monitor := generator.GenerateMonitor(resource)
+	if err := generator.ApplyOverlays(resource, monitor); err != nil {
+		return stepResult{}, err
+	}
+	if err := r.applyObject(ctx, resource, monitor, kind, false); err != nil {
+		return stepResult{}, err
+	}
+	return done(""), nil
+}
+
+// ensureMetricsService applies the metrics Service when the existing one differs from the generated one.
+func (r *EKSPodIdentityWebhookReconciler) ensureMetricsService(ctx context.Context, resource *installerv1alpha1.EKSPodIdentityWebhook) error {
+	service := generator.GenerateMetricsService(resource)
+	if err := generator.ApplyOverlays(resource, service); err != nil {
+		return err
+	}
+
+	exists := corev1.Service{}
+	err := r.Client.Get(ctx, types.NamespacedName{Namespace: service.Namespace, Name: service.Name}, &exists)
+	if err != nil && !kerrors.IsNotFound(err) {
+		r.Logger.Error(err, "Failed to get service", "Namespace", service.Namespace, "Name", service.Name)
+		return err
+	}
+	adopted := false
+	if err == nil {
+		if !metav1.IsControlledBy(&exists, resource) {
+			if err := r.adopt(resource, &exists, "Service", validateAdoptedService(&exists, service)); err != nil {
+				return err
+			}
+			adopted = true
+		}
+		if !adopted &&
+			containsLabels(exists.Labels, service.Labels) &&
+			containsLabels(exists.Annotations, service.Annotations) &&
+			equality.Semantic.DeepDerivative(service.Spec.Ports, exists.Spec.Ports) &&
+			equality.Semantic.DeepEqual(service.Spec.Selector, exists.Spec.Selector) {
+			return nil
+		}
+	}
+	return r.applyObject(ctx, resource, service, "Service", adopted)
+}
+
+// monitorInstalled returns true when the CRD of the monitor kind of Prometheus Operator is installed.
+func (r *EKSPodIdentityWebhookReconciler) monitorInstalled(kind string) (bool, error) {
+	gvk := generator.MonitoringGroupVersion.WithKind(kind)
+	_, err := r.Client.RESTMapper().RESTMapping(gvk.GroupKind(), gvk.Version)
+	if meta.IsNoMatchError(err) {
+		return false, nil
+	} else if err != nil {
+		r.Logger.Error(err, "Failed to find CRD", "Kind", gvk.String())
+		return false, err
+	}
+	return true, nil
+}
+
+// deleteMonitors deletes the generated ServiceMonitor and PodMonitor in the namespace, except the kind which is in use.
+func (r *EKSPodIdentityWebhookReconciler) deleteMonitors(ctx context.Context, resource *installerv1alpha1.EKSPodIdentityWebhook, namespace, except string) error {
+	for _, kind := range []string{installerv1alpha1.MonitorServiceMonitor, installerv1alpha1.MonitorPodMonitor} {
+		if kind == except {
+			continue
+		}
+		installed, err := r.monitorInstalled(kind)
+		if err != nil {
+			return err
+		}
+		if !installed {
+			continue
+		}
+		monitor := &unstructured.Unstructured{}
+		monitor.SetGroupVersionKind(generator.MonitoringGroupVersion.WithKind(kind))
+		if err := r.deleteObject(ctx, resource, monitor, namespace, generator.MonitorName, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
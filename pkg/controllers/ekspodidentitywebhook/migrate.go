@@ -0,0 +1,220 @@
+package ekspodidentitywebhook
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	installerv1alpha1 "github.com/h3poteto/eks-pod-identity-webhook-installer/api/v1alpha1"
+	"github.com/h3poteto/eks-pod-identity-webhook-installer/pkg/generator"
+)
+
+// migrationPollInterval is how often we check the webhook in the new namespace during a migration.
+const migrationPollInterval = 10 * time.Second
+
+// syncMigrationTarget starts a migration when spec.namespace differs from the namespace of the installed objects,
+// or retargets a migration which is still provisioning. It returns true when status is changed.
+func (r *EKSPodIdentityWebhookReconciler) syncMigrationTarget(resource *installerv1alpha1.EKSPodIdentityWebhook) bool {
+	m := resource.Status.Migration
+	if m == nil {
+		ref := resource.Status.PodIdentityWebhookServiceAccount
+		if ref == nil || ref.Namespace == resource.Spec.Namespace {
+			return false
+		}
+		resource.Status.Migration = &installerv1alpha1.NamespaceMigration{
+			From:      ref.Namespace,
+			To:        resource.Spec.Namespace,
+			Phase:     installerv1alpha1.MigrationPhaseProvisioning,
+			StartedAt: metav1.Now(),
+		}
+		r.Recorder.Eventf(resource, corev1.EventTypeNormal, "NamespaceMigrationStarted", "Migrating the webhook from %s to %s", ref.Namespace, resource.Spec.Namespace)
+		r.Logger.Info("Start namespace migration", "From", ref.Namespace, "To", resource.Spec.Namespace)
+		return true
+	}
+
+	// Once the MutatingWebhookConfiguration is switched, finish the migration first.
+	// The next migration starts after that, because status refs still differ from spec.namespace.
+	if m.To == resource.Spec.Namespace || m.Phase != installerv1alpha1.MigrationPhaseProvisioning {
+		return false
+	}
+	m.Abandoned = m.To
+	m.To = resource.Spec.Namespace
+	r.Recorder.Eventf(resource, corev1.EventTypeNormal, "NamespaceMigrationRetargeted", "Migrating the webhook from %s to %s instead of %s", m.From, m.To, m.Abandoned)
+	r.Logger.Info("Retarget namespace migration", "From", m.From, "To", m.To, "Abandoned", m.Abandoned)
+	return true
+}
+
+// migrationReady returns true when the webhook in the new namespace can serve requests.
+func (r *EKSPodIdentityWebhookReconciler) migrationReady(ctx context.Context, resource *installerv1alpha1.EKSPodIdentityWebhook, daemonset *appsv1.DaemonSet) (bool, string, error) {
+	namespace := resource.Status.Migration.To
+
+	s := daemonset.Status
+	if s.ObservedGeneration < daemonset.Generation {
+		return false, "DaemonSet is not observed yet", nil
+	}
+	if s.DesiredNumberScheduled == 0 || s.NumberReady < s.DesiredNumberScheduled || s.UpdatedNumberScheduled < s.DesiredNumberScheduled {
+		return false, fmt.Sprintf("%d/%d pods are ready", s.NumberReady, s.DesiredNumberScheduled), nil
+	}
+
+	// The certificate is issued from a CertificateSigningRequest unless spec.network.tlsSecretName is served.
+	if !generator.UsesURL(resource) {
+		secret := corev1.Secret{}
+		err := r.Client.Get(ctx, types.NamespacedName{Namespace: namespace, Name: generator.SecretName}, &secret)
+		if kerrors.IsNotFound(err) {
+			return false, "TLS secret is not issued yet", nil
+		} else if err != nil {
+			r.Logger.Error(err, "Failed to get secret", "Namespace", namespace, "Name", generator.SecretName)
+			return false, "", err
+		}
+		if len(secret.Data[corev1.TLSCertKey]) == 0 {
+			return false, "TLS secret has no certificate", nil
+		}
+	}
+
+	endpoints := corev1.Endpoints{}
+	err := r.Client.Get(ctx, types.NamespacedName{Namespace: namespace, Name: generator.ServiceName}, &endpoints)
+	if kerrors.IsNotFound(err) {
+		return false, "Service has no endpoints", nil
+	} else if err != nil {
+		r.Logger.Error(err, "Failed to get endpoints", "Namespace", namespace, "Name", generator.ServiceName)
+		return false, "", err
+	}
+	for _, subset := range endpoints.Subsets {
+		if len(subset.Addresses) > 0 {
+			return true, "", nil
+		}
+	}
+	return false, "Service has no ready endpoints", nil
+}
+
+// abandonMigrationTarget deletes objects in the namespace which is no longer the target of the migration.
+// When spec.namespace is changed back to the original namespace, the migration is cancelled.
+func (r *EKSPodIdentityWebhookReconciler) abandonMigrationTarget(ctx context.Context, resource *installerv1alpha1.EKSPodIdentityWebhook) error {
+	m := resource.Status.Migration
+	if err := r.cleanupNamespace(ctx, resource, m.Abandoned); err != nil {
+		return err
+	}
+	status := &resource.Status
+	if ref := status.PodIdentityWebhookServiceAccount; ref != nil && ref.Namespace == m.Abandoned {
+		status.PodIdentityWebhookServiceAccount = nil
+	}
+	if ref := status.PodIdentityWebhookService; ref != nil && ref.Namespace == m.Abandoned {
+		status.PodIdentityWebhookService = nil
+	}
+	if ref := status.PodIdentityWebhookDaemonset; ref != nil && ref.Namespace == m.Abandoned {
+		status.PodIdentityWebhookDaemonset = nil
+	}
+	m.Abandoned = ""
+	if m.From == m.To {
+		status.Migration = nil
+		r.Recorder.Eventf(resource, corev1.EventTypeNormal, "NamespaceMigrationCancelled", "Migration is cancelled, the webhook stays in %s", m.From)
+		r.Logger.Info("Cancel namespace migration", "Namespace", m.From)
+	}
+	return nil
+}
+
+// finishMigration tears down the old namespace and clears the migration.
+func (r *EKSPodIdentityWebhookReconciler) finishMigration(ctx context.Context, resource *installerv1alpha1.EKSPodIdentityWebhook) error {
+	m := resource.Status.Migration
+	if err := r.cleanupNamespace(ctx, resource, m.From); err != nil {
+		return err
+	}
+	resource.Status.Migration = nil
+	// Drop the old ServiceAccount from the ClusterRoleBinding.
+	if resource.Spec.ExistingServiceAccountName == "" {
+		if _, err := r.createServiceAccount(ctx, resource); err != nil {
+			return err
+		}
+	}
+	r.Recorder.Eventf(resource, corev1.EventTypeNormal, "NamespaceMigrated", "Success to migrate the webhook from %s to %s", m.From, m.To)
+	r.Logger.Info("Finish namespace migration", "From", m.From, "To", m.To)
+	return nil
+}
+
+// cleanupNamespace deletes the webhook objects which the resource controls, and the TLS secret in the namespace.
+// The secret has no owner, so it is kept while a DaemonSet which the resource does not control may use it.
+func (r *EKSPodIdentityWebhookReconciler) cleanupNamespace(ctx context.Context, resource *installerv1alpha1.EKSPodIdentityWebhook, namespace string) error {
+	daemonset := appsv1.DaemonSet{}
+	err := r.Client.Get(ctx, types.NamespacedName{Namespace: namespace, Name: generator.DaemonsetName}, &daemonset)
+	if err != nil && !kerrors.IsNotFound(err) {
+		r.Logger.Error(err, "Failed to get daemonset", "Namespace", namespace, "Name", generator.DaemonsetName)
+		return err
+	}
+	foreign := err == nil && !metav1.IsControlledBy(&daemonset, resource)
+
+	owned := []client.Object{
+		&appsv1.DaemonSet{},
+		&corev1.Service{},
+		&networkingv1.NetworkPolicy{},
+		&corev1.ServiceAccount{},
+	}
+	names := []string{
+		generator.DaemonsetName,
+		generator.ServiceName,
+		generator.NetworkPolicyName,
+		generator.ServiceAccountName,
+	}
+	// With spec.existingServiceAccountName the installer may not be allowed to read RBAC.
+	// Generated RBAC in the old namespace is recorded in the inventory, and pruned by Inventory step then.
+	if resource.Spec.ExistingServiceAccountName == "" {
+		owned = append(owned, &rbacv1.RoleBinding{}, &rbacv1.Role{})
+		names = append(names, generator.ServiceAccountName, generator.ServiceAccountName)
+	}
+	for i, obj := range owned {
+		if err := r.deleteObject(ctx, resource, obj, namespace, names[i], true); err != nil {
+			return err
+		}
+	}
+	if err := r.deleteObject(ctx, resource, &corev1.Service{}, namespace, generator.MetricsServiceName, true); err != nil {
+		return err
+	}
+	if err := r.deleteMonitors(ctx, resource, namespace, ""); err != nil {
+		return err
+	}
+	if err := r.deleteObject(ctx, resource, &corev1.ServiceAccount{}, namespace, probeServiceAccountName, true); err != nil {
+		return err
+	}
+	// The secret is created by the webhook, so it has no owner.
+	if foreign {
+		r.Logger.Info("DaemonSet is not owned, so skip deleting the TLS secret", "Namespace", namespace, "Name", generator.SecretName)
+	} else if err := r.deleteObject(ctx, resource, &corev1.Secret{}, namespace, generator.SecretName, false); err != nil {
+		return err
+	}
+	r.Recorder.Eventf(resource, corev1.EventTypeNormal, "NamespaceCleanedUp", "Success to delete the webhook in %s", namespace)
+	return nil
+}
+
+func (r *EKSPodIdentityWebhookReconciler) deleteObject(
+	ctx context.Context,
+	resource *installerv1alpha1.EKSPodIdentityWebhook,
+	obj client.Object,
+	namespace, name string,
+	requireOwner bool,
+) error {
+	err := r.Client.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, obj)
+	if kerrors.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		r.Logger.Error(err, "Failed to get object", "Namespace", namespace, "Name", name)
+		return err
+	}
+	if requireOwner && !metav1.IsControlledBy(obj, resource) {
+		r.Logger.Info("Object is not owned, so skip deleting", "Namespace", namespace, "Name", name)
+		return nil
+	}
+	if err := r.Client.Delete(ctx, obj); client.IgnoreNotFound(err) != nil {
+		r.Logger.Error(err, "Failed to delete object", "Namespace", namespace, "Name", name)
+		return err
+	}
+	r.Logger.Info("Success to delete object", "Namespace", namespace, "Name", name)
+	return nil
+}
@@ -0,0 +1,295 @@
+package ekspodidentitywebhook
+
+import (
+	"context"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	installerv1alpha1 "github.com/h3poteto/eks-pod-identity-webhook-installer/api/v1alpha1"
+	"github.com/h3poteto/eks-pod-identity-webhook-installer/pkg/generator"
+)
+
+// applyClient accepts server-side apply, which the fake client does not support, without changing anything.
+type applyClient struct {
+	client.Client
+}
+
+func (c *applyClient) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	if patch.Type() == types.ApplyPatchType {
+		return nil
+	}
+	return c.Client.Patch(ctx, obj, patch, opts...)
+}
+
+// installed returns the objects of the webhook in the namespace. The TLS secret has no owner as the webhook creates it.
+func installed(resource *installerv1alpha1.EKSPodIdentityWebhook, namespace string, owners []metav1.OwnerReference) []client.Object {
+	meta := func(name string) metav1.ObjectMeta {
+		return metav1.ObjectMeta{Namespace: namespace, Name: name, OwnerReferences: owners}
+	}
+	return []client.Object{
+		&appsv1.DaemonSet{ObjectMeta: meta(generator.DaemonsetName)},
+		&corev1.Service{ObjectMeta: meta(generator.ServiceName)},
+		&corev1.ServiceAccount{ObjectMeta: meta(generator.ServiceAccountName)},
+		&rbacv1.Role{ObjectMeta: meta(generator.ServiceAccountName)},
+		&rbacv1.RoleBinding{ObjectMeta: meta(generator.ServiceAccountName)},
+		&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: generator.SecretName}},
+	}
+}
+
+func exists(t *testing.T, c client.Client, obj client.Object) bool {
+	t.Helper()
+	err := c.Get(context.Background(), client.ObjectKeyFromObject(obj), obj.DeepCopyObject().(client.Object))
+	if kerrors.IsNotFound(err) {
+		return false
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return true
+}
+
+func migratingResource(from, to string) *installerv1alpha1.EKSPodIdentityWebhook {
+	resource := testResource()
+	resource.UID = "resource-uid"
+	resource.Spec.Namespace = to
+	resource.Status.PodIdentityWebhookServiceAccount = &installerv1alpha1.ServiceAccountRef{Namespace: from, Name: generator.ServiceAccountName}
+	resource.Status.PodIdentityWebhookService = &installerv1alpha1.ServiceRef{Namespace: from, Name: generator.ServiceName}
+	resource.Status.PodIdentityWebhookDaemonset = &installerv1alpha1.DaemonsetRef{Namespace: from, Name: generator.DaemonsetName}
+	return resource
+}
+
+func TestSyncMigrationTarget(t *testing.T) {
+	cases := []struct {
+		name      string
+		migration *installerv1alpha1.NamespaceMigration
+		changed   bool
+		want      *installerv1alpha1.NamespaceMigration
+	}{
+		{
+			name:    "start",
+			changed: true,
+			want:    &installerv1alpha1.NamespaceMigration{From: "old", To: "new", Phase: installerv1alpha1.MigrationPhaseProvisioning},
+		},
+		{
+			name:      "in progress",
+			migration: &installerv1alpha1.NamespaceMigration{From: "old", To: "new", Phase: installerv1alpha1.MigrationPhaseProvisioning},
+			want:      &installerv1alpha1.NamespaceMigration{From: "old", To: "new", Phase: installerv1alpha1.MigrationPhaseProvisioning},
+		},
+		{
+			name:      "retarget while provisioning",
+			migration: &installerv1alpha1.NamespaceMigration{From: "old", To: "other", Phase: installerv1alpha1.MigrationPhaseProvisioning},
+			changed:   true,
+			want:      &installerv1alpha1.NamespaceMigration{From: "old", To: "new", Abandoned: "other", Phase: installerv1alpha1.MigrationPhaseProvisioning},
+		},
+		{
+			name:      "not retargeted after switching",
+			migration: &installerv1alpha1.NamespaceMigration{From: "old", To: "other", Phase: installerv1alpha1.MigrationPhaseSwitching},
+			want:      &installerv1alpha1.NamespaceMigration{From: "old", To: "other", Phase: installerv1alpha1.MigrationPhaseSwitching},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			resource := migratingResource("old", "new")
+			resource.Status.Migration = c.migration
+			r := testReconciler(t)
+			if got := r.syncMigrationTarget(resource); got != c.changed {
+				t.Errorf("changed is %v, want %v", got, c.changed)
+			}
+			m := resource.Status.Migration
+			if m == nil || m.From != c.want.From || m.To != c.want.To || m.Abandoned != c.want.Abandoned || m.Phase != c.want.Phase {
+				t.Errorf("migration is %+v, want %+v", m, c.want)
+			}
+		})
+	}
+
+	// Nothing is migrated when status references spec.namespace.
+	resource := migratingResource("new", "new")
+	if testReconciler(t).syncMigrationTarget(resource) || resource.Status.Migration != nil {
+		t.Errorf("migration is started: %+v", resource.Status.Migration)
+	}
+}
+
+func TestMigrationCleanupWaitsForReady(t *testing.T) {
+	ctx := context.Background()
+	resource := migratingResource("old", "new")
+	resource.Status.Migration = &installerv1alpha1.NamespaceMigration{From: "old", To: "new", Phase: installerv1alpha1.MigrationPhaseProvisioning}
+
+	old := installed(resource, "old", ownedBy(resource))
+	daemonset := &appsv1.DaemonSet{ObjectMeta: metav1.ObjectMeta{Namespace: "new", Name: generator.DaemonsetName, Generation: 1, OwnerReferences: ownedBy(resource)}}
+	r := testReconciler(t, append(old, daemonset)...)
+	r.Client = &applyClient{r.Client}
+
+	// Every step but the readiness of the DaemonSet and the cleanup succeeds, so the order of steps decides when the cleanup runs.
+	steps := r.steps(resource)
+	for i := range steps {
+		switch steps[i].name {
+		case "MigrationCleanup":
+		case "DaemonSet":
+			// ready is kept, which holds the MutatingWebhookConfiguration back until the webhook is ready.
+			steps[i].run = returns(done(""), nil)
+		default:
+			steps[i].run = returns(done(""), nil)
+			steps[i].ready = nil
+		}
+	}
+	run := func() {
+		t.Helper()
+		state := &syncState{resource: resource, daemonset: daemonset}
+		if _, err := r.runSteps(ctx, state, steps); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The new DaemonSet is not ready.
+	run()
+	for _, obj := range old {
+		if !exists(t, r.Client, obj) {
+			t.Errorf("%T in the old namespace is deleted before the webhook in the new namespace is ready", obj)
+		}
+	}
+	if m := resource.Status.Migration; m == nil || m.Phase != installerv1alpha1.MigrationPhaseProvisioning {
+		t.Fatalf("migration is %+v", m)
+	}
+
+	// The DaemonSet is ready, but the certificate is not issued yet.
+	daemonset.Status = appsv1.DaemonSetStatus{ObservedGeneration: 1, DesiredNumberScheduled: 2, NumberReady: 2, UpdatedNumberScheduled: 2}
+	run()
+	for _, obj := range old {
+		if !exists(t, r.Client, obj) {
+			t.Errorf("%T in the old namespace is deleted before the certificate is issued", obj)
+		}
+	}
+
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "new", Name: generator.SecretName}, Data: map[string][]byte{corev1.TLSCertKey: []byte("cert")}}
+	endpoints := &corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "new", Name: generator.ServiceName},
+		Subsets:    []corev1.EndpointSubset{{Addresses: []corev1.EndpointAddress{{IP: "10.0.0.1"}}}},
+	}
+	for _, obj := range []client.Object{secret, endpoints} {
+		if err := r.Client.Create(ctx, obj); err != nil {
+			t.Fatal(err)
+		}
+	}
+	run()
+	for _, obj := range old {
+		if exists(t, r.Client, obj) {
+			t.Errorf("%T in the old namespace is not deleted", obj)
+		}
+	}
+	if resource.Status.Migration != nil {
+		t.Errorf("migration is not finished: %+v", resource.Status.Migration)
+	}
+	for _, obj := range []client.Object{daemonset, secret, endpoints} {
+		if !exists(t, r.Client, obj) {
+			t.Errorf("%T in the new namespace is deleted", obj)
+		}
+	}
+}
+
+func TestAbandonMigrationTarget(t *testing.T) {
+	cases := []struct {
+		name      string
+		migration installerv1alpha1.NamespaceMigration
+		cancelled bool
+	}{
+		{
+			name:      "retargeted",
+			migration: installerv1alpha1.NamespaceMigration{From: "old", To: "other", Abandoned: "new", Phase: installerv1alpha1.MigrationPhaseProvisioning},
+		},
+		{
+			name:      "cancelled",
+			migration: installerv1alpha1.NamespaceMigration{From: "old", To: "old", Abandoned: "new", Phase: installerv1alpha1.MigrationPhaseProvisioning},
+			cancelled: true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ctx := context.Background()
+			resource := migratingResource("old", c.migration.To)
+			// The ServiceAccount step already ran for the abandoned namespace.
+			resource.Status.PodIdentityWebhookServiceAccount = &installerv1alpha1.ServiceAccountRef{Namespace: "new", Name: generator.ServiceAccountName}
+			m := c.migration
+			resource.Status.Migration = &m
+
+			old := installed(resource, "old", ownedBy(resource))
+			abandoned := installed(resource, "new", ownedBy(resource))
+			r := testReconciler(t, append(old, abandoned...)...)
+
+			if err := r.abandonMigrationTarget(ctx, resource); err != nil {
+				t.Fatal(err)
+			}
+			for _, obj := range old {
+				if !exists(t, r.Client, obj) {
+					t.Errorf("%T of the old install is deleted", obj)
+				}
+			}
+			for _, obj := range abandoned {
+				if exists(t, r.Client, obj) {
+					t.Errorf("%T in the abandoned namespace is not deleted", obj)
+				}
+			}
+			status := resource.Status
+			if status.PodIdentityWebhookServiceAccount != nil {
+				t.Errorf("reference to the abandoned namespace is kept: %+v", status.PodIdentityWebhookServiceAccount)
+			}
+			if status.PodIdentityWebhookDaemonset == nil || status.PodIdentityWebhookDaemonset.Namespace != "old" {
+				t.Errorf("reference to the old install is changed: %+v", status.PodIdentityWebhookDaemonset)
+			}
+			if c.cancelled != (status.Migration == nil) {
+				t.Errorf("migration is %+v", status.Migration)
+			}
+			if status.Migration != nil && status.Migration.Abandoned != "" {
+				t.Errorf("abandoned is not cleared: %+v", status.Migration)
+			}
+		})
+	}
+}
+
+func TestCleanupNamespace(t *testing.T) {
+	ctx := context.Background()
+	resource := migratingResource("old", "new")
+	other := testResource()
+	other.Name = "other"
+	other.UID = "other-uid"
+
+	cases := []struct {
+		name    string
+		objects []client.Object
+		deleted bool
+		secret  bool
+	}{
+		{name: "controlled", objects: installed(resource, "old", ownedBy(resource)), deleted: true, secret: true},
+		{name: "not owned", objects: installed(resource, "old", nil)},
+		{name: "controlled by another resource", objects: installed(resource, "old", ownedBy(other))},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			// Objects of the same names in other namespaces are never touched.
+			elsewhere := installed(resource, "new", ownedBy(resource))
+			r := testReconciler(t, append(c.objects, elsewhere...)...)
+			if err := r.cleanupNamespace(ctx, resource, "old"); err != nil {
+				t.Fatal(err)
+			}
+			for _, obj := range c.objects {
+				want := c.deleted
+				if _, ok := obj.(*corev1.Secret); ok {
+					want = c.secret
+				}
+				if exists(t, r.Client, obj) == want {
+					t.Errorf("%T is deleted: %v, want %v", obj, !want, want)
+				}
+			}
+			for _, obj := range elsewhere {
+				if !exists(t, r.Client, obj) {
+					t.Errorf("%T in another namespace is deleted", obj)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package ekspodidentitywebhook
+
+import (
+	"context"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	installerv1alpha1 "github.com/h3poteto/eks-pod-identity-webhook-installer/api/v1alpha1"
+	"github.com/h3poteto/eks-pod-identity-webhook-installer/pkg/generator"
+)
+
+// namespaceTerminatingInterval is how long we wait for a terminating namespace to be deleted before recreating it.
+const namespaceTerminatingInterval = 5 * time.Second
+
+// ensureNamespace creates spec.namespace when spec.createNamespace is set.
+// The namespace is owned by the resource, so it is recreated when deleted out of band,
+// and garbage collected on uninstall. A namespace which the installer did not create is never touched.
+// It returns false when the namespace is not ready yet.
+func (r *EKSPodIdentityWebhookReconciler) ensureNamespace(ctx context.Context, resource *installerv1alpha1.EKSPodIdentityWebhook) (bool, error) {
+	if resource.Spec.CreateNamespace == nil {
+		return true, nil
+	}
+	namespace := generator.GenerateNamespace(resource)
+	if err := generator.ApplyOverlays(resource, namespace); err != nil {
+		return false, err
+	}
+
+	exists := corev1.Namespace{}
+	err := r.Client.Get(ctx, types.NamespacedName{Name: namespace.Name}, &exists)
+	if err != nil && !kerrors.IsNotFound(err) {
+		r.Logger.Error(err, "Failed to get namespace", "Name", namespace.Name)
+		return false, err
+	}
+	if err == nil {
+		if exists.Status.Phase == corev1.NamespaceTerminating {
+			r.Logger.Info("Namespace is terminating, so waiting for deletion", "Name", exists.Name)
+			return false, nil
+		}
+		if !metav1.IsControlledBy(&exists, resource) {
+			r.Logger.Info("Namespace already exists and is not created by the installer", "Name", exists.Name)
+			return true, nil
+		}
+		if containsLabels(exists.Labels, namespace.Labels) && containsLabels(exists.Annotations, namespace.Annotations) {
+			return true, nil
+		}
+	}
+
+	if err := r.applyObject(ctx, resource, namespace, "Namespace", false); err != nil {
+		return false, err
+	}
+	return true, nil
+}
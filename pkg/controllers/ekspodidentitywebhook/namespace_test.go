@@ -0,0 +1,133 @@
+package ekspodidentitywebhook
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	installerv1alpha1 "github.com/h3poteto/eks-pod-identity-webhook-installer/api/v1alpha1"
+	"github.com/h3poteto/eks-pod-identity-webhook-installer/pkg/generator"
+)
+
+// recordingApplyClient records objects which are applied with server-side apply, which the fake client does not support.
+type recordingApplyClient struct {
+	client.Client
+	applied []client.Object
+}
+
+func (c *recordingApplyClient) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	if patch.Type() == types.ApplyPatchType {
+		c.applied = append(c.applied, obj)
+		return nil
+	}
+	return c.Client.Patch(ctx, obj, patch, opts...)
+}
+
+func TestEnsureNamespace(t *testing.T) {
+	ctx := context.Background()
+	resource := testResource()
+	resource.UID = "resource-uid"
+	resource.Spec.Namespace = "webhook"
+	resource.Spec.CreateNamespace = &installerv1alpha1.CreateNamespace{Labels: map[string]string{"team": "platform"}}
+	generated := generator.GenerateNamespace(resource)
+
+	namespace := func(labels map[string]string, owners []metav1.OwnerReference, phase corev1.NamespacePhase) *corev1.Namespace {
+		return &corev1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{Name: "webhook", Labels: labels, OwnerReferences: owners},
+			Status:     corev1.NamespaceStatus{Phase: phase},
+		}
+	}
+	drifted := map[string]string{}
+	for k, v := range generated.Labels {
+		drifted[k] = v
+	}
+	delete(drifted, "team")
+
+	cases := []struct {
+		name      string
+		existing  *corev1.Namespace
+		create    bool
+		wantReady bool
+		// wantApply is true when the generated namespace is applied.
+		wantApply bool
+	}{
+		{name: "createNamespace is not set", wantReady: true},
+		// The namespace was deleted out of band, so it is created again.
+		{name: "missing", create: true, wantReady: true, wantApply: true},
+		{
+			// A namespace can not be created while the old one is terminating.
+			name:     "terminating",
+			existing: namespace(generated.Labels, ownedBy(resource), corev1.NamespaceTerminating),
+			create:   true,
+		},
+		{
+			name:      "not controlled by the resource",
+			existing:  namespace(map[string]string{"owner": "someone"}, nil, corev1.NamespaceActive),
+			create:    true,
+			wantReady: true,
+		},
+		{
+			name:      "labels are drifted",
+			existing:  namespace(drifted, ownedBy(resource), corev1.NamespaceActive),
+			create:    true,
+			wantReady: true,
+			wantApply: true,
+		},
+		{
+			name:      "up to date",
+			existing:  namespace(generated.Labels, ownedBy(resource), corev1.NamespaceActive),
+			create:    true,
+			wantReady: true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			res := resource.DeepCopy()
+			if !c.create {
+				res.Spec.CreateNamespace = nil
+			}
+			objects := []client.Object{}
+			if c.existing != nil {
+				objects = append(objects, c.existing)
+			}
+			r := testReconciler(t, objects...)
+			recorder := &recordingApplyClient{Client: r.Client}
+			r.Client = recorder
+
+			ready, err := r.ensureNamespace(ctx, res)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ready != c.wantReady {
+				t.Errorf("ready is %v, want %v", ready, c.wantReady)
+			}
+			if applied := len(recorder.applied) > 0; applied != c.wantApply {
+				t.Fatalf("applied is %v, want %v", applied, c.wantApply)
+			}
+			if c.wantApply {
+				applied := recorder.applied[0]
+				if applied.GetName() != "webhook" || applied.GetLabels()["team"] != "platform" {
+					t.Errorf("applied %s with %v", applied.GetName(), applied.GetLabels())
+				}
+			}
+			// The namespace is only written by apply, which the recorder drops, so nothing else changes it.
+			if c.existing != nil {
+				live := &corev1.Namespace{}
+				if err := r.Client.Get(ctx, client.ObjectKeyFromObject(c.existing), live); err != nil {
+					t.Fatal(err)
+				}
+				if !equalLabels(live.Labels, c.existing.Labels) {
+					t.Errorf("labels are changed to %v", live.Labels)
+				}
+			}
+		})
+	}
+}
+
+func equalLabels(a, b map[string]string) bool {
+	return len(a) == len(b) && containsLabels(a, b)
+}
@@ -0,0 +1,110 @@
+package ekspodidentitywebhook
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/url"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+
+	installerv1alpha1 "github.com/h3poteto/eks-pod-identity-webhook-installer/api/v1alpha1"
+	"github.com/h3poteto/eks-pod-identity-webhook-installer/pkg/generator"
+)
+
+// tlsSecretRetryInterval is how often we check spec.network.tlsSecretName again, because Secrets are not watched.
+const tlsSecretRetryInterval = 1 * time.Minute
+
+// networkStep validates spec.network. In NodePort and URL modes, the certificate in spec.network.tlsSecretName
+// must cover the host of spec.network.url, otherwise the API server rejects the TLS handshake.
+func (r *EKSPodIdentityWebhookReconciler) networkStep(ctx context.Context, state *syncState) (stepResult, error) {
+	resource := state.resource
+	network := resource.Spec.Network
+	mode := generator.NetworkMode(resource)
+	if !generator.UsesURL(resource) {
+		return done(fmt.Sprintf("%s mode", mode)), nil
+	}
+	if network.URL == "" {
+		return fail(fmt.Sprintf("spec.network.url is required in %s mode", mode)), nil
+	}
+	u, err := url.Parse(network.URL)
+	if err != nil || u.Scheme != "https" || u.Hostname() == "" {
+		return fail(fmt.Sprintf("spec.network.url %s is not a valid https URL", network.URL)), nil
+	}
+	if network.TLSSecretName == "" {
+		return fail(fmt.Sprintf("spec.network.tlsSecretName is required in %s mode", mode)), nil
+	}
+
+	secret, err := r.tlsSecret(ctx, resource)
+	if kerrors.IsNotFound(err) {
+		return wait(fmt.Sprintf("Secret %s/%s does not exist", resource.Spec.Namespace, network.TLSSecretName), tlsSecretRetryInterval), nil
+	} else if err != nil {
+		return stepResult{}, err
+	}
+	if len(secret.Data["ca.crt"]) == 0 || len(secret.Data[corev1.TLSPrivateKeyKey]) == 0 {
+		return wait(fmt.Sprintf("Secret %s/%s must have ca.crt, tls.crt and tls.key", secret.Namespace, secret.Name), tlsSecretRetryInterval), nil
+	}
+	block, _ := pem.Decode(secret.Data[corev1.TLSCertKey])
+	if block == nil {
+		return wait(fmt.Sprintf("tls.crt of Secret %s/%s is not a PEM encoded certificate", secret.Namespace, secret.Name), tlsSecretRetryInterval), nil
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return wait(fmt.Sprintf("tls.crt of Secret %s/%s is invalid: %v", secret.Namespace, secret.Name, err), tlsSecretRetryInterval), nil
+	}
+	if err := cert.VerifyHostname(u.Hostname()); err != nil {
+		return wait(fmt.Sprintf("tls.crt of Secret %s/%s does not cover %s: %v", secret.Namespace, secret.Name, u.Hostname(), err), tlsSecretRetryInterval), nil
+	}
+	return done(fmt.Sprintf("%s mode with %s", mode, network.URL)), nil
+}
+
+func (r *EKSPodIdentityWebhookReconciler) tlsSecret(ctx context.Context, resource *installerv1alpha1.EKSPodIdentityWebhook) (*corev1.Secret, error) {
+	secret := corev1.Secret{}
+	err := r.Client.Get(ctx, types.NamespacedName{Namespace: resource.Spec.Namespace, Name: resource.Spec.Network.TLSSecretName}, &secret)
+	if err != nil && !kerrors.IsNotFound(err) {
+		r.Logger.Error(err, "Failed to get secret", "Namespace", resource.Spec.Namespace, "Name", resource.Spec.Network.TLSSecretName)
+	}
+	return &secret, err
+}
+
+// webhookCA returns caBundle of the MutatingWebhookConfiguration. It is ca.crt of spec.network.tlsSecretName
+// in NodePort and URL modes, ca.crt of the webhook server of the installer in Embedded implementation,
+// and the CA of the cluster otherwise.
+func (r *EKSPodIdentityWebhookReconciler) webhookCA(ctx context.Context, resource *installerv1alpha1.EKSPodIdentityWebhook) ([]byte, error) {
+	if generator.Embedded(resource) {
+		return r.embeddedCA()
+	}
+	if !generator.UsesURL(resource) {
+		return r.clusterCA(ctx, resource)
+	}
+	secret, err := r.tlsSecret(ctx, resource)
+	if err != nil {
+		return nil, err
+	}
+	return secret.Data["ca.crt"], nil
+}
+
+// hasSpecFields returns true when the live object has the fields in spec.
+// It reads the object as unstructured, because typed objects drop fields which k8s.io/api does not know.
+func (r *EKSPodIdentityWebhookReconciler) hasSpecFields(ctx context.Context, obj *unstructured.Unstructured, spec map[string]interface{}) (bool, error) {
+	if len(spec) == 0 {
+		return true, nil
+	}
+	if err := r.Client.Get(ctx, types.NamespacedName{Namespace: obj.GetNamespace(), Name: obj.GetName()}, obj); err != nil {
+		r.Logger.Error(err, "Failed to get object", "Namespace", obj.GetNamespace(), "Name", obj.GetName())
+		return false, err
+	}
+	for field, value := range spec {
+		live, _, _ := unstructured.NestedFieldNoCopy(obj.Object, "spec", field)
+		if !equality.Semantic.DeepEqual(live, value) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,76 @@
+package ekspodidentitywebhook
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	installerv1alpha1 "github.com/h3poteto/eks-pod-identity-webhook-installer/api/v1alpha1"
+	"github.com/h3poteto/eks-pod-identity-webhook-installer/pkg/generator"
+)
+
+// networkPolicyStep applies the NetworkPolicy when spec.networkPolicy is set, and deletes the generated one when it is unset.
+func (r *EKSPodIdentityWebhookReconciler) networkPolicyStep(ctx context.Context, state *syncState) (stepResult, error) {
+	resource := state.resource
+	if resource.Spec.NetworkPolicy == nil {
+		if err := r.deleteObject(ctx, resource, &networkingv1.NetworkPolicy{}, resource.Spec.Namespace, generator.NetworkPolicyName, true); err != nil {
+			return stepResult{}, err
+		}
+		return done(""), nil
+	}
+	if err := r.ensureNetworkPolicy(ctx, resource); err != nil {
+		return stepResult{}, err
+	}
+	return done(""), nil
+}
+
+// ensureNetworkPolicy applies the NetworkPolicy when the existing one differs from the generated one.
+func (r *EKSPodIdentityWebhookReconciler) ensureNetworkPolicy(ctx context.Context, resource *installerv1alpha1.EKSPodIdentityWebhook) error {
+	policy := generator.GenerateNetworkPolicy(resource)
+	if err := generator.ApplyOverlays(resource, policy); err != nil {
+		return err
+	}
+
+	exists := networkingv1.NetworkPolicy{}
+	err := r.Client.Get(ctx, types.NamespacedName{Namespace: policy.Namespace, Name: policy.Name}, &exists)
+	if err != nil && !kerrors.IsNotFound(err) {
+		r.Logger.Error(err, "Failed to get networkpolicy", "Namespace", policy.Namespace, "Name", policy.Name)
+		return err
+	}
+
+	adopted := false
+	if err == nil {
+		if !metav1.IsControlledBy(&exists, resource) {
+			if err := r.adopt(resource, &exists, "NetworkPolicy", nil); err != nil {
+				return err
+			}
+			adopted = true
+		}
+		if !adopted &&
+			containsLabels(exists.Labels, policy.Labels) &&
+			containsLabels(exists.Annotations, policy.Annotations) &&
+			equality.Semantic.DeepEqual(policy.Spec, exists.Spec) {
+			return nil
+		}
+	}
+
+	if adopted {
+		exists.Spec = policy.Spec
+		if err := r.replaceAdopted(ctx, resource, &exists, "NetworkPolicy"); err != nil {
+			return err
+		}
+	}
+	if err := r.applyObject(ctx, resource, policy, "NetworkPolicy", adopted); err != nil {
+		return err
+	}
+	if adopted {
+		r.Recorder.Eventf(resource, corev1.EventTypeNormal, "NetworkPolicyAdopted", "Success to adopt %s/%s", policy.Namespace, policy.Name)
+		r.Logger.Info("Success to adopt NetworkPolicy")
+	}
+	return nil
+}
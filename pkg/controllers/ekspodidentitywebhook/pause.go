@@ -0,0 +1,282 @@
+package ekspodidentitywebhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	installerv1alpha1 "github.com/h3poteto/eks-pod-identity-webhook-installer/api/v1alpha1"
+	"github.com/h3poteto/eks-pod-identity-webhook-installer/pkg/generator"
+)
+
+// maxEventDiffLines limits the diff in an event, because events are not meant to carry large messages.
+// The whole diff is logged.
+const maxEventDiffLines = 10
+
+const (
+	reasonResumed = "ReconciliationResumed"
+	// reasonRevertingChanges is the reason of Paused condition until changes made while paused are reverted.
+	reasonRevertingChanges = "RevertingChanges"
+)
+
+// syncPaused records Paused condition in status. It returns true when reconciliation must stop.
+// When the resource is resumed, it reports what the following reconcile will revert.
+func (r *EKSPodIdentityWebhookReconciler) syncPaused(ctx context.Context, resource *installerv1alpha1.EKSPodIdentityWebhook) (bool, error) {
+	wasPaused := meta.IsStatusConditionTrue(resource.Status.Conditions, installerv1alpha1.ConditionPaused)
+
+	if resource.Spec.Paused {
+		if wasPaused {
+			r.Logger.Info("Reconciliation is paused", "Name", resource.Name)
+			return true, nil
+		}
+		meta.SetStatusCondition(&resource.Status.Conditions, metav1.Condition{
+			Type:               installerv1alpha1.ConditionPaused,
+			Status:             metav1.ConditionTrue,
+			ObservedGeneration: resource.Generation,
+			Reason:             "ReconciliationPaused",
+			Message:            "Reconciliation, drift correction and CSR approval are suspended by spec.paused",
+		})
+		r.Recorder.Event(resource, corev1.EventTypeNormal, "Paused", "Reconciliation is paused")
+		r.Logger.Info("Reconciliation is paused", "Name", resource.Name)
+		return true, nil
+	}
+
+	if !wasPaused {
+		return false, nil
+	}
+
+	diff, err := r.drift(ctx, resource)
+	if err != nil {
+		return false, err
+	}
+	message := "Reconciliation is resumed, no changes to revert"
+	reason := reasonResumed
+	if len(diff) > 0 {
+		// Hand edits are owned by other field managers, e.g. kubectl-edit, so they are reverted with forced ownership.
+		reason = reasonRevertingChanges
+		r.Logger.Info("Reconciliation is resumed, reverting changes", "Name", resource.Name, "diff", strings.Join(diff, "\n"))
+		lines := diff
+		if len(lines) > maxEventDiffLines {
+			lines = append(lines[:maxEventDiffLines:maxEventDiffLines], fmt.Sprintf("and %d more", len(diff)-maxEventDiffLines))
+		}
+		message = "Reconciliation is resumed, reverting: " + strings.Join(lines, "; ")
+	}
+	r.Recorder.Event(resource, corev1.EventTypeNormal, "Resumed", message)
+
+	meta.SetStatusCondition(&resource.Status.Conditions, metav1.Condition{
+		Type:               installerv1alpha1.ConditionPaused,
+		Status:             metav1.ConditionFalse,
+		ObservedGeneration: resource.Generation,
+		Reason:             reason,
+		Message:            message,
+	})
+	return false, nil
+}
+
+// reverting returns true while changes made during the pause are reverted.
+// Generated objects are applied with forced ownership then.
+func reverting(resource *installerv1alpha1.EKSPodIdentityWebhook) bool {
+	condition := meta.FindStatusCondition(resource.Status.Conditions, installerv1alpha1.ConditionPaused)
+	return condition != nil && condition.Status == metav1.ConditionFalse && condition.Reason == reasonRevertingChanges
+}
+
+// finishRevert records that changes made during the pause are reverted, once every step applied its objects
+// and no change is held for a maintenance window. Otherwise they are reverted again in the next reconcile.
+func (r *EKSPodIdentityWebhookReconciler) finishRevert(state *syncState, err error) {
+	resource := state.resource
+	if !reverting(resource) || err != nil || state.gate.holdsAny() {
+		return
+	}
+	for _, s := range resource.Status.Steps {
+		if s.Outcome == installerv1alpha1.StepBlocked || s.Outcome == installerv1alpha1.StepFailed {
+			return
+		}
+	}
+	meta.SetStatusCondition(&resource.Status.Conditions, metav1.Condition{
+		Type:               installerv1alpha1.ConditionPaused,
+		Status:             metav1.ConditionFalse,
+		ObservedGeneration: resource.Generation,
+		Reason:             reasonResumed,
+		Message:            "Reconciliation is resumed, changes made while paused are reverted",
+	})
+	r.Recorder.Event(resource, corev1.EventTypeNormal, "Reverted", "Changes made while paused are reverted")
+	r.Logger.Info("Success to revert changes made while paused", "Name", resource.Name)
+}
+
+// drift lists differences between live objects and generated ones, which reconciliation will revert.
+func (r *EKSPodIdentityWebhookReconciler) drift(ctx context.Context, resource *installerv1alpha1.EKSPodIdentityWebhook) ([]string, error) {
+	if generator.Embedded(resource) {
+		return r.mutatingWebhookConfigurationDrift(ctx, resource, generator.EmbeddedWebhookService(), []string{})
+	}
+	diff := []string{}
+
+	selector, err := r.daemonsetSelector(ctx, resource)
+	if err != nil {
+		return nil, err
+	}
+
+	service := generator.GenerateService(resource)
+	generator.InheritSelector(selector, nil, service)
+	if err := generator.ApplyOverlays(resource, service); err != nil {
+		return nil, err
+	}
+	{
+		exists := corev1.Service{}
+		err := r.Client.Get(ctx, types.NamespacedName{Namespace: service.Namespace, Name: service.Name}, &exists)
+		if kerrors.IsNotFound(err) {
+			diff = append(diff, fmt.Sprintf("Service %s/%s will be created", service.Namespace, service.Name))
+		} else if err != nil {
+			return nil, err
+		} else {
+			diff = append(diff, derivativeDiff("Service "+service.Namespace+"/"+service.Name+" spec", service.Spec, exists.Spec)...)
+		}
+	}
+
+	if resource.Spec.NetworkPolicy != nil {
+		policy := generator.GenerateNetworkPolicy(resource)
+		if err := generator.ApplyOverlays(resource, policy); err != nil {
+			return nil, err
+		}
+		exists := networkingv1.NetworkPolicy{}
+		err := r.Client.Get(ctx, types.NamespacedName{Namespace: policy.Namespace, Name: policy.Name}, &exists)
+		if kerrors.IsNotFound(err) {
+			diff = append(diff, fmt.Sprintf("NetworkPolicy %s/%s will be created", policy.Namespace, policy.Name))
+		} else if err != nil {
+			return nil, err
+		} else {
+			diff = append(diff, derivativeDiff("NetworkPolicy "+policy.Namespace+"/"+policy.Name+" spec", policy.Spec, exists.Spec)...)
+		}
+	}
+
+	daemonset, err := generator.GenerateDaemonset(resource)
+	if err != nil {
+		return nil, err
+	}
+	generator.InheritSelector(selector, daemonset, nil)
+	if err := generator.ApplyOverlays(resource, daemonset); err != nil {
+		return nil, err
+	}
+	{
+		exists := appsv1.DaemonSet{}
+		err := r.Client.Get(ctx, types.NamespacedName{Namespace: daemonset.Namespace, Name: daemonset.Name}, &exists)
+		if kerrors.IsNotFound(err) {
+			diff = append(diff, fmt.Sprintf("DaemonSet %s/%s will be created", daemonset.Namespace, daemonset.Name))
+		} else if err != nil {
+			return nil, err
+		} else {
+			diff = append(diff, derivativeDiff("DaemonSet "+daemonset.Namespace+"/"+daemonset.Name+" spec.template", daemonset.Spec.Template, exists.Spec.Template)...)
+		}
+	}
+
+	return r.mutatingWebhookConfigurationDrift(ctx, resource, service, diff)
+}
+
+func (r *EKSPodIdentityWebhookReconciler) mutatingWebhookConfigurationDrift(ctx context.Context, resource *installerv1alpha1.EKSPodIdentityWebhook, service *corev1.Service, diff []string) ([]string, error) {
+	CA, err := r.webhookCA(ctx, resource)
+	if err != nil {
+		return nil, err
+	}
+	mutating := generator.GenerateMutatingWebhookConfiguration(resource, service, CA)
+	if err := generator.ApplyOverlays(resource, mutating); err != nil {
+		return nil, err
+	}
+	{
+		exists := admissionregistrationv1.MutatingWebhookConfiguration{}
+		err := r.Client.Get(ctx, types.NamespacedName{Name: mutating.Name}, &exists)
+		if kerrors.IsNotFound(err) {
+			diff = append(diff, fmt.Sprintf("MutatingWebhookConfiguration %s will be created", mutating.Name))
+		} else if err != nil {
+			return nil, err
+		} else {
+			diff = append(diff, derivativeDiff("MutatingWebhookConfiguration "+mutating.Name+" webhooks", mutating.Webhooks, exists.Webhooks)...)
+		}
+	}
+	return diff, nil
+}
+
+// derivativeDiff lists fields which are set in desired but have other values in live.
+// Fields which are not set in desired are defaulted by the API server, so they are ignored
+// in the same way as equality.Semantic.DeepDerivative.
+func derivativeDiff(path string, desired, live interface{}) []string {
+	d, err := toJSONValue(desired)
+	if err != nil {
+		return []string{fmt.Sprintf("%s: %v", path, err)}
+	}
+	l, err := toJSONValue(live)
+	if err != nil {
+		return []string{fmt.Sprintf("%s: %v", path, err)}
+	}
+	return diffValue(path, d, l)
+}
+
+func toJSONValue(obj interface{}) (interface{}, error) {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func diffValue(path string, desired, live interface{}) []string {
+	switch d := desired.(type) {
+	case nil:
+		return nil
+	case map[string]interface{}:
+		l, ok := live.(map[string]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("%s: %s -> %s", path, compact(live), compact(desired))}
+		}
+		keys := make([]string, 0, len(d))
+		for k := range d {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		diff := []string{}
+		for _, k := range keys {
+			diff = append(diff, diffValue(path+"."+k, d[k], l[k])...)
+		}
+		return diff
+	case []interface{}:
+		l, ok := live.([]interface{})
+		if !ok || len(l) != len(d) {
+			return []string{fmt.Sprintf("%s: %s -> %s", path, compact(live), compact(desired))}
+		}
+		diff := []string{}
+		for i := range d {
+			diff = append(diff, diffValue(fmt.Sprintf("%s[%d]", path, i), d[i], l[i])...)
+		}
+		return diff
+	default:
+		if reflect.DeepEqual(desired, live) {
+			return nil
+		}
+		return []string{fmt.Sprintf("%s: %s -> %s", path, compact(live), compact(desired))}
+	}
+}
+
+func compact(v interface{}) string {
+	if v == nil {
+		return "<unset>"
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return string(data)
+}
@@ -0,0 +1,95 @@
+package ekspodidentitywebhook
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	installerv1alpha1 "github.com/h3poteto/eks-pod-identity-webhook-installer/api/v1alpha1"
+)
+
+func TestFinishRevert(t *testing.T) {
+	cases := []struct {
+		name      string
+		reason    string
+		steps     []string
+		err       error
+		held      bool
+		reverting bool
+	}{
+		{
+			name:   "resumed without changes",
+			reason: reasonResumed,
+			steps:  []string{installerv1alpha1.StepSucceeded},
+		},
+		{
+			name:   "reverted",
+			reason: reasonRevertingChanges,
+			steps:  []string{installerv1alpha1.StepSucceeded, installerv1alpha1.StepWaiting},
+		},
+		{
+			name:      "step failed",
+			reason:    reasonRevertingChanges,
+			steps:     []string{installerv1alpha1.StepSucceeded, installerv1alpha1.StepFailed},
+			reverting: true,
+		},
+		{
+			name:      "step blocked",
+			reason:    reasonRevertingChanges,
+			steps:     []string{installerv1alpha1.StepWaiting, installerv1alpha1.StepBlocked},
+			reverting: true,
+		},
+		{
+			name:      "error",
+			reason:    reasonRevertingChanges,
+			steps:     []string{installerv1alpha1.StepSucceeded},
+			err:       errors.New("boom"),
+			reverting: true,
+		},
+		{
+			name:      "held for a maintenance window",
+			reason:    reasonRevertingChanges,
+			steps:     []string{installerv1alpha1.StepSucceeded},
+			held:      true,
+			reverting: true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := testReconciler(t)
+			resource := testResource()
+			meta.SetStatusCondition(&resource.Status.Conditions, metav1.Condition{
+				Type:   installerv1alpha1.ConditionPaused,
+				Status: metav1.ConditionFalse,
+				Reason: c.reason,
+			})
+			for i, outcome := range c.steps {
+				resource.Status.Steps = append(resource.Status.Steps, installerv1alpha1.StepStatus{Name: string(rune('A' + i)), Outcome: outcome})
+			}
+			state := &syncState{resource: resource, gate: &maintenanceGate{open: true}}
+			if c.held {
+				state.gate = &maintenanceGate{next: time.Now().Add(time.Hour), held: []pendingChange{{kind: "DaemonSet"}}}
+			}
+
+			r.finishRevert(state, c.err)
+			if got := reverting(resource); got != c.reverting {
+				t.Errorf("reverting is %v, want %v", got, c.reverting)
+			}
+		})
+	}
+}
+
+func TestRevertingWhilePaused(t *testing.T) {
+	resource := testResource()
+	meta.SetStatusCondition(&resource.Status.Conditions, metav1.Condition{
+		Type:   installerv1alpha1.ConditionPaused,
+		Status: metav1.ConditionTrue,
+		Reason: reasonRevertingChanges,
+	})
+	if reverting(resource) {
+		t.Error("changes must not be reverted while paused")
+	}
+}
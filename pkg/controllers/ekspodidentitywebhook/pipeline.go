@@ -0,0 +1,196 @@
+package ekspodidentitywebhook
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/util/retry"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	installerv1alpha1 "github.com/h3poteto/eks-pod-identity-webhook-installer/api/v1alpha1"
+	"github.com/h3poteto/eks-pod-identity-webhook-installer/pkg/generator"
+)
+
+// syncState is shared by steps in a reconcile. Steps write status into resource,
+// and it is patched once after all steps ran.
+type syncState struct {
+	resource       *installerv1alpha1.EKSPodIdentityWebhook
+	serviceAccount *corev1.ServiceAccount
+	service        *corev1.Service
+	daemonset      *appsv1.DaemonSet
+	gate           *maintenanceGate
+}
+
+// stepResult is the outcome of a step which did not fail.
+type stepResult struct {
+	// waiting is true when the step has to wait for something, so steps depending on it are blocked.
+	waiting bool
+	// failed is true when the step can not proceed until the resource is fixed, so it is not retried.
+	failed       bool
+	message      string
+	requeueAfter time.Duration
+}
+
+func done(message string) stepResult {
+	return stepResult{message: message}
+}
+
+func fail(message string) stepResult {
+	return stepResult{failed: true, message: message}
+}
+
+func wait(message string, after time.Duration) stepResult {
+	return stepResult{waiting: true, message: message, requeueAfter: after}
+}
+
+// step is a stage of reconciliation. A step runs only when all steps in dependsOn succeeded in the same reconcile.
+type step struct {
+	name      string
+	dependsOn []string
+	run       func(ctx context.Context, state *syncState) (stepResult, error)
+	// ready is an optional check which runs after run succeeded.
+	ready func(ctx context.Context, state *syncState) (stepResult, error)
+}
+
+// steps returns the reconciliation steps in order.
+func (r *EKSPodIdentityWebhookReconciler) steps(resource *installerv1alpha1.EKSPodIdentityWebhook) []step {
+	if generator.Embedded(resource) {
+		return r.embeddedSteps()
+	}
+	return []step{
+		{name: "Overlays", run: r.overlaysStep},
+		{name: "MaintenanceWindows", run: r.maintenanceWindowsStep},
+		{name: "Namespace", dependsOn: []string{"Overlays"}, run: r.namespaceStep},
+		{name: "Preflight", dependsOn: []string{"Namespace"}, run: r.preflightStep},
+		{name: "Migration", dependsOn: []string{"Preflight"}, run: r.migrationStep},
+		{name: "ServiceAccount", dependsOn: []string{"Migration"}, run: r.serviceAccountStep},
+		{name: "Service", dependsOn: []string{"Migration"}, run: r.serviceStep},
+		{name: "Network", dependsOn: []string{"Migration"}, run: r.networkStep},
+		{name: "NetworkPolicy", dependsOn: []string{"Migration"}, run: r.networkPolicyStep},
+		{name: "Metrics", dependsOn: []string{"Migration"}, run: r.metricsStep},
+		{name: "PodSecurity", dependsOn: []string{"Migration"}, run: r.podSecurityStep},
+		{name: "DaemonSet", dependsOn: []string{"ServiceAccount", "Service", "Network", "PodSecurity", "MaintenanceWindows"}, run: r.daemonsetStep, ready: r.daemonsetReady},
+		{name: "MutatingWebhookConfiguration", dependsOn: []string{"Service", "NetworkPolicy", "DaemonSet", "MaintenanceWindows"}, run: r.mutatingWebhookConfigurationStep},
+		{name: "MigrationCleanup", dependsOn: []string{"MutatingWebhookConfiguration"}, run: r.migrationCleanupStep},
+		{name: "Inventory", dependsOn: []string{"MigrationCleanup", "Metrics"}, run: r.inventoryStep},
+	}
+}
+
+// runSteps runs steps in order and records the outcome of each step in status.
+// Errors of steps are aggregated, so a failed step does not prevent independent steps from running.
+func (r *EKSPodIdentityWebhookReconciler) runSteps(ctx context.Context, state *syncState, steps []step) (ctrl.Result, error) {
+	succeeded := map[string]bool{}
+	outcomes := make([]installerv1alpha1.StepStatus, 0, len(steps))
+	errs := []error{}
+	result := ctrl.Result{}
+
+	for _, s := range steps {
+		blockers := []string{}
+		for _, dep := range s.dependsOn {
+			if !succeeded[dep] {
+				blockers = append(blockers, dep)
+			}
+		}
+		if len(blockers) > 0 {
+			outcomes = append(outcomes, installerv1alpha1.StepStatus{
+				Name:    s.name,
+				Outcome: installerv1alpha1.StepBlocked,
+				Message: fmt.Sprintf("waiting for %s", strings.Join(blockers, ", ")),
+			})
+			continue
+		}
+
+		res, err := s.run(ctx, state)
+		if err == nil && !res.waiting && !res.failed && s.ready != nil {
+			res, err = s.ready(ctx, state)
+		}
+		if err != nil {
+			r.Logger.Error(err, "Step failed", "Step", s.name)
+			errs = append(errs, fmt.Errorf("%s: %w", s.name, err))
+			outcomes = append(outcomes, installerv1alpha1.StepStatus{
+				Name:    s.name,
+				Outcome: installerv1alpha1.StepFailed,
+				Message: err.Error(),
+			})
+			continue
+		}
+		if res.failed {
+			r.Logger.Info("Step failed", "Step", s.name, "reason", res.message)
+			outcomes = append(outcomes, installerv1alpha1.StepStatus{
+				Name:    s.name,
+				Outcome: installerv1alpha1.StepFailed,
+				Message: res.message,
+			})
+			continue
+		}
+		if res.waiting {
+			r.Logger.Info("Step is waiting", "Step", s.name, "reason", res.message)
+			outcomes = append(outcomes, installerv1alpha1.StepStatus{
+				Name:    s.name,
+				Outcome: installerv1alpha1.StepWaiting,
+				Message: res.message,
+			})
+			result.RequeueAfter = sooner(result.RequeueAfter, res.requeueAfter)
+			continue
+		}
+		// A succeeded step can also ask to be run again, e.g. to find a CRD which is installed later.
+		result.RequeueAfter = sooner(result.RequeueAfter, res.requeueAfter)
+		succeeded[s.name] = true
+		outcomes = append(outcomes, installerv1alpha1.StepStatus{
+			Name:    s.name,
+			Outcome: installerv1alpha1.StepSucceeded,
+			Message: res.message,
+		})
+	}
+	state.resource.Status.Steps = outcomes
+
+	if len(errs) > 0 {
+		return ctrl.Result{}, utilerrors.NewAggregate(errs)
+	}
+	return result, nil
+}
+
+// sooner returns the shorter of two requeue intervals, where zero means no requeue.
+func sooner(current, after time.Duration) time.Duration {
+	if after > 0 && (current == 0 || after < current) {
+		return after
+	}
+	return current
+}
+
+// patchStatus writes status of desired with a merge patch against original.
+// On conflict the latest resource is fetched and the status is applied to it again.
+func (r *EKSPodIdentityWebhookReconciler) patchStatus(ctx context.Context, original, desired *installerv1alpha1.EKSPodIdentityWebhook) error {
+	if equality.Semantic.DeepEqual(original.Status, desired.Status) {
+		return nil
+	}
+	base := original.DeepCopy()
+	status := desired.Status.DeepCopy()
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		target := base.DeepCopy()
+		target.Status = *status
+		err := r.Client.Status().Patch(ctx, target, client.MergeFromWithOptions(base, client.MergeFromWithOptimisticLock{}))
+		if err == nil {
+			desired.ObjectMeta = target.ObjectMeta
+			return nil
+		}
+		if !kerrors.IsConflict(err) {
+			r.Logger.Error(err, "Failed to update EKSPodIdentityWebhook status")
+			return err
+		}
+		latest := installerv1alpha1.EKSPodIdentityWebhook{}
+		if err := r.Client.Get(ctx, client.ObjectKeyFromObject(base), &latest); err != nil {
+			return err
+		}
+		base = &latest
+		return err
+	})
+}
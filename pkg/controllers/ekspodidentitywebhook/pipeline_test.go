@@ -0,0 +1,281 @@
+package ekspodidentitywebhook
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	fakeclientset "k8s.io/client-go/kubernetes/fake"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	installerv1alpha1 "github.com/h3poteto/eks-pod-identity-webhook-installer/api/v1alpha1"
+)
+
+func testScheme(t *testing.T) *runtime.Scheme {
+	t.Helper()
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := installerv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	return scheme
+}
+
+// mapperClient has a RESTMapper, which the fake client lacks. The mapper knows no kinds,
+// so CRDs such as ServiceMonitor are not installed.
+type mapperClient struct {
+	client.Client
+}
+
+func (c *mapperClient) RESTMapper() meta.RESTMapper {
+	return meta.NewDefaultRESTMapper(nil)
+}
+
+func testReconciler(t *testing.T, objects ...client.Object) *EKSPodIdentityWebhookReconciler {
+	t.Helper()
+	scheme := testScheme(t)
+	return &EKSPodIdentityWebhookReconciler{
+		Client:    &mapperClient{fake.NewClientBuilder().WithScheme(scheme).WithObjects(objects...).Build()},
+		Scheme:    scheme,
+		Logger:    logf.NullLogger{},
+		Recorder:  record.NewFakeRecorder(100),
+		Clientset: fakeclientset.NewSimpleClientset(),
+	}
+}
+
+func testResource() *installerv1alpha1.EKSPodIdentityWebhook {
+	return &installerv1alpha1.EKSPodIdentityWebhook{
+		ObjectMeta: metav1.ObjectMeta{Name: "cluster"},
+		Spec: installerv1alpha1.EKSPodIdentityWebhookSpec{
+			TokenAudience: "sts.amazonaws.com",
+			Namespace:     "kube-system",
+		},
+	}
+}
+
+func returns(res stepResult, err error) func(context.Context, *syncState) (stepResult, error) {
+	return func(context.Context, *syncState) (stepResult, error) {
+		return res, err
+	}
+}
+
+func TestRunSteps(t *testing.T) {
+	cases := []struct {
+		name     string
+		steps    []step
+		outcomes map[string]string
+		requeue  time.Duration
+		errs     []string
+	}{
+		{
+			name: "dependencies",
+			steps: []step{
+				{name: "A", run: returns(wait("not yet", time.Minute), nil)},
+				{name: "B", dependsOn: []string{"A"}, run: returns(done("ran"), nil)},
+				{name: "C", run: returns(done("ran"), nil)},
+				{name: "D", dependsOn: []string{"C"}, run: returns(done("ran"), nil)},
+				{name: "E", dependsOn: []string{"B", "D"}, run: returns(done("ran"), nil)},
+			},
+			outcomes: map[string]string{
+				"A": installerv1alpha1.StepWaiting,
+				"B": installerv1alpha1.StepBlocked,
+				"C": installerv1alpha1.StepSucceeded,
+				"D": installerv1alpha1.StepSucceeded,
+				"E": installerv1alpha1.StepBlocked,
+			},
+			requeue: time.Minute,
+		},
+		{
+			name: "failed result blocks dependents without an error",
+			steps: []step{
+				{name: "A", run: returns(fail("invalid spec"), nil)},
+				{name: "B", dependsOn: []string{"A"}, run: returns(done("ran"), nil)},
+			},
+			outcomes: map[string]string{
+				"A": installerv1alpha1.StepFailed,
+				"B": installerv1alpha1.StepBlocked,
+			},
+		},
+		{
+			name: "requeue is the soonest",
+			steps: []step{
+				{name: "A", run: returns(wait("not yet", 5*time.Minute), nil)},
+				{name: "B", run: returns(stepResult{message: "again later", requeueAfter: 3 * time.Minute}, nil)},
+				{name: "C", run: returns(wait("not yet", time.Minute), nil)},
+				{name: "D", run: returns(wait("no requeue", 0), nil)},
+			},
+			outcomes: map[string]string{
+				"A": installerv1alpha1.StepWaiting,
+				"B": installerv1alpha1.StepSucceeded,
+				"C": installerv1alpha1.StepWaiting,
+				"D": installerv1alpha1.StepWaiting,
+			},
+			requeue: time.Minute,
+		},
+		{
+			name: "ready check",
+			steps: []step{
+				{name: "A", run: returns(done("applied"), nil), ready: returns(wait("rolling out", 10*time.Second), nil)},
+				{name: "B", dependsOn: []string{"A"}, run: returns(done("ran"), nil)},
+				{name: "C", run: returns(wait("not yet", time.Minute), nil), ready: returns(stepResult{}, errors.New("ready must not run"))},
+			},
+			outcomes: map[string]string{
+				"A": installerv1alpha1.StepWaiting,
+				"B": installerv1alpha1.StepBlocked,
+				"C": installerv1alpha1.StepWaiting,
+			},
+			requeue: 10 * time.Second,
+		},
+		{
+			name: "errors are aggregated",
+			steps: []step{
+				{name: "A", run: returns(stepResult{}, errors.New("boom"))},
+				{name: "B", run: returns(wait("not yet", time.Minute), nil)},
+				{name: "C", run: returns(done("applied"), nil), ready: returns(stepResult{}, errors.New("not ready"))},
+				{name: "D", dependsOn: []string{"A"}, run: returns(done("ran"), nil)},
+			},
+			outcomes: map[string]string{
+				"A": installerv1alpha1.StepFailed,
+				"B": installerv1alpha1.StepWaiting,
+				"C": installerv1alpha1.StepFailed,
+				"D": installerv1alpha1.StepBlocked,
+			},
+			errs: []string{"A: boom", "C: not ready"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := testReconciler(t)
+			state := &syncState{resource: testResource()}
+			result, err := r.runSteps(context.Background(), state, c.steps)
+			if len(c.errs) > 0 {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				for _, e := range c.errs {
+					if !strings.Contains(err.Error(), e) {
+						t.Errorf("error %q does not contain %q", err, e)
+					}
+				}
+				if result.RequeueAfter != 0 {
+					t.Errorf("result must be empty with an error, but got %v", result)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if result.RequeueAfter != c.requeue {
+				t.Errorf("requeueAfter is %v, want %v", result.RequeueAfter, c.requeue)
+			}
+
+			steps := state.resource.Status.Steps
+			if len(steps) != len(c.steps) {
+				t.Fatalf("%d outcomes are recorded for %d steps", len(steps), len(c.steps))
+			}
+			for i, s := range steps {
+				if s.Name != c.steps[i].name {
+					t.Errorf("outcome %d is %s, want %s", i, s.Name, c.steps[i].name)
+				}
+				if s.Outcome != c.outcomes[s.Name] {
+					t.Errorf("%s is %s, want %s: %s", s.Name, s.Outcome, c.outcomes[s.Name], s.Message)
+				}
+			}
+		})
+	}
+}
+
+func TestRunStepsBlockedMessage(t *testing.T) {
+	r := testReconciler(t)
+	state := &syncState{resource: testResource()}
+	_, err := r.runSteps(context.Background(), state, []step{
+		{name: "A", run: returns(wait("not yet", 0), nil)},
+		{name: "B", run: returns(fail("invalid"), nil)},
+		{name: "C", dependsOn: []string{"A", "B"}, run: returns(done("ran"), nil)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := state.resource.Status.Steps[2].Message; got != "waiting for A, B" {
+		t.Errorf("message is %q", got)
+	}
+}
+
+func TestSooner(t *testing.T) {
+	cases := []struct {
+		current, after, want time.Duration
+	}{
+		{0, 0, 0},
+		{0, time.Minute, time.Minute},
+		{time.Minute, 0, time.Minute},
+		{time.Minute, time.Second, time.Second},
+		{time.Second, time.Minute, time.Second},
+	}
+	for _, c := range cases {
+		if got := sooner(c.current, c.after); got != c.want {
+			t.Errorf("sooner(%v, %v) = %v, want %v", c.current, c.after, got, c.want)
+		}
+	}
+}
+
+func TestPatchStatus(t *testing.T) {
+	ctx := context.Background()
+	r := testReconciler(t, testResource())
+
+	original := installerv1alpha1.EKSPodIdentityWebhook{}
+	if err := r.Client.Get(ctx, client.ObjectKey{Name: "cluster"}, &original); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another writer changes the resource after we read it, so the first patch conflicts.
+	latest := original.DeepCopy()
+	latest.Labels = map[string]string{"changed": "true"}
+	latest.Status.Phase = "init"
+	if err := r.Client.Update(ctx, latest); err != nil {
+		t.Fatal(err)
+	}
+
+	desired := original.DeepCopy()
+	desired.Status.Phase = "deployed"
+	desired.Status.Steps = []installerv1alpha1.StepStatus{{Name: "A", Outcome: installerv1alpha1.StepSucceeded}}
+	if err := r.patchStatus(ctx, &original, desired); err != nil {
+		t.Fatal(err)
+	}
+
+	got := installerv1alpha1.EKSPodIdentityWebhook{}
+	if err := r.Client.Get(ctx, client.ObjectKey{Name: "cluster"}, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Status.Phase != "deployed" || len(got.Status.Steps) != 1 {
+		t.Errorf("status is not patched: %+v", got.Status)
+	}
+	if got.Labels["changed"] != "true" {
+		t.Errorf("the change of the other writer is lost: %v", got.Labels)
+	}
+	if desired.ResourceVersion != got.ResourceVersion {
+		t.Errorf("resourceVersion of desired is %s, want %s", desired.ResourceVersion, got.ResourceVersion)
+	}
+}
+
+func TestPatchStatusUnchanged(t *testing.T) {
+	// The resource does not exist, so any request fails.
+	r := testReconciler(t)
+	resource := testResource()
+	if err := r.patchStatus(context.Background(), resource, resource.DeepCopy()); err != nil {
+		t.Fatalf("unchanged status must not be patched: %v", err)
+	}
+	changed := resource.DeepCopy()
+	changed.Status.Phase = "deployed"
+	if err := r.patchStatus(context.Background(), resource, changed); err == nil {
+		t.Fatal("changed status must be patched")
+	}
+}
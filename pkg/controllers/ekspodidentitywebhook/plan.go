@@ -0,0 +1,421 @@
+package ekspodidentitywebhook
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+
+	installerv1alpha1 "github.com/h3poteto/eks-pod-identity-webhook-installer/api/v1alpha1"
+	"github.com/h3poteto/eks-pod-identity-webhook-installer/pkg/generator"
+)
+
+// planInterval is how often a plan is computed again, because live objects can change without an event.
+const planInterval = 5 * time.Minute
+
+// maxPlanDiffLines limits the diff of an action in status.
+const maxPlanDiffLines = 20
+
+// daemonsetGenerationAnnotation is updated by the API server on every change of the pod template, so it is not a planned change.
+const daemonsetGenerationAnnotation = "deprecated.daemonset.template.generation"
+
+// planning returns true when the resource is planned instead of reconciled.
+func (r *EKSPodIdentityWebhookReconciler) planning(resource *installerv1alpha1.EKSPodIdentityWebhook) bool {
+	return r.Plan || resource.Spec.Mode == installerv1alpha1.ModePlan
+}
+
+// syncPlan records what reconciliation would change in status.plan. Nothing but status is written.
+func (r *EKSPodIdentityWebhookReconciler) syncPlan(ctx context.Context, resource *installerv1alpha1.EKSPodIdentityWebhook) error {
+	actions, err := r.plan(ctx, resource)
+	if err != nil {
+		r.Recorder.Eventf(resource, corev1.EventTypeWarning, "PlanFailed", "Failed to plan: %v", err)
+		return err
+	}
+	summary := summarizePlan(actions)
+	if previous := resource.Status.Plan; previous != nil && previous.Summary == summary && equality.Semantic.DeepEqual(previous.Actions, actions) {
+		// plannedAt is kept, so that status is not patched every planInterval without new information.
+		r.Logger.Info("Plan is not changed", "Name", resource.Name, "Summary", summary)
+		return nil
+	}
+	if resource.Status.Plan == nil || resource.Status.Plan.Summary != summary {
+		r.Recorder.Eventf(resource, corev1.EventTypeNormal, "Planned", "Plan: %s", summary)
+	}
+	r.Logger.Info("Planned", "Name", resource.Name, "Summary", summary)
+	resource.Status.Plan = &installerv1alpha1.PlanStatus{
+		PlannedAt: metav1.Now(),
+		Summary:   summary,
+		Actions:   actions,
+	}
+	return nil
+}
+
+// plan computes create, update and delete actions of generated objects against live objects with server-side dry-run.
+func (r *EKSPodIdentityWebhookReconciler) plan(ctx context.Context, resource *installerv1alpha1.EKSPodIdentityWebhook) ([]installerv1alpha1.PlannedAction, error) {
+	generated, err := generator.GenerateObjects(resource, nil)
+	if err != nil {
+		return nil, err
+	}
+	if errs := generator.ValidateOverlays(resource, generated); len(errs) > 0 {
+		return nil, utilerrors.NewAggregate(errs)
+	}
+	selector, err := r.daemonsetSelector(ctx, resource)
+	if err != nil {
+		return nil, err
+	}
+	namespaceMissing := false
+	if err := r.Client.Get(ctx, client.ObjectKey{Name: resource.Spec.Namespace}, &corev1.Namespace{}); kerrors.IsNotFound(err) {
+		namespaceMissing = true
+	} else if err != nil {
+		return nil, err
+	}
+	CA, caErr := []byte(nil), error(nil)
+	if !namespaceMissing {
+		CA, caErr = r.webhookCA(ctx, resource)
+	}
+
+	objects, err := generator.GenerateObjects(resource, CA)
+	if err != nil {
+		return nil, err
+	}
+	actions := []installerv1alpha1.PlannedAction{}
+	for _, obj := range objects {
+		var spec map[string]interface{}
+		switch o := obj.(type) {
+		case *appsv1.DaemonSet:
+			generator.InheritSelector(selector, o, nil)
+		case *corev1.Service:
+			if o.Name == generator.ServiceName {
+				generator.InheritSelector(selector, nil, o)
+				spec = generator.ServiceSpecExtensions(resource)
+			}
+		case *unstructured.Unstructured:
+			installed, err := r.monitorInstalled(o.GetKind())
+			if err != nil {
+				return nil, err
+			}
+			if !installed {
+				continue
+			}
+		}
+		spec, err := generator.ApplyOverlaysWithSpec(resource, obj, spec)
+		if err != nil {
+			return nil, err
+		}
+		action, err := r.planObject(ctx, resource, obj, spec, namespaceMissing)
+		if err != nil {
+			return nil, err
+		}
+		if action.Kind == "MutatingWebhookConfiguration" && (namespaceMissing || caErr != nil) {
+			action.Message = strings.TrimSpace(action.Message + " caBundle is not known until the certificate is issued.")
+		}
+		actions = append(actions, action)
+	}
+
+	deletes, err := r.planDeletes(ctx, resource)
+	if err != nil {
+		return nil, err
+	}
+	return append(actions, deletes...), nil
+}
+
+// planObject dry-runs server-side apply of obj, and compares the result with the live object.
+func (r *EKSPodIdentityWebhookReconciler) planObject(
+	ctx context.Context,
+	resource *installerv1alpha1.EKSPodIdentityWebhook,
+	obj client.Object,
+	spec map[string]interface{},
+	namespaceMissing bool,
+) (installerv1alpha1.PlannedAction, error) {
+	gvk, err := apiutil.GVKForObject(obj, r.Scheme)
+	if err != nil {
+		return installerv1alpha1.PlannedAction{}, err
+	}
+	action := installerv1alpha1.PlannedAction{
+		Kind:      gvk.Kind,
+		Namespace: obj.GetNamespace(),
+		Name:      obj.GetName(),
+	}
+
+	live := &unstructured.Unstructured{}
+	live.SetGroupVersionKind(gvk)
+	err = r.Client.Get(ctx, client.ObjectKeyFromObject(obj), live)
+	if err != nil && !kerrors.IsNotFound(err) {
+		r.Logger.Error(err, "Failed to get object", "Kind", gvk.Kind, "Name", obj.GetName())
+		return action, err
+	}
+	found := err == nil
+
+	force := false
+	switch {
+	case !found:
+		action.Action = installerv1alpha1.PlanActionCreate
+		if namespaceMissing && obj.GetNamespace() != "" {
+			action.Message = fmt.Sprintf("Namespace %s does not exist yet, so it is not validated with dry-run.", obj.GetNamespace())
+			return action, nil
+		}
+	case metav1.IsControlledBy(live, resource):
+		action.Action = installerv1alpha1.PlanActionUpdate
+	case gvk.Kind == "Namespace":
+		action.Action = installerv1alpha1.PlanActionUnchanged
+		action.Message = "It is not created by the installer, so it is not changed."
+		return action, nil
+	case resource.Spec.AdoptExisting:
+		action.Action = installerv1alpha1.PlanActionAdopt
+		force = true
+	default:
+		action.Action = installerv1alpha1.PlanActionConflict
+		action.Message = "It exists and is not owned by the installer. Set adoptExisting to take it over."
+		return action, nil
+	}
+
+	planned, err := r.toApplyConfiguration(obj, spec)
+	if err != nil {
+		return action, err
+	}
+	opts := []client.PatchOption{client.FieldOwner(FieldManager), client.DryRunAll}
+	if force {
+		opts = append(opts, client.ForceOwnership)
+	}
+	err = r.Client.Patch(ctx, planned, client.Apply, opts...)
+	if kerrors.IsConflict(err) && !force {
+		managers, fields := applyConflicts(err)
+		if !legacy(managers) {
+			action.Action = installerv1alpha1.PlanActionConflict
+			action.Message = fmt.Sprintf("Fields are managed by %s: %s", strings.Join(managers, ", "), strings.Join(fields, ", "))
+			return action, nil
+		}
+		if planned, err = r.toApplyConfiguration(obj, spec); err != nil {
+			return action, err
+		}
+		err = r.Client.Patch(ctx, planned, client.Apply, client.FieldOwner(FieldManager), client.DryRunAll, client.ForceOwnership)
+	}
+	if err != nil {
+		action.Message = fmt.Sprintf("Dry-run failed: %v", err)
+		return action, nil
+	}
+	if !found {
+		return action, nil
+	}
+
+	diff := planDiff("", planFields(planned), planFields(live))
+	if len(diff) > maxPlanDiffLines {
+		diff = append(diff[:maxPlanDiffLines:maxPlanDiffLines], fmt.Sprintf("and %d more", len(diff)-maxPlanDiffLines))
+	}
+	action.Diff = diff
+	if action.Action == installerv1alpha1.PlanActionUpdate && len(diff) == 0 {
+		action.Action = installerv1alpha1.PlanActionUnchanged
+	}
+	return action, nil
+}
+
+// planDeletes lists owned objects which reconciliation would delete: disabled features, unused monitors,
+// the old namespace after a namespace migration, and objects in the inventory which are not generated anymore.
+func (r *EKSPodIdentityWebhookReconciler) planDeletes(ctx context.Context, resource *installerv1alpha1.EKSPodIdentityWebhook) ([]installerv1alpha1.PlannedAction, error) {
+	type target struct {
+		obj             client.Object
+		namespace, name string
+		message         string
+	}
+	namespace := resource.Spec.Namespace
+	targets := []target{}
+	if resource.Spec.NetworkPolicy == nil {
+		targets = append(targets, target{&networkingv1.NetworkPolicy{}, namespace, generator.NetworkPolicyName, "spec.networkPolicy is not set."})
+	}
+	if resource.Spec.Metrics == nil {
+		targets = append(targets, target{&corev1.Service{}, namespace, generator.MetricsServiceName, "spec.metrics is not set."})
+	}
+	for _, kind := range []string{installerv1alpha1.MonitorServiceMonitor, installerv1alpha1.MonitorPodMonitor} {
+		if resource.Spec.Metrics != nil && kind == generator.MonitorKind(resource) {
+			continue
+		}
+		installed, err := r.monitorInstalled(kind)
+		if err != nil {
+			return nil, err
+		}
+		if installed {
+			monitor := &unstructured.Unstructured{}
+			monitor.SetGroupVersionKind(generator.MonitoringGroupVersion.WithKind(kind))
+			targets = append(targets, target{monitor, namespace, generator.MonitorName, fmt.Sprintf("%s is not used.", kind)})
+		}
+	}
+	if ref := resource.Status.PodIdentityWebhookDaemonset; ref != nil && ref.Namespace != namespace {
+		message := fmt.Sprintf("The webhook is migrated to %s, and it is deleted after the MutatingWebhookConfiguration is switched.", namespace)
+		targets = append(targets,
+			target{&appsv1.DaemonSet{}, ref.Namespace, generator.DaemonsetName, message},
+			target{&corev1.Service{}, ref.Namespace, generator.ServiceName, message},
+			target{&corev1.Service{}, ref.Namespace, generator.MetricsServiceName, message},
+			target{&networkingv1.NetworkPolicy{}, ref.Namespace, generator.NetworkPolicyName, message},
+			target{&corev1.ServiceAccount{}, ref.Namespace, generator.ServiceAccountName, message},
+		)
+		// RBAC is not read with spec.existingServiceAccountName, and the old one is in the inventory then.
+		if resource.Spec.ExistingServiceAccountName == "" {
+			targets = append(targets,
+				target{&rbacv1.RoleBinding{}, ref.Namespace, generator.ServiceAccountName, message},
+				target{&rbacv1.Role{}, ref.Namespace, generator.ServiceAccountName, message},
+			)
+		}
+	}
+
+	objects, err := r.generatedObjects(resource)
+	if err != nil {
+		return nil, err
+	}
+	generated := map[string]bool{}
+	for _, obj := range objects {
+		gvk, err := apiutil.GVKForObject(obj, r.Scheme)
+		if err != nil {
+			return nil, err
+		}
+		generated[inventoryKey(installerv1alpha1.InventoryEntry{Group: gvk.Group, Kind: gvk.Kind, Namespace: obj.GetNamespace(), Name: obj.GetName()})] = true
+	}
+	for _, entry := range resource.Status.Inventory {
+		if generated[inventoryKey(entry)] || (entry.Group == "" && entry.Kind == "Namespace") {
+			continue
+		}
+		obj := &unstructured.Unstructured{}
+		obj.SetGroupVersionKind(schema.GroupVersionKind{Group: entry.Group, Version: entry.Version, Kind: entry.Kind})
+		obj.SetUID(entry.UID)
+		targets = append(targets, target{obj, entry.Namespace, entry.Name, "It is not generated by the current spec, so it is pruned."})
+	}
+
+	actions := []installerv1alpha1.PlannedAction{}
+	seen := map[string]bool{}
+	for _, t := range targets {
+		uid := t.obj.GetUID()
+		err := r.Client.Get(ctx, client.ObjectKey{Namespace: t.namespace, Name: t.name}, t.obj)
+		if kerrors.IsNotFound(err) || meta.IsNoMatchError(err) {
+			continue
+		} else if err != nil {
+			r.Logger.Error(err, "Failed to get object", "Namespace", t.namespace, "Name", t.name)
+			return nil, err
+		}
+		// Objects which are not owned, or replaced after they were recorded in the inventory, are never deleted.
+		if !metav1.IsControlledBy(t.obj, resource) || (uid != "" && uid != t.obj.GetUID()) {
+			continue
+		}
+		gvk, err := apiutil.GVKForObject(t.obj, r.Scheme)
+		if err != nil {
+			return nil, err
+		}
+		key := inventoryKey(installerv1alpha1.InventoryEntry{Group: gvk.Group, Kind: gvk.Kind, Namespace: t.namespace, Name: t.name})
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		action := installerv1alpha1.PlannedAction{
+			Action:    installerv1alpha1.PlanActionDelete,
+			Kind:      gvk.Kind,
+			Namespace: t.namespace,
+			Name:      t.name,
+			Message:   t.message,
+		}
+		if err := r.Client.Delete(ctx, t.obj, client.DryRunAll); client.IgnoreNotFound(err) != nil {
+			action.Message = fmt.Sprintf("%s Dry-run failed: %v", t.message, err)
+		}
+		actions = append(actions, action)
+	}
+	return actions, nil
+}
+
+// planFields returns fields of an object which the plan compares.
+// Metadata except labels, annotations and owner references is maintained by the API server, so it is ignored.
+func planFields(u *unstructured.Unstructured) map[string]interface{} {
+	fields := map[string]interface{}{}
+	for k, v := range u.Object {
+		if k != "apiVersion" && k != "kind" && k != "metadata" && k != "status" {
+			fields[k] = v
+		}
+	}
+	metadata := map[string]interface{}{}
+	for _, k := range []string{"labels", "annotations", "ownerReferences"} {
+		if v, ok, _ := unstructured.NestedFieldNoCopy(u.Object, "metadata", k); ok {
+			metadata[k] = v
+		}
+	}
+	if annotations, ok := metadata["annotations"].(map[string]interface{}); ok {
+		copied := map[string]interface{}{}
+		for k, v := range annotations {
+			if k != daemonsetGenerationAnnotation {
+				copied[k] = v
+			}
+		}
+		metadata["annotations"] = copied
+	}
+	fields["metadata"] = metadata
+	return fields
+}
+
+// planDiff lists fields which differ between planned and live. Unlike derivativeDiff,
+// fields which are only in live are also listed, because apply removes them.
+func planDiff(path string, planned, live interface{}) []string {
+	switch p := planned.(type) {
+	case map[string]interface{}:
+		if l, ok := live.(map[string]interface{}); ok {
+			keys := make([]string, 0, len(p)+len(l))
+			for k := range p {
+				keys = append(keys, k)
+			}
+			for k := range l {
+				if _, ok := p[k]; !ok {
+					keys = append(keys, k)
+				}
+			}
+			sort.Strings(keys)
+			diff := []string{}
+			for _, k := range keys {
+				child := k
+				if path != "" {
+					child = path + "." + k
+				}
+				diff = append(diff, planDiff(child, p[k], l[k])...)
+			}
+			return diff
+		}
+	case []interface{}:
+		if l, ok := live.([]interface{}); ok && len(l) == len(p) {
+			diff := []string{}
+			for i := range p {
+				diff = append(diff, planDiff(fmt.Sprintf("%s[%d]", path, i), p[i], l[i])...)
+			}
+			return diff
+		}
+	}
+	if reflect.DeepEqual(planned, live) {
+		return nil
+	}
+	return []string{fmt.Sprintf("%s: %s -> %s", path, compact(live), compact(planned))}
+}
+
+// summarizePlan counts the actions, e.g. "2 to create, 1 to update, 0 to delete".
+func summarizePlan(actions []installerv1alpha1.PlannedAction) string {
+	counts := map[string]int{}
+	for _, a := range actions {
+		counts[a.Action]++
+	}
+	summary := fmt.Sprintf("%d to create, %d to update, %d to adopt, %d to delete",
+		counts[installerv1alpha1.PlanActionCreate],
+		counts[installerv1alpha1.PlanActionUpdate],
+		counts[installerv1alpha1.PlanActionAdopt],
+		counts[installerv1alpha1.PlanActionDelete],
+	)
+	if n := counts[installerv1alpha1.PlanActionConflict]; n > 0 {
+		summary += fmt.Sprintf(", %d conflicts", n)
+	}
+	return summary
+}
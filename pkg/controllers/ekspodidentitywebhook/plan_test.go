@@ -0,0 +1,313 @@
+package ekspodidentitywebhook
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	installerv1alpha1 "github.com/h3poteto/eks-pod-identity-webhook-installer/api/v1alpha1"
+	"github.com/h3poteto/eks-pod-identity-webhook-installer/pkg/generator"
+)
+
+// dryRunOnlyClient fails the test on any write which is not a dry-run.
+// Dry-run writes are dropped as the API server does, because the fake client ignores dry-run of Delete.
+type dryRunOnlyClient struct {
+	client.Client
+	t *testing.T
+}
+
+func dryRun(values []string) bool {
+	for _, v := range values {
+		if v == metav1.DryRunAll {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *dryRunOnlyClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	o := &client.CreateOptions{}
+	o.ApplyOptions(opts)
+	if !dryRun(o.DryRun) {
+		c.t.Errorf("%T %s is created", obj, obj.GetName())
+	}
+	return nil
+}
+
+func (c *dryRunOnlyClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	o := &client.UpdateOptions{}
+	o.ApplyOptions(opts)
+	if !dryRun(o.DryRun) {
+		c.t.Errorf("%T %s is updated", obj, obj.GetName())
+	}
+	return nil
+}
+
+func (c *dryRunOnlyClient) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	o := &client.PatchOptions{}
+	o.ApplyOptions(opts)
+	if !dryRun(o.DryRun) {
+		c.t.Errorf("%T %s is patched", obj, obj.GetName())
+	}
+	return nil
+}
+
+func (c *dryRunOnlyClient) Delete(ctx context.Context, obj client.Object, opts ...client.DeleteOption) error {
+	o := &client.DeleteOptions{}
+	o.ApplyOptions(opts)
+	if !dryRun(o.DryRun) {
+		c.t.Errorf("%T %s is deleted", obj, obj.GetName())
+	}
+	return nil
+}
+
+func (c *dryRunOnlyClient) DeleteAllOf(ctx context.Context, obj client.Object, opts ...client.DeleteAllOfOption) error {
+	c.t.Errorf("%T is deleted", obj)
+	return nil
+}
+
+func (c *dryRunOnlyClient) Status() client.StatusWriter {
+	c.t.Error("status is written")
+	return c.Client.Status()
+}
+
+func TestSyncPlan(t *testing.T) {
+	ctx := context.Background()
+	resource := testResource()
+	resource.UID = "resource-uid"
+	resource.Spec.Mode = installerv1alpha1.ModePlan
+	generator.Namespace = resource.Spec.Namespace
+
+	objects, err := generator.GenerateObjects(resource, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var serviceAccount *corev1.ServiceAccount
+	for _, obj := range objects {
+		if sa, ok := obj.(*corev1.ServiceAccount); ok {
+			serviceAccount = sa
+		}
+	}
+	if serviceAccount == nil {
+		t.Fatal("ServiceAccount is not generated")
+	}
+	// The ServiceAccount is live as it is generated, so it is unchanged.
+	serviceAccount = serviceAccount.DeepCopy()
+	serviceAccount.OwnerReferences = ownedBy(resource)
+	// The Service has a label which the spec does not generate, so it is updated.
+	live := &corev1.Service{ObjectMeta: metav1.ObjectMeta{
+		Namespace:       resource.Spec.Namespace,
+		Name:            generator.ServiceName,
+		Labels:          map[string]string{"stale": "true"},
+		OwnerReferences: ownedBy(resource),
+	}}
+	// spec.networkPolicy is not set, so the owned NetworkPolicy is deleted.
+	networkPolicy := &networkingv1.NetworkPolicy{ObjectMeta: metav1.ObjectMeta{
+		Namespace:       resource.Spec.Namespace,
+		Name:            generator.NetworkPolicyName,
+		OwnerReferences: ownedBy(resource),
+	}}
+	namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: resource.Spec.Namespace}}
+
+	r := testReconciler(t, namespace, serviceAccount, live, networkPolicy)
+	r.Client = &dryRunOnlyClient{Client: r.Client, t: t}
+
+	if err := r.syncPlan(ctx, resource); err != nil {
+		t.Fatal(err)
+	}
+	plan := resource.Status.Plan
+	if plan == nil {
+		t.Fatal("plan is not recorded")
+	}
+	actions := map[string]installerv1alpha1.PlannedAction{}
+	for _, a := range plan.Actions {
+		actions[a.Kind+"/"+a.Name] = a
+	}
+	want := map[string]string{
+		"ServiceAccount/" + generator.ServiceAccountName:    installerv1alpha1.PlanActionUnchanged,
+		"Service/" + generator.ServiceName:                  installerv1alpha1.PlanActionUpdate,
+		"DaemonSet/" + generator.DaemonsetName:              installerv1alpha1.PlanActionCreate,
+		"NetworkPolicy/" + generator.NetworkPolicyName:      installerv1alpha1.PlanActionDelete,
+		"MutatingWebhookConfiguration/pod-identity-webhook": installerv1alpha1.PlanActionCreate,
+	}
+	for key, action := range want {
+		a, ok := actions[key]
+		if !ok {
+			t.Errorf("%s is not planned: %+v", key, plan.Actions)
+			continue
+		}
+		if a.Action != action {
+			t.Errorf("%s is %s, want %s: %s %v", key, a.Action, action, a.Message, a.Diff)
+		}
+	}
+	if diff := actions["Service/"+generator.ServiceName].Diff; len(diff) == 0 || !contains(diff, `metadata.labels.stale: "true" -> <unset>`) {
+		t.Errorf("diff of Service is %v", diff)
+	}
+	if plan.Summary != summarizePlan(plan.Actions) {
+		t.Errorf("summary is %q", plan.Summary)
+	}
+
+	// The same plan keeps plannedAt, so that status is not patched again.
+	plannedAt := metav1.NewTime(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))
+	plan.PlannedAt = plannedAt
+	if err := r.syncPlan(ctx, resource); err != nil {
+		t.Fatal(err)
+	}
+	if !resource.Status.Plan.PlannedAt.Equal(&plannedAt) {
+		t.Errorf("plannedAt is changed to %s", resource.Status.Plan.PlannedAt)
+	}
+
+	// A changed plan is recorded at the time.
+	resource.Spec.NetworkPolicy = &installerv1alpha1.NetworkPolicyConfig{}
+	if err := r.syncPlan(ctx, resource); err != nil {
+		t.Fatal(err)
+	}
+	if resource.Status.Plan.PlannedAt.Equal(&plannedAt) {
+		t.Error("plannedAt is not updated")
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func TestPlanDiff(t *testing.T) {
+	cases := []struct {
+		name    string
+		planned interface{}
+		live    interface{}
+		want    []string
+	}{
+		{
+			name:    "equal",
+			planned: map[string]interface{}{"a": "x", "b": []interface{}{int64(1)}},
+			live:    map[string]interface{}{"a": "x", "b": []interface{}{int64(1)}},
+		},
+		{
+			name:    "changed",
+			planned: map[string]interface{}{"spec": map[string]interface{}{"replicas": int64(2)}},
+			live:    map[string]interface{}{"spec": map[string]interface{}{"replicas": int64(1)}},
+			want:    []string{"spec.replicas: 1 -> 2"},
+		},
+		{
+			name:    "added",
+			planned: map[string]interface{}{"a": "x", "b": "y"},
+			live:    map[string]interface{}{"a": "x"},
+			want:    []string{`b: <unset> -> "y"`},
+		},
+		{
+			// Apply removes fields which only live has, because the installer manages them.
+			name:    "removed",
+			planned: map[string]interface{}{"a": "x"},
+			live:    map[string]interface{}{"a": "x", "b": "y"},
+			want:    []string{`b: "y" -> <unset>`},
+		},
+		{
+			name:    "sorted keys",
+			planned: map[string]interface{}{"c": "1", "a": "1", "b": "1"},
+			live:    map[string]interface{}{"c": "2", "a": "2", "b": "2"},
+			want:    []string{`a: "2" -> "1"`, `b: "2" -> "1"`, `c: "2" -> "1"`},
+		},
+		{
+			name:    "list items",
+			planned: map[string]interface{}{"args": []interface{}{"--a", "--b"}},
+			live:    map[string]interface{}{"args": []interface{}{"--a", "--c"}},
+			want:    []string{`args[1]: "--c" -> "--b"`},
+		},
+		{
+			name:    "list length",
+			planned: map[string]interface{}{"args": []interface{}{"--a", "--b"}},
+			live:    map[string]interface{}{"args": []interface{}{"--a"}},
+			want:    []string{`args: ["--a"] -> ["--a","--b"]`},
+		},
+		{
+			name:    "type",
+			planned: map[string]interface{}{"a": map[string]interface{}{"b": "c"}},
+			live:    map[string]interface{}{"a": "b"},
+			want:    []string{`a: "b" -> {"b":"c"}`},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := planDiff("", c.planned, c.live)
+			if len(got) == 0 && len(c.want) == 0 {
+				return
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("diff is %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+func TestPlanFields(t *testing.T) {
+	u := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "apps/v1",
+		"kind":       "DaemonSet",
+		"metadata": map[string]interface{}{
+			"name":            "pod-identity-webhook",
+			"resourceVersion": "1",
+			"labels":          map[string]interface{}{"app": "webhook"},
+			"annotations":     map[string]interface{}{daemonsetGenerationAnnotation: "3", "note": "kept"},
+		},
+		"spec":   map[string]interface{}{"minReadySeconds": int64(1)},
+		"status": map[string]interface{}{"numberReady": int64(1)},
+	}}
+	want := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels":      map[string]interface{}{"app": "webhook"},
+			"annotations": map[string]interface{}{"note": "kept"},
+		},
+		"spec": map[string]interface{}{"minReadySeconds": int64(1)},
+	}
+	if got := planFields(u); !reflect.DeepEqual(got, want) {
+		t.Errorf("fields are %+v, want %+v", got, want)
+	}
+}
+
+func TestSummarizePlan(t *testing.T) {
+	action := func(a string) installerv1alpha1.PlannedAction {
+		return installerv1alpha1.PlannedAction{Action: a}
+	}
+	cases := []struct {
+		name    string
+		actions []installerv1alpha1.PlannedAction
+		want    string
+	}{
+		{name: "empty", want: "0 to create, 0 to update, 0 to adopt, 0 to delete"},
+		{
+			name: "counts",
+			actions: []installerv1alpha1.PlannedAction{
+				action(installerv1alpha1.PlanActionCreate),
+				action(installerv1alpha1.PlanActionCreate),
+				action(installerv1alpha1.PlanActionUpdate),
+				action(installerv1alpha1.PlanActionAdopt),
+				action(installerv1alpha1.PlanActionDelete),
+				action(installerv1alpha1.PlanActionUnchanged),
+			},
+			want: "2 to create, 1 to update, 1 to adopt, 1 to delete",
+		},
+		{
+			name:    "conflicts",
+			actions: []installerv1alpha1.PlannedAction{action(installerv1alpha1.PlanActionConflict), action(installerv1alpha1.PlanActionConflict)},
+			want:    "0 to create, 0 to update, 0 to adopt, 0 to delete, 2 conflicts",
+		},
+	}
+	for _, c := range cases {
+		if got := summarizePlan(c.actions); got != c.want {
+			t.Errorf("%s: summary is %q, want %q", c.name, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package ekspodidentitywebhook
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	installerv1alpha1 "github.com/h3poteto/eks-pod-identity-webhook-installer/api/v1alpha1"
+	"github.com/h3poteto/eks-pod-identity-webhook-installer/pkg/generator"
+	"github.com/h3poteto/eks-pod-identity-webhook-installer/pkg/psa"
+)
+
+// podSecurityRetryInterval is how often we check the pod template again, because labels of a namespace which
+// the installer did not create are not watched.
+const podSecurityRetryInterval = 1 * time.Minute
+
+// podSecurityStep checks the generated pod template against the Pod Security Standard which spec.namespace enforces,
+// and records the result in PodSecurityCompliant condition. The DaemonSet is not applied while it violates the level,
+// because Pod Security Admission would reject every pod.
+func (r *EKSPodIdentityWebhookReconciler) podSecurityStep(ctx context.Context, state *syncState) (stepResult, error) {
+	resource := state.resource
+
+	namespace := corev1.Namespace{}
+	if err := r.Client.Get(ctx, types.NamespacedName{Name: resource.Spec.Namespace}, &namespace); err != nil {
+		r.Logger.Error(err, "Failed to get namespace", "Name", resource.Spec.Namespace)
+		return stepResult{}, err
+	}
+	level := namespace.Labels[psa.EnforceLabel]
+
+	daemonset, err := generator.GenerateDaemonset(resource)
+	if err != nil {
+		return stepResult{}, err
+	}
+	if err := generator.ApplyOverlays(resource, daemonset); err != nil {
+		return stepResult{}, err
+	}
+	violations := psa.Check(level, &daemonset.Spec.Template.Spec)
+
+	condition := metav1.Condition{
+		Type:               installerv1alpha1.ConditionPodSecurityCompliant,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: resource.Generation,
+		Reason:             "Compliant",
+		Message:            fmt.Sprintf("pod template satisfies %s level which namespace %s enforces", level, namespace.Name),
+	}
+	if level == "" {
+		condition.Reason = "NotEnforced"
+		condition.Message = fmt.Sprintf("namespace %s does not enforce a Pod Security Standard", namespace.Name)
+	}
+	if len(violations) > 0 {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "Violation"
+		condition.Message = fmt.Sprintf("pod template violates %s level which namespace %s enforces: %s", level, namespace.Name, strings.Join(violations, "; "))
+		if !meta.IsStatusConditionPresentAndEqual(resource.Status.Conditions, condition.Type, condition.Status) {
+			r.Recorder.Event(resource, corev1.EventTypeWarning, "PodSecurityViolation", condition.Message)
+		}
+	}
+	meta.SetStatusCondition(&resource.Status.Conditions, condition)
+	if len(violations) > 0 {
+		return wait(condition.Message, podSecurityRetryInterval), nil
+	}
+	return done(""), nil
+}
@@ -0,0 +1,176 @@
+package ekspodidentitywebhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/uuid"
+
+	installerv1alpha1 "github.com/h3poteto/eks-pod-identity-webhook-installer/api/v1alpha1"
+	"github.com/h3poteto/eks-pod-identity-webhook-installer/pkg/generator"
+	"github.com/h3poteto/eks-pod-identity-webhook-installer/pkg/provider"
+)
+
+const (
+	// probeServiceAccountName is a ServiceAccount which the mutation probe pretends to run a pod as.
+	probeServiceAccountName = generator.ServiceAccountName + "-probe"
+
+	probeTimeout = 10 * time.Second
+)
+
+// probeMutation sends an AdmissionReview of a pod, which runs as the probe ServiceAccount, directly to the webhook pod,
+// and verifies that the patched pod is mutated in the way of the provider.
+func (r *EKSPodIdentityWebhookReconciler) probeMutation(ctx context.Context, resource *installerv1alpha1.EKSPodIdentityWebhook, pod *corev1.Pod) error {
+	if err := r.ensureProbeServiceAccount(ctx, resource); err != nil {
+		return err
+	}
+	if pod.Status.PodIP == "" {
+		return errors.New("pod has no IP")
+	}
+
+	CA, err := r.webhookCA(ctx, resource)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(CA) {
+		return errors.New("caBundle has no certificate")
+	}
+	serverName := generator.ServiceName + "." + resource.Spec.Namespace + ".svc"
+	if generator.UsesURL(resource) {
+		u, err := url.Parse(resource.Spec.Network.URL)
+		if err != nil {
+			return err
+		}
+		serverName = u.Hostname()
+	}
+	httpClient := &http.Client{
+		Timeout: probeTimeout,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: pool, ServerName: serverName},
+		},
+	}
+
+	p := provider.For(resource)
+	review := probeReview(resource.Spec.Namespace)
+	body, err := json.Marshal(review)
+	if err != nil {
+		return err
+	}
+	endpoint := "https://" + net.JoinHostPort(pod.Status.PodIP, strconv.Itoa(int(generator.WebhookPort(resource)))) + p.MutatePath()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("webhook responded %d", res.StatusCode)
+	}
+
+	response := admissionv1beta1.AdmissionReview{}
+	if err := json.Unmarshal(data, &response); err != nil {
+		return fmt.Errorf("invalid AdmissionReview: %w", err)
+	}
+	if response.Response == nil || !response.Response.Allowed {
+		return errors.New("webhook did not allow the pod")
+	}
+	patch, err := jsonpatch.DecodePatch(response.Response.Patch)
+	if err != nil {
+		return fmt.Errorf("invalid patch: %w", err)
+	}
+	patched, err := patch.Apply(review.Request.Object.Raw)
+	if err != nil {
+		return fmt.Errorf("failed to apply patch: %w", err)
+	}
+	mutated := corev1.Pod{}
+	if err := json.Unmarshal(patched, &mutated); err != nil {
+		return err
+	}
+	if !p.Mutated(&mutated) {
+		return errors.New("webhook did not mutate the pod")
+	}
+	return nil
+}
+
+// ensureProbeServiceAccount applies the ServiceAccount which the mutation probe uses.
+func (r *EKSPodIdentityWebhookReconciler) ensureProbeServiceAccount(ctx context.Context, resource *installerv1alpha1.EKSPodIdentityWebhook) error {
+	serviceAccount := corev1.ServiceAccount{}
+	err := r.Client.Get(ctx, types.NamespacedName{Namespace: resource.Spec.Namespace, Name: probeServiceAccountName}, &serviceAccount)
+	annotations := provider.For(resource).ProbeAnnotations()
+	if err == nil && containsLabels(serviceAccount.Annotations, annotations) {
+		return nil
+	}
+	probe := &corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        probeServiceAccountName,
+			Namespace:   resource.Spec.Namespace,
+			Labels:      generator.Labels(resource, nil),
+			Annotations: annotations,
+			OwnerReferences: []metav1.OwnerReference{
+				*metav1.NewControllerRef(resource, schema.GroupVersionKind{
+					Group:   installerv1alpha1.GroupVersion.Group,
+					Version: installerv1alpha1.GroupVersion.Version,
+					Kind:    "EKSPodIdentityWebhook",
+				}),
+			},
+		},
+	}
+	return r.applyObject(ctx, resource, probe, "ServiceAccount", false)
+}
+
+// probeReview is an AdmissionReview of creating a pod which runs as the probe ServiceAccount.
+func probeReview(namespace string) *admissionv1beta1.AdmissionReview {
+	pod := corev1.Pod{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "pod-identity-webhook-probe",
+			Namespace: namespace,
+		},
+		Spec: corev1.PodSpec{
+			ServiceAccountName: probeServiceAccountName,
+			Containers: []corev1.Container{
+				{Name: "probe", Image: "probe"},
+			},
+		},
+	}
+	raw, _ := json.Marshal(pod)
+	return &admissionv1beta1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: admissionv1beta1.SchemeGroupVersion.String(), Kind: "AdmissionReview"},
+		Request: &admissionv1beta1.AdmissionRequest{
+			UID:       uuid.NewUUID(),
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+			Namespace: namespace,
+			Name:      pod.Name,
+			Operation: admissionv1beta1.Create,
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	}
+}
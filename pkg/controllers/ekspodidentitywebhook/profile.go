@@ -0,0 +1,82 @@
+package ekspodidentitywebhook
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	installerv1alpha1 "github.com/h3poteto/eks-pod-identity-webhook-installer/api/v1alpha1"
+	"github.com/h3poteto/eks-pod-identity-webhook-installer/pkg/generator"
+	"github.com/h3poteto/eks-pod-identity-webhook-installer/pkg/preflight"
+	"github.com/h3poteto/eks-pod-identity-webhook-installer/pkg/profile"
+)
+
+// syncProfile fills unset fields of the resource with spec.profile in memory, and records the effective values in status.profile.
+// The distribution and the issuer are resolved again only after the generation changes.
+func (r *EKSPodIdentityWebhookReconciler) syncProfile(ctx context.Context, resource *installerv1alpha1.EKSPodIdentityWebhook) error {
+	if resource.Spec.Profile == "" {
+		resource.Status.Profile = nil
+		return nil
+	}
+
+	current := resource.Status.Profile
+	resolved := current != nil && current.ObservedGeneration == resource.Generation
+	status := &installerv1alpha1.ProfileStatus{
+		Name:               resource.Spec.Profile,
+		ObservedGeneration: resource.Generation,
+	}
+	if resolved {
+		status.Name = current.Name
+		status.DetectedBy = current.DetectedBy
+		status.Issuer = current.Issuer
+	} else if resource.Spec.Profile == installerv1alpha1.ProfileAuto {
+		name, detectedBy, err := profile.Detect(ctx, r.reader())
+		if err != nil {
+			r.Logger.Error(err, "Failed to detect the distribution", "Name", resource.Name)
+			r.Recorder.Eventf(resource, corev1.EventTypeWarning, "ProfileDetectionFailed", "Failed to detect the distribution: %v", err)
+			return err
+		}
+		status.Name = name
+		status.DetectedBy = detectedBy
+		if name == "" {
+			r.Recorder.Event(resource, corev1.EventTypeWarning, "ProfileNotDetected", "No distribution is detected, so no profile is applied")
+		} else {
+			r.Recorder.Eventf(resource, corev1.EventTypeNormal, "ProfileDetected", "Success to detect %s from %s", name, detectedBy)
+		}
+		r.Logger.Info("Detected the distribution", "Name", resource.Name, "profile", name, "detectedBy", detectedBy)
+	}
+
+	values, ok := profile.Get(status.Name)
+	if ok {
+		profile.Apply(resource, values)
+		if !resolved {
+			status.Issuer = r.issuer(ctx, resource, values)
+		}
+	}
+	status.NetworkMode = generator.NetworkMode(resource)
+	status.CASource = generator.CASource(resource)
+	status.Tolerations = resource.Spec.Webhook.Tolerations
+	resource.Status.Profile = status
+	return nil
+}
+
+// issuer returns the service account issuer of the cluster, or an empty string when it can not be read.
+// It is only reported, so failures do not stop reconciliation.
+func (r *EKSPodIdentityWebhookReconciler) issuer(ctx context.Context, resource *installerv1alpha1.EKSPodIdentityWebhook, values profile.Values) string {
+	if values.IssuerSource == profile.IssuerSourceAPIServerPod {
+		issuer, err := profile.APIServerIssuer(ctx, r.reader(), values)
+		if err != nil {
+			r.Logger.Error(err, "Failed to read the issuer from kube-apiserver pods")
+		} else if issuer != "" {
+			return issuer
+		}
+	}
+	// The API server may not run as a pod, or it may use the default issuer. A token tells the issuer in any case.
+	issuer, err := preflight.TokenIssuer(ctx, r.Clientset, metav1.NamespaceDefault, resource.Spec.TokenAudience)
+	if err != nil {
+		r.Logger.Error(err, "Failed to read the issuer from a token")
+		return ""
+	}
+	return issuer
+}
@@ -0,0 +1,184 @@
+package ekspodidentitywebhook
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	installerv1alpha1 "github.com/h3poteto/eks-pod-identity-webhook-installer/api/v1alpha1"
+	"github.com/h3poteto/eks-pod-identity-webhook-installer/pkg/generator"
+)
+
+// permissionRetryInterval is how often we verify permissions of an existing ServiceAccount again,
+// because changes of RBAC are not watched.
+const permissionRetryInterval = 1 * time.Minute
+
+// existingServiceAccountStep uses spec.existingServiceAccountName instead of generating a ServiceAccount and RBAC.
+// Permissions are verified with SubjectAccessReview and recorded in ServiceAccountAuthorized condition.
+func (r *EKSPodIdentityWebhookReconciler) existingServiceAccountStep(ctx context.Context, state *syncState) (stepResult, error) {
+	resource := state.resource
+	name := resource.Spec.ExistingServiceAccountName
+
+	serviceAccount := corev1.ServiceAccount{}
+	err := r.Client.Get(ctx, types.NamespacedName{Namespace: resource.Spec.Namespace, Name: name}, &serviceAccount)
+	if kerrors.IsNotFound(err) {
+		meta.SetStatusCondition(&resource.Status.Conditions, metav1.Condition{
+			Type:               installerv1alpha1.ConditionServiceAccountAuthorized,
+			Status:             metav1.ConditionFalse,
+			ObservedGeneration: resource.Generation,
+			Reason:             "ServiceAccountNotFound",
+			Message:            fmt.Sprintf("ServiceAccount %s/%s does not exist", resource.Spec.Namespace, name),
+		})
+		return wait(fmt.Sprintf("ServiceAccount %s/%s does not exist", resource.Spec.Namespace, name), permissionRetryInterval), nil
+	} else if err != nil {
+		r.Logger.Error(err, "Failed to get serviceaccount", "Namespace", resource.Spec.Namespace, "Name", name)
+		return stepResult{}, err
+	}
+
+	if err := r.deleteGeneratedServiceAccount(ctx, resource); err != nil {
+		return stepResult{}, err
+	}
+
+	missing, err := r.missingPermissions(ctx, resource, &serviceAccount)
+	if err != nil {
+		return stepResult{}, err
+	}
+	condition := metav1.Condition{
+		Type:               installerv1alpha1.ConditionServiceAccountAuthorized,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: resource.Generation,
+		Reason:             "PermissionsGranted",
+		Message:            fmt.Sprintf("ServiceAccount %s/%s has all required permissions", serviceAccount.Namespace, serviceAccount.Name),
+	}
+	if len(missing) > 0 {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "MissingPermissions"
+		condition.Message = fmt.Sprintf("ServiceAccount %s/%s is missing: %s", serviceAccount.Namespace, serviceAccount.Name, strings.Join(missing, "; "))
+		if !meta.IsStatusConditionPresentAndEqual(resource.Status.Conditions, condition.Type, condition.Status) {
+			r.Recorder.Event(resource, corev1.EventTypeWarning, "MissingPermissions", condition.Message)
+		}
+	}
+	meta.SetStatusCondition(&resource.Status.Conditions, condition)
+
+	resource.Status.PodIdentityWebhookServiceAccount = &installerv1alpha1.ServiceAccountRef{
+		Namespace: serviceAccount.Namespace,
+		Name:      serviceAccount.Name,
+	}
+	state.serviceAccount = &serviceAccount
+	if len(missing) > 0 {
+		return wait(condition.Message, permissionRetryInterval), nil
+	}
+	return done(""), nil
+}
+
+// missingPermissions lists rules of the generated Role and ClusterRole which are not granted to the ServiceAccount.
+func (r *EKSPodIdentityWebhookReconciler) missingPermissions(ctx context.Context, resource *installerv1alpha1.EKSPodIdentityWebhook, serviceAccount *corev1.ServiceAccount) ([]string, error) {
+	missing := []string{}
+	for _, rule := range generator.GenerateRole(resource).Rules {
+		m, err := r.missingVerbs(ctx, serviceAccount, rule, serviceAccount.Namespace)
+		if err != nil {
+			return nil, err
+		}
+		missing = append(missing, m...)
+	}
+	for _, rule := range generator.GenerateClusterRole(resource).Rules {
+		m, err := r.missingVerbs(ctx, serviceAccount, rule, "")
+		if err != nil {
+			return nil, err
+		}
+		missing = append(missing, m...)
+	}
+	return missing, nil
+}
+
+func (r *EKSPodIdentityWebhookReconciler) missingVerbs(ctx context.Context, serviceAccount *corev1.ServiceAccount, rule rbacv1.PolicyRule, namespace string) ([]string, error) {
+	names := rule.ResourceNames
+	if len(names) == 0 {
+		names = []string{""}
+	}
+	missing := []string{}
+	for _, group := range rule.APIGroups {
+		for _, resource := range rule.Resources {
+			for _, name := range names {
+				verbs := []string{}
+				for _, verb := range rule.Verbs {
+					review := &authorizationv1.SubjectAccessReview{
+						Spec: authorizationv1.SubjectAccessReviewSpec{
+							User:   "system:serviceaccount:" + serviceAccount.Namespace + ":" + serviceAccount.Name,
+							Groups: []string{"system:serviceaccounts", "system:serviceaccounts:" + serviceAccount.Namespace, "system:authenticated"},
+							ResourceAttributes: &authorizationv1.ResourceAttributes{
+								Namespace: namespace,
+								Verb:      verb,
+								Group:     group,
+								Resource:  resource,
+								Name:      name,
+							},
+						},
+					}
+					if err := r.Client.Create(ctx, review); err != nil {
+						r.Logger.Error(err, "Failed to create SubjectAccessReview")
+						return nil, err
+					}
+					if !review.Status.Allowed {
+						verbs = append(verbs, verb)
+					}
+				}
+				if len(verbs) == 0 {
+					continue
+				}
+				target := resource
+				if group != "" {
+					target = resource + "." + group
+				}
+				if name != "" {
+					target += "/" + name
+				}
+				scope := "cluster-wide"
+				if namespace != "" {
+					scope = "in " + namespace
+				}
+				missing = append(missing, fmt.Sprintf("%s %s %s", strings.Join(verbs, ","), target, scope))
+			}
+		}
+	}
+	return missing, nil
+}
+
+// deleteGeneratedServiceAccount deletes the ServiceAccount and RBAC which were generated before spec.existingServiceAccountName was set.
+// Only objects recorded in status.inventory are deleted, and they are read without the cache, so that the installer
+// does not need to list and watch RBAC in this mode. Nothing is read when no such object is recorded.
+func (r *EKSPodIdentityWebhookReconciler) deleteGeneratedServiceAccount(ctx context.Context, resource *installerv1alpha1.EKSPodIdentityWebhook) error {
+	for _, entry := range resource.Status.Inventory {
+		if !generatedServiceAccountEntry(resource, entry) {
+			continue
+		}
+		if err := r.prune(ctx, resource, entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// generatedServiceAccountEntry returns true when entry is the ServiceAccount or RBAC which the installer generates.
+// The ServiceAccount is kept when spec.existingServiceAccountName takes it over.
+func generatedServiceAccountEntry(resource *installerv1alpha1.EKSPodIdentityWebhook, entry installerv1alpha1.InventoryEntry) bool {
+	if entry.Name != generator.ServiceAccountName {
+		return false
+	}
+	switch {
+	case entry.Group == rbacv1.GroupName:
+		return entry.Kind == "ClusterRoleBinding" || entry.Kind == "ClusterRole" || entry.Kind == "RoleBinding" || entry.Kind == "Role"
+	case entry.Group == "" && entry.Kind == "ServiceAccount":
+		return resource.Spec.ExistingServiceAccountName != generator.ServiceAccountName
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+package ekspodidentitywebhook
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	installerv1alpha1 "github.com/h3poteto/eks-pod-identity-webhook-installer/api/v1alpha1"
+	"github.com/h3poteto/eks-pod-identity-webhook-installer/pkg/generator"
+)
+
+func ownedBy(resource *installerv1alpha1.EKSPodIdentityWebhook) []metav1.OwnerReference {
+	return []metav1.OwnerReference{*metav1.NewControllerRef(resource, schema.GroupVersionKind{
+		Group:   installerv1alpha1.GroupVersion.Group,
+		Version: installerv1alpha1.GroupVersion.Version,
+		Kind:    "EKSPodIdentityWebhook",
+	})}
+}
+
+func TestDeleteGeneratedServiceAccount(t *testing.T) {
+	ctx := context.Background()
+	resource := testResource()
+	resource.UID = "resource-uid"
+	resource.Spec.ExistingServiceAccountName = "managed"
+
+	meta := func(namespace, uid string) metav1.ObjectMeta {
+		return metav1.ObjectMeta{Namespace: namespace, Name: generator.ServiceAccountName, UID: types.UID("uid-" + uid), OwnerReferences: ownedBy(resource)}
+	}
+	clusterRole := &rbacv1.ClusterRole{ObjectMeta: meta("", "clusterrole")}
+	role := &rbacv1.Role{ObjectMeta: meta(resource.Spec.Namespace, "role")}
+	serviceAccount := &corev1.ServiceAccount{ObjectMeta: meta(resource.Spec.Namespace, "serviceaccount")}
+	// It is not in the inventory, so it is not deleted.
+	roleBinding := &rbacv1.RoleBinding{ObjectMeta: meta(resource.Spec.Namespace, "rolebinding")}
+
+	resource.Status.Inventory = []installerv1alpha1.InventoryEntry{
+		{Group: rbacv1.GroupName, Version: "v1", Kind: "ClusterRole", Name: clusterRole.Name, UID: clusterRole.UID},
+		{Group: rbacv1.GroupName, Version: "v1", Kind: "Role", Namespace: role.Namespace, Name: role.Name, UID: role.UID},
+		{Version: "v1", Kind: "ServiceAccount", Namespace: serviceAccount.Namespace, Name: serviceAccount.Name, UID: serviceAccount.UID},
+		// Entries which are already deleted are skipped.
+		{Group: rbacv1.GroupName, Version: "v1", Kind: "ClusterRoleBinding", Name: generator.ServiceAccountName, UID: "deleted"},
+	}
+
+	r := testReconciler(t, clusterRole, role, serviceAccount, roleBinding)
+	if err := r.deleteGeneratedServiceAccount(ctx, resource); err != nil {
+		t.Fatal(err)
+	}
+	for _, obj := range []client.Object{&rbacv1.ClusterRole{}, &rbacv1.Role{}, &corev1.ServiceAccount{}} {
+		err := r.Client.Get(ctx, client.ObjectKey{Namespace: namespaceOf(obj, resource), Name: generator.ServiceAccountName}, obj)
+		if !kerrors.IsNotFound(err) {
+			t.Errorf("%T is not deleted: %v", obj, err)
+		}
+	}
+	if err := r.Client.Get(ctx, client.ObjectKeyFromObject(roleBinding), &rbacv1.RoleBinding{}); err != nil {
+		t.Errorf("RoleBinding which is not recorded is deleted: %v", err)
+	}
+}
+
+func TestGeneratedServiceAccountEntry(t *testing.T) {
+	cases := []struct {
+		name     string
+		existing string
+		entry    installerv1alpha1.InventoryEntry
+		want     bool
+	}{
+		{"ClusterRoleBinding", "managed", installerv1alpha1.InventoryEntry{Group: rbacv1.GroupName, Kind: "ClusterRoleBinding", Name: generator.ServiceAccountName}, true},
+		{"Role", "managed", installerv1alpha1.InventoryEntry{Group: rbacv1.GroupName, Kind: "Role", Name: generator.ServiceAccountName}, true},
+		{"other name", "managed", installerv1alpha1.InventoryEntry{Group: rbacv1.GroupName, Kind: "Role", Name: "other"}, false},
+		{"ServiceAccount", "managed", installerv1alpha1.InventoryEntry{Kind: "ServiceAccount", Name: generator.ServiceAccountName}, true},
+		{"ServiceAccount which is taken over", generator.ServiceAccountName, installerv1alpha1.InventoryEntry{Kind: "ServiceAccount", Name: generator.ServiceAccountName}, false},
+		{"Service", "managed", installerv1alpha1.InventoryEntry{Kind: "Service", Name: generator.ServiceAccountName}, false},
+	}
+	for _, c := range cases {
+		resource := testResource()
+		resource.Spec.ExistingServiceAccountName = c.existing
+		if got := generatedServiceAccountEntry(resource, c.entry); got != c.want {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func namespaceOf(obj client.Object, resource *installerv1alpha1.EKSPodIdentityWebhook) string {
+	if _, ok := obj.(*rbacv1.ClusterRole); ok {
+		return ""
+	}
+	return resource.Spec.Namespace
+}
@@ -0,0 +1,214 @@
+package ekspodidentitywebhook
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	installerv1alpha1 "github.com/h3poteto/eks-pod-identity-webhook-installer/api/v1alpha1"
+	"github.com/h3poteto/eks-pod-identity-webhook-installer/pkg/generator"
+)
+
+// overlaysStep validates spec.overlays against generated objects, and records the result in OverlaysValid condition.
+// Objects are not written while an overlay is invalid, because they may lack something the overlay adds.
+func (r *EKSPodIdentityWebhookReconciler) overlaysStep(ctx context.Context, state *syncState) (stepResult, error) {
+	resource := state.resource
+	objects, err := generator.GenerateObjects(resource, nil)
+	if err != nil {
+		// The spec can not be fixed by retrying, so nothing is written until it changes.
+		r.Logger.Error(err, "Failed to generate objects", "Name", resource.Name)
+		r.Recorder.Eventf(resource, corev1.EventTypeWarning, "InvalidSpec", "Failed to generate objects: %v", err)
+		return fail(err.Error()), nil
+	}
+	errs := generator.ValidateOverlays(resource, objects)
+	condition := metav1.Condition{
+		Type:               installerv1alpha1.ConditionOverlaysValid,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: resource.Generation,
+		Reason:             "OverlaysApplied",
+		Message:            fmt.Sprintf("%d overlays are valid", len(resource.Spec.Overlays)),
+	}
+	if len(errs) > 0 {
+		messages := make([]string, 0, len(errs))
+		for _, err := range errs {
+			messages = append(messages, err.Error())
+		}
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "InvalidOverlay"
+		condition.Message = strings.Join(messages, "; ")
+	}
+	current := meta.FindStatusCondition(resource.Status.Conditions, installerv1alpha1.ConditionOverlaysValid)
+	if len(errs) > 0 && (current == nil || current.Status != metav1.ConditionFalse || current.Message != condition.Message) {
+		r.Recorder.Eventf(resource, corev1.EventTypeWarning, "InvalidOverlay", "Invalid overlays: %s", condition.Message)
+	}
+	meta.SetStatusCondition(&resource.Status.Conditions, condition)
+	if len(errs) > 0 {
+		return fail(condition.Message), nil
+	}
+	return done(""), nil
+}
+
+func (r *EKSPodIdentityWebhookReconciler) namespaceStep(ctx context.Context, state *syncState) (stepResult, error) {
+	ready, err := r.ensureNamespace(ctx, state.resource)
+	if err != nil {
+		return stepResult{}, err
+	}
+	if !ready {
+		return wait(fmt.Sprintf("namespace %s is terminating", state.resource.Spec.Namespace), namespaceTerminatingInterval), nil
+	}
+	return done(""), nil
+}
+
+func (r *EKSPodIdentityWebhookReconciler) preflightStep(ctx context.Context, state *syncState) (stepResult, error) {
+	if !r.preflight(ctx, state.resource) {
+		return wait("preflight checks failed, see PreflightPassed condition", preflightRetryInterval), nil
+	}
+	return done(""), nil
+}
+
+func (r *EKSPodIdentityWebhookReconciler) migrationStep(ctx context.Context, state *syncState) (stepResult, error) {
+	resource := state.resource
+	r.syncMigrationTarget(resource)
+	if m := resource.Status.Migration; m != nil && m.Phase == installerv1alpha1.MigrationPhaseProvisioning && m.Abandoned != "" {
+		if err := r.abandonMigrationTarget(ctx, resource); err != nil {
+			return stepResult{}, err
+		}
+	}
+	if m := resource.Status.Migration; m != nil {
+		return done(fmt.Sprintf("migrating from %s to %s", m.From, m.To)), nil
+	}
+	return done(""), nil
+}
+
+func (r *EKSPodIdentityWebhookReconciler) serviceAccountStep(ctx context.Context, state *syncState) (stepResult, error) {
+	resource := state.resource
+	if resource.Spec.ExistingServiceAccountName != "" {
+		return r.existingServiceAccountStep(ctx, state)
+	}
+	meta.RemoveStatusCondition(&resource.Status.Conditions, installerv1alpha1.ConditionServiceAccountAuthorized)
+	create, serviceAccount, err := r.serviceAccountShouldCreate(ctx, resource)
+	if err != nil {
+		return stepResult{}, err
+	}
+	if create {
+		serviceAccount, err = r.createServiceAccount(ctx, resource)
+		if err != nil {
+			return stepResult{}, err
+		}
+	}
+	resource.Status.PodIdentityWebhookServiceAccount = &installerv1alpha1.ServiceAccountRef{
+		Namespace: serviceAccount.Namespace,
+		Name:      serviceAccount.Name,
+	}
+	state.serviceAccount = serviceAccount
+	return done(""), nil
+}
+
+func (r *EKSPodIdentityWebhookReconciler) serviceStep(ctx context.Context, state *syncState) (stepResult, error) {
+	resource := state.resource
+	service, adopted, err := r.ensureService(ctx, resource)
+	if err != nil {
+		return stepResult{}, err
+	}
+	ref := resource.Status.PodIdentityWebhookService
+	resource.Status.PodIdentityWebhookService = &installerv1alpha1.ServiceRef{
+		Namespace: service.Namespace,
+		Name:      service.Name,
+		Adopted:   adopted || (ref != nil && ref.Namespace == service.Namespace && ref.Adopted),
+	}
+	state.service = service
+	return done(""), nil
+}
+
+func (r *EKSPodIdentityWebhookReconciler) daemonsetStep(ctx context.Context, state *syncState) (stepResult, error) {
+	resource := state.resource
+	var daemonset *appsv1.DaemonSet
+	var adopted bool
+	var err error
+	result := done("")
+	if resource.Spec.UpgradeStrategy.Type == installerv1alpha1.UpgradeCanary {
+		daemonset, adopted, result, err = r.canaryUpgrade(ctx, resource, state.gate)
+	} else {
+		resource.Status.Upgrade = nil
+		var desired *corev1.PodTemplateSpec
+		daemonset, adopted, err = r.ensureDaemonset(ctx, resource, state.gate, func(d, _ *appsv1.DaemonSet) {
+			desired = d.Spec.Template.DeepCopy()
+		})
+		if err == nil {
+			err = r.recordLastGood(resource, daemonset, desired)
+		}
+	}
+	if err != nil {
+		return stepResult{}, err
+	}
+	ref := resource.Status.PodIdentityWebhookDaemonset
+	resource.Status.PodIdentityWebhookDaemonset = &installerv1alpha1.DaemonsetRef{
+		Namespace: daemonset.Namespace,
+		Name:      daemonset.Name,
+		Adopted:   adopted || (ref != nil && ref.Namespace == daemonset.Namespace && ref.Adopted),
+	}
+	state.daemonset = daemonset
+	if err := r.syncWorkloadStatus(ctx, resource, daemonset); err != nil {
+		return stepResult{}, err
+	}
+	if result.message == "" && state.gate.holds("DaemonSet") {
+		result.message = fmt.Sprintf("pod template is held until the maintenance window at %s", state.gate.next.Format(time.RFC3339))
+	}
+	return result, nil
+}
+
+// daemonsetReady holds the MutatingWebhookConfiguration back during a migration,
+// until the webhook in the new namespace can serve requests.
+func (r *EKSPodIdentityWebhookReconciler) daemonsetReady(ctx context.Context, state *syncState) (stepResult, error) {
+	m := state.resource.Status.Migration
+	if m == nil || m.Phase != installerv1alpha1.MigrationPhaseProvisioning {
+		return done(""), nil
+	}
+	ready, message, err := r.migrationReady(ctx, state.resource, state.daemonset)
+	if err != nil {
+		return stepResult{}, err
+	}
+	if !ready {
+		return wait(fmt.Sprintf("webhook in %s is not ready: %s", m.To, message), migrationPollInterval), nil
+	}
+	m.Phase = installerv1alpha1.MigrationPhaseSwitching
+	r.Recorder.Eventf(state.resource, corev1.EventTypeNormal, "NamespaceMigrationSwitching", "Webhook in %s is ready, switching MutatingWebhookConfiguration", m.To)
+	return done(""), nil
+}
+
+func (r *EKSPodIdentityWebhookReconciler) mutatingWebhookConfigurationStep(ctx context.Context, state *syncState) (stepResult, error) {
+	resource := state.resource
+	mutating, adopted, err := r.ensureMutatingWebhookConfiguration(ctx, resource, state.service, state.gate)
+	if err != nil {
+		return stepResult{}, err
+	}
+	ref := resource.Status.PodIdentityWebhookConfiguration
+	resource.Status.PodIdentityWebhookConfiguration = &installerv1alpha1.MutatingWebhookConfigurationRef{
+		Name:    mutating.Name,
+		Adopted: adopted || (ref != nil && ref.Adopted),
+	}
+	// A migration must not clean up the old namespace until the MutatingWebhookConfiguration is switched.
+	if state.gate.holds("MutatingWebhookConfiguration") {
+		return wait(fmt.Sprintf("changes are held until the maintenance window at %s", state.gate.next.Format(time.RFC3339)), time.Until(state.gate.next)+time.Second), nil
+	}
+	return done(""), nil
+}
+
+func (r *EKSPodIdentityWebhookReconciler) migrationCleanupStep(ctx context.Context, state *syncState) (stepResult, error) {
+	m := state.resource.Status.Migration
+	if m == nil {
+		return done(""), nil
+	}
+	// Record the phase first, so the cleanup is resumed if it fails.
+	m.Phase = installerv1alpha1.MigrationPhaseCleaningUp
+	if err := r.finishMigration(ctx, state.resource); err != nil {
+		return stepResult{}, err
+	}
+	return done(""), nil
+}
@@ -0,0 +1,296 @@
+package ekspodidentitywebhook
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	installerv1alpha1 "github.com/h3poteto/eks-pod-identity-webhook-installer/api/v1alpha1"
+)
+
+// upgradePollInterval is how often we check canary pods and the rollout during an upgrade.
+const upgradePollInterval = 10 * time.Second
+
+// podTemplateGenerationLabel is set on pods by the DaemonSet controller, so pods created from the current template can be found.
+// Its value is daemonsetGenerationAnnotation of the DaemonSet, not the generation, which also changes with the update strategy.
+const podTemplateGenerationLabel = "pod-template-generation"
+
+// failedReasons are waiting reasons of a container which do not recover without changing the pod template.
+var failedReasons = map[string]bool{
+	"CrashLoopBackOff":           true,
+	"ImagePullBackOff":           true,
+	"ErrImagePull":               true,
+	"InvalidImageName":           true,
+	"CreateContainerConfigError": true,
+	"CreateContainerError":       true,
+	"RunContainerError":          true,
+}
+
+// canaryUpgrade applies the DaemonSet with the Canary upgrade strategy.
+// A new pod template is applied with OnDelete strategy, and pods on canary nodes are deleted so that they are recreated from it.
+// After canary pods become ready and pass the mutation probe, the strategy is switched to RollingUpdate to roll it out to the rest.
+// When canary pods or the rollout fail, the last good template is applied again.
+func (r *EKSPodIdentityWebhookReconciler) canaryUpgrade(ctx context.Context, resource *installerv1alpha1.EKSPodIdentityWebhook, gate *maintenanceGate) (*appsv1.DaemonSet, bool, stepResult, error) {
+	var desired *corev1.PodTemplateSpec
+	revision := ""
+	start := false
+	mutate := func(d, exists *appsv1.DaemonSet) {
+		desired = d.Spec.Template.DeepCopy()
+		revision = templateRevision(desired)
+		u := resource.Status.Upgrade
+		if u != nil && u.Revision == revision {
+			switch u.Phase {
+			case installerv1alpha1.UpgradePhaseCanary:
+				d.Spec.UpdateStrategy = appsv1.DaemonSetUpdateStrategy{Type: appsv1.OnDeleteDaemonSetStrategyType}
+			case installerv1alpha1.UpgradePhaseRolledBack:
+				r.restoreLastGood(resource, d)
+			}
+			return
+		}
+		// A new pod template is started as a canary, unless the DaemonSet is created now.
+		if exists != nil && !equality.Semantic.DeepDerivative(d.Spec.Template, exists.Spec.Template) {
+			d.Spec.UpdateStrategy = appsv1.DaemonSetUpdateStrategy{Type: appsv1.OnDeleteDaemonSetStrategyType}
+			start = true
+		}
+	}
+	daemonset, adopted, err := r.ensureDaemonset(ctx, resource, gate, mutate)
+	if err != nil {
+		return nil, false, stepResult{}, err
+	}
+
+	u := resource.Status.Upgrade
+	switch {
+	case start:
+		result, err := r.startCanary(ctx, resource, daemonset, revision)
+		return daemonset, adopted, result, err
+	case u == nil || u.Revision != revision:
+		// The pod template is not changed, or the DaemonSet is created now.
+		resource.Status.Upgrade = nil
+		return daemonset, adopted, done(""), r.recordLastGood(resource, daemonset, desired)
+	case u.Phase == installerv1alpha1.UpgradePhaseCanary:
+		result, err := r.verifyCanary(ctx, resource, daemonset)
+		if err != nil || u.Phase == installerv1alpha1.UpgradePhaseCanary {
+			return daemonset, adopted, result, err
+		}
+		// Apply RollingUpdate strategy or the last good template right away.
+		daemonset, adopted, err = r.ensureDaemonset(ctx, resource, gate, mutate)
+		return daemonset, adopted, result, err
+	case u.Phase == installerv1alpha1.UpgradePhasePromoting:
+		result, err := r.verifyRollout(ctx, resource, daemonset, desired)
+		if err != nil || u.Phase != installerv1alpha1.UpgradePhaseRolledBack {
+			return daemonset, adopted, result, err
+		}
+		daemonset, adopted, err = r.ensureDaemonset(ctx, resource, gate, mutate)
+		return daemonset, adopted, result, err
+	default:
+		// The webhook keeps running the last good template, so steps depending on the DaemonSet can proceed.
+		return daemonset, adopted, done(fmt.Sprintf("upgrade to revision %s was rolled back, change the pod template to retry: %s", u.Revision, u.Message)), nil
+	}
+}
+
+// startCanary deletes webhook pods on canary nodes, so that they are recreated from the new pod template.
+func (r *EKSPodIdentityWebhookReconciler) startCanary(ctx context.Context, resource *installerv1alpha1.EKSPodIdentityWebhook, daemonset *appsv1.DaemonSet, revision string) (stepResult, error) {
+	pods, err := r.webhookPods(ctx, daemonset)
+	if err != nil {
+		return stepResult{}, err
+	}
+	sort.Slice(pods, func(i, j int) bool { return pods[i].Spec.NodeName < pods[j].Spec.NodeName })
+
+	nodes := []string{}
+	for i := range pods {
+		if int32(len(nodes)) >= resource.Spec.UpgradeStrategy.CanaryNodes {
+			break
+		}
+		pod := &pods[i]
+		if pod.Spec.NodeName == "" || pod.DeletionTimestamp != nil {
+			continue
+		}
+		if err := r.Client.Delete(ctx, pod); client.IgnoreNotFound(err) != nil {
+			r.Logger.Error(err, "Failed to delete pod", "Namespace", pod.Namespace, "Name", pod.Name)
+			return stepResult{}, err
+		}
+		nodes = append(nodes, pod.Spec.NodeName)
+	}
+
+	resource.Status.Upgrade = &installerv1alpha1.UpgradeStatus{
+		Revision:           revision,
+		Phase:              installerv1alpha1.UpgradePhaseCanary,
+		CanaryNodes:        nodes,
+		LastTransitionTime: metav1.Now(),
+		Message:            "waiting for canary pods",
+	}
+	r.Recorder.Eventf(resource, corev1.EventTypeNormal, "CanaryStarted", "Rolling out revision %s to canary nodes %s", revision, strings.Join(nodes, ", "))
+	r.Logger.Info("Start canary", "Revision", revision, "Nodes", nodes)
+	return wait(fmt.Sprintf("canary of revision %s started on %s", revision, strings.Join(nodes, ", ")), upgradePollInterval), nil
+}
+
+// verifyCanary promotes the new pod template when canary pods are ready and pass the mutation probe,
+// and rolls it back when they fail or time out.
+func (r *EKSPodIdentityWebhookReconciler) verifyCanary(ctx context.Context, resource *installerv1alpha1.EKSPodIdentityWebhook, daemonset *appsv1.DaemonSet) (stepResult, error) {
+	u := resource.Status.Upgrade
+	pods, err := r.webhookPods(ctx, daemonset)
+	if err != nil {
+		return stepResult{}, err
+	}
+	generation := daemonset.Annotations[daemonsetGenerationAnnotation]
+	canaries := map[string]*corev1.Pod{}
+	for i := range pods {
+		pod := &pods[i]
+		if generation != "" && pod.Labels[podTemplateGenerationLabel] == generation && pod.DeletionTimestamp == nil {
+			canaries[pod.Spec.NodeName] = pod
+		}
+	}
+
+	pending := []string{}
+	for _, node := range u.CanaryNodes {
+		pod, ok := canaries[node]
+		if !ok {
+			pending = append(pending, fmt.Sprintf("%s: pod is not created yet", node))
+			continue
+		}
+		if health := podHealth(pod); health != nil {
+			if failedReasons[health.Reason] {
+				return r.rollback(resource, fmt.Sprintf("canary pod %s on %s is %s: %s", pod.Name, node, health.Reason, health.Message)), nil
+			}
+			pending = append(pending, fmt.Sprintf("%s: %s", node, health.Reason))
+			continue
+		}
+		if !resource.Spec.UpgradeStrategy.SkipMutationProbe {
+			if err := r.probeMutation(ctx, resource, pod); err != nil {
+				r.Logger.Info("Mutation probe failed", "Pod", pod.Name, "error", err)
+				pending = append(pending, fmt.Sprintf("%s: mutation probe failed: %v", node, err))
+				continue
+			}
+		}
+	}
+
+	if len(pending) > 0 {
+		timeout := time.Duration(resource.Spec.UpgradeStrategy.VerifyTimeoutSeconds) * time.Second
+		if time.Since(u.LastTransitionTime.Time) > timeout {
+			return r.rollback(resource, fmt.Sprintf("canary is not verified in %s: %s", timeout, strings.Join(pending, "; "))), nil
+		}
+		u.Message = strings.Join(pending, "; ")
+		return wait(fmt.Sprintf("verifying canary of revision %s: %s", u.Revision, u.Message), upgradePollInterval), nil
+	}
+
+	u.Phase = installerv1alpha1.UpgradePhasePromoting
+	u.LastTransitionTime = metav1.Now()
+	u.Message = "rolling out to every node"
+	r.Recorder.Eventf(resource, corev1.EventTypeNormal, "CanaryPromoted", "Canary of revision %s is verified, rolling out to every node", u.Revision)
+	r.Logger.Info("Promote canary", "Revision", u.Revision)
+	return wait(fmt.Sprintf("rolling out revision %s", u.Revision), upgradePollInterval), nil
+}
+
+// verifyRollout finishes the upgrade when every pod runs the new pod template, and rolls it back when a pod fails.
+func (r *EKSPodIdentityWebhookReconciler) verifyRollout(ctx context.Context, resource *installerv1alpha1.EKSPodIdentityWebhook, daemonset *appsv1.DaemonSet, desired *corev1.PodTemplateSpec) (stepResult, error) {
+	u := resource.Status.Upgrade
+	pods, err := r.webhookPods(ctx, daemonset)
+	if err != nil {
+		return stepResult{}, err
+	}
+	for i := range pods {
+		if health := podHealth(&pods[i]); health != nil && failedReasons[health.Reason] {
+			return r.rollback(resource, fmt.Sprintf("pod %s on %s is %s: %s", pods[i].Name, health.Node, health.Reason, health.Message)), nil
+		}
+	}
+	if !rolledOut(daemonset) {
+		s := daemonset.Status
+		u.Message = fmt.Sprintf("%d/%d pods are updated, %d are ready", s.UpdatedNumberScheduled, s.DesiredNumberScheduled, s.NumberReady)
+		return wait(fmt.Sprintf("rolling out revision %s: %s", u.Revision, u.Message), upgradePollInterval), nil
+	}
+
+	resource.Status.Upgrade = nil
+	if err := r.recordLastGood(resource, daemonset, desired); err != nil {
+		return stepResult{}, err
+	}
+	r.Recorder.Eventf(resource, corev1.EventTypeNormal, "UpgradeCompleted", "Revision %s is rolled out to every node", u.Revision)
+	r.Logger.Info("Upgrade completed", "Revision", u.Revision)
+	return done(""), nil
+}
+
+// rollback marks the upgrade as rolled back. The caller applies the last good template.
+func (r *EKSPodIdentityWebhookReconciler) rollback(resource *installerv1alpha1.EKSPodIdentityWebhook, reason string) stepResult {
+	u := resource.Status.Upgrade
+	u.Phase = installerv1alpha1.UpgradePhaseRolledBack
+	u.LastTransitionTime = metav1.Now()
+	u.Message = reason
+	r.Recorder.Eventf(resource, corev1.EventTypeWarning, "UpgradeFailed", "Revision %s failed: %s", u.Revision, reason)
+	if resource.Status.LastGoodTemplate == nil {
+		r.Recorder.Eventf(resource, corev1.EventTypeWarning, "RollbackUnavailable", "No last good template is recorded, so revision %s is kept on canary nodes and not rolled out", u.Revision)
+	} else {
+		r.Recorder.Eventf(resource, corev1.EventTypeNormal, "RolledBack", "Rolling back to revision %s", resource.Status.LastGoodRevision)
+	}
+	r.Logger.Info("Roll back upgrade", "Revision", u.Revision, "LastGoodRevision", resource.Status.LastGoodRevision, "reason", reason)
+	return done(fmt.Sprintf("upgrade to revision %s was rolled back: %s", u.Revision, reason))
+}
+
+// restoreLastGood replaces the pod template with the last good one. Without it, the new template is kept with OnDelete strategy,
+// so it does not spread beyond canary nodes.
+func (r *EKSPodIdentityWebhookReconciler) restoreLastGood(resource *installerv1alpha1.EKSPodIdentityWebhook, daemonset *appsv1.DaemonSet) {
+	raw := resource.Status.LastGoodTemplate
+	if raw == nil {
+		daemonset.Spec.UpdateStrategy = appsv1.DaemonSetUpdateStrategy{Type: appsv1.OnDeleteDaemonSetStrategyType}
+		return
+	}
+	template := corev1.PodTemplateSpec{}
+	if err := json.Unmarshal(raw.Raw, &template); err != nil {
+		r.Logger.Error(err, "Last good template is invalid")
+		daemonset.Spec.UpdateStrategy = appsv1.DaemonSetUpdateStrategy{Type: appsv1.OnDeleteDaemonSetStrategyType}
+		return
+	}
+	daemonset.Spec.Template = template
+}
+
+// recordLastGood records the pod template when it is rolled out to every node and ready.
+func (r *EKSPodIdentityWebhookReconciler) recordLastGood(resource *installerv1alpha1.EKSPodIdentityWebhook, daemonset *appsv1.DaemonSet, desired *corev1.PodTemplateSpec) error {
+	if desired == nil || !rolledOut(daemonset) || !equality.Semantic.DeepDerivative(*desired, daemonset.Spec.Template) {
+		return nil
+	}
+	revision := templateRevision(desired)
+	if resource.Status.LastGoodRevision == revision && resource.Status.LastGoodTemplate != nil {
+		return nil
+	}
+	raw, err := json.Marshal(desired)
+	if err != nil {
+		return err
+	}
+	resource.Status.LastGoodTemplate = &runtime.RawExtension{Raw: raw}
+	resource.Status.LastGoodRevision = revision
+	return nil
+}
+
+// upgrading returns true when a canary upgrade of the pod template is in progress or was rolled back.
+// It is not held by maintenance windows, because it started in a window.
+func upgrading(resource *installerv1alpha1.EKSPodIdentityWebhook, template *corev1.PodTemplateSpec) bool {
+	u := resource.Status.Upgrade
+	return u != nil && u.Revision == templateRevision(template)
+}
+
+// rolledOut returns true when every pod of the DaemonSet runs the current pod template and is ready.
+func rolledOut(daemonset *appsv1.DaemonSet) bool {
+	s := daemonset.Status
+	return s.ObservedGeneration >= daemonset.Generation &&
+		s.DesiredNumberScheduled > 0 &&
+		s.UpdatedNumberScheduled == s.DesiredNumberScheduled &&
+		s.NumberReady == s.DesiredNumberScheduled &&
+		s.NumberUnavailable == 0
+}
+
+// templateRevision returns a short hash of a generated pod template.
+func templateRevision(template *corev1.PodTemplateSpec) string {
+	data, _ := json.Marshal(template)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])[:10]
+}
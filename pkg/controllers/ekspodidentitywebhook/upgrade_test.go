@@ -0,0 +1,364 @@
+package ekspodidentitywebhook
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	installerv1alpha1 "github.com/h3poteto/eks-pod-identity-webhook-installer/api/v1alpha1"
+	"github.com/h3poteto/eks-pod-identity-webhook-installer/pkg/generator"
+)
+
+func canaryResource() *installerv1alpha1.EKSPodIdentityWebhook {
+	resource := testResource()
+	resource.Spec.UpgradeStrategy = installerv1alpha1.UpgradeStrategy{
+		Type:                 "Canary",
+		CanaryNodes:          1,
+		VerifyTimeoutSeconds: 300,
+		SkipMutationProbe:    true,
+	}
+	return resource
+}
+
+// canaryDaemonset returns a DaemonSet whose pod template is at templateGeneration.
+// The generation is larger, because switching the update strategy changes only the generation.
+func canaryDaemonset(templateGeneration string) *appsv1.DaemonSet {
+	return &appsv1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "kube-system",
+			Name:        generator.DaemonsetName,
+			Generation:  5,
+			Annotations: map[string]string{daemonsetGenerationAnnotation: templateGeneration},
+		},
+		Spec: appsv1.DaemonSetSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": generator.DaemonsetName}},
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: generator.DaemonsetName, Image: "webhook:v2"}}},
+			},
+		},
+	}
+}
+
+func webhookPod(node, templateGeneration string, state corev1.ContainerState) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "kube-system",
+			Name:      generator.DaemonsetName + "-" + node,
+			Labels:    map[string]string{"app": generator.DaemonsetName, podTemplateGenerationLabel: templateGeneration},
+		},
+		Spec: corev1.PodSpec{NodeName: node},
+		Status: corev1.PodStatus{
+			Phase:             corev1.PodRunning,
+			ContainerStatuses: []corev1.ContainerStatus{{Name: generator.DaemonsetName, State: state}},
+		},
+	}
+	if state.Running != nil {
+		pod.Status.ContainerStatuses[0].Ready = true
+		pod.Status.Conditions = []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}}
+	}
+	return pod
+}
+
+var (
+	running     = corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}
+	crashing    = corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "CrashLoopBackOff", Message: "back-off"}}
+	starting    = corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "ContainerCreating"}}
+	lastGood, _ = json.Marshal(corev1.PodTemplateSpec{
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: generator.DaemonsetName, Image: "webhook:v1"}}},
+	})
+)
+
+func TestStartCanary(t *testing.T) {
+	ctx := context.Background()
+	resource := canaryResource()
+	resource.Spec.UpgradeStrategy.CanaryNodes = 2
+	pending := webhookPod("", "1", starting)
+	pending.Name = generator.DaemonsetName + "-pending"
+	r := testReconciler(t,
+		webhookPod("node-c", "1", running),
+		webhookPod("node-a", "1", running),
+		webhookPod("node-b", "1", running),
+		pending,
+	)
+
+	result, err := r.startCanary(ctx, resource, canaryDaemonset("2"), "rev2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.waiting {
+		t.Errorf("canary must wait: %+v", result)
+	}
+	u := resource.Status.Upgrade
+	if u == nil || u.Phase != installerv1alpha1.UpgradePhaseCanary || u.Revision != "rev2" {
+		t.Fatalf("upgrade is %+v", u)
+	}
+	if strings.Join(u.CanaryNodes, ",") != "node-a,node-b" {
+		t.Errorf("canary nodes are %v", u.CanaryNodes)
+	}
+	for node, deleted := range map[string]bool{"node-a": true, "node-b": true, "node-c": false, "pending": false} {
+		err := r.Client.Get(ctx, client.ObjectKey{Namespace: "kube-system", Name: generator.DaemonsetName + "-" + node}, &corev1.Pod{})
+		if deleted != kerrors.IsNotFound(err) {
+			t.Errorf("pod on %s: deleted is %v, but got %v", node, deleted, err)
+		}
+	}
+}
+
+func TestVerifyCanary(t *testing.T) {
+	cases := []struct {
+		name    string
+		pods    []client.Object
+		started time.Duration
+		phase   string
+		message string
+	}{
+		{
+			name:  "promote after the strategy changes the generation",
+			pods:  []client.Object{webhookPod("node-a", "2", running), webhookPod("node-b", "1", running)},
+			phase: installerv1alpha1.UpgradePhasePromoting,
+		},
+		{
+			name:    "pod of the old template is not a canary",
+			pods:    []client.Object{webhookPod("node-a", "1", running)},
+			phase:   installerv1alpha1.UpgradePhaseCanary,
+			message: "node-a: pod is not created yet",
+		},
+		{
+			name:    "canary is starting",
+			pods:    []client.Object{webhookPod("node-a", "2", starting)},
+			phase:   installerv1alpha1.UpgradePhaseCanary,
+			message: "node-a: ContainerCreating",
+		},
+		{
+			name:    "crashing canary is rolled back",
+			pods:    []client.Object{webhookPod("node-a", "2", crashing)},
+			phase:   installerv1alpha1.UpgradePhaseRolledBack,
+			message: "CrashLoopBackOff",
+		},
+		{
+			name:    "timeout is rolled back",
+			pods:    []client.Object{webhookPod("node-a", "2", starting)},
+			started: 10 * time.Minute,
+			phase:   installerv1alpha1.UpgradePhaseRolledBack,
+			message: "canary is not verified in 5m0s",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			resource := canaryResource()
+			resource.Status.LastGoodTemplate = &runtime.RawExtension{Raw: lastGood}
+			resource.Status.LastGoodRevision = "rev1"
+			resource.Status.Upgrade = &installerv1alpha1.UpgradeStatus{
+				Revision:           "rev2",
+				Phase:              installerv1alpha1.UpgradePhaseCanary,
+				CanaryNodes:        []string{"node-a"},
+				LastTransitionTime: metav1.NewTime(time.Now().Add(-c.started)),
+			}
+			r := testReconciler(t, c.pods...)
+
+			if _, err := r.verifyCanary(context.Background(), resource, canaryDaemonset("2")); err != nil {
+				t.Fatal(err)
+			}
+			u := resource.Status.Upgrade
+			if u.Phase != c.phase {
+				t.Errorf("phase is %s, want %s: %s", u.Phase, c.phase, u.Message)
+			}
+			if !strings.Contains(u.Message, c.message) {
+				t.Errorf("message is %q, want %q", u.Message, c.message)
+			}
+		})
+	}
+}
+
+func TestVerifyRollout(t *testing.T) {
+	rolledOutStatus := appsv1.DaemonSetStatus{
+		ObservedGeneration:     5,
+		DesiredNumberScheduled: 2,
+		UpdatedNumberScheduled: 2,
+		NumberReady:            2,
+	}
+	cases := []struct {
+		name    string
+		pods    []client.Object
+		status  appsv1.DaemonSetStatus
+		phase   string
+		message string
+	}{
+		{
+			name:   "completed",
+			pods:   []client.Object{webhookPod("node-a", "2", running), webhookPod("node-b", "2", running)},
+			status: rolledOutStatus,
+		},
+		{
+			name: "rolling out",
+			pods: []client.Object{webhookPod("node-a", "2", running), webhookPod("node-b", "1", running)},
+			status: appsv1.DaemonSetStatus{
+				ObservedGeneration:     5,
+				DesiredNumberScheduled: 2,
+				UpdatedNumberScheduled: 1,
+				NumberReady:            2,
+			},
+			phase:   installerv1alpha1.UpgradePhasePromoting,
+			message: "1/2 pods are updated, 2 are ready",
+		},
+		{
+			name:    "crashing pod is rolled back",
+			pods:    []client.Object{webhookPod("node-a", "2", running), webhookPod("node-b", "2", crashing)},
+			status:  rolledOutStatus,
+			phase:   installerv1alpha1.UpgradePhaseRolledBack,
+			message: "is CrashLoopBackOff",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			resource := canaryResource()
+			resource.Status.Upgrade = &installerv1alpha1.UpgradeStatus{Revision: "rev2", Phase: installerv1alpha1.UpgradePhasePromoting}
+			daemonset := canaryDaemonset("2")
+			daemonset.Status = c.status
+			r := testReconciler(t, c.pods...)
+
+			if _, err := r.verifyRollout(context.Background(), resource, daemonset, daemonset.Spec.Template.DeepCopy()); err != nil {
+				t.Fatal(err)
+			}
+			u := resource.Status.Upgrade
+			if c.phase == "" {
+				if u != nil {
+					t.Fatalf("upgrade is not finished: %+v", u)
+				}
+				if resource.Status.LastGoodRevision != templateRevision(&daemonset.Spec.Template) {
+					t.Errorf("last good revision is %q", resource.Status.LastGoodRevision)
+				}
+				return
+			}
+			if u == nil || u.Phase != c.phase || !strings.Contains(u.Message, c.message) {
+				t.Errorf("upgrade is %+v, want %s: %q", u, c.phase, c.message)
+			}
+		})
+	}
+}
+
+func TestRollback(t *testing.T) {
+	t.Run("restores the last good template", func(t *testing.T) {
+		r := testReconciler(t)
+		resource := canaryResource()
+		resource.Status.LastGoodTemplate = &runtime.RawExtension{Raw: lastGood}
+		resource.Status.LastGoodRevision = "rev1"
+		resource.Status.Upgrade = &installerv1alpha1.UpgradeStatus{Revision: "rev2", Phase: installerv1alpha1.UpgradePhaseCanary}
+
+		result := r.rollback(resource, "broken")
+		// The last good template keeps serving, so steps depending on the DaemonSet are not blocked.
+		if result.waiting || result.failed {
+			t.Errorf("result is %+v", result)
+		}
+		if !strings.Contains(<-r.Recorder.(*record.FakeRecorder).Events, "UpgradeFailed") ||
+			!strings.Contains(<-r.Recorder.(*record.FakeRecorder).Events, "RolledBack") {
+			t.Error("events are not recorded")
+		}
+
+		daemonset := canaryDaemonset("2")
+		r.restoreLastGood(resource, daemonset)
+		if image := daemonset.Spec.Template.Spec.Containers[0].Image; image != "webhook:v1" {
+			t.Errorf("image is %s", image)
+		}
+		if daemonset.Spec.UpdateStrategy.Type != "" {
+			t.Errorf("strategy is %s", daemonset.Spec.UpdateStrategy.Type)
+		}
+	})
+
+	t.Run("keeps the new template on canary nodes without the last good template", func(t *testing.T) {
+		r := testReconciler(t)
+		resource := canaryResource()
+		resource.Status.Upgrade = &installerv1alpha1.UpgradeStatus{Revision: "rev2", Phase: installerv1alpha1.UpgradePhaseCanary}
+
+		r.rollback(resource, "broken")
+		<-r.Recorder.(*record.FakeRecorder).Events
+		if event := <-r.Recorder.(*record.FakeRecorder).Events; !strings.Contains(event, "RollbackUnavailable") {
+			t.Errorf("event is %s", event)
+		}
+
+		daemonset := canaryDaemonset("2")
+		r.restoreLastGood(resource, daemonset)
+		if image := daemonset.Spec.Template.Spec.Containers[0].Image; image != "webhook:v2" {
+			t.Errorf("image is %s", image)
+		}
+		if daemonset.Spec.UpdateStrategy.Type != appsv1.OnDeleteDaemonSetStrategyType {
+			t.Errorf("strategy is %s", daemonset.Spec.UpdateStrategy.Type)
+		}
+	})
+}
+
+func TestRecordLastGood(t *testing.T) {
+	rolledOutStatus := appsv1.DaemonSetStatus{
+		ObservedGeneration:     5,
+		DesiredNumberScheduled: 1,
+		UpdatedNumberScheduled: 1,
+		NumberReady:            1,
+	}
+	other := canaryDaemonset("2").Spec.Template.DeepCopy()
+	other.Spec.Containers[0].Image = "webhook:v3"
+
+	cases := []struct {
+		name     string
+		desired  *corev1.PodTemplateSpec
+		status   appsv1.DaemonSetStatus
+		recorded bool
+	}{
+		{
+			name:     "rolled out",
+			desired:  canaryDaemonset("2").Spec.Template.DeepCopy(),
+			status:   rolledOutStatus,
+			recorded: true,
+		},
+		{
+			name:    "not rolled out",
+			desired: canaryDaemonset("2").Spec.Template.DeepCopy(),
+			status:  appsv1.DaemonSetStatus{ObservedGeneration: 5, DesiredNumberScheduled: 1, NumberReady: 1},
+		},
+		{
+			name:    "template is not applied",
+			desired: other,
+			status:  rolledOutStatus,
+		},
+		{
+			name:   "without desired template",
+			status: rolledOutStatus,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := testReconciler(t)
+			resource := canaryResource()
+			daemonset := canaryDaemonset("2")
+			daemonset.Status = c.status
+
+			if err := r.recordLastGood(resource, daemonset, c.desired); err != nil {
+				t.Fatal(err)
+			}
+			if recorded := resource.Status.LastGoodTemplate != nil; recorded != c.recorded {
+				t.Fatalf("recorded is %v, want %v", recorded, c.recorded)
+			}
+			if !c.recorded {
+				return
+			}
+			if resource.Status.LastGoodRevision != templateRevision(c.desired) {
+				t.Errorf("revision is %s", resource.Status.LastGoodRevision)
+			}
+			template := corev1.PodTemplateSpec{}
+			if err := json.Unmarshal(resource.Status.LastGoodTemplate.Raw, &template); err != nil {
+				t.Fatal(err)
+			}
+			if template.Spec.Containers[0].Image != "webhook:v2" {
+				t.Errorf("template is %+v", template)
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package ekspodidentitywebhook
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"sort"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	installerv1alpha1 "github.com/h3poteto/eks-pod-identity-webhook-installer/api/v1alpha1"
+	"github.com/h3poteto/eks-pod-identity-webhook-installer/pkg/generator"
+)
+
+// syncWorkloadStatus summarizes the DaemonSet and its pods into status.workload.
+func (r *EKSPodIdentityWebhookReconciler) syncWorkloadStatus(ctx context.Context, resource *installerv1alpha1.EKSPodIdentityWebhook, daemonset *appsv1.DaemonSet) error {
+	s := daemonset.Status
+	workload := &installerv1alpha1.WorkloadStatus{
+		Kind:          "DaemonSet",
+		Desired:       s.DesiredNumberScheduled,
+		ReadyReplicas: s.NumberReady,
+		Updated:       s.UpdatedNumberScheduled,
+		Unavailable:   s.NumberUnavailable,
+		Ready:         fmt.Sprintf("%d/%d", s.NumberReady, s.DesiredNumberScheduled),
+		Version:       imageVersion(webhookContainer(&daemonset.Spec.Template.Spec).Image),
+	}
+
+	pods, err := r.webhookPods(ctx, daemonset)
+	if err != nil {
+		return err
+	}
+	digests := map[string]bool{}
+	for i := range pods {
+		pod := &pods[i]
+		for _, c := range pod.Status.ContainerStatuses {
+			if c.Name == generator.DaemonsetName && c.ImageID != "" {
+				digests[imageDigest(c.ImageID)] = true
+			}
+		}
+		if health := podHealth(pod); health != nil {
+			workload.NotReadyPods = append(workload.NotReadyPods, *health)
+		}
+	}
+	for d := range digests {
+		workload.ImageDigests = append(workload.ImageDigests, d)
+	}
+	sort.Strings(workload.ImageDigests)
+	sort.Slice(workload.NotReadyPods, func(i, j int) bool {
+		return workload.NotReadyPods[i].Pod < workload.NotReadyPods[j].Pod
+	})
+
+	expiry, err := r.certificateExpiry(ctx, resource)
+	if err != nil {
+		return err
+	}
+	workload.CertificateExpiry = expiry
+	resource.Status.Workload = workload
+	return nil
+}
+
+// webhookPods lists pods of the DaemonSet. They are read from the API server, so that the installer does not cache every pod in the cluster.
+func (r *EKSPodIdentityWebhookReconciler) webhookPods(ctx context.Context, daemonset *appsv1.DaemonSet) ([]corev1.Pod, error) {
+	if daemonset.Spec.Selector == nil {
+		return nil, nil
+	}
+	pods := corev1.PodList{}
+	if err := r.reader().List(ctx, &pods, client.InNamespace(daemonset.Namespace), client.MatchingLabels(daemonset.Spec.Selector.MatchLabels)); err != nil {
+		r.Logger.Error(err, "Failed to list pods", "Namespace", daemonset.Namespace)
+		return nil, err
+	}
+	return pods.Items, nil
+}
+
+// certificateExpiry returns when the serving certificate expires, or nil when it is not issued yet.
+func (r *EKSPodIdentityWebhookReconciler) certificateExpiry(ctx context.Context, resource *installerv1alpha1.EKSPodIdentityWebhook) (*metav1.Time, error) {
+	name := generator.SecretName
+	if generator.UsesURL(resource) {
+		name = resource.Spec.Network.TLSSecretName
+	}
+	secret := corev1.Secret{}
+	err := r.Client.Get(ctx, types.NamespacedName{Namespace: resource.Spec.Namespace, Name: name}, &secret)
+	if kerrors.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		r.Logger.Error(err, "Failed to get secret", "Namespace", resource.Spec.Namespace, "Name", name)
+		return nil, err
+	}
+	block, _ := pem.Decode(secret.Data[corev1.TLSCertKey])
+	if block == nil {
+		return nil, nil
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		r.Logger.Info("Serving certificate is invalid", "Namespace", secret.Namespace, "Name", secret.Name, "error", err)
+		return nil, nil
+	}
+	expiry := metav1.NewTime(cert.NotAfter)
+	return &expiry, nil
+}
+
+// podHealth returns why the pod is not ready, or nil when it is ready.
+func podHealth(pod *corev1.Pod) *installerv1alpha1.PodHealth {
+	for _, c := range pod.Status.Conditions {
+		if c.Type == corev1.PodReady && c.Status == corev1.ConditionTrue {
+			return nil
+		}
+	}
+	health := &installerv1alpha1.PodHealth{
+		Node:   pod.Spec.NodeName,
+		Pod:    pod.Name,
+		Reason: string(pod.Status.Phase),
+	}
+	for _, c := range pod.Status.ContainerStatuses {
+		if c.Name != generator.DaemonsetName {
+			continue
+		}
+		switch {
+		case c.State.Waiting != nil:
+			health.Reason = c.State.Waiting.Reason
+			health.Message = c.State.Waiting.Message
+		case c.State.Terminated != nil:
+			health.Reason = c.State.Terminated.Reason
+			health.Message = c.State.Terminated.Message
+		case c.State.Running != nil && !c.Ready:
+			health.Reason = "NotReady"
+			health.Message = "readiness probe is failing"
+		}
+	}
+	return health
+}
+
+// webhookContainer returns the webhook container in the pod spec.
+func webhookContainer(spec *corev1.PodSpec) *corev1.Container {
+	for i := range spec.Containers {
+		if spec.Containers[i].Name == generator.DaemonsetName {
+			return &spec.Containers[i]
+		}
+	}
+	return &corev1.Container{}
+}
+
+// imageVersion returns the tag or the digest of the image.
+func imageVersion(image string) string {
+	if i := strings.Index(image, "@"); i >= 0 {
+		return image[i+1:]
+	}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		return image[i+1:]
+	}
+	return "latest"
+}
+
+// imageDigest trims the scheme of a container runtime from an image ID, e.g. docker-pullable://.
+func imageDigest(imageID string) string {
+	if i := strings.Index(imageID, "://"); i >= 0 {
+		return imageID[i+3:]
+	}
+	return imageID
+}
@@ -0,0 +1,188 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		spec    string
+		wantErr bool
+	}{
+		{spec: "* * * * *"},
+		{spec: "*/15 0-6,22-23 * * 1-5"},
+		{spec: "0 0 1 jan,JUL *"},
+		{spec: "5/20 * * * SUN"},
+		{spec: "0 0 * * 7"},
+		{spec: "  @weekly "},
+		{spec: "* * * *", wantErr: true},
+		{spec: "* * * * * *", wantErr: true},
+		{spec: "60 * * * *", wantErr: true},
+		{spec: "* 24 * * *", wantErr: true},
+		{spec: "* * 0 * *", wantErr: true},
+		{spec: "* * * 13 *", wantErr: true},
+		{spec: "* * * * 8", wantErr: true},
+		{spec: "5-1 * * * *", wantErr: true},
+		{spec: "* * * * MON-SUN", wantErr: true},
+		{spec: "*/0 * * * *", wantErr: true},
+		{spec: "*/x * * * *", wantErr: true},
+		{spec: "a * * * *", wantErr: true},
+		{spec: "1,,2 * * * *", wantErr: true},
+		{spec: "@every 1h", wantErr: true},
+	}
+	for _, c := range cases {
+		_, err := Parse(c.spec)
+		if c.wantErr && err == nil {
+			t.Errorf("%q: expected an error", c.spec)
+		}
+		if !c.wantErr && err != nil {
+			t.Errorf("%q: %v", c.spec, err)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	utc := func(s string) time.Time {
+		v, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	local := func(s string) time.Time {
+		return utc(s).In(newYork)
+	}
+
+	cases := []struct {
+		name string
+		spec string
+		from time.Time
+		// want are successive times when the schedule fires.
+		want []time.Time
+	}{
+		{
+			name: "steps",
+			spec: "*/15 * * * *",
+			from: utc("2021-01-01T00:07:00Z"),
+			want: []time.Time{utc("2021-01-01T00:15:00Z"), utc("2021-01-01T00:30:00Z"), utc("2021-01-01T00:45:00Z"), utc("2021-01-01T01:00:00Z")},
+		},
+		{
+			name: "step from a value",
+			spec: "5/20 * * * *",
+			from: utc("2021-01-01T10:00:00Z"),
+			want: []time.Time{utc("2021-01-01T10:05:00Z"), utc("2021-01-01T10:25:00Z"), utc("2021-01-01T10:45:00Z"), utc("2021-01-01T11:05:00Z")},
+		},
+		{
+			name: "next is after from",
+			spec: "0 0 * * *",
+			from: utc("2021-01-01T00:00:00Z"),
+			want: []time.Time{utc("2021-01-02T00:00:00Z")},
+		},
+		{
+			name: "seconds are truncated",
+			spec: "* * * * *",
+			from: utc("2021-01-01T00:00:30Z"),
+			want: []time.Time{utc("2021-01-01T00:01:00Z"), utc("2021-01-01T00:02:00Z")},
+		},
+		{
+			// 2021-01-01 is Friday.
+			name: "weekdays",
+			spec: "0 2 * * 1-5",
+			from: utc("2021-01-01T03:00:00Z"),
+			want: []time.Time{utc("2021-01-04T02:00:00Z"), utc("2021-01-05T02:00:00Z")},
+		},
+		{
+			name: "7 is Sunday",
+			spec: "0 0 * * 7",
+			from: utc("2021-01-01T00:00:00Z"),
+			want: []time.Time{utc("2021-01-03T00:00:00Z"), utc("2021-01-10T00:00:00Z")},
+		},
+		{
+			name: "month names",
+			spec: "0 0 1 JAN,jul *",
+			from: utc("2021-02-10T00:00:00Z"),
+			want: []time.Time{utc("2021-07-01T00:00:00Z"), utc("2022-01-01T00:00:00Z")},
+		},
+		{
+			name: "day-of-month or day-of-week",
+			spec: "0 0 13 * FRI",
+			from: utc("2021-01-01T00:00:00Z"),
+			want: []time.Time{utc("2021-01-08T00:00:00Z"), utc("2021-01-13T00:00:00Z"), utc("2021-01-15T00:00:00Z")},
+		},
+		{
+			name: "day-of-month and restricted day-of-week with *",
+			spec: "0 0 */10 * MON",
+			from: utc("2021-01-01T00:00:00Z"),
+			want: []time.Time{utc("2021-01-11T00:00:00Z"), utc("2021-02-01T00:00:00Z")},
+		},
+		{
+			name: "macro",
+			spec: "@yearly",
+			from: utc("2021-06-01T00:00:00Z"),
+			want: []time.Time{utc("2022-01-01T00:00:00Z")},
+		},
+		{
+			name: "February 29",
+			spec: "0 0 29 2 *",
+			from: utc("2021-01-01T00:00:00Z"),
+			want: []time.Time{utc("2024-02-29T00:00:00Z")},
+		},
+		{
+			name: "never",
+			spec: "0 0 30 2 *",
+			from: utc("2021-01-01T00:00:00Z"),
+			want: []time.Time{{}},
+		},
+		{
+			name: "in the location of from",
+			spec: "0 2 * * *",
+			from: local("2021-01-01T12:00:00Z"),
+			want: []time.Time{utc("2021-01-02T07:00:00Z"), utc("2021-01-03T07:00:00Z")},
+		},
+		{
+			// 2:00 EST is 3:00 EDT on 2021-03-14, so 2:30 does not exist that day.
+			name: "hour skipped by daylight saving time",
+			spec: "30 2 * * *",
+			from: local("2021-03-13T08:00:00Z"),
+			want: []time.Time{utc("2021-03-15T06:30:00Z"), utc("2021-03-16T06:30:00Z")},
+		},
+		{
+			name: "hourly across the start of daylight saving time",
+			spec: "0 * * * *",
+			from: local("2021-03-14T06:30:00Z"),
+			// 1:00 EST, then 3:00 EDT.
+			want: []time.Time{utc("2021-03-14T07:00:00Z"), utc("2021-03-14T08:00:00Z")},
+		},
+		{
+			// 2:00 EDT is 1:00 EST on 2021-11-07, so 1:30 comes twice.
+			name: "hour repeated by daylight saving time",
+			spec: "30 1 * * *",
+			from: local("2021-11-07T04:00:00Z"),
+			want: []time.Time{utc("2021-11-07T05:30:00Z"), utc("2021-11-07T06:30:00Z"), utc("2021-11-08T06:30:00Z")},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s, err := Parse(c.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			from := c.from
+			for i, want := range c.want {
+				got := s.Next(from)
+				if !got.Equal(want) {
+					t.Fatalf("fire %d after %s is %s, want %s", i, from, got, want.In(from.Location()))
+				}
+				if !got.IsZero() && got.Location() != c.from.Location() {
+					t.Errorf("location is %s, want %s", got.Location(), c.from.Location())
+				}
+				from = got
+			}
+		})
+	}
+}
@@ -0,0 +1,559 @@
+// Package doctor diagnoses an installed pod-identity-webhook by inspecting the objects referenced in EKSPodIdentityWebhook status.
+package doctor
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	certificatesv1 "k8s.io/api/certificates/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	installerv1alpha1 "github.com/h3poteto/eks-pod-identity-webhook-installer/api/v1alpha1"
+	"github.com/h3poteto/eks-pod-identity-webhook-installer/pkg/generator"
+	"github.com/h3poteto/eks-pod-identity-webhook-installer/pkg/profile"
+	"github.com/h3poteto/eks-pod-identity-webhook-installer/pkg/provider"
+)
+
+type Status string
+
+const (
+	StatusPass Status = "pass"
+	StatusWarn Status = "warn"
+	StatusFail Status = "fail"
+
+	OutputText = "text"
+	OutputJSON = "json"
+
+	// certExpiryWarning is how long before expiry we start warning about the serving certificate.
+	certExpiryWarning = 7 * 24 * time.Hour
+	// pendingCSRWarning is how long a CSR can stay pending before we warn.
+	pendingCSRWarning = 5 * time.Minute
+	// podListLimit is the page size of listing pods, so that a namespace with many pods is not read at once to sample a few.
+	podListLimit = 100
+)
+
+// Check is a single diagnosis.
+type Check struct {
+	Name    string `json:"name"`
+	Status  Status `json:"status"`
+	Message string `json:"message"`
+}
+
+// Report is the diagnosis of one EKSPodIdentityWebhook.
+type Report struct {
+	Name   string  `json:"name"`
+	Checks []Check `json:"checks"`
+}
+
+// Failed returns true if any check failed.
+func (r *Report) Failed() bool {
+	for _, c := range r.Checks {
+		if c.Status == StatusFail {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Report) add(name string, status Status, format string, args ...interface{}) {
+	r.Checks = append(r.Checks, Check{Name: name, Status: status, Message: fmt.Sprintf(format, args...)})
+}
+
+// Options are parameters of doctor subcommand.
+type Options struct {
+	Kubeconfig string
+	Name       string
+	Output     string
+	PodSamples int
+}
+
+// Doctor inspects installations in a cluster.
+type Doctor struct {
+	Client     client.Client
+	PodSamples int
+}
+
+// Run parses args of doctor subcommand, diagnoses the cluster and writes the report to out.
+// It returns false when any check failed.
+func Run(args []string, out io.Writer) (bool, error) {
+	opts := Options{}
+	fs := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	fs.StringVar(&opts.Kubeconfig, "kubeconfig", "", "Path to a kubeconfig. Default loading rules are used when it is empty.")
+	fs.StringVar(&opts.Name, "name", "", "Name of EKSPodIdentityWebhook to diagnose. All resources are diagnosed when it is empty.")
+	fs.StringVar(&opts.Output, "o", OutputText, "Output format, text or json.")
+	fs.IntVar(&opts.PodSamples, "pod-samples", 20, "Maximum number of pods which use a role-arn annotated ServiceAccount to inspect.")
+	if err := fs.Parse(args); err != nil {
+		return false, err
+	}
+	if opts.Output != OutputText && opts.Output != OutputJSON {
+		return false, fmt.Errorf("unknown output format %q", opts.Output)
+	}
+
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	loadingRules.ExplicitPath = opts.Kubeconfig
+	cfg, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, &clientcmd.ConfigOverrides{}).ClientConfig()
+	if err != nil {
+		return false, err
+	}
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		return false, err
+	}
+	if err := installerv1alpha1.AddToScheme(scheme); err != nil {
+		return false, err
+	}
+	c, err := client.New(cfg, client.Options{Scheme: scheme})
+	if err != nil {
+		return false, err
+	}
+
+	d := &Doctor{Client: c, PodSamples: opts.PodSamples}
+	reports, err := d.Diagnose(context.Background(), opts.Name)
+	if err != nil {
+		return false, err
+	}
+	if err := write(out, opts.Output, reports); err != nil {
+		return false, err
+	}
+	for _, r := range reports {
+		if r.Failed() {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Diagnose inspects the named EKSPodIdentityWebhook, or all of them when name is empty.
+func (d *Doctor) Diagnose(ctx context.Context, name string) ([]Report, error) {
+	resources := []installerv1alpha1.EKSPodIdentityWebhook{}
+	if name != "" {
+		resource := installerv1alpha1.EKSPodIdentityWebhook{}
+		if err := d.Client.Get(ctx, types.NamespacedName{Name: name}, &resource); err != nil {
+			return nil, err
+		}
+		resources = append(resources, resource)
+	} else {
+		list := installerv1alpha1.EKSPodIdentityWebhookList{}
+		if err := d.Client.List(ctx, &list); err != nil {
+			return nil, err
+		}
+		resources = list.Items
+	}
+	if len(resources) == 0 {
+		return nil, errors.New("no EKSPodIdentityWebhook is found")
+	}
+
+	reports := []Report{}
+	for i := range resources {
+		reports = append(reports, d.diagnose(ctx, &resources[i]))
+	}
+	return reports, nil
+}
+
+// diagnose checks the resource with its profile applied, because the stored spec leaves the fields which the profile fills unset.
+func (d *Doctor) diagnose(ctx context.Context, resource *installerv1alpha1.EKSPodIdentityWebhook) Report {
+	resource = profile.Effective(resource)
+	report := Report{Name: resource.Name}
+	status := resource.Status
+
+	if c := meta.FindStatusCondition(status.Conditions, installerv1alpha1.ConditionPreflightPassed); c == nil {
+		report.add("Preflight", StatusWarn, "preflight checks have not run yet")
+	} else if c.Status != metav1.ConditionTrue {
+		report.add("Preflight", StatusFail, "%s", c.Message)
+	} else {
+		report.add("Preflight", StatusPass, "preflight checks passed")
+	}
+
+	if generator.Embedded(resource) {
+		d.diagnoseEmbedded(ctx, &report, resource)
+		return report
+	}
+
+	d.checkServiceAccount(ctx, &report, status.PodIdentityWebhookServiceAccount)
+	service := d.checkService(ctx, &report, status.PodIdentityWebhookService)
+	d.checkDaemonset(ctx, &report, resource, status.PodIdentityWebhookDaemonset)
+	mutating := d.checkMutatingWebhookConfiguration(ctx, &report, status.PodIdentityWebhookConfiguration, service)
+	d.checkCertificate(ctx, &report, resource, service, mutating)
+	d.checkCSRs(ctx, &report, status.PodIdentityWebhookServiceAccount)
+	d.checkPods(ctx, &report, provider.For(resource), mutating)
+	return report
+}
+
+// diagnoseEmbedded checks the Service of the webhook server of the installer, which the MutatingWebhookConfiguration points at,
+// because there is no DaemonSet nor certificate from CertificateSigningRequest in Embedded implementation.
+func (d *Doctor) diagnoseEmbedded(ctx context.Context, report *Report, resource *installerv1alpha1.EKSPodIdentityWebhook) {
+	mutating := d.checkMutatingWebhookConfiguration(ctx, report, resource.Status.PodIdentityWebhookConfiguration, nil)
+	if mutating != nil && len(mutating.Webhooks) > 0 && mutating.Webhooks[0].ClientConfig.Service != nil {
+		ref := mutating.Webhooks[0].ClientConfig.Service
+		d.checkService(ctx, report, &installerv1alpha1.ServiceRef{Namespace: ref.Namespace, Name: ref.Name})
+	}
+	d.checkPods(ctx, report, provider.For(resource), mutating)
+}
+
+func (d *Doctor) checkServiceAccount(ctx context.Context, report *Report, ref *installerv1alpha1.ServiceAccountRef) {
+	const name = "ServiceAccount"
+	if ref == nil {
+		report.add(name, StatusFail, "status does not reference a ServiceAccount")
+		return
+	}
+	sa := corev1.ServiceAccount{}
+	if err := d.Client.Get(ctx, types.NamespacedName{Namespace: ref.Namespace, Name: ref.Name}, &sa); err != nil {
+		report.add(name, StatusFail, "failed to get %s/%s: %v", ref.Namespace, ref.Name, err)
+		return
+	}
+	report.add(name, StatusPass, "%s/%s exists", ref.Namespace, ref.Name)
+}
+
+func (d *Doctor) checkService(ctx context.Context, report *Report, ref *installerv1alpha1.ServiceRef) *corev1.Service {
+	const name = "Service"
+	if ref == nil {
+		report.add(name, StatusFail, "status does not reference a Service")
+		return nil
+	}
+	service := corev1.Service{}
+	if err := d.Client.Get(ctx, types.NamespacedName{Namespace: ref.Namespace, Name: ref.Name}, &service); err != nil {
+		report.add(name, StatusFail, "failed to get %s/%s: %v", ref.Namespace, ref.Name, err)
+		return nil
+	}
+	endpoints := corev1.Endpoints{}
+	if err := d.Client.Get(ctx, types.NamespacedName{Namespace: ref.Namespace, Name: ref.Name}, &endpoints); err != nil {
+		report.add(name, StatusFail, "failed to get endpoints of %s/%s: %v", ref.Namespace, ref.Name, err)
+		return &service
+	}
+	ready := 0
+	notReady := 0
+	for _, subset := range endpoints.Subsets {
+		ready += len(subset.Addresses)
+		notReady += len(subset.NotReadyAddresses)
+	}
+	if ready == 0 {
+		report.add(name, StatusFail, "%s/%s has no ready endpoints, %d not ready", ref.Namespace, ref.Name, notReady)
+	} else if notReady > 0 {
+		report.add(name, StatusWarn, "%s/%s has %d ready and %d not ready endpoints", ref.Namespace, ref.Name, ready, notReady)
+	} else {
+		report.add(name, StatusPass, "%s/%s has %d ready endpoints", ref.Namespace, ref.Name, ready)
+	}
+	return &service
+}
+
+// checkDaemonset verifies that pods of the DaemonSet are ready and use the host network in HostNetwork mode.
+func (d *Doctor) checkDaemonset(ctx context.Context, report *Report, resource *installerv1alpha1.EKSPodIdentityWebhook, ref *installerv1alpha1.DaemonsetRef) {
+	const name = "DaemonSet"
+	if ref == nil {
+		report.add(name, StatusFail, "status does not reference a DaemonSet")
+		return
+	}
+	daemonset := appsv1.DaemonSet{}
+	if err := d.Client.Get(ctx, types.NamespacedName{Namespace: ref.Namespace, Name: ref.Name}, &daemonset); err != nil {
+		report.add(name, StatusFail, "failed to get %s/%s: %v", ref.Namespace, ref.Name, err)
+		return
+	}
+	hostNetwork := generator.NetworkMode(resource) == installerv1alpha1.NetworkModeHostNetwork
+	if daemonset.Spec.Template.Spec.HostNetwork != hostNetwork {
+		report.add(name, StatusFail, "%s/%s has hostNetwork %v, but network mode is %s", ref.Namespace, ref.Name, daemonset.Spec.Template.Spec.HostNetwork, generator.NetworkMode(resource))
+		return
+	}
+	s := daemonset.Status
+	switch {
+	case s.NumberReady == 0:
+		report.add(name, StatusFail, "%s/%s has no ready pods, %d desired", ref.Namespace, ref.Name, s.DesiredNumberScheduled)
+	case s.NumberReady < s.DesiredNumberScheduled:
+		report.add(name, StatusWarn, "%s/%s has %d/%d ready pods", ref.Namespace, ref.Name, s.NumberReady, s.DesiredNumberScheduled)
+	default:
+		report.add(name, StatusPass, "%s/%s has %d/%d ready pods", ref.Namespace, ref.Name, s.NumberReady, s.DesiredNumberScheduled)
+	}
+}
+
+func (d *Doctor) checkMutatingWebhookConfiguration(
+	ctx context.Context,
+	report *Report,
+	ref *installerv1alpha1.MutatingWebhookConfigurationRef,
+	service *corev1.Service,
+) *admissionregistrationv1.MutatingWebhookConfiguration {
+	const name = "MutatingWebhookConfiguration"
+	if ref == nil {
+		report.add(name, StatusFail, "status does not reference a MutatingWebhookConfiguration")
+		return nil
+	}
+	mutating := admissionregistrationv1.MutatingWebhookConfiguration{}
+	if err := d.Client.Get(ctx, types.NamespacedName{Name: ref.Name}, &mutating); err != nil {
+		report.add(name, StatusFail, "failed to get %s: %v", ref.Name, err)
+		return nil
+	}
+	if len(mutating.Webhooks) == 0 {
+		report.add(name, StatusFail, "%s has no webhooks", ref.Name)
+		return &mutating
+	}
+	for _, w := range mutating.Webhooks {
+		if len(w.ClientConfig.CABundle) == 0 {
+			report.add(name, StatusFail, "webhook %s has empty caBundle", w.Name)
+			return &mutating
+		}
+		if service != nil && w.ClientConfig.Service != nil &&
+			(w.ClientConfig.Service.Namespace != service.Namespace || w.ClientConfig.Service.Name != service.Name) {
+			report.add(name, StatusFail, "webhook %s points to %s/%s instead of %s/%s", w.Name, w.ClientConfig.Service.Namespace, w.ClientConfig.Service.Name, service.Namespace, service.Name)
+			return &mutating
+		}
+	}
+	report.add(name, StatusPass, "%s has %d webhooks with caBundle", ref.Name, len(mutating.Webhooks))
+	return &mutating
+}
+
+// checkCertificate verifies the serving certificate against caBundle. In NodePort and URL modes, the certificate is
+// spec.network.tlsSecretName and it must cover the host of spec.network.url instead of the DNS name of the Service.
+func (d *Doctor) checkCertificate(
+	ctx context.Context,
+	report *Report,
+	resource *installerv1alpha1.EKSPodIdentityWebhook,
+	service *corev1.Service,
+	mutating *admissionregistrationv1.MutatingWebhookConfiguration,
+) {
+	const name = "Certificate"
+	namespace := resource.Spec.Namespace
+	secretName := generator.SecretName
+	dnsName := ""
+	if service != nil {
+		dnsName = service.Name + "." + service.Namespace + ".svc"
+	}
+	if generator.UsesURL(resource) {
+		secretName = resource.Spec.Network.TLSSecretName
+		u, err := url.Parse(resource.Spec.Network.URL)
+		if err != nil || u.Hostname() == "" {
+			report.add(name, StatusFail, "spec.network.url %s is not a valid URL", resource.Spec.Network.URL)
+			return
+		}
+		dnsName = u.Hostname()
+	}
+
+	secret := corev1.Secret{}
+	if err := d.Client.Get(ctx, types.NamespacedName{Namespace: namespace, Name: secretName}, &secret); err != nil {
+		report.add(name, StatusFail, "failed to get TLS secret %s/%s: %v", namespace, secretName, err)
+		return
+	}
+	cert, err := parseCertificate(secret.Data[corev1.TLSCertKey])
+	if err != nil {
+		report.add(name, StatusFail, "TLS secret %s/%s has invalid %s: %v", namespace, secretName, corev1.TLSCertKey, err)
+		return
+	}
+	now := time.Now()
+	if now.After(cert.NotAfter) {
+		report.add(name, StatusFail, "serving certificate expired at %s", cert.NotAfter.Format(time.RFC3339))
+		return
+	}
+	if now.Before(cert.NotBefore) {
+		report.add(name, StatusFail, "serving certificate is not valid before %s", cert.NotBefore.Format(time.RFC3339))
+		return
+	}
+	if mutating == nil || len(mutating.Webhooks) == 0 {
+		report.add(name, StatusWarn, "serving certificate is valid until %s, but there is no caBundle to verify it", cert.NotAfter.Format(time.RFC3339))
+		return
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(mutating.Webhooks[0].ClientConfig.CABundle) {
+		report.add(name, StatusFail, "caBundle of %s has no valid certificate", mutating.Name)
+		return
+	}
+	opts := x509.VerifyOptions{
+		Roots:       pool,
+		CurrentTime: now,
+		KeyUsages:   []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSName:     dnsName,
+	}
+	if _, err := cert.Verify(opts); err != nil {
+		report.add(name, StatusFail, "serving certificate is not trusted by caBundle of %s: %v", mutating.Name, err)
+		return
+	}
+	if cert.NotAfter.Sub(now) < certExpiryWarning {
+		report.add(name, StatusWarn, "serving certificate expires soon at %s", cert.NotAfter.Format(time.RFC3339))
+		return
+	}
+	report.add(name, StatusPass, "serving certificate is trusted by caBundle and valid until %s", cert.NotAfter.Format(time.RFC3339))
+}
+
+func (d *Doctor) checkCSRs(ctx context.Context, report *Report, ref *installerv1alpha1.ServiceAccountRef) {
+	const name = "CertificateSigningRequest"
+	if ref == nil {
+		return
+	}
+	username := "system:serviceaccount:" + ref.Namespace + ":" + ref.Name
+	list := certificatesv1.CertificateSigningRequestList{}
+	if err := d.Client.List(ctx, &list); err != nil {
+		report.add(name, StatusWarn, "failed to list CertificateSigningRequests: %v", err)
+		return
+	}
+	csrs := []certificatesv1.CertificateSigningRequest{}
+	for _, csr := range list.Items {
+		if csr.Spec.Username == username {
+			csrs = append(csrs, csr)
+		}
+	}
+	if len(csrs) == 0 {
+		report.add(name, StatusPass, "no CertificateSigningRequests from %s", username)
+		return
+	}
+	sort.Slice(csrs, func(i, j int) bool {
+		return csrs[i].CreationTimestamp.Before(&csrs[j].CreationTimestamp)
+	})
+
+	now := time.Now()
+	problems := 0
+	for i, csr := range csrs {
+		latest := i == len(csrs)-1
+		switch csrState(&csr) {
+		case certificatesv1.CertificateDenied, certificatesv1.CertificateFailed:
+			problems++
+			status := StatusWarn
+			if latest {
+				status = StatusFail
+			}
+			report.add(name, status, "%s is %s", csr.Name, csrState(&csr))
+		case "":
+			if now.Sub(csr.CreationTimestamp.Time) > pendingCSRWarning {
+				problems++
+				report.add(name, StatusWarn, "%s has been pending since %s", csr.Name, csr.CreationTimestamp.Format(time.RFC3339))
+			}
+		}
+	}
+	if problems == 0 {
+		report.add(name, StatusPass, "%d CertificateSigningRequests from %s are approved", len(csrs), username)
+	}
+}
+
+func (d *Doctor) checkPods(ctx context.Context, report *Report, p provider.Provider, mutating *admissionregistrationv1.MutatingWebhookConfiguration) {
+	const name = "PodMutation"
+	serviceAccounts := corev1.ServiceAccountList{}
+	if err := d.Client.List(ctx, &serviceAccounts); err != nil {
+		report.add(name, StatusWarn, "failed to list ServiceAccounts: %v", err)
+		return
+	}
+	annotated := map[string]bool{}
+	namespaces := map[string]bool{}
+	for _, sa := range serviceAccounts.Items {
+		if p.Injects(&sa) {
+			annotated[sa.Namespace+"/"+sa.Name] = true
+			namespaces[sa.Namespace] = true
+		}
+	}
+	if len(annotated) == 0 {
+		report.add(name, StatusPass, "no ServiceAccounts are mutated by %s provider", p.Name())
+		return
+	}
+
+	sampled := 0
+	unmutated := []string{}
+	stale := []string{}
+	for _, ns := range sortedKeys(namespaces) {
+		// Pods are listed page by page until enough pods are sampled.
+		continueToken := ""
+		for sampled < d.PodSamples {
+			pods := corev1.PodList{}
+			if err := d.Client.List(ctx, &pods, client.InNamespace(ns), client.Limit(podListLimit), client.Continue(continueToken)); err != nil {
+				report.add(name, StatusWarn, "failed to list pods in %s: %v", ns, err)
+				break
+			}
+			for _, pod := range pods.Items {
+				if sampled >= d.PodSamples {
+					break
+				}
+				if !annotated[pod.Namespace+"/"+pod.Spec.ServiceAccountName] {
+					continue
+				}
+				sampled++
+				if p.Mutated(&pod) {
+					continue
+				}
+				// Pods created before the webhook existed are never mutated, so they only need a restart.
+				if mutating != nil && pod.CreationTimestamp.Before(&mutating.CreationTimestamp) {
+					stale = append(stale, pod.Namespace+"/"+pod.Name)
+				} else {
+					unmutated = append(unmutated, pod.Namespace+"/"+pod.Name)
+				}
+			}
+			continueToken = pods.Continue
+			if continueToken == "" {
+				break
+			}
+		}
+	}
+
+	switch {
+	case len(unmutated) > 0:
+		report.add(name, StatusFail, "%d/%d sampled pods are not mutated: %s", len(unmutated), sampled, strings.Join(unmutated, ", "))
+	case len(stale) > 0:
+		report.add(name, StatusWarn, "%d/%d sampled pods were created before the webhook and need a restart: %s", len(stale), sampled, strings.Join(stale, ", "))
+	default:
+		report.add(name, StatusPass, "%d sampled pods are mutated", sampled)
+	}
+}
+
+func parseCertificate(data []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func csrState(csr *certificatesv1.CertificateSigningRequest) certificatesv1.RequestConditionType {
+	for _, c := range csr.Status.Conditions {
+		switch c.Type {
+		case certificatesv1.CertificateApproved, certificatesv1.CertificateDenied, certificatesv1.CertificateFailed:
+			if c.Status == corev1.ConditionFalse {
+				continue
+			}
+			if c.Type == certificatesv1.CertificateApproved && len(csr.Status.Certificate) == 0 {
+				// Approved but not issued yet.
+				continue
+			}
+			return c.Type
+		}
+	}
+	return ""
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func write(out io.Writer, output string, reports []Report) error {
+	if output == OutputJSON {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(reports)
+	}
+	for _, r := range reports {
+		if _, err := fmt.Fprintf(out, "EKSPodIdentityWebhook %s\n", r.Name); err != nil {
+			return err
+		}
+		for _, c := range r.Checks {
+			if _, err := fmt.Fprintf(out, "  [%s] %s: %s\n", strings.ToUpper(string(c.Status)), c.Name, c.Message); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
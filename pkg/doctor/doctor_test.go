@@ -0,0 +1,467 @@
+package doctor
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	certificatesv1 "k8s.io/api/certificates/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	installerv1alpha1 "github.com/h3poteto/eks-pod-identity-webhook-installer/api/v1alpha1"
+	"github.com/h3poteto/eks-pod-identity-webhook-installer/pkg/generator"
+	"github.com/h3poteto/eks-pod-identity-webhook-installer/pkg/provider"
+)
+
+func testClient(t *testing.T, objects ...client.Object) client.Client {
+	t.Helper()
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	return fake.NewClientBuilder().WithScheme(scheme).WithObjects(objects...).Build()
+}
+
+// issue returns a CA certificate and a serving certificate for dnsName which the CA signs, in PEM.
+func issue(t *testing.T, dnsName string) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(365 * 24 * time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serving := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: dnsName},
+		DNSNames:     []string{dnsName},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	servingDER, err := x509.CreateCertificate(rand.Reader, serving, ca, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: servingDER})
+}
+
+func TestCheckCertificate(t *testing.T) {
+	service := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: generator.ServiceName}}
+	serviceDNS := generator.ServiceName + ".kube-system.svc"
+
+	cases := []struct {
+		name       string
+		network    installerv1alpha1.NetworkConfig
+		secretName string
+		dnsName    string
+		want       Status
+	}{
+		{
+			name:       "Service mode",
+			secretName: generator.SecretName,
+			dnsName:    serviceDNS,
+			want:       StatusPass,
+		},
+		{
+			name:       "HostNetwork mode",
+			network:    installerv1alpha1.NetworkConfig{Mode: installerv1alpha1.NetworkModeHostNetwork},
+			secretName: generator.SecretName,
+			dnsName:    serviceDNS,
+			want:       StatusPass,
+		},
+		{
+			name:       "URL mode",
+			network:    installerv1alpha1.NetworkConfig{Mode: installerv1alpha1.NetworkModeURL, URL: "https://webhook.example.com:8443/mutate", TLSSecretName: "custom-tls"},
+			secretName: "custom-tls",
+			dnsName:    "webhook.example.com",
+			want:       StatusPass,
+		},
+		{
+			name:       "NodePort mode",
+			network:    installerv1alpha1.NetworkConfig{Mode: installerv1alpha1.NetworkModeNodePort, URL: "https://node.example.com:30443/mutate", TLSSecretName: "custom-tls"},
+			secretName: "custom-tls",
+			dnsName:    "node.example.com",
+			want:       StatusPass,
+		},
+		{
+			name:       "URL mode with a certificate of the Service",
+			network:    installerv1alpha1.NetworkConfig{Mode: installerv1alpha1.NetworkModeURL, URL: "https://webhook.example.com/mutate", TLSSecretName: "custom-tls"},
+			secretName: "custom-tls",
+			dnsName:    serviceDNS,
+			want:       StatusFail,
+		},
+		{
+			name:       "URL mode does not read the generated secret",
+			network:    installerv1alpha1.NetworkConfig{Mode: installerv1alpha1.NetworkModeURL, URL: "https://webhook.example.com/mutate", TLSSecretName: "custom-tls"},
+			secretName: generator.SecretName,
+			dnsName:    "webhook.example.com",
+			want:       StatusFail,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ca, cert := issue(t, c.dnsName)
+			secret := &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: c.secretName},
+				Data:       map[string][]byte{corev1.TLSCertKey: cert},
+			}
+			mutating := &admissionregistrationv1.MutatingWebhookConfiguration{
+				ObjectMeta: metav1.ObjectMeta{Name: "pod-identity-webhook"},
+				Webhooks: []admissionregistrationv1.MutatingWebhook{{
+					Name:         "pod-identity-webhook.amazonaws.com",
+					ClientConfig: admissionregistrationv1.WebhookClientConfig{CABundle: ca},
+				}},
+			}
+			resource := &installerv1alpha1.EKSPodIdentityWebhook{
+				ObjectMeta: metav1.ObjectMeta{Name: "cluster"},
+				Spec:       installerv1alpha1.EKSPodIdentityWebhookSpec{Namespace: "kube-system", Network: c.network},
+			}
+
+			scheme := runtime.NewScheme()
+			if err := clientgoscheme.AddToScheme(scheme); err != nil {
+				t.Fatal(err)
+			}
+			d := &Doctor{Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(secret).Build()}
+			report := &Report{}
+			d.checkCertificate(context.Background(), report, resource, service, mutating)
+			if len(report.Checks) != 1 {
+				t.Fatalf("checks are %+v", report.Checks)
+			}
+			if got := report.Checks[0]; got.Status != c.want {
+				t.Errorf("status is %s, want %s: %s", got.Status, c.want, got.Message)
+			}
+		})
+	}
+}
+
+func TestDiagnoseDaemonsetNetworkMode(t *testing.T) {
+	cases := []struct {
+		name        string
+		spec        installerv1alpha1.EKSPodIdentityWebhookSpec
+		status      *installerv1alpha1.ProfileStatus
+		hostNetwork bool
+		want        Status
+	}{
+		{name: "Service mode", hostNetwork: false, want: StatusPass},
+		{name: "Service mode with host network", hostNetwork: true, want: StatusFail},
+		{
+			name:        "HostNetwork mode",
+			spec:        installerv1alpha1.EKSPodIdentityWebhookSpec{Network: installerv1alpha1.NetworkConfig{Mode: installerv1alpha1.NetworkModeHostNetwork}},
+			hostNetwork: true,
+			want:        StatusPass,
+		},
+		{
+			name:        "k3s profile",
+			spec:        installerv1alpha1.EKSPodIdentityWebhookSpec{Profile: installerv1alpha1.ProfileK3s},
+			hostNetwork: true,
+			want:        StatusPass,
+		},
+		{
+			name:        "k3s profile without host network",
+			spec:        installerv1alpha1.EKSPodIdentityWebhookSpec{Profile: installerv1alpha1.ProfileK3s},
+			hostNetwork: false,
+			want:        StatusFail,
+		},
+		{
+			name:        "auto detected k3s",
+			spec:        installerv1alpha1.EKSPodIdentityWebhookSpec{Profile: installerv1alpha1.ProfileAuto},
+			status:      &installerv1alpha1.ProfileStatus{Name: installerv1alpha1.ProfileK3s},
+			hostNetwork: true,
+			want:        StatusPass,
+		},
+		{
+			name:        "the spec is preferred over the profile",
+			spec:        installerv1alpha1.EKSPodIdentityWebhookSpec{Profile: installerv1alpha1.ProfileK3s, Network: installerv1alpha1.NetworkConfig{Mode: installerv1alpha1.NetworkModeService}},
+			hostNetwork: false,
+			want:        StatusPass,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			daemonset := &appsv1.DaemonSet{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "pod-identity-webhook"},
+				Status:     appsv1.DaemonSetStatus{DesiredNumberScheduled: 1, NumberReady: 1},
+			}
+			daemonset.Spec.Template.Spec.HostNetwork = c.hostNetwork
+			resource := &installerv1alpha1.EKSPodIdentityWebhook{
+				ObjectMeta: metav1.ObjectMeta{Name: "cluster"},
+				Spec:       c.spec,
+				Status: installerv1alpha1.EKSPodIdentityWebhookStatus{
+					Profile:                     c.status,
+					PodIdentityWebhookDaemonset: &installerv1alpha1.DaemonsetRef{Namespace: daemonset.Namespace, Name: daemonset.Name},
+				},
+			}
+			resource.Spec.Namespace = "kube-system"
+
+			scheme := runtime.NewScheme()
+			if err := clientgoscheme.AddToScheme(scheme); err != nil {
+				t.Fatal(err)
+			}
+			d := &Doctor{Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(daemonset).Build()}
+			report := d.diagnose(context.Background(), resource)
+			if resource.Spec.Network.Mode != c.spec.Network.Mode {
+				t.Errorf("the stored spec is changed to %s", resource.Spec.Network.Mode)
+			}
+			for _, check := range report.Checks {
+				if check.Name != "DaemonSet" {
+					continue
+				}
+				if check.Status != c.want {
+					t.Errorf("status is %s, want %s: %s", check.Status, c.want, check.Message)
+				}
+				return
+			}
+			t.Fatalf("DaemonSet is not checked: %+v", report.Checks)
+		})
+	}
+}
+
+func TestCheckCSRs(t *testing.T) {
+	ref := &installerv1alpha1.ServiceAccountRef{Namespace: "kube-system", Name: generator.ServiceAccountName}
+	username := "system:serviceaccount:kube-system:" + generator.ServiceAccountName
+	now := time.Now()
+	csr := func(name, user string, created time.Time, condition certificatesv1.RequestConditionType, issued bool) *certificatesv1.CertificateSigningRequest {
+		c := &certificatesv1.CertificateSigningRequest{
+			ObjectMeta: metav1.ObjectMeta{Name: name, CreationTimestamp: metav1.NewTime(created)},
+			Spec:       certificatesv1.CertificateSigningRequestSpec{Username: user},
+		}
+		if condition != "" {
+			c.Status.Conditions = []certificatesv1.CertificateSigningRequestCondition{{Type: condition, Status: corev1.ConditionTrue}}
+		}
+		if issued {
+			c.Status.Certificate = []byte("certificate")
+		}
+		return c
+	}
+	approved := func(name string, created time.Time) *certificatesv1.CertificateSigningRequest {
+		return csr(name, username, created, certificatesv1.CertificateApproved, true)
+	}
+
+	cases := []struct {
+		name    string
+		objects []client.Object
+		want    []Status
+	}{
+		{name: "no CSRs", want: []Status{StatusPass}},
+		{name: "approved", objects: []client.Object{approved("a", now.Add(-time.Hour)), approved("b", now)}, want: []Status{StatusPass}},
+		{
+			name:    "CSRs of others are ignored",
+			objects: []client.Object{csr("other", "system:serviceaccount:default:other", now.Add(-time.Hour), certificatesv1.CertificateDenied, false)},
+			want:    []Status{StatusPass},
+		},
+		{
+			name:    "the latest is denied",
+			objects: []client.Object{approved("a", now.Add(-time.Hour)), csr("b", username, now, certificatesv1.CertificateDenied, false)},
+			want:    []Status{StatusFail},
+		},
+		{
+			// The webhook got a certificate from a later CSR, so an old failure is only a warning.
+			name:    "an old one is failed",
+			objects: []client.Object{csr("a", username, now.Add(-time.Hour), certificatesv1.CertificateFailed, false), approved("b", now)},
+			want:    []Status{StatusWarn},
+		},
+		{
+			name:    "pending for long",
+			objects: []client.Object{csr("a", username, now.Add(-time.Hour), "", false)},
+			want:    []Status{StatusWarn},
+		},
+		{
+			// An approved CSR without a certificate is still pending.
+			name:    "approved but not issued",
+			objects: []client.Object{csr("a", username, now.Add(-time.Hour), certificatesv1.CertificateApproved, false)},
+			want:    []Status{StatusWarn},
+		},
+		{
+			name:    "pending for a while",
+			objects: []client.Object{csr("a", username, now, "", false)},
+			want:    []Status{StatusPass},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			d := &Doctor{Client: testClient(t, c.objects...)}
+			report := &Report{}
+			d.checkCSRs(context.Background(), report, ref)
+			got := []Status{}
+			for _, check := range report.Checks {
+				got = append(got, check.Status)
+			}
+			if len(got) != len(c.want) {
+				t.Fatalf("checks are %+v", report.Checks)
+			}
+			for i := range got {
+				if got[i] != c.want[i] {
+					t.Errorf("status is %s, want %s: %s", got[i], c.want[i], report.Checks[i].Message)
+				}
+			}
+		})
+	}
+}
+
+// pagingClient serves pods in pages of the limit of a list, which the fake client ignores.
+type pagingClient struct {
+	client.Client
+	t *testing.T
+	// lists counts list calls of pods.
+	lists int
+}
+
+func (c *pagingClient) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	pods, ok := list.(*corev1.PodList)
+	if !ok {
+		return c.Client.List(ctx, list, opts...)
+	}
+	c.lists++
+	o := &client.ListOptions{}
+	o.ApplyOptions(opts)
+	if o.Limit == 0 {
+		c.t.Error("pods are listed without limit")
+	}
+	if err := c.Client.List(ctx, pods, opts...); err != nil {
+		return err
+	}
+	offset := 0
+	if o.Continue != "" {
+		offset, _ = strconv.Atoi(o.Continue)
+	}
+	items := pods.Items[offset:]
+	pods.Continue = ""
+	if o.Limit > 0 && int64(len(items)) > o.Limit {
+		items = items[:o.Limit]
+		pods.Continue = strconv.Itoa(offset + int(o.Limit))
+	}
+	pods.Items = items
+	return nil
+}
+
+func TestCheckPods(t *testing.T) {
+	webhookCreated := time.Now().Add(-time.Hour)
+	mutating := &admissionregistrationv1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "pod-identity-webhook", CreationTimestamp: metav1.NewTime(webhookCreated)},
+	}
+	annotated := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{
+		Namespace:   "app",
+		Name:        "annotated",
+		Annotations: map[string]string{provider.AWSRoleARNAnnotation: "arn:aws:iam::111122223333:role/app"},
+	}}
+	plain := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "app", Name: "plain"}}
+	pod := func(name, serviceAccount string, created time.Time, mutated bool) *corev1.Pod {
+		p := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "app", Name: name, CreationTimestamp: metav1.NewTime(created)},
+			Spec: corev1.PodSpec{
+				ServiceAccountName: serviceAccount,
+				Containers:         []corev1.Container{{Name: "app"}},
+			},
+		}
+		if mutated {
+			p.Spec.Containers[0].Env = []corev1.EnvVar{{Name: provider.AWSRoleARNEnv, Value: "arn:aws:iam::111122223333:role/app"}}
+		}
+		return p
+	}
+	now := time.Now()
+
+	cases := []struct {
+		name    string
+		objects []client.Object
+		samples int
+		want    Status
+		message string
+	}{
+		{name: "no annotated ServiceAccounts", objects: []client.Object{plain, pod("a", "plain", now, false)}, samples: 20, want: StatusPass, message: "no ServiceAccounts"},
+		{
+			name:    "mutated",
+			objects: []client.Object{annotated, pod("a", "annotated", now, true), pod("b", "plain", now, false)},
+			samples: 20,
+			want:    StatusPass,
+			message: "1 sampled pods are mutated",
+		},
+		{
+			name:    "not mutated",
+			objects: []client.Object{annotated, pod("a", "annotated", now, true), pod("b", "annotated", now, false)},
+			samples: 20,
+			want:    StatusFail,
+			message: "1/2 sampled pods are not mutated: app/b",
+		},
+		{
+			name:    "created before the webhook",
+			objects: []client.Object{annotated, pod("a", "annotated", webhookCreated.Add(-time.Hour), false)},
+			samples: 20,
+			want:    StatusWarn,
+			message: "need a restart: app/a",
+		},
+		{
+			name:    "samples",
+			objects: []client.Object{annotated, pod("a", "annotated", now, true), pod("b", "annotated", now, true), pod("c", "annotated", now, true)},
+			samples: 2,
+			want:    StatusPass,
+			message: "2 sampled pods are mutated",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			d := &Doctor{Client: testClient(t, c.objects...), PodSamples: c.samples}
+			report := &Report{}
+			d.checkPods(context.Background(), report, provider.AWS{}, mutating)
+			if len(report.Checks) != 1 {
+				t.Fatalf("checks are %+v", report.Checks)
+			}
+			if got := report.Checks[0]; got.Status != c.want || !strings.Contains(got.Message, c.message) {
+				t.Errorf("check is %s %q, want %s %q", got.Status, got.Message, c.want, c.message)
+			}
+		})
+	}
+
+	t.Run("pages", func(t *testing.T) {
+		objects := []client.Object{annotated}
+		// Pods which do not use the annotated ServiceAccount fill the first page.
+		for i := 0; i < podListLimit; i++ {
+			objects = append(objects, pod("plain-"+strconv.Itoa(i), "plain", now, false))
+		}
+		objects = append(objects, pod("z-1", "annotated", now, true), pod("z-2", "annotated", now, true))
+		for i := 0; i < podListLimit; i++ {
+			objects = append(objects, pod("zz-"+strconv.Itoa(i), "annotated", now, true))
+		}
+		c := &pagingClient{Client: testClient(t, objects...), t: t}
+		d := &Doctor{Client: c, PodSamples: 2}
+		report := &Report{}
+		d.checkPods(context.Background(), report, provider.AWS{}, mutating)
+		if got := report.Checks[0]; got.Status != StatusPass || !strings.Contains(got.Message, "2 sampled pods are mutated") {
+			t.Errorf("check is %s %q", got.Status, got.Message)
+		}
+		// The second page has enough pods, so the third page is not read.
+		if c.lists != 2 {
+			t.Errorf("pods are listed %d times, want 2", c.lists)
+		}
+	})
+}
@@ -0,0 +1,39 @@
+package generator
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	installerv1alpha1 "github.com/h3poteto/eks-pod-identity-webhook-installer/api/v1alpha1"
+)
+
+const (
+	// EmbeddedWebhookPath is the path of the mutating webhook in the webhook server of the installer.
+	EmbeddedWebhookPath = "/mutate-v1-pod"
+	// EmbeddedServicePort is the port of the Service in front of the webhook server of the installer.
+	EmbeddedServicePort = 443
+)
+
+// EmbeddedService is the Service in front of the webhook server of the installer, which is set by --embedded-webhook-service.
+// The default is the Service in config/webhook.
+var EmbeddedService = types.NamespacedName{
+	Namespace: "eks-pod-identity-webhook-installer-system",
+	Name:      "eks-pod-identity-webhook-installer-webhook-service",
+}
+
+// Embedded returns true when pods are mutated by the installer instead of amazon-eks-pod-identity-webhook.
+func Embedded(resource *installerv1alpha1.EKSPodIdentityWebhook) bool {
+	return resource.Spec.Implementation == installerv1alpha1.ImplementationEmbedded
+}
+
+// EmbeddedWebhookService returns EmbeddedService, which the MutatingWebhookConfiguration points at in Embedded implementation.
+// It is deployed with the installer, so it is not generated.
+func EmbeddedWebhookService() *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: EmbeddedService.Namespace,
+			Name:      EmbeddedService.Name,
+		},
+	}
+}
@@ -4,6 +4,7 @@ package generator
 
 import (
 	installerv1alpha1 "github.com/h3poteto/eks-pod-identity-webhook-installer/api/v1alpha1"
+	"github.com/h3poteto/eks-pod-identity-webhook-installer/pkg/provider"
 
 	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
 	appsv1 "k8s.io/api/apps/v1"
@@ -11,8 +12,8 @@ import (
 	rbacv1 "k8s.io/api/rbac/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime/schema"
-	"k8s.io/apimachinery/pkg/util/intstr"
 	utilpointer "k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 const (
@@ -21,26 +22,137 @@ const (
 	ServiceName                      = baseName
 	SecretName                       = baseName
 	DaemonsetName                    = baseName
+	NetworkPolicyName                = baseName
 	MutatingWebhookconfigurationName = baseName
 
+	// WebhookVersion is the image tag of pod-identity-webhook.
+	WebhookVersion = provider.AWSWebhookVersion
+
 	WebhookServerLabelKey      = "ekspodidentitywebhooks.installer.h3poteto.dev"
 	WebhookServerLabelValuePod = "pod"
 )
 
 var Namespace string = ""
 
+// Pod Security Admission labels.
+// https://kubernetes.io/docs/concepts/security/pod-security-admission/
+const (
+	podSecurityEnforceLabel = "pod-security.kubernetes.io/enforce"
+	podSecurityAuditLabel   = "pod-security.kubernetes.io/audit"
+	podSecurityWarnLabel    = "pod-security.kubernetes.io/warn"
+	podSecurityVersionLabel = "-version"
+)
+
+// GenerateObjects returns every object which is installed for the resource, in the order of creation.
+// The ServiceAccount and RBAC are omitted when spec.existingServiceAccountName is set,
+// and the NetworkPolicy and metrics objects are omitted when they are not enabled.
+// In Embedded implementation only the Namespace and the MutatingWebhookConfiguration are generated.
+// It returns an error when the DaemonSet can not be generated from the spec.
+func GenerateObjects(resource *installerv1alpha1.EKSPodIdentityWebhook, serverCertificate []byte) ([]client.Object, error) {
+	objects := []client.Object{}
+	if resource.Spec.CreateNamespace != nil {
+		objects = append(objects, GenerateNamespace(resource))
+	}
+	if Embedded(resource) {
+		return append(objects, GenerateMutatingWebhookConfiguration(resource, EmbeddedWebhookService(), serverCertificate)), nil
+	}
+	if resource.Spec.ExistingServiceAccountName == "" {
+		serviceAccount := GenerateServiceAccount(resource)
+		role := GenerateRole(resource)
+		clusterRole := GenerateClusterRole(resource)
+		objects = append(objects,
+			serviceAccount,
+			role,
+			GenerateRoleBinding(resource, role, serviceAccount),
+			clusterRole,
+			GenerateClusterRoleBinding(resource, clusterRole, serviceAccount),
+		)
+	}
+	service := GenerateService(resource)
+	objects = append(objects, service)
+	if resource.Spec.NetworkPolicy != nil {
+		objects = append(objects, GenerateNetworkPolicy(resource))
+	}
+	if resource.Spec.Metrics != nil {
+		objects = append(objects, GenerateMetricsService(resource), GenerateMonitor(resource))
+	}
+	daemonset, err := GenerateDaemonset(resource)
+	if err != nil {
+		return nil, err
+	}
+	return append(objects,
+		daemonset,
+		GenerateMutatingWebhookConfiguration(resource, service, serverCertificate),
+	), nil
+}
+
+// WebhookServiceAccountName returns the name of the ServiceAccount which the webhook runs as.
+func WebhookServiceAccountName(resource *installerv1alpha1.EKSPodIdentityWebhook) string {
+	if resource.Spec.ExistingServiceAccountName != "" {
+		return resource.Spec.ExistingServiceAccountName
+	}
+	return ServiceAccountName
+}
+
+func GenerateNamespace(resource *installerv1alpha1.EKSPodIdentityWebhook) *corev1.Namespace {
+	labels := map[string]string{
+		WebhookServerLabelKey: "namespace",
+	}
+	annotations := map[string]string{}
+	if spec := resource.Spec.CreateNamespace; spec != nil {
+		for k, v := range spec.Labels {
+			labels[k] = v
+		}
+		for k, v := range spec.Annotations {
+			annotations[k] = v
+		}
+		if ps := spec.PodSecurity; ps != nil {
+			version := ps.Version
+			if version == "" {
+				version = "latest"
+			}
+			for label, level := range map[string]string{
+				podSecurityEnforceLabel: ps.Enforce,
+				podSecurityAuditLabel:   ps.Audit,
+				podSecurityWarnLabel:    ps.Warn,
+			} {
+				if level == "" {
+					continue
+				}
+				labels[label] = level
+				labels[label+podSecurityVersionLabel] = version
+			}
+		}
+	}
+	return &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        resource.Spec.Namespace,
+			Labels:      Labels(resource, labels),
+			Annotations: Annotations(resource, annotations),
+			OwnerReferences: []metav1.OwnerReference{
+				*metav1.NewControllerRef(resource, schema.GroupVersionKind{
+					Group:   installerv1alpha1.GroupVersion.Group,
+					Version: installerv1alpha1.GroupVersion.Version,
+					Kind:    "EKSPodIdentityWebhook",
+				}),
+			},
+		},
+	}
+}
+
+// GenerateMutatingWebhookConfiguration returns the MutatingWebhookConfiguration with rules of the provider.
 func GenerateMutatingWebhookConfiguration(resource *installerv1alpha1.EKSPodIdentityWebhook, service *corev1.Service, serverCertificate []byte) *admissionregistrationv1.MutatingWebhookConfiguration {
 	ignore := admissionregistrationv1.Ignore
-	allscopes := admissionregistrationv1.AllScopes
 	equivalent := admissionregistrationv1.Equivalent
 	sideeffect := admissionregistrationv1.SideEffectClassNone
 	return &admissionregistrationv1.MutatingWebhookConfiguration{
 		ObjectMeta: metav1.ObjectMeta{
 			Name: MutatingWebhookconfigurationName,
-			Labels: map[string]string{
+			Labels: Labels(resource, map[string]string{
 				WebhookServerLabelKey: "webhook-configuration",
 				"kind":                "mutator",
-			},
+			}),
+			Annotations: Annotations(resource, nil),
 			OwnerReferences: []metav1.OwnerReference{
 				*metav1.NewControllerRef(resource, schema.GroupVersionKind{
 					Group:   installerv1alpha1.GroupVersion.Group,
@@ -51,43 +163,65 @@ func GenerateMutatingWebhookConfiguration(resource *installerv1alpha1.EKSPodIden
 		},
 		Webhooks: []admissionregistrationv1.MutatingWebhook{
 			{
-				Name: service.Name + "." + service.Namespace + ".svc",
-				ClientConfig: admissionregistrationv1.WebhookClientConfig{
-					Service: &admissionregistrationv1.ServiceReference{
-						Namespace: service.Namespace,
-						Name:      service.Name,
-						Path:      utilpointer.StringPtr("/mutate"),
-					},
-					CABundle: serverCertificate,
-				},
-				Rules: []admissionregistrationv1.RuleWithOperations{
-					{
-						Operations: []admissionregistrationv1.OperationType{
-							"CREATE",
-						},
-						Rule: admissionregistrationv1.Rule{
-							APIGroups:   []string{""},
-							APIVersions: []string{"v1"},
-							Resources:   []string{"pods"},
-							Scope:       &allscopes,
-						},
-					},
-				},
+				Name:                    service.Name + "." + service.Namespace + ".svc",
+				ClientConfig:            webhookClientConfig(resource, service, serverCertificate),
+				Rules:                   provider.For(resource).Rules(),
 				FailurePolicy:           &ignore,
 				MatchPolicy:             &equivalent,
 				SideEffects:             &sideeffect,
 				TimeoutSeconds:          utilpointer.Int32Ptr(30),
-				AdmissionReviewVersions: []string{"v1beta1"},
+				AdmissionReviewVersions: admissionReviewVersions(resource),
+			},
+		},
+	}
+}
+
+// admissionReviewVersions returns versions of AdmissionReview which the webhook understands.
+func admissionReviewVersions(resource *installerv1alpha1.EKSPodIdentityWebhook) []string {
+	if Embedded(resource) {
+		return []string{"v1", "v1beta1"}
+	}
+	return provider.For(resource).AdmissionReviewVersions()
+}
+
+// webhookClientConfig points at the Service, or at spec.network.url in NodePort and URL modes.
+// In Embedded implementation it points at the webhook server of the installer.
+func webhookClientConfig(resource *installerv1alpha1.EKSPodIdentityWebhook, service *corev1.Service, caBundle []byte) admissionregistrationv1.WebhookClientConfig {
+	if Embedded(resource) {
+		return admissionregistrationv1.WebhookClientConfig{
+			Service: &admissionregistrationv1.ServiceReference{
+				Namespace: service.Namespace,
+				Name:      service.Name,
+				Path:      utilpointer.StringPtr(EmbeddedWebhookPath),
+				Port:      utilpointer.Int32Ptr(EmbeddedServicePort),
 			},
+			CABundle: caBundle,
+		}
+	}
+	if UsesURL(resource) {
+		return admissionregistrationv1.WebhookClientConfig{
+			URL:      utilpointer.StringPtr(resource.Spec.Network.URL),
+			CABundle: caBundle,
+		}
+	}
+	return admissionregistrationv1.WebhookClientConfig{
+		Service: &admissionregistrationv1.ServiceReference{
+			Namespace: service.Namespace,
+			Name:      service.Name,
+			Path:      utilpointer.StringPtr(provider.For(resource).MutatePath()),
+			Port:      utilpointer.Int32Ptr(ServicePort(resource)),
 		},
+		CABundle: caBundle,
 	}
 }
 
 func GenerateService(resource *installerv1alpha1.EKSPodIdentityWebhook) *corev1.Service {
-	return &corev1.Service{
+	service := &corev1.Service{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      ServiceName,
-			Namespace: Namespace,
+			Name:        ServiceName,
+			Namespace:   Namespace,
+			Labels:      Labels(resource, nil),
+			Annotations: Annotations(resource, nil),
 			OwnerReferences: []metav1.OwnerReference{
 				*metav1.NewControllerRef(resource, schema.GroupVersionKind{
 					Group:   installerv1alpha1.GroupVersion.Group,
@@ -99,25 +233,32 @@ func GenerateService(resource *installerv1alpha1.EKSPodIdentityWebhook) *corev1.
 		Spec: corev1.ServiceSpec{
 			Ports: []corev1.ServicePort{
 				{
-					Protocol: corev1.ProtocolTCP,
-					Port:     443,
-					TargetPort: intstr.IntOrString{
-						IntVal: 443,
-					},
+					Protocol:   corev1.ProtocolTCP,
+					Port:       ServicePort(resource),
+					TargetPort: ServiceTargetPort(resource),
 				},
 			},
 			Selector: map[string]string{
 				WebhookServerLabelKey: WebhookServerLabelValuePod,
 			},
+			Type:           corev1.ServiceTypeClusterIP,
+			IPFamilyPolicy: resource.Spec.Network.Service.IPFamilyPolicy,
 		},
 	}
+	if NetworkMode(resource) == installerv1alpha1.NetworkModeNodePort {
+		service.Spec.Type = corev1.ServiceTypeNodePort
+		service.Spec.Ports[0].NodePort = resource.Spec.Network.Service.NodePort
+	}
+	return service
 }
 
 func GenerateServiceAccount(resource *installerv1alpha1.EKSPodIdentityWebhook) *corev1.ServiceAccount {
 	return &corev1.ServiceAccount{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      ServiceAccountName,
-			Namespace: Namespace,
+			Name:        ServiceAccountName,
+			Namespace:   Namespace,
+			Labels:      Labels(resource, nil),
+			Annotations: Annotations(resource, nil),
 			OwnerReferences: []metav1.OwnerReference{
 				*metav1.NewControllerRef(resource, schema.GroupVersionKind{
 					Group:   installerv1alpha1.GroupVersion.Group,
@@ -132,8 +273,10 @@ func GenerateServiceAccount(resource *installerv1alpha1.EKSPodIdentityWebhook) *
 func GenerateRole(resource *installerv1alpha1.EKSPodIdentityWebhook) *rbacv1.Role {
 	return &rbacv1.Role{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      ServiceAccountName,
-			Namespace: Namespace,
+			Name:        ServiceAccountName,
+			Namespace:   Namespace,
+			Labels:      Labels(resource, nil),
+			Annotations: Annotations(resource, nil),
 			OwnerReferences: []metav1.OwnerReference{
 				*metav1.NewControllerRef(resource, schema.GroupVersionKind{
 					Group:   installerv1alpha1.GroupVersion.Group,
@@ -161,8 +304,10 @@ func GenerateRole(resource *installerv1alpha1.EKSPodIdentityWebhook) *rbacv1.Rol
 func GenerateRoleBinding(resource *installerv1alpha1.EKSPodIdentityWebhook, role *rbacv1.Role, sa *corev1.ServiceAccount) *rbacv1.RoleBinding {
 	return &rbacv1.RoleBinding{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      ServiceAccountName,
-			Namespace: Namespace,
+			Name:        ServiceAccountName,
+			Namespace:   Namespace,
+			Labels:      Labels(resource, nil),
+			Annotations: Annotations(resource, nil),
 			OwnerReferences: []metav1.OwnerReference{
 				*metav1.NewControllerRef(resource, schema.GroupVersionKind{
 					Group:   installerv1alpha1.GroupVersion.Group,
@@ -189,7 +334,9 @@ func GenerateRoleBinding(resource *installerv1alpha1.EKSPodIdentityWebhook, role
 func GenerateClusterRole(resource *installerv1alpha1.EKSPodIdentityWebhook) *rbacv1.ClusterRole {
 	return &rbacv1.ClusterRole{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: ServiceAccountName,
+			Name:        ServiceAccountName,
+			Labels:      Labels(resource, nil),
+			Annotations: Annotations(resource, nil),
 			OwnerReferences: []metav1.OwnerReference{
 				*metav1.NewControllerRef(resource, schema.GroupVersionKind{
 					Group:   installerv1alpha1.GroupVersion.Group,
@@ -216,7 +363,9 @@ func GenerateClusterRole(resource *installerv1alpha1.EKSPodIdentityWebhook) *rba
 func GenerateClusterRoleBinding(resource *installerv1alpha1.EKSPodIdentityWebhook, clusterRole *rbacv1.ClusterRole, sa *corev1.ServiceAccount) *rbacv1.ClusterRoleBinding {
 	return &rbacv1.ClusterRoleBinding{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: ServiceAccountName,
+			Name:        ServiceAccountName,
+			Labels:      Labels(resource, nil),
+			Annotations: Annotations(resource, nil),
 			OwnerReferences: []metav1.OwnerReference{
 				*metav1.NewControllerRef(resource, schema.GroupVersionKind{
 					Group:   installerv1alpha1.GroupVersion.Group,
@@ -240,14 +389,40 @@ func GenerateClusterRoleBinding(resource *installerv1alpha1.EKSPodIdentityWebhoo
 	}
 }
 
-func GenerateDaemonset(resource *installerv1alpha1.EKSPodIdentityWebhook) *appsv1.DaemonSet {
-	return &appsv1.DaemonSet{
+// GenerateDaemonset returns the DaemonSet which runs the webhook container of the provider on every node.
+// It returns an error when the security contexts in spec.webhook can not be merged into the hardened defaults.
+func GenerateDaemonset(resource *installerv1alpha1.EKSPodIdentityWebhook) (*appsv1.DaemonSet, error) {
+	p := provider.For(resource)
+	opts := providerOptions(resource)
+	container := p.Container(resource, opts)
+	container.Name = DaemonsetName
+	container.Ports = append([]corev1.ContainerPort{
+		{
+			Name:          "https",
+			ContainerPort: WebhookPort(resource),
+			Protocol:      corev1.ProtocolTCP,
+		},
+	}, container.Ports...)
+	container.LivenessProbe = livenessProbe(resource)
+	container.ReadinessProbe = readinessProbe(resource)
+	securityContext, err := containerSecurityContext(resource)
+	if err != nil {
+		return nil, err
+	}
+	container.SecurityContext = securityContext
+	podSecurity, err := podSecurityContext(resource)
+	if err != nil {
+		return nil, err
+	}
+
+	daemonset := &appsv1.DaemonSet{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      DaemonsetName,
 			Namespace: Namespace,
-			Labels: map[string]string{
+			Labels: Labels(resource, map[string]string{
 				WebhookServerLabelKey: "eks-webhook-daemonset",
-			},
+			}),
+			Annotations: Annotations(resource, nil),
 			OwnerReferences: []metav1.OwnerReference{
 				*metav1.NewControllerRef(resource, schema.GroupVersionKind{
 					Group:   installerv1alpha1.GroupVersion.Group,
@@ -257,6 +432,9 @@ func GenerateDaemonset(resource *installerv1alpha1.EKSPodIdentityWebhook) *appsv
 			},
 		},
 		Spec: appsv1.DaemonSetSpec{
+			UpdateStrategy: appsv1.DaemonSetUpdateStrategy{
+				Type: appsv1.RollingUpdateDaemonSetStrategyType,
+			},
 			Selector: &metav1.LabelSelector{
 				MatchLabels: map[string]string{
 					WebhookServerLabelKey: WebhookServerLabelValuePod,
@@ -264,47 +442,93 @@ func GenerateDaemonset(resource *installerv1alpha1.EKSPodIdentityWebhook) *appsv
 			},
 			Template: corev1.PodTemplateSpec{
 				ObjectMeta: metav1.ObjectMeta{
-					Labels: map[string]string{
+					Labels: Labels(resource, map[string]string{
 						WebhookServerLabelKey: WebhookServerLabelValuePod,
-					},
+					}),
+					Annotations: Annotations(resource, nil),
 				},
 				Spec: corev1.PodSpec{
-					Volumes: []corev1.Volume{
-						{
-							Name: "webhook-certs",
-							VolumeSource: corev1.VolumeSource{
-								EmptyDir: &corev1.EmptyDirVolumeSource{},
-							},
-						},
-					},
-					Containers: []corev1.Container{
-						{
-							Name:            DaemonsetName,
-							Image:           "amazon/amazon-eks-pod-identity-webhook:latest",
-							ImagePullPolicy: corev1.PullAlways,
-							Command: []string{
-								"/webhook",
-								"--in-cluster",
-								"--namespace=" + resource.Spec.Namespace,
-								"--service-name=" + ServiceName,
-								"--tls-secret=" + SecretName,
-								"--annotation-prefix=eks.amazonaws.com",
-								"--token-audience=" + resource.Spec.TokenAudience,
-								"--logtostderr",
-								"--v=4",
-							},
-							VolumeMounts: []corev1.VolumeMount{
-								{
-									Name:      "webhook-certs",
-									ReadOnly:  false,
-									MountPath: "/var/run/app/certs",
-								},
-							},
-						},
-					},
-					ServiceAccountName: ServiceAccountName,
+					Volumes:            p.Volumes(resource, opts),
+					Containers:         []corev1.Container{container},
+					ServiceAccountName: WebhookServiceAccountName(resource),
+					SecurityContext:    podSecurity,
+					Tolerations:        resource.Spec.Webhook.Tolerations,
 				},
 			},
 		},
 	}
+	spec := &daemonset.Spec.Template.Spec
+	if resource.Spec.Metrics != nil {
+		container := &spec.Containers[0]
+		container.Ports = append(container.Ports, corev1.ContainerPort{
+			Name:          MetricsPortName,
+			ContainerPort: MetricsPort(resource),
+			Protocol:      corev1.ProtocolTCP,
+		})
+	}
+	if NetworkMode(resource) == installerv1alpha1.NetworkModeHostNetwork {
+		spec.HostNetwork = true
+		spec.DNSPolicy = corev1.DNSClusterFirstWithHostNet
+	}
+	if UsesURL(resource) {
+		// Serve the certificate in spec.network.tlsSecretName, whose SANs cover the host of spec.network.url.
+		spec.Volumes = append(spec.Volumes, corev1.Volume{
+			Name: "webhook-tls",
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{
+					SecretName: resource.Spec.Network.TLSSecretName,
+				},
+			},
+		})
+		container := &spec.Containers[0]
+		container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+			Name:      "webhook-tls",
+			ReadOnly:  true,
+			MountPath: TLSMountPath,
+		})
+	}
+	return daemonset, nil
+}
+
+// providerOptions returns what the provider needs to build the webhook container.
+func providerOptions(resource *installerv1alpha1.EKSPodIdentityWebhook) provider.Options {
+	opts := provider.Options{
+		Namespace:   resource.Spec.Namespace,
+		ServiceName: ServiceName,
+		Port:        WebhookPort(resource),
+		SecretName:  SecretName,
+	}
+	if UsesURL(resource) {
+		opts.TLSCertFile = TLSMountPath + "/" + corev1.TLSCertKey
+		opts.TLSKeyFile = TLSMountPath + "/" + corev1.TLSPrivateKeyKey
+	}
+	if resource.Spec.Metrics != nil {
+		opts.MetricsPort = MetricsPort(resource)
+	}
+	return opts
+}
+
+// InheritSelector makes the DaemonSet and the Service use the selector of an existing DaemonSet.
+// Selector of DaemonSet is immutable, so an adopted DaemonSet keeps its own selector,
+// and its pods keep the labels which the existing Service selects.
+func InheritSelector(selector map[string]string, daemonset *appsv1.DaemonSet, service *corev1.Service) {
+	if len(selector) == 0 {
+		return
+	}
+	if daemonset != nil {
+		matchLabels := map[string]string{}
+		for k, v := range selector {
+			matchLabels[k] = v
+			daemonset.Spec.Template.Labels[k] = v
+		}
+		daemonset.Spec.Selector = &metav1.LabelSelector{
+			MatchLabels: matchLabels,
+		}
+	}
+	if service != nil {
+		service.Spec.Selector = map[string]string{}
+		for k, v := range selector {
+			service.Spec.Selector[k] = v
+		}
+	}
 }
@@ -0,0 +1,51 @@
+package generator
+
+import (
+	installerv1alpha1 "github.com/h3poteto/eks-pod-identity-webhook-installer/api/v1alpha1"
+)
+
+// Recommended labels.
+// https://kubernetes.io/docs/concepts/overview/working-with-objects/common-labels/
+const (
+	AppNameLabel      = "app.kubernetes.io/name"
+	AppInstanceLabel  = "app.kubernetes.io/instance"
+	AppVersionLabel   = "app.kubernetes.io/version"
+	AppManagedByLabel = "app.kubernetes.io/managed-by"
+	AppPartOfLabel    = "app.kubernetes.io/part-of"
+
+	ManagedBy = "eks-pod-identity-webhook-installer"
+	PartOf    = "eks-pod-identity-webhook"
+)
+
+// Labels returns labels of a generated object. spec.commonLabels are merged first,
+// and then the recommended labels and labels of the object, so that selectors keep working.
+func Labels(resource *installerv1alpha1.EKSPodIdentityWebhook, labels map[string]string) map[string]string {
+	result := map[string]string{}
+	for k, v := range resource.Spec.CommonLabels {
+		result[k] = v
+	}
+	result[AppNameLabel] = baseName
+	result[AppInstanceLabel] = resource.Name
+	result[AppVersionLabel] = WebhookVersion
+	result[AppManagedByLabel] = ManagedBy
+	result[AppPartOfLabel] = PartOf
+	for k, v := range labels {
+		result[k] = v
+	}
+	return result
+}
+
+// Annotations returns annotations of a generated object, which are spec.commonAnnotations merged with annotations of the object.
+func Annotations(resource *installerv1alpha1.EKSPodIdentityWebhook, annotations map[string]string) map[string]string {
+	if len(resource.Spec.CommonAnnotations) == 0 && len(annotations) == 0 {
+		return nil
+	}
+	result := map[string]string{}
+	for k, v := range resource.Spec.CommonAnnotations {
+		result[k] = v
+	}
+	for k, v := range annotations {
+		result[k] = v
+	}
+	return result
+}
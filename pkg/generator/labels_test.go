@@ -0,0 +1,20 @@
+package generator
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVersionLabel(t *testing.T) {
+	resource := overlayResource()
+	daemonset := generateDaemonset(t, resource)
+	image := daemonset.Spec.Template.Spec.Containers[0].Image
+	version := daemonset.Labels[AppVersionLabel]
+	// The label describes the image which runs, so a mutable tag is not used.
+	if version == "" || version == "latest" {
+		t.Fatalf("version label is %q", version)
+	}
+	if !strings.HasSuffix(image, ":"+version) {
+		t.Errorf("version label is %q, but the image is %s", version, image)
+	}
+}
@@ -0,0 +1,127 @@
+package generator
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	installerv1alpha1 "github.com/h3poteto/eks-pod-identity-webhook-installer/api/v1alpha1"
+)
+
+const (
+	MetricsServiceName = baseName + "-metrics"
+	MonitorName        = baseName
+
+	// MetricsPortName is the name of the metrics port of the container and the metrics Service.
+	MetricsPortName = "metrics"
+	MetricsPath     = "/metrics"
+
+	webhookServerLabelValueMetrics = "metrics"
+)
+
+// MonitoringGroupVersion is the API of Prometheus Operator. Its objects are generated as unstructured,
+// because the installer does not depend on Prometheus Operator.
+var MonitoringGroupVersion = schema.GroupVersion{Group: "monitoring.coreos.com", Version: "v1"}
+
+// MetricsPort returns the port which the webhook serves metrics on.
+func MetricsPort(resource *installerv1alpha1.EKSPodIdentityWebhook) int32 {
+	if resource.Spec.Metrics == nil || resource.Spec.Metrics.Port == 0 {
+		return installerv1alpha1.DefaultMetricsPort
+	}
+	return resource.Spec.Metrics.Port
+}
+
+// MonitorKind returns the kind of the object which scrapes the metrics. It must not be called when spec.metrics is nil.
+func MonitorKind(resource *installerv1alpha1.EKSPodIdentityWebhook) string {
+	if resource.Spec.Metrics.Monitor == "" {
+		return installerv1alpha1.MonitorServiceMonitor
+	}
+	return resource.Spec.Metrics.Monitor
+}
+
+// GenerateMetricsService returns a Service which selects the metrics port of webhook pods.
+func GenerateMetricsService(resource *installerv1alpha1.EKSPodIdentityWebhook) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      MetricsServiceName,
+			Namespace: Namespace,
+			Labels: Labels(resource, map[string]string{
+				WebhookServerLabelKey: webhookServerLabelValueMetrics,
+			}),
+			Annotations: Annotations(resource, nil),
+			OwnerReferences: []metav1.OwnerReference{
+				*metav1.NewControllerRef(resource, schema.GroupVersionKind{
+					Group:   installerv1alpha1.GroupVersion.Group,
+					Version: installerv1alpha1.GroupVersion.Version,
+					Kind:    "EKSPodIdentityWebhook",
+				}),
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Type: corev1.ServiceTypeClusterIP,
+			Ports: []corev1.ServicePort{
+				{
+					Name:       MetricsPortName,
+					Protocol:   corev1.ProtocolTCP,
+					Port:       MetricsPort(resource),
+					TargetPort: intstr.FromString(MetricsPortName),
+				},
+			},
+			Selector: map[string]string{
+				WebhookServerLabelKey: WebhookServerLabelValuePod,
+			},
+		},
+	}
+}
+
+// GenerateMonitor returns a ServiceMonitor or PodMonitor of Prometheus Operator which scrapes webhook pods.
+// It must not be called when spec.metrics is nil.
+func GenerateMonitor(resource *installerv1alpha1.EKSPodIdentityWebhook) *unstructured.Unstructured {
+	kind := MonitorKind(resource)
+	endpoint := map[string]interface{}{
+		"port": MetricsPortName,
+		"path": MetricsPath,
+	}
+	if interval := resource.Spec.Metrics.Interval; interval != "" {
+		endpoint["interval"] = interval
+	}
+
+	labels := map[string]string{}
+	for k, v := range resource.Spec.Metrics.Labels {
+		labels[k] = v
+	}
+	monitor := &unstructured.Unstructured{}
+	monitor.SetGroupVersionKind(MonitoringGroupVersion.WithKind(kind))
+	monitor.SetName(MonitorName)
+	monitor.SetNamespace(Namespace)
+	monitor.SetLabels(Labels(resource, labels))
+	monitor.SetAnnotations(Annotations(resource, nil))
+	monitor.SetOwnerReferences([]metav1.OwnerReference{
+		*metav1.NewControllerRef(resource, schema.GroupVersionKind{
+			Group:   installerv1alpha1.GroupVersion.Group,
+			Version: installerv1alpha1.GroupVersion.Version,
+			Kind:    "EKSPodIdentityWebhook",
+		}),
+	})
+
+	spec := map[string]interface{}{
+		"namespaceSelector": map[string]interface{}{
+			"matchNames": []interface{}{Namespace},
+		},
+	}
+	if kind == installerv1alpha1.MonitorPodMonitor {
+		spec["selector"] = map[string]interface{}{
+			"matchLabels": map[string]interface{}{WebhookServerLabelKey: WebhookServerLabelValuePod},
+		}
+		spec["podMetricsEndpoints"] = []interface{}{endpoint}
+	} else {
+		spec["selector"] = map[string]interface{}{
+			"matchLabels": map[string]interface{}{WebhookServerLabelKey: webhookServerLabelValueMetrics},
+		}
+		spec["endpoints"] = []interface{}{endpoint}
+	}
+	monitor.Object["spec"] = spec
+	return monitor
+}
@@ -0,0 +1,139 @@
+package generator
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	installerv1alpha1 "github.com/h3poteto/eks-pod-identity-webhook-installer/api/v1alpha1"
+)
+
+func TestGenerateMetricsService(t *testing.T) {
+	cases := []struct {
+		name string
+		port int32
+		want int32
+	}{
+		{name: "default port", want: installerv1alpha1.DefaultMetricsPort},
+		{name: "spec port", port: 9100, want: 9100},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			resource := overlayResource()
+			resource.Spec.Metrics.Port = c.port
+			service := GenerateMetricsService(resource)
+			want := []corev1.ServicePort{{Name: MetricsPortName, Protocol: corev1.ProtocolTCP, Port: c.want, TargetPort: intstr.FromString(MetricsPortName)}}
+			if !reflect.DeepEqual(service.Spec.Ports, want) {
+				t.Errorf("ports are %+v, want %+v", service.Spec.Ports, want)
+			}
+			if service.Spec.Selector[WebhookServerLabelKey] != WebhookServerLabelValuePod {
+				t.Errorf("selector is %v", service.Spec.Selector)
+			}
+
+			// The Service targets the port by name, so the container must have it.
+			container := generateDaemonset(t, resource).Spec.Template.Spec.Containers[0]
+			found := false
+			for _, p := range container.Ports {
+				if p.Name == MetricsPortName {
+					found = p.ContainerPort == c.want
+				}
+			}
+			if !found {
+				t.Errorf("container ports are %+v", container.Ports)
+			}
+		})
+	}
+
+	t.Run("metrics are not set", func(t *testing.T) {
+		resource := overlayResource()
+		resource.Spec.Metrics = nil
+		for _, p := range generateDaemonset(t, resource).Spec.Template.Spec.Containers[0].Ports {
+			if p.Name == MetricsPortName {
+				t.Error("metrics port is exposed")
+			}
+		}
+		objects, err := GenerateObjects(resource, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, obj := range objects {
+			if _, ok := obj.(*unstructured.Unstructured); ok || obj.GetName() == MetricsServiceName {
+				t.Errorf("%s %s is generated", Kind(obj), obj.GetName())
+			}
+		}
+	})
+}
+
+func TestGenerateMonitor(t *testing.T) {
+	cases := []struct {
+		name      string
+		metrics   installerv1alpha1.MetricsConfig
+		kind      string
+		endpoints string
+		selector  string
+		interval  string
+	}{
+		{
+			name:      "default",
+			kind:      "ServiceMonitor",
+			endpoints: "endpoints",
+			selector:  webhookServerLabelValueMetrics,
+		},
+		{
+			name:      "ServiceMonitor with interval",
+			metrics:   installerv1alpha1.MetricsConfig{Monitor: installerv1alpha1.MonitorServiceMonitor, Interval: "30s"},
+			kind:      "ServiceMonitor",
+			endpoints: "endpoints",
+			selector:  webhookServerLabelValueMetrics,
+			interval:  "30s",
+		},
+		{
+			// A PodMonitor selects pods directly, not the metrics Service.
+			name:      "PodMonitor",
+			metrics:   installerv1alpha1.MetricsConfig{Monitor: installerv1alpha1.MonitorPodMonitor},
+			kind:      "PodMonitor",
+			endpoints: "podMetricsEndpoints",
+			selector:  WebhookServerLabelValuePod,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			resource := overlayResource()
+			metrics := c.metrics
+			metrics.Labels = map[string]string{"release": "prometheus"}
+			resource.Spec.Metrics = &metrics
+			Namespace = resource.Spec.Namespace
+			monitor := GenerateMonitor(resource)
+
+			if gvk := monitor.GroupVersionKind(); gvk != MonitoringGroupVersion.WithKind(c.kind) {
+				t.Errorf("kind is %s", gvk)
+			}
+			if monitor.GetLabels()["release"] != "prometheus" || monitor.GetLabels()[AppInstanceLabel] != resource.Name {
+				t.Errorf("labels are %v", monitor.GetLabels())
+			}
+			selector, _, _ := unstructured.NestedString(monitor.Object, "spec", "selector", "matchLabels", WebhookServerLabelKey)
+			if selector != c.selector {
+				t.Errorf("selector is %q, want %q", selector, c.selector)
+			}
+			namespaces, _, _ := unstructured.NestedStringSlice(monitor.Object, "spec", "namespaceSelector", "matchNames")
+			if !reflect.DeepEqual(namespaces, []string{resource.Spec.Namespace}) {
+				t.Errorf("namespaces are %v", namespaces)
+			}
+			endpoints, _, _ := unstructured.NestedSlice(monitor.Object, "spec", c.endpoints)
+			if len(endpoints) != 1 {
+				t.Fatalf("%s are %v", c.endpoints, endpoints)
+			}
+			endpoint := endpoints[0].(map[string]interface{})
+			if endpoint["port"] != MetricsPortName || endpoint["path"] != MetricsPath {
+				t.Errorf("endpoint is %v", endpoint)
+			}
+			// Without interval, the interval of Prometheus is used.
+			if interval, ok := endpoint["interval"]; (c.interval == "" && ok) || (c.interval != "" && interval != c.interval) {
+				t.Errorf("interval is %v, want %q", interval, c.interval)
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package generator
+
+import (
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	installerv1alpha1 "github.com/h3poteto/eks-pod-identity-webhook-installer/api/v1alpha1"
+)
+
+// TLSMountPath is where the Secret of spec.network.tlsSecretName is mounted.
+// The webhook reads tls.crt and tls.key from it instead of requesting a certificate.
+const TLSMountPath = "/etc/webhook/certs"
+
+// NetworkMode returns spec.network.mode, or Service when it is empty.
+func NetworkMode(resource *installerv1alpha1.EKSPodIdentityWebhook) string {
+	if resource.Spec.Network.Mode == "" {
+		return installerv1alpha1.NetworkModeService
+	}
+	return resource.Spec.Network.Mode
+}
+
+// CASource returns spec.network.caSource, or ServiceAccountToken when it is empty.
+func CASource(resource *installerv1alpha1.EKSPodIdentityWebhook) string {
+	if resource.Spec.Network.CASource == "" {
+		return installerv1alpha1.CASourceServiceAccountToken
+	}
+	return resource.Spec.Network.CASource
+}
+
+// UsesURL returns true when the MutatingWebhookConfiguration points at spec.network.url instead of the Service.
+// In that case the serving certificate comes from spec.network.tlsSecretName, because a certificate issued
+// from a CertificateSigningRequest covers only the DNS names of the Service.
+func UsesURL(resource *installerv1alpha1.EKSPodIdentityWebhook) bool {
+	mode := NetworkMode(resource)
+	return mode == installerv1alpha1.NetworkModeNodePort || mode == installerv1alpha1.NetworkModeURL
+}
+
+// ServicePort returns the port of the Service.
+func ServicePort(resource *installerv1alpha1.EKSPodIdentityWebhook) int32 {
+	if resource.Spec.Network.Service.Port == 0 {
+		return installerv1alpha1.DefaultServicePort
+	}
+	return resource.Spec.Network.Service.Port
+}
+
+// ServiceTargetPort returns the port of pods which the Service sends requests to.
+func ServiceTargetPort(resource *installerv1alpha1.EKSPodIdentityWebhook) intstr.IntOrString {
+	if p := resource.Spec.Network.Service.TargetPort; p != nil {
+		return *p
+	}
+	return intstr.FromInt(int(WebhookPort(resource)))
+}
+
+// ServiceSpecExtensions returns fields of the Service spec which k8s.io/api of the installer does not know yet.
+// They are merged into the apply configuration of the Service.
+func ServiceSpecExtensions(resource *installerv1alpha1.EKSPodIdentityWebhook) map[string]interface{} {
+	if p := resource.Spec.Network.Service.InternalTrafficPolicy; p != "" {
+		return map[string]interface{}{"internalTrafficPolicy": p}
+	}
+	return nil
+}
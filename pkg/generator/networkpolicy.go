@@ -0,0 +1,100 @@
+package generator
+
+import (
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	installerv1alpha1 "github.com/h3poteto/eks-pod-identity-webhook-installer/api/v1alpha1"
+)
+
+// namespaceNameLabel is the label of a namespace which has the name of the namespace.
+const namespaceNameLabel = "kubernetes.io/metadata.name"
+
+// InstallerPodLabels are the labels of the installer pods. The default is the labels in config/manager.
+// The NetworkPolicy allows them to send the mutation probe of canary upgrades to webhook pods.
+var InstallerPodLabels = map[string]string{
+	"control-plane": "controller-manager",
+}
+
+// installerPeer selects the installer pods. The installer runs in the namespace of EmbeddedService, which is deployed with it,
+// and the namespace is matched by kubernetes.io/metadata.name label, which Kubernetes 1.21 or later sets.
+func installerPeer() networkingv1.NetworkPolicyPeer {
+	return networkingv1.NetworkPolicyPeer{
+		NamespaceSelector: &metav1.LabelSelector{
+			MatchLabels: map[string]string{
+				namespaceNameLabel: EmbeddedService.Namespace,
+			},
+		},
+		PodSelector: &metav1.LabelSelector{
+			MatchLabels: InstallerPodLabels,
+		},
+	}
+}
+
+// GenerateNetworkPolicy returns a NetworkPolicy which allows ingress on the webhook port from the API server, the installer and spec.networkPolicy.from,
+// ingress on the metrics port from spec.networkPolicy.from, and egress only to the API server. It must not be called when spec.networkPolicy is nil.
+func GenerateNetworkPolicy(resource *installerv1alpha1.EKSPodIdentityWebhook) *networkingv1.NetworkPolicy {
+	spec := resource.Spec.NetworkPolicy
+	apiServer := make([]networkingv1.NetworkPolicyPeer, 0, len(spec.APIServerCIDRs))
+	for _, cidr := range spec.APIServerCIDRs {
+		apiServer = append(apiServer, networkingv1.NetworkPolicyPeer{
+			IPBlock: &networkingv1.IPBlock{CIDR: cidr},
+		})
+	}
+	from := append(append([]networkingv1.NetworkPolicyPeer{}, apiServer...), installerPeer())
+	from = append(from, spec.From...)
+	// NetworkPolicy matches the port of the pod, not the port of the Service.
+	port := ServiceTargetPort(resource)
+	ingress := []networkingv1.NetworkPolicyIngressRule{
+		{
+			Ports: []networkingv1.NetworkPolicyPort{
+				{Port: &port},
+			},
+			From: from,
+		},
+	}
+	if resource.Spec.Metrics != nil && len(spec.From) > 0 {
+		metrics := intstr.FromString(MetricsPortName)
+		ingress = append(ingress, networkingv1.NetworkPolicyIngressRule{
+			Ports: []networkingv1.NetworkPolicyPort{
+				{Port: &metrics},
+			},
+			From: spec.From,
+		})
+	}
+
+	return &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        NetworkPolicyName,
+			Namespace:   Namespace,
+			Labels:      Labels(resource, nil),
+			Annotations: Annotations(resource, nil),
+			OwnerReferences: []metav1.OwnerReference{
+				*metav1.NewControllerRef(resource, schema.GroupVersionKind{
+					Group:   installerv1alpha1.GroupVersion.Group,
+					Version: installerv1alpha1.GroupVersion.Version,
+					Kind:    "EKSPodIdentityWebhook",
+				}),
+			},
+		},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{
+				MatchLabels: map[string]string{
+					WebhookServerLabelKey: WebhookServerLabelValuePod,
+				},
+			},
+			Ingress: ingress,
+			Egress: []networkingv1.NetworkPolicyEgressRule{
+				{
+					To: apiServer,
+				},
+			},
+			PolicyTypes: []networkingv1.PolicyType{
+				networkingv1.PolicyTypeIngress,
+				networkingv1.PolicyTypeEgress,
+			},
+		},
+	}
+}
@@ -0,0 +1,97 @@
+package generator
+
+import (
+	"reflect"
+	"testing"
+
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	installerv1alpha1 "github.com/h3poteto/eks-pod-identity-webhook-installer/api/v1alpha1"
+)
+
+func networkPolicyResource(metrics bool, from ...networkingv1.NetworkPolicyPeer) *installerv1alpha1.EKSPodIdentityWebhook {
+	resource := overlayResource()
+	if !metrics {
+		resource.Spec.Metrics = nil
+	}
+	resource.Spec.NetworkPolicy = &installerv1alpha1.NetworkPolicyConfig{
+		APIServerCIDRs: []string{"10.0.0.0/24", "10.0.1.0/24"},
+		From:           from,
+	}
+	return resource
+}
+
+func TestGenerateNetworkPolicy(t *testing.T) {
+	monitoring := networkingv1.NetworkPolicyPeer{
+		NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{namespaceNameLabel: "monitoring"}},
+	}
+	apiServer := []networkingv1.NetworkPolicyPeer{
+		{IPBlock: &networkingv1.IPBlock{CIDR: "10.0.0.0/24"}},
+		{IPBlock: &networkingv1.IPBlock{CIDR: "10.0.1.0/24"}},
+	}
+
+	t.Run("webhook port", func(t *testing.T) {
+		policyResource := networkPolicyResource(false, monitoring)
+		policy := GenerateNetworkPolicy(policyResource)
+		if len(policy.Spec.Ingress) != 1 {
+			t.Fatalf("ingress is %+v", policy.Spec.Ingress)
+		}
+		rule := policy.Spec.Ingress[0]
+		if len(rule.Ports) != 1 || *rule.Ports[0].Port != ServiceTargetPort(policyResource) {
+			t.Errorf("ports are %+v", rule.Ports)
+		}
+		// The installer sends the mutation probe of canary upgrades, so it is allowed even when from does not list it.
+		want := append(append(append([]networkingv1.NetworkPolicyPeer{}, apiServer...), installerPeer()), monitoring)
+		if !reflect.DeepEqual(rule.From, want) {
+			t.Errorf("peers are %+v, want %+v", rule.From, want)
+		}
+		if !reflect.DeepEqual(policy.Spec.Egress, []networkingv1.NetworkPolicyEgressRule{{To: apiServer}}) {
+			t.Errorf("egress is %+v", policy.Spec.Egress)
+		}
+		if policy.Namespace != Namespace || policy.Spec.PodSelector.MatchLabels[WebhookServerLabelKey] != WebhookServerLabelValuePod {
+			t.Errorf("policy selects %s in %s", policy.Spec.PodSelector.MatchLabels, policy.Namespace)
+		}
+	})
+
+	t.Run("installer peer", func(t *testing.T) {
+		peer := installerPeer()
+		if got := peer.NamespaceSelector.MatchLabels[namespaceNameLabel]; got != EmbeddedService.Namespace {
+			t.Errorf("namespace is %q, want %q", got, EmbeddedService.Namespace)
+		}
+		if !reflect.DeepEqual(peer.PodSelector.MatchLabels, InstallerPodLabels) {
+			t.Errorf("pod labels are %v", peer.PodSelector.MatchLabels)
+		}
+	})
+
+	cases := []struct {
+		name    string
+		metrics bool
+		from    []networkingv1.NetworkPolicyPeer
+		want    bool
+	}{
+		{name: "metrics and from", metrics: true, from: []networkingv1.NetworkPolicyPeer{monitoring}, want: true},
+		// Nothing scrapes the metrics port, so no rule is needed.
+		{name: "metrics without from", metrics: true},
+		{name: "from without metrics", from: []networkingv1.NetworkPolicyPeer{monitoring}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			policy := GenerateNetworkPolicy(networkPolicyResource(c.metrics, c.from...))
+			var metrics *networkingv1.NetworkPolicyIngressRule
+			for i, rule := range policy.Spec.Ingress {
+				for _, p := range rule.Ports {
+					if p.Port != nil && p.Port.String() == MetricsPortName {
+						metrics = &policy.Spec.Ingress[i]
+					}
+				}
+			}
+			if (metrics != nil) != c.want {
+				t.Fatalf("metrics rule is %+v", metrics)
+			}
+			if metrics != nil && !reflect.DeepEqual(metrics.From, c.from) {
+				t.Errorf("metrics peers are %+v, want only from", metrics.From)
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package generator
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	utiljson "k8s.io/apimachinery/pkg/util/json"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+
+	installerv1alpha1 "github.com/h3poteto/eks-pod-identity-webhook-installer/api/v1alpha1"
+)
+
+// ApplyOverlays applies spec.overlays which target obj, in order. obj is replaced with the patched object.
+func ApplyOverlays(resource *installerv1alpha1.EKSPodIdentityWebhook, obj client.Object) error {
+	_, err := ApplyOverlaysWithSpec(resource, obj, nil)
+	return err
+}
+
+// ApplyOverlaysWithSpec sets spec fields which the type of obj does not know, e.g. ServiceSpecExtensions, before it applies
+// spec.overlays, so that overlays can override them. It returns such fields as they are after the overlays,
+// because obj can not hold them.
+func ApplyOverlaysWithSpec(resource *installerv1alpha1.EKSPodIdentityWebhook, obj client.Object, spec map[string]interface{}) (map[string]interface{}, error) {
+	doc, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	if len(spec) > 0 {
+		if doc, err = setSpecFields(doc, spec); err != nil {
+			return nil, err
+		}
+	}
+
+	kind := Kind(obj)
+	for i, overlay := range resource.Spec.Overlays {
+		if overlay.Target.Kind != kind || (overlay.Target.Name != "" && overlay.Target.Name != obj.GetName()) {
+			continue
+		}
+		if doc, err = applyOverlay(overlay, doc, obj); err != nil {
+			return nil, fmt.Errorf("overlays[%d] for %s %s: %w", i, kind, obj.GetName(), err)
+		}
+	}
+
+	// Decode into an empty object, so that fields removed by the patches are cleared.
+	out, err := decodeAs(doc, obj)
+	if err != nil {
+		return nil, err
+	}
+	reflect.ValueOf(obj).Elem().Set(out.Elem())
+	return unknownSpecFields(doc, obj)
+}
+
+// ValidateOverlays applies overlays to objects, and returns an error for each overlay which can not be applied.
+// It does not modify objects.
+func ValidateOverlays(resource *installerv1alpha1.EKSPodIdentityWebhook, objects []client.Object) []error {
+	errs := []error{}
+	for _, obj := range objects {
+		if err := ApplyOverlays(resource, obj.DeepCopyObject().(client.Object)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for i, overlay := range resource.Spec.Overlays {
+		if !targets(overlay.Target, objects) {
+			errs = append(errs, fmt.Errorf("overlays[%d]: no generated object matches %s %s", i, overlay.Target.Kind, overlay.Target.Name))
+		}
+	}
+	return errs
+}
+
+// Kind returns the kind of a generated object.
+func Kind(obj client.Object) string {
+	if u, ok := obj.(*unstructured.Unstructured); ok {
+		return u.GetKind()
+	}
+	return reflect.Indirect(reflect.ValueOf(obj)).Type().Name()
+}
+
+func targets(target installerv1alpha1.OverlayTarget, objects []client.Object) bool {
+	for _, obj := range objects {
+		if Kind(obj) == target.Kind && (target.Name == "" || target.Name == obj.GetName()) {
+			return true
+		}
+	}
+	return false
+}
+
+func applyOverlay(overlay installerv1alpha1.Overlay, original []byte, obj client.Object) ([]byte, error) {
+	patch, err := yaml.YAMLToJSON([]byte(overlay.Patch))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse patch: %w", err)
+	}
+
+	var patched []byte
+	switch overlay.Type {
+	case installerv1alpha1.OverlayJSON6902:
+		p, err := jsonpatch.DecodePatch(patch)
+		if err != nil {
+			return nil, fmt.Errorf("invalid JSON patch: %w", err)
+		}
+		patched, err = p.Apply(original)
+		if err != nil {
+			return nil, fmt.Errorf("failed to apply JSON patch: %w", err)
+		}
+	case installerv1alpha1.OverlayStrategicMerge, "":
+		if _, ok := obj.(*unstructured.Unstructured); ok {
+			// Custom resources have no patch strategies, so a strategic merge patch is a JSON merge patch.
+			patched, err = jsonpatch.MergePatch(original, patch)
+			if err != nil {
+				return nil, fmt.Errorf("failed to apply merge patch: %w", err)
+			}
+			break
+		}
+		patched, err = strategicpatch.StrategicMergePatch(original, patch, obj)
+		if err != nil {
+			return nil, fmt.Errorf("failed to apply strategic merge patch: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown overlay type %s", overlay.Type)
+	}
+
+	if _, err := decodeAs(patched, obj); err != nil {
+		return nil, fmt.Errorf("patched object is invalid: %w", err)
+	}
+	return patched, nil
+}
+
+// decodeAs decodes doc into a new object of the same type as obj.
+func decodeAs(doc []byte, obj client.Object) (reflect.Value, error) {
+	out := reflect.New(reflect.Indirect(reflect.ValueOf(obj)).Type())
+	err := json.Unmarshal(doc, out.Interface())
+	return out, err
+}
+
+func setSpecFields(doc []byte, fields map[string]interface{}) ([]byte, error) {
+	u := map[string]interface{}{}
+	if err := json.Unmarshal(doc, &u); err != nil {
+		return nil, err
+	}
+	for field, value := range fields {
+		if err := unstructured.SetNestedField(u, value, "spec", field); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(u)
+}
+
+// unknownSpecFields returns fields of spec in doc which the Spec of obj does not have.
+func unknownSpecFields(doc []byte, obj client.Object) (map[string]interface{}, error) {
+	if _, ok := obj.(*unstructured.Unstructured); ok {
+		return nil, nil
+	}
+	specField, ok := reflect.Indirect(reflect.ValueOf(obj)).Type().FieldByName("Spec")
+	if !ok {
+		return nil, nil
+	}
+	known := map[string]bool{}
+	for i := 0; i < specField.Type.NumField(); i++ {
+		name := strings.Split(specField.Type.Field(i).Tag.Get("json"), ",")[0]
+		known[name] = true
+	}
+
+	// utiljson decodes numbers into int64 as the API server does, so that they can be compared with live objects.
+	u := map[string]interface{}{}
+	if err := utiljson.Unmarshal(doc, &u); err != nil {
+		return nil, err
+	}
+	spec, _ := u["spec"].(map[string]interface{})
+	var fields map[string]interface{}
+	for field, value := range spec {
+		if known[field] {
+			continue
+		}
+		if fields == nil {
+			fields = map[string]interface{}{}
+		}
+		fields[field] = value
+	}
+	return fields, nil
+}
@@ -0,0 +1,366 @@
+package generator
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	installerv1alpha1 "github.com/h3poteto/eks-pod-identity-webhook-installer/api/v1alpha1"
+)
+
+func overlayResource(overlays ...installerv1alpha1.Overlay) *installerv1alpha1.EKSPodIdentityWebhook {
+	resource := &installerv1alpha1.EKSPodIdentityWebhook{
+		ObjectMeta: metav1.ObjectMeta{Name: "cluster"},
+		Spec: installerv1alpha1.EKSPodIdentityWebhookSpec{
+			TokenAudience: "sts.amazonaws.com",
+			Namespace:     "kube-system",
+			Metrics:       &installerv1alpha1.MetricsConfig{},
+			Overlays:      overlays,
+		},
+	}
+	resource.Default()
+	return resource
+}
+
+func generateDaemonset(t *testing.T, resource *installerv1alpha1.EKSPodIdentityWebhook) *appsv1.DaemonSet {
+	t.Helper()
+	daemonset, err := GenerateDaemonset(resource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return daemonset
+}
+
+func TestApplyOverlays(t *testing.T) {
+	t.Run("strategic merge", func(t *testing.T) {
+		resource := overlayResource(installerv1alpha1.Overlay{
+			Target: installerv1alpha1.OverlayTarget{Kind: "DaemonSet"},
+			Patch: `
+spec:
+  template:
+    spec:
+      priorityClassName: system-node-critical
+      containers:
+      - name: pod-identity-webhook
+        resources:
+          limits:
+            memory: 64Mi
+`,
+		})
+		daemonset := generateDaemonset(t, resource)
+		if err := ApplyOverlays(resource, daemonset); err != nil {
+			t.Fatal(err)
+		}
+		spec := daemonset.Spec.Template.Spec
+		if spec.PriorityClassName != "system-node-critical" {
+			t.Errorf("priorityClassName is %q", spec.PriorityClassName)
+		}
+		// Containers are merged by name, so the generated container keeps its command.
+		if len(spec.Containers) != 1 || len(spec.Containers[0].Command) == 0 {
+			t.Fatalf("containers are not merged: %+v", spec.Containers)
+		}
+		if got := spec.Containers[0].Resources.Limits.Memory().String(); got != "64Mi" {
+			t.Errorf("memory limit is %s", got)
+		}
+	})
+
+	t.Run("strategic merge deletes a field", func(t *testing.T) {
+		resource := overlayResource(installerv1alpha1.Overlay{
+			Target: installerv1alpha1.OverlayTarget{Kind: "DaemonSet", Name: DaemonsetName},
+			Patch:  `{"spec":{"template":{"spec":{"securityContext":null}}}}`,
+		})
+		daemonset := generateDaemonset(t, resource)
+		if err := ApplyOverlays(resource, daemonset); err != nil {
+			t.Fatal(err)
+		}
+		if daemonset.Spec.Template.Spec.SecurityContext != nil {
+			t.Errorf("securityContext is not deleted: %+v", daemonset.Spec.Template.Spec.SecurityContext)
+		}
+	})
+
+	t.Run("JSON6902", func(t *testing.T) {
+		resource := overlayResource(installerv1alpha1.Overlay{
+			Target: installerv1alpha1.OverlayTarget{Kind: "Service"},
+			Type:   installerv1alpha1.OverlayJSON6902,
+			Patch: `
+- op: add
+  path: /metadata/annotations
+  value:
+    example.com/owner: platform
+- op: replace
+  path: /spec/ports/0/port
+  value: 8443
+`,
+		})
+		service := GenerateService(resource)
+		if err := ApplyOverlays(resource, service); err != nil {
+			t.Fatal(err)
+		}
+		if service.Annotations["example.com/owner"] != "platform" {
+			t.Errorf("annotations are %v", service.Annotations)
+		}
+		if service.Spec.Ports[0].Port != 8443 {
+			t.Errorf("port is %d", service.Spec.Ports[0].Port)
+		}
+	})
+
+	t.Run("merge patch of unstructured", func(t *testing.T) {
+		resource := overlayResource(installerv1alpha1.Overlay{
+			Target: installerv1alpha1.OverlayTarget{Kind: "ServiceMonitor"},
+			Patch: `
+metadata:
+  labels:
+    release: prometheus
+spec:
+  endpoints:
+  - port: metrics
+    interval: 15s
+`,
+		})
+		monitor := GenerateMonitor(resource)
+		if err := ApplyOverlays(resource, monitor); err != nil {
+			t.Fatal(err)
+		}
+		if monitor.GetLabels()["release"] != "prometheus" {
+			t.Errorf("labels are %v", monitor.GetLabels())
+		}
+		// Lists are replaced, because custom resources have no patch strategies.
+		endpoints, _, _ := unstructured.NestedSlice(monitor.Object, "spec", "endpoints")
+		if len(endpoints) != 1 || endpoints[0].(map[string]interface{})["interval"] != "15s" {
+			t.Errorf("endpoints are %v", endpoints)
+		}
+	})
+
+	t.Run("other targets are not changed", func(t *testing.T) {
+		resource := overlayResource(
+			installerv1alpha1.Overlay{
+				Target: installerv1alpha1.OverlayTarget{Kind: "DaemonSet", Name: "other"},
+				Patch:  `{"metadata":{"labels":{"patched":"true"}}}`,
+			},
+			installerv1alpha1.Overlay{
+				Target: installerv1alpha1.OverlayTarget{Kind: "Service"},
+				Patch:  `{"metadata":{"labels":{"patched":"true"}}}`,
+			},
+		)
+		daemonset := generateDaemonset(t, resource)
+		if err := ApplyOverlays(resource, daemonset); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := daemonset.Labels["patched"]; ok {
+			t.Errorf("DaemonSet is patched: %v", daemonset.Labels)
+		}
+	})
+
+	t.Run("overlays are applied in order", func(t *testing.T) {
+		resource := overlayResource(
+			installerv1alpha1.Overlay{
+				Target: installerv1alpha1.OverlayTarget{Kind: "Service"},
+				Patch:  `{"metadata":{"labels":{"order":"first"}}}`,
+			},
+			installerv1alpha1.Overlay{
+				Target: installerv1alpha1.OverlayTarget{Kind: "Service"},
+				Type:   installerv1alpha1.OverlayJSON6902,
+				Patch:  `[{"op":"replace","path":"/metadata/labels/order","value":"second"}]`,
+			},
+		)
+		service := GenerateService(resource)
+		if err := ApplyOverlays(resource, service); err != nil {
+			t.Fatal(err)
+		}
+		if service.Labels["order"] != "second" {
+			t.Errorf("order is %q", service.Labels["order"])
+		}
+	})
+}
+
+func TestApplyOverlaysWithSpec(t *testing.T) {
+	cases := []struct {
+		name     string
+		policy   string
+		overlays []installerv1alpha1.Overlay
+		want     map[string]interface{}
+		typ      corev1.ServiceType
+	}{
+		{
+			name:   "without overlays",
+			policy: "Local",
+			want:   map[string]interface{}{"internalTrafficPolicy": "Local"},
+		},
+		{
+			name:   "strategic merge overrides the extension",
+			policy: "Local",
+			overlays: []installerv1alpha1.Overlay{{
+				Target: installerv1alpha1.OverlayTarget{Kind: "Service"},
+				Patch:  `{"spec":{"internalTrafficPolicy":"Cluster"}}`,
+			}},
+			want: map[string]interface{}{"internalTrafficPolicy": "Cluster"},
+		},
+		{
+			name:   "JSON6902 removes the extension",
+			policy: "Local",
+			overlays: []installerv1alpha1.Overlay{{
+				Target: installerv1alpha1.OverlayTarget{Kind: "Service"},
+				Type:   installerv1alpha1.OverlayJSON6902,
+				Patch:  `[{"op":"test","path":"/spec/internalTrafficPolicy","value":"Local"},{"op":"remove","path":"/spec/internalTrafficPolicy"}]`,
+			}},
+		},
+		{
+			name: "overlay adds a field which the type does not know",
+			overlays: []installerv1alpha1.Overlay{{
+				Target: installerv1alpha1.OverlayTarget{Kind: "Service"},
+				Patch:  `{"spec":{"internalTrafficPolicy":"Local","type":"NodePort"}}`,
+			}},
+			want: map[string]interface{}{"internalTrafficPolicy": "Local"},
+			typ:  corev1.ServiceTypeNodePort,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			resource := overlayResource(c.overlays...)
+			resource.Spec.Network.Service.InternalTrafficPolicy = c.policy
+			service := GenerateService(resource)
+			got, err := ApplyOverlaysWithSpec(resource, service, ServiceSpecExtensions(resource))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("fields are %v, want %v", got, c.want)
+			}
+			if c.typ != "" && service.Spec.Type != c.typ {
+				t.Errorf("type is %s, want %s", service.Spec.Type, c.typ)
+			}
+		})
+	}
+}
+
+func TestApplyOverlaysError(t *testing.T) {
+	cases := []struct {
+		name    string
+		overlay installerv1alpha1.Overlay
+		want    string
+	}{
+		{
+			name: "failing JSON patch",
+			overlay: installerv1alpha1.Overlay{
+				Target: installerv1alpha1.OverlayTarget{Kind: "Service"},
+				Type:   installerv1alpha1.OverlayJSON6902,
+				Patch:  `[{"op":"remove","path":"/spec/externalName"}]`,
+			},
+			want: "overlays[0] for Service pod-identity-webhook: failed to apply JSON patch",
+		},
+		{
+			name: "invalid JSON patch",
+			overlay: installerv1alpha1.Overlay{
+				Target: installerv1alpha1.OverlayTarget{Kind: "Service"},
+				Type:   installerv1alpha1.OverlayJSON6902,
+				Patch:  `{"op":"remove"}`,
+			},
+			want: "invalid JSON patch",
+		},
+		{
+			name: "invalid YAML",
+			overlay: installerv1alpha1.Overlay{
+				Target: installerv1alpha1.OverlayTarget{Kind: "Service"},
+				Patch:  "spec: [",
+			},
+			want: "failed to parse patch",
+		},
+		{
+			name: "patched object is invalid",
+			overlay: installerv1alpha1.Overlay{
+				Target: installerv1alpha1.OverlayTarget{Kind: "Service"},
+				Type:   installerv1alpha1.OverlayJSON6902,
+				Patch:  `[{"op":"replace","path":"/spec/ports","value":"443"}]`,
+			},
+			want: "patched object is invalid",
+		},
+		{
+			name: "unknown type",
+			overlay: installerv1alpha1.Overlay{
+				Target: installerv1alpha1.OverlayTarget{Kind: "Service"},
+				Type:   "Kustomize",
+				Patch:  `{}`,
+			},
+			want: "unknown overlay type Kustomize",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			resource := overlayResource(c.overlay)
+			service := GenerateService(resource)
+			err := ApplyOverlays(resource, service)
+			if err == nil || !strings.Contains(err.Error(), c.want) {
+				t.Errorf("error is %v, want %q", err, c.want)
+			}
+		})
+	}
+}
+
+func TestValidateOverlays(t *testing.T) {
+	resource := overlayResource(
+		installerv1alpha1.Overlay{
+			Target: installerv1alpha1.OverlayTarget{Kind: "DaemonSet"},
+			Patch:  `{"metadata":{"labels":{"patched":"true"}}}`,
+		},
+		// NetworkPolicy is not generated, because spec.networkPolicy is not set.
+		installerv1alpha1.Overlay{
+			Target: installerv1alpha1.OverlayTarget{Kind: "NetworkPolicy"},
+			Patch:  `{}`,
+		},
+		installerv1alpha1.Overlay{
+			Target: installerv1alpha1.OverlayTarget{Kind: "Service", Name: "missing"},
+			Patch:  `{}`,
+		},
+		installerv1alpha1.Overlay{
+			Target: installerv1alpha1.OverlayTarget{Kind: "Service", Name: ServiceName},
+			Type:   installerv1alpha1.OverlayJSON6902,
+			Patch:  `[{"op":"test","path":"/spec/type","value":"NodePort"}]`,
+		},
+		// The CRD rejects kinds which are never generated, but they are reported in case it is bypassed.
+		installerv1alpha1.Overlay{
+			Target: installerv1alpha1.OverlayTarget{Kind: "Pod"},
+			Patch:  `{}`,
+		},
+	)
+	daemonset := generateDaemonset(t, resource)
+	objects := []client.Object{daemonset, GenerateService(resource)}
+
+	errs := ValidateOverlays(resource, objects)
+	want := []string{
+		"overlays[3] for Service pod-identity-webhook",
+		"overlays[1]: no generated object matches NetworkPolicy",
+		"overlays[2]: no generated object matches Service missing",
+		"overlays[4]: no generated object matches Pod",
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("errors are %v, want %d errors", errs, len(want))
+	}
+	for i, w := range want {
+		if !strings.Contains(errs[i].Error(), w) {
+			t.Errorf("error %d is %v, want %q", i, errs[i], w)
+		}
+	}
+	if _, ok := daemonset.Labels["patched"]; ok {
+		t.Error("ValidateOverlays modified the object")
+	}
+}
+
+func TestKind(t *testing.T) {
+	monitor := &unstructured.Unstructured{}
+	monitor.SetKind("PodMonitor")
+	for obj, want := range map[client.Object]string{
+		&appsv1.DaemonSet{}: "DaemonSet",
+		&corev1.Service{}:   "Service",
+		monitor:             "PodMonitor",
+	} {
+		if got := Kind(obj); got != want {
+			t.Errorf("Kind is %s, want %s", got, want)
+		}
+	}
+}
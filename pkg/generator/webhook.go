@@ -0,0 +1,136 @@
+package generator
+
+import (
+	"encoding/json"
+	"fmt"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	utilpointer "k8s.io/utils/pointer"
+
+	installerv1alpha1 "github.com/h3poteto/eks-pod-identity-webhook-installer/api/v1alpha1"
+	"github.com/h3poteto/eks-pod-identity-webhook-installer/pkg/provider"
+)
+
+// Default thresholds of probes. The liveness probe waits for the certificate to be issued from a CertificateSigningRequest.
+var (
+	defaultLivenessProbe = corev1.Probe{
+		InitialDelaySeconds: 30,
+		PeriodSeconds:       10,
+		TimeoutSeconds:      5,
+		SuccessThreshold:    1,
+		FailureThreshold:    3,
+	}
+	defaultReadinessProbe = corev1.Probe{
+		InitialDelaySeconds: 5,
+		PeriodSeconds:       5,
+		TimeoutSeconds:      5,
+		SuccessThreshold:    1,
+		FailureThreshold:    3,
+	}
+)
+
+// WebhookPort returns the port which the webhook listens on.
+func WebhookPort(resource *installerv1alpha1.EKSPodIdentityWebhook) int32 {
+	if resource.Spec.Webhook.Port == 0 {
+		return installerv1alpha1.DefaultWebhookPort
+	}
+	return resource.Spec.Webhook.Port
+}
+
+func livenessProbe(resource *installerv1alpha1.EKSPodIdentityWebhook) *corev1.Probe {
+	return healthProbe(resource, defaultLivenessProbe, resource.Spec.Webhook.LivenessProbe)
+}
+
+func readinessProbe(resource *installerv1alpha1.EKSPodIdentityWebhook) *corev1.Probe {
+	return healthProbe(resource, defaultReadinessProbe, resource.Spec.Webhook.ReadinessProbe)
+}
+
+func healthProbe(resource *installerv1alpha1.EKSPodIdentityWebhook, probe corev1.Probe, config *installerv1alpha1.ProbeConfig) *corev1.Probe {
+	probe.Handler = corev1.Handler{
+		HTTPGet: &corev1.HTTPGetAction{
+			Path:   provider.For(resource).HealthPath(),
+			Port:   intstr.FromInt(int(WebhookPort(resource))),
+			Scheme: corev1.URISchemeHTTPS,
+		},
+	}
+	if config == nil {
+		return &probe
+	}
+	if config.InitialDelaySeconds != nil {
+		probe.InitialDelaySeconds = *config.InitialDelaySeconds
+	}
+	if config.PeriodSeconds != nil {
+		probe.PeriodSeconds = *config.PeriodSeconds
+	}
+	if config.TimeoutSeconds != nil {
+		probe.TimeoutSeconds = *config.TimeoutSeconds
+	}
+	if config.SuccessThreshold != nil {
+		probe.SuccessThreshold = *config.SuccessThreshold
+	}
+	if config.FailureThreshold != nil {
+		probe.FailureThreshold = *config.FailureThreshold
+	}
+	return &probe
+}
+
+// nonRootUser is nobody, because the image of pod-identity-webhook does not set a non-root user.
+const nonRootUser = 65534
+
+func podSecurityContext(resource *installerv1alpha1.EKSPodIdentityWebhook) (*corev1.PodSecurityContext, error) {
+	sc := &corev1.PodSecurityContext{
+		RunAsNonRoot: utilpointer.BoolPtr(true),
+		RunAsUser:    utilpointer.Int64Ptr(nonRootUser),
+		RunAsGroup:   utilpointer.Int64Ptr(nonRootUser),
+		FSGroup:      utilpointer.Int64Ptr(nonRootUser),
+		SeccompProfile: &corev1.SeccompProfile{
+			Type: corev1.SeccompProfileTypeRuntimeDefault,
+		},
+	}
+	if override := resource.Spec.Webhook.PodSecurityContext; override != nil {
+		if err := mergeSecurityContext(sc, override); err != nil {
+			return nil, fmt.Errorf("spec.webhook.podSecurityContext is invalid: %w", err)
+		}
+	}
+	return sc, nil
+}
+
+func containerSecurityContext(resource *installerv1alpha1.EKSPodIdentityWebhook) (*corev1.SecurityContext, error) {
+	sc := &corev1.SecurityContext{
+		RunAsNonRoot:             utilpointer.BoolPtr(true),
+		ReadOnlyRootFilesystem:   utilpointer.BoolPtr(true),
+		AllowPrivilegeEscalation: utilpointer.BoolPtr(false),
+		Capabilities: &corev1.Capabilities{
+			Drop: []corev1.Capability{"ALL"},
+		},
+		SeccompProfile: &corev1.SeccompProfile{
+			Type: corev1.SeccompProfileTypeRuntimeDefault,
+		},
+	}
+	if override := resource.Spec.Webhook.SecurityContext; override != nil {
+		if err := mergeSecurityContext(sc, override); err != nil {
+			return nil, fmt.Errorf("spec.webhook.securityContext is invalid: %w", err)
+		}
+	}
+	return sc, nil
+}
+
+// mergeSecurityContext merges fields which are set in override into sc with a JSON merge patch.
+// Every field of security contexts is optional, so unset fields keep the hardened defaults.
+func mergeSecurityContext(sc, override interface{}) error {
+	original, err := json.Marshal(sc)
+	if err != nil {
+		return err
+	}
+	patch, err := json.Marshal(override)
+	if err != nil {
+		return err
+	}
+	merged, err := jsonpatch.MergePatch(original, patch)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(merged, sc)
+}
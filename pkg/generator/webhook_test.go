@@ -0,0 +1,138 @@
+package generator
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	utilpointer "k8s.io/utils/pointer"
+
+	installerv1alpha1 "github.com/h3poteto/eks-pod-identity-webhook-installer/api/v1alpha1"
+)
+
+func TestSecurityContextOverride(t *testing.T) {
+	t.Run("defaults", func(t *testing.T) {
+		spec := generateDaemonset(t, overlayResource()).Spec.Template.Spec
+		pod := spec.SecurityContext
+		if !*pod.RunAsNonRoot || *pod.RunAsUser != nonRootUser || *pod.FSGroup != nonRootUser || pod.SeccompProfile.Type != corev1.SeccompProfileTypeRuntimeDefault {
+			t.Errorf("pod security context is %+v", pod)
+		}
+		container := spec.Containers[0].SecurityContext
+		if !*container.ReadOnlyRootFilesystem || *container.AllowPrivilegeEscalation || !reflect.DeepEqual(container.Capabilities.Drop, []corev1.Capability{"ALL"}) {
+			t.Errorf("container security context is %+v", container)
+		}
+	})
+
+	t.Run("override", func(t *testing.T) {
+		resource := overlayResource()
+		resource.Spec.Webhook.PodSecurityContext = &corev1.PodSecurityContext{
+			RunAsUser:          utilpointer.Int64Ptr(1000),
+			SupplementalGroups: []int64{2000},
+		}
+		resource.Spec.Webhook.SecurityContext = &corev1.SecurityContext{
+			// false is set explicitly, so it overrides the default.
+			ReadOnlyRootFilesystem: utilpointer.BoolPtr(false),
+			Capabilities:           &corev1.Capabilities{Add: []corev1.Capability{"NET_BIND_SERVICE"}},
+		}
+		spec := generateDaemonset(t, resource).Spec.Template.Spec
+
+		pod := spec.SecurityContext
+		if *pod.RunAsUser != 1000 || !reflect.DeepEqual(pod.SupplementalGroups, []int64{2000}) {
+			t.Errorf("override is not applied to the pod: %+v", pod)
+		}
+		// Fields which are not set in the override keep the hardened defaults.
+		if !*pod.RunAsNonRoot || *pod.RunAsGroup != nonRootUser || pod.SeccompProfile == nil {
+			t.Errorf("defaults of the pod are lost: %+v", pod)
+		}
+
+		container := spec.Containers[0].SecurityContext
+		if *container.ReadOnlyRootFilesystem {
+			t.Error("readOnlyRootFilesystem is not overridden")
+		}
+		if *container.AllowPrivilegeEscalation || !*container.RunAsNonRoot {
+			t.Errorf("defaults of the container are lost: %+v", container)
+		}
+		// Capabilities are merged by field, so drop is kept when only add is set.
+		if !reflect.DeepEqual(container.Capabilities.Add, []corev1.Capability{"NET_BIND_SERVICE"}) || !reflect.DeepEqual(container.Capabilities.Drop, []corev1.Capability{"ALL"}) {
+			t.Errorf("capabilities are %+v", container.Capabilities)
+		}
+	})
+}
+
+func TestMergeSecurityContext(t *testing.T) {
+	sc := &corev1.SecurityContext{RunAsNonRoot: utilpointer.BoolPtr(true)}
+	// A value which can not be encoded in JSON is an error instead of being ignored.
+	if err := mergeSecurityContext(sc, map[string]interface{}{"runAsUser": func() {}}); err == nil {
+		t.Error("error is not returned")
+	}
+	if !*sc.RunAsNonRoot {
+		t.Error("security context is changed on an error")
+	}
+}
+
+// thresholds returns the thresholds of a probe without the handler.
+func thresholds(probe *corev1.Probe) corev1.Probe {
+	p := *probe
+	p.Handler = corev1.Handler{}
+	return p
+}
+
+func TestProbes(t *testing.T) {
+	t.Run("defaults", func(t *testing.T) {
+		resource := overlayResource()
+		resource.Spec.Webhook.Port = 8443
+		container := generateDaemonset(t, resource).Spec.Template.Spec.Containers[0]
+		if got := thresholds(container.LivenessProbe); got != defaultLivenessProbe {
+			t.Errorf("liveness probe is %+v, want %+v", got, defaultLivenessProbe)
+		}
+		if got := thresholds(container.ReadinessProbe); got != defaultReadinessProbe {
+			t.Errorf("readiness probe is %+v, want %+v", got, defaultReadinessProbe)
+		}
+		for _, probe := range []*corev1.Probe{container.LivenessProbe, container.ReadinessProbe} {
+			want := &corev1.HTTPGetAction{Path: "/healthz", Port: intstr.FromInt(8443), Scheme: corev1.URISchemeHTTPS}
+			if !reflect.DeepEqual(probe.HTTPGet, want) {
+				t.Errorf("probe gets %+v, want %+v", probe.HTTPGet, want)
+			}
+		}
+	})
+
+	t.Run("spec", func(t *testing.T) {
+		resource := overlayResource()
+		resource.Spec.Webhook.LivenessProbe = &installerv1alpha1.ProbeConfig{
+			InitialDelaySeconds: utilpointer.Int32Ptr(120),
+			PeriodSeconds:       utilpointer.Int32Ptr(20),
+			TimeoutSeconds:      utilpointer.Int32Ptr(10),
+			SuccessThreshold:    utilpointer.Int32Ptr(1),
+			FailureThreshold:    utilpointer.Int32Ptr(6),
+		}
+		// Only the failure threshold is set, so the other thresholds keep the defaults.
+		resource.Spec.Webhook.ReadinessProbe = &installerv1alpha1.ProbeConfig{
+			FailureThreshold: utilpointer.Int32Ptr(10),
+		}
+		container := generateDaemonset(t, resource).Spec.Template.Spec.Containers[0]
+
+		liveness := corev1.Probe{InitialDelaySeconds: 120, PeriodSeconds: 20, TimeoutSeconds: 10, SuccessThreshold: 1, FailureThreshold: 6}
+		if got := thresholds(container.LivenessProbe); got != liveness {
+			t.Errorf("liveness probe is %+v, want %+v", got, liveness)
+		}
+		readiness := defaultReadinessProbe
+		readiness.FailureThreshold = 10
+		if got := thresholds(container.ReadinessProbe); got != readiness {
+			t.Errorf("readiness probe is %+v, want %+v", got, readiness)
+		}
+		if container.ReadinessProbe.HTTPGet == nil {
+			t.Error("handler is lost")
+		}
+	})
+
+	t.Run("zero initial delay", func(t *testing.T) {
+		// 0 is a valid initial delay, which differs from unset.
+		resource := overlayResource()
+		resource.Spec.Webhook.LivenessProbe = &installerv1alpha1.ProbeConfig{InitialDelaySeconds: utilpointer.Int32Ptr(0)}
+		container := generateDaemonset(t, resource).Spec.Template.Spec.Containers[0]
+		if container.LivenessProbe.InitialDelaySeconds != 0 {
+			t.Errorf("initial delay is %d", container.LivenessProbe.InitialDelaySeconds)
+		}
+	})
+}
@@ -0,0 +1,91 @@
+package mutation
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	installerv1alpha1 "github.com/h3poteto/eks-pod-identity-webhook-installer/api/v1alpha1"
+)
+
+// Handler mutates pods in AdmissionReview requests, with the configuration of the EKSPodIdentityWebhook
+// in Embedded implementation.
+type Handler struct {
+	Client  client.Reader
+	Logger  logr.Logger
+	decoder *admission.Decoder
+}
+
+var _ admission.Handler = &Handler{}
+
+// InjectDecoder is called by the webhook server.
+func (h *Handler) InjectDecoder(d *admission.Decoder) error {
+	h.decoder = d
+	return nil
+}
+
+func (h *Handler) Handle(ctx context.Context, req admission.Request) admission.Response {
+	pod := &corev1.Pod{}
+	if err := h.decoder.Decode(req, pod); err != nil {
+		h.Logger.Error(err, "Failed to decode pod", "UID", req.UID)
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	resource, err := h.embedded(ctx)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	if resource == nil {
+		return admission.Allowed("no EKSPodIdentityWebhook is in Embedded implementation")
+	}
+
+	// The namespace of a pod is empty in the request when it is created by a controller.
+	namespace := req.Namespace
+	name := pod.Spec.ServiceAccountName
+	if name == "" {
+		name = "default"
+	}
+	serviceAccount := &corev1.ServiceAccount{}
+	err = h.Client.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, serviceAccount)
+	if kerrors.IsNotFound(err) {
+		return admission.Allowed("service account is not found")
+	} else if err != nil {
+		h.Logger.Error(err, "Failed to get service account", "Namespace", namespace, "Name", name)
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+
+	if !Mutate(pod, serviceAccount, ConfigFor(resource)) {
+		return admission.Allowed("service account has no role")
+	}
+	mutated, err := json.Marshal(pod)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	h.Logger.V(1).Info("Mutate pod", "Namespace", namespace, "Name", pod.Name, "GenerateName", pod.GenerateName, "ServiceAccount", name)
+	return admission.PatchResponseFromRaw(req.Object.Raw, mutated)
+}
+
+// embedded returns the EKSPodIdentityWebhook in Embedded implementation, or nil when there is none.
+// When there are more than one, the first one by name is used.
+func (h *Handler) embedded(ctx context.Context) (*installerv1alpha1.EKSPodIdentityWebhook, error) {
+	list := installerv1alpha1.EKSPodIdentityWebhookList{}
+	if err := h.Client.List(ctx, &list); err != nil {
+		h.Logger.Error(err, "Failed to list EKSPodIdentityWebhook")
+		return nil, err
+	}
+	sort.Slice(list.Items, func(i, j int) bool { return list.Items[i].Name < list.Items[j].Name })
+	for i := range list.Items {
+		if list.Items[i].Spec.Implementation == installerv1alpha1.ImplementationEmbedded {
+			return &list.Items[i], nil
+		}
+	}
+	return nil, nil
+}
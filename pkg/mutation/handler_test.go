@@ -0,0 +1,224 @@
+package mutation
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	installerv1alpha1 "github.com/h3poteto/eks-pod-identity-webhook-installer/api/v1alpha1"
+)
+
+func embeddedWebhook(name string, webhook installerv1alpha1.WebhookConfig) *installerv1alpha1.EKSPodIdentityWebhook {
+	return &installerv1alpha1.EKSPodIdentityWebhook{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: installerv1alpha1.EKSPodIdentityWebhookSpec{
+			TokenAudience:  "sts.amazonaws.com",
+			Implementation: installerv1alpha1.ImplementationEmbedded,
+			Webhook:        webhook,
+		},
+	}
+}
+
+func serviceAccount(namespace, name string, annotations map[string]string) *corev1.ServiceAccount {
+	return &corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Annotations: annotations},
+	}
+}
+
+// TestHandle serves AdmissionReview requests in testdata, and compares the patched pod with <name>.pod.json.
+// When <name>.pod.json does not exist, the request must be allowed without a patch.
+// The fixtures are written by hand after the source of amazon-eks-pod-identity-webhook. They are not recorded
+// from a running upstream webhook, so compare them with it when the upstream behavior changes.
+func TestHandle(t *testing.T) {
+	appSA := serviceAccount("default", "app", map[string]string{RoleARNAnnotation: "arn:aws:iam::123456789012:role/app"})
+	cases := []struct {
+		name    string
+		objects []client.Object
+	}{
+		{
+			name:    "basic",
+			objects: []client.Object{embeddedWebhook("cluster", installerv1alpha1.WebhookConfig{}), appSA},
+		},
+		{
+			name: "no-role",
+			objects: []client.Object{
+				embeddedWebhook("cluster", installerv1alpha1.WebhookConfig{}),
+				serviceAccount("default", "default", nil),
+			},
+		},
+		{
+			name: "v1",
+			objects: []client.Object{
+				// The first Embedded one by name is used.
+				embeddedWebhook("b", installerv1alpha1.WebhookConfig{}),
+				embeddedWebhook("a", installerv1alpha1.WebhookConfig{AWSDefaultRegion: "ap-northeast-1", STSRegionalEndpoints: true}),
+				serviceAccount("batch", "exporter", map[string]string{
+					RoleARNAnnotation:         "arn:aws:iam::123456789012:role/exporter",
+					AudienceAnnotation:        "exporter.example.com",
+					TokenExpirationAnnotation: "3600",
+				}),
+			},
+		},
+		{
+			name:    "skip-containers",
+			objects: []client.Object{embeddedWebhook("cluster", installerv1alpha1.WebhookConfig{}), appSA},
+		},
+		{
+			name:    "already-mutated",
+			objects: []client.Object{embeddedWebhook("cluster", installerv1alpha1.WebhookConfig{}), appSA},
+		},
+		{
+			// AWS_STS_REGIONAL_ENDPOINTS is not reserved, because it is not enabled.
+			name:    "reserved-env",
+			objects: []client.Object{embeddedWebhook("cluster", installerv1alpha1.WebhookConfig{AWSDefaultRegion: "ap-northeast-1"}), appSA},
+		},
+	}
+
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := installerv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			webhook := &admission.Webhook{Handler: &Handler{
+				Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(c.objects...).Build(),
+				Logger: logf.NullLogger{},
+			}}
+			if err := webhook.InjectLogger(logf.NullLogger{}); err != nil {
+				t.Fatal(err)
+			}
+			if err := webhook.InjectScheme(scheme); err != nil {
+				t.Fatal(err)
+			}
+
+			request, err := ioutil.ReadFile(filepath.Join("testdata", c.name+".request.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			review := serve(t, webhook, request)
+			if !review.Response.Allowed {
+				t.Fatalf("request is not allowed: %v", review.Response.Result)
+			}
+
+			want, err := ioutil.ReadFile(filepath.Join("testdata", c.name+".pod.json"))
+			if err != nil {
+				if len(review.Response.Patch) > 0 {
+					t.Fatalf("pod is patched: %s", review.Response.Patch)
+				}
+				return
+			}
+			patch, err := jsonpatch.DecodePatch(review.Response.Patch)
+			if err != nil {
+				t.Fatalf("invalid patch %s: %v", review.Response.Patch, err)
+			}
+			in := struct {
+				Request struct {
+					Object json.RawMessage `json:"object"`
+				} `json:"request"`
+			}{}
+			if err := json.Unmarshal(request, &in); err != nil {
+				t.Fatal(err)
+			}
+			patched, err := patch.Apply(in.Request.Object)
+			if err != nil {
+				t.Fatalf("failed to apply patch %s: %v", review.Response.Patch, err)
+			}
+			compare(t, want, patched)
+		})
+	}
+}
+
+func TestHandleWithoutEmbedded(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := installerv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	external := embeddedWebhook("cluster", installerv1alpha1.WebhookConfig{})
+	external.Spec.Implementation = installerv1alpha1.ImplementationExternal
+	webhook := &admission.Webhook{Handler: &Handler{
+		Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+			external,
+			serviceAccount("default", "app", map[string]string{RoleARNAnnotation: "arn:aws:iam::123456789012:role/app"}),
+		).Build(),
+		Logger: logf.NullLogger{},
+	}}
+	if err := webhook.InjectLogger(logf.NullLogger{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := webhook.InjectScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	request, err := ioutil.ReadFile(filepath.Join("testdata", "basic.request.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	review := serve(t, webhook, request)
+	if !review.Response.Allowed || len(review.Response.Patch) > 0 {
+		t.Fatalf("pod must be allowed without a patch, but got %+v", review.Response)
+	}
+}
+
+func serve(t *testing.T, webhook *admission.Webhook, request []byte) *admissionv1.AdmissionReview {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/mutate-v1-pod", bytes.NewReader(request))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	webhook.ServeHTTP(rec, req)
+
+	review := &admissionv1.AdmissionReview{}
+	if err := json.Unmarshal(rec.Body.Bytes(), review); err != nil {
+		t.Fatalf("invalid response %s: %v", rec.Body.String(), err)
+	}
+	in := metav1.TypeMeta{}
+	if err := json.Unmarshal(request, &in); err != nil {
+		t.Fatal(err)
+	}
+	if review.APIVersion != in.APIVersion {
+		t.Errorf("response is %s, but request is %s", review.APIVersion, in.APIVersion)
+	}
+	if review.Response == nil {
+		t.Fatalf("response is empty: %s", rec.Body.String())
+	}
+	return review
+}
+
+// compare decodes both pods, so that the order of fields and omitted empty values do not matter.
+func compare(t *testing.T, want, got []byte) {
+	t.Helper()
+	wantPod := corev1.Pod{}
+	if err := json.Unmarshal(want, &wantPod); err != nil {
+		t.Fatal(err)
+	}
+	gotPod := corev1.Pod{}
+	if err := json.Unmarshal(got, &gotPod); err != nil {
+		t.Fatal(err)
+	}
+	if !equality.Semantic.DeepEqual(wantPod, gotPod) {
+		w, _ := json.MarshalIndent(wantPod, "", "  ")
+		g, _ := json.MarshalIndent(gotPod, "", "  ")
+		t.Errorf("mutated pod differs\nwant: %s\ngot: %s", w, g)
+	}
+}
@@ -0,0 +1,173 @@
+// Package mutation injects credentials of IAM roles for service accounts into pods,
+// in the same way as amazon-eks-pod-identity-webhook.
+// https://github.com/aws/amazon-eks-pod-identity-webhook
+package mutation
+
+import (
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+
+	installerv1alpha1 "github.com/h3poteto/eks-pod-identity-webhook-installer/api/v1alpha1"
+	"github.com/h3poteto/eks-pod-identity-webhook-installer/pkg/provider"
+)
+
+const (
+	// AnnotationPrefix is the prefix of annotations, which --annotation-prefix sets in the upstream webhook.
+	AnnotationPrefix = provider.AWSAnnotationPrefix
+
+	// RoleARNAnnotation on a ServiceAccount is the role which pods assume.
+	RoleARNAnnotation = provider.AWSRoleARNAnnotation
+	// AudienceAnnotation on a ServiceAccount overrides the audience of the token.
+	AudienceAnnotation = AnnotationPrefix + "/audience"
+	// STSRegionalEndpointsAnnotation on a ServiceAccount sets AWS_STS_REGIONAL_ENDPOINTS=regional when it is "true".
+	STSRegionalEndpointsAnnotation = AnnotationPrefix + "/sts-regional-endpoints"
+	// TokenExpirationAnnotation on a ServiceAccount overrides the expiration of the token in seconds.
+	TokenExpirationAnnotation = AnnotationPrefix + "/token-expiration"
+	// SkipContainersAnnotation on a pod is a comma separated list of containers which are not mutated.
+	SkipContainersAnnotation = AnnotationPrefix + "/skip-containers"
+
+	VolumeName     = "aws-iam-token"
+	TokenMountPath = "/var/run/secrets/eks.amazonaws.com/serviceaccount"
+	TokenFileName  = "token"
+
+	DefaultTokenExpiration int64 = 86400
+	// MinTokenExpiration is the shortest expiration which kubelet accepts.
+	MinTokenExpiration int64 = 600
+)
+
+// Config is what the upstream webhook takes from command line flags.
+type Config struct {
+	// Audience is the audience of the token, unless the ServiceAccount overrides it.
+	Audience string
+	// Region sets AWS_DEFAULT_REGION and AWS_REGION when it is not empty.
+	Region string
+	// RegionalSTS sets AWS_STS_REGIONAL_ENDPOINTS=regional for every ServiceAccount.
+	RegionalSTS bool
+}
+
+// ConfigFor returns the configuration of the resource.
+func ConfigFor(resource *installerv1alpha1.EKSPodIdentityWebhook) Config {
+	return Config{
+		Audience:    resource.Spec.TokenAudience,
+		Region:      resource.Spec.Webhook.AWSDefaultRegion,
+		RegionalSTS: resource.Spec.Webhook.STSRegionalEndpoints,
+	}
+}
+
+// Mutate injects environment variables, a volume mount and the projected token volume into pod,
+// when the ServiceAccount has a role. It returns false when pod is not changed.
+// Containers in SkipContainersAnnotation, and containers which already define any of the injected variables, are left as they are.
+func Mutate(pod *corev1.Pod, serviceAccount *corev1.ServiceAccount, config Config) bool {
+	roleARN := serviceAccount.Annotations[RoleARNAnnotation]
+	if roleARN == "" {
+		return false
+	}
+	audience := config.Audience
+	if v, ok := serviceAccount.Annotations[AudienceAnnotation]; ok && v != "" {
+		audience = v
+	}
+	regionalSTS := config.RegionalSTS
+	if v, ok := serviceAccount.Annotations[STSRegionalEndpointsAnnotation]; ok {
+		regionalSTS = v == "true"
+	}
+	expiration := DefaultTokenExpiration
+	if v, ok := serviceAccount.Annotations[TokenExpirationAnnotation]; ok {
+		if seconds, err := strconv.ParseInt(v, 10, 64); err == nil {
+			expiration = seconds
+		}
+	}
+	if expiration < MinTokenExpiration {
+		expiration = MinTokenExpiration
+	}
+
+	env := []corev1.EnvVar{}
+	if regionalSTS {
+		env = append(env, corev1.EnvVar{Name: "AWS_STS_REGIONAL_ENDPOINTS", Value: "regional"})
+	}
+	if config.Region != "" {
+		env = append(env,
+			corev1.EnvVar{Name: "AWS_DEFAULT_REGION", Value: config.Region},
+			corev1.EnvVar{Name: "AWS_REGION", Value: config.Region},
+		)
+	}
+	env = append(env,
+		corev1.EnvVar{Name: provider.AWSRoleARNEnv, Value: roleARN},
+		corev1.EnvVar{Name: "AWS_WEB_IDENTITY_TOKEN_FILE", Value: TokenMountPath + "/" + TokenFileName},
+	)
+
+	skip := map[string]bool{}
+	for _, name := range strings.Split(pod.Annotations[SkipContainersAnnotation], ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			skip[name] = true
+		}
+	}
+
+	changed := false
+	for _, containers := range [][]corev1.Container{pod.Spec.InitContainers, pod.Spec.Containers} {
+		for i := range containers {
+			if skip[containers[i].Name] {
+				continue
+			}
+			if mutateContainer(&containers[i], env) {
+				changed = true
+			}
+		}
+	}
+	if !changed {
+		return false
+	}
+
+	for _, v := range pod.Spec.Volumes {
+		if v.Name == VolumeName {
+			return true
+		}
+	}
+	// The upstream webhook adds the volume at the head.
+	volume := corev1.Volume{
+		Name: VolumeName,
+		VolumeSource: corev1.VolumeSource{
+			Projected: &corev1.ProjectedVolumeSource{
+				Sources: []corev1.VolumeProjection{
+					{
+						ServiceAccountToken: &corev1.ServiceAccountTokenProjection{
+							Audience:          audience,
+							ExpirationSeconds: &expiration,
+							Path:              TokenFileName,
+						},
+					},
+				},
+			},
+		},
+	}
+	pod.Spec.Volumes = append([]corev1.Volume{volume}, pod.Spec.Volumes...)
+	return true
+}
+
+// mutateContainer appends env and the token mount to the container. Like the upstream webhook, the container is skipped
+// entirely when it defines any variable in env, which are AWS_ROLE_ARN and AWS_WEB_IDENTITY_TOKEN_FILE, and the region
+// and STS variables when they are enabled.
+func mutateContainer(container *corev1.Container, env []corev1.EnvVar) bool {
+	reserved := map[string]bool{}
+	for _, e := range env {
+		reserved[e.Name] = true
+	}
+	for _, e := range container.Env {
+		if reserved[e.Name] {
+			return false
+		}
+	}
+	container.Env = append(container.Env, env...)
+	for _, m := range container.VolumeMounts {
+		if m.MountPath == TokenMountPath {
+			return true
+		}
+	}
+	container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+		Name:      VolumeName,
+		ReadOnly:  true,
+		MountPath: TokenMountPath,
+	})
+	return true
+}
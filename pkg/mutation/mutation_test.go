@@ -0,0 +1,52 @@
+package mutation
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestMutateReservedEnv(t *testing.T) {
+	cases := []struct {
+		name    string
+		env     string
+		config  Config
+		mutated bool
+	}{
+		{name: "AWS_ROLE_ARN", env: "AWS_ROLE_ARN", mutated: false},
+		{name: "AWS_WEB_IDENTITY_TOKEN_FILE", env: "AWS_WEB_IDENTITY_TOKEN_FILE", mutated: false},
+		{name: "AWS_REGION with region", env: "AWS_REGION", config: Config{Region: "us-east-1"}, mutated: false},
+		{name: "AWS_DEFAULT_REGION with region", env: "AWS_DEFAULT_REGION", config: Config{Region: "us-east-1"}, mutated: false},
+		{name: "AWS_REGION without region", env: "AWS_REGION", mutated: true},
+		{name: "AWS_STS_REGIONAL_ENDPOINTS with regional STS", env: "AWS_STS_REGIONAL_ENDPOINTS", config: Config{RegionalSTS: true}, mutated: false},
+		{name: "AWS_STS_REGIONAL_ENDPOINTS without regional STS", env: "AWS_STS_REGIONAL_ENDPOINTS", mutated: true},
+		{name: "other", env: "AWS_PROFILE", config: Config{Region: "us-east-1", RegionalSTS: true}, mutated: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			pod := &corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{{
+				Name: "app",
+				Env:  []corev1.EnvVar{{Name: c.env, Value: "defined"}},
+			}}}}
+			serviceAccount := &corev1.ServiceAccount{}
+			serviceAccount.Annotations = map[string]string{RoleARNAnnotation: "arn:aws:iam::123456789012:role/app"}
+
+			if got := Mutate(pod, serviceAccount, c.config); got != c.mutated {
+				t.Fatalf("mutated is %v, want %v", got, c.mutated)
+			}
+			container := pod.Spec.Containers[0]
+			if !c.mutated {
+				if len(container.Env) != 1 || len(container.VolumeMounts) != 0 || len(pod.Spec.Volumes) != 0 {
+					t.Errorf("pod is changed: %+v", pod.Spec)
+				}
+				return
+			}
+			if container.Env[0].Value != "defined" {
+				t.Errorf("defined variable is changed: %+v", container.Env)
+			}
+			if len(container.VolumeMounts) != 1 || len(pod.Spec.Volumes) != 1 {
+				t.Errorf("token is not mounted: %+v", pod.Spec)
+			}
+		})
+	}
+}
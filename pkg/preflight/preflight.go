@@ -0,0 +1,241 @@
+// Package preflight verifies that the cluster can run pod-identity-webhook before the installer creates anything.
+package preflight
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	installerv1alpha1 "github.com/h3poteto/eks-pod-identity-webhook-installer/api/v1alpha1"
+	"github.com/h3poteto/eks-pod-identity-webhook-installer/pkg/generator"
+)
+
+const (
+	CheckNamespace       = "Namespace"
+	CheckCSRAPI          = "CertificateSigningRequestAPI"
+	CheckTokenRequest    = "TokenRequest"
+	CheckWebhookConflict = "MutatingWebhookConfiguration"
+
+	// testServiceAccountName is the ServiceAccount used to issue a test token.
+	// It exists in every namespace, so we don't have to create anything.
+	testServiceAccountName = "default"
+	// 10 minutes is the minimum expiration the API server accepts.
+	testTokenExpirationSeconds = 600
+)
+
+// Result is the outcome of a single preflight check.
+type Result struct {
+	Name    string
+	Passed  bool
+	Message string
+}
+
+// Checker runs preflight checks against a cluster.
+type Checker struct {
+	Client    client.Client
+	Clientset kubernetes.Interface
+}
+
+// Run executes every check for the resource and returns the results in order.
+func (c *Checker) Run(ctx context.Context, resource *installerv1alpha1.EKSPodIdentityWebhook) []Result {
+	results := []Result{}
+	nsResult := c.checkNamespace(ctx, resource.Spec.Namespace)
+	results = append(results, nsResult)
+	results = append(results, c.checkCSRAPI())
+	if nsResult.Passed {
+		results = append(results, c.checkTokenRequest(ctx, resource.Spec.Namespace, resource.Spec.TokenAudience))
+	} else {
+		results = append(results, Result{
+			Name:    CheckTokenRequest,
+			Passed:  false,
+			Message: "skipped because namespace does not exist",
+		})
+	}
+	results = append(results, c.checkWebhookConflict(ctx, resource))
+	return results
+}
+
+// Passed returns true if all results passed.
+func Passed(results []Result) bool {
+	for _, r := range results {
+		if !r.Passed {
+			return false
+		}
+	}
+	return true
+}
+
+// Summary formats results into a message which is suitable for a condition.
+func Summary(results []Result) string {
+	lines := make([]string, 0, len(results))
+	for _, r := range results {
+		status := "ok"
+		if !r.Passed {
+			status = "failed"
+		}
+		lines = append(lines, fmt.Sprintf("%s %s: %s", r.Name, status, r.Message))
+	}
+	return strings.Join(lines, "; ")
+}
+
+func (c *Checker) checkNamespace(ctx context.Context, namespace string) Result {
+	ns := corev1.Namespace{}
+	err := c.Client.Get(ctx, types.NamespacedName{Name: namespace}, &ns)
+	if kerrors.IsNotFound(err) {
+		return Result{Name: CheckNamespace, Passed: false, Message: fmt.Sprintf("namespace %s does not exist", namespace)}
+	} else if err != nil {
+		return Result{Name: CheckNamespace, Passed: false, Message: fmt.Sprintf("failed to get namespace %s: %v", namespace, err)}
+	}
+	if ns.Status.Phase == corev1.NamespaceTerminating {
+		return Result{Name: CheckNamespace, Passed: false, Message: fmt.Sprintf("namespace %s is terminating", namespace)}
+	}
+	return Result{Name: CheckNamespace, Passed: true, Message: fmt.Sprintf("namespace %s exists", namespace)}
+}
+
+func (c *Checker) checkCSRAPI() Result {
+	resources, err := c.Clientset.Discovery().ServerResourcesForGroupVersion("certificates.k8s.io/v1")
+	if err != nil {
+		return Result{Name: CheckCSRAPI, Passed: false, Message: fmt.Sprintf("certificates.k8s.io/v1 is not served: %v", err)}
+	}
+	for _, r := range resources.APIResources {
+		if r.Name == "certificatesigningrequests" {
+			return Result{Name: CheckCSRAPI, Passed: true, Message: "certificates.k8s.io/v1 CertificateSigningRequest is available"}
+		}
+	}
+	return Result{Name: CheckCSRAPI, Passed: false, Message: "certificates.k8s.io/v1 does not serve certificatesigningrequests"}
+}
+
+func (c *Checker) checkTokenRequest(ctx context.Context, namespace, audience string) Result {
+	token, err := requestToken(ctx, c.Clientset, namespace, audience)
+	if err != nil {
+		return Result{
+			Name:    CheckTokenRequest,
+			Passed:  false,
+			Message: fmt.Sprintf("TokenRequest for %s/%s failed, kube-apiserver may lack --service-account-issuer, --service-account-signing-key-file or --api-audiences: %v", namespace, testServiceAccountName, err),
+		}
+	}
+	claims, err := decodeClaims(token)
+	if err != nil {
+		return Result{Name: CheckTokenRequest, Passed: false, Message: fmt.Sprintf("failed to decode projected token: %v", err)}
+	}
+	if claims.Issuer == "" {
+		return Result{Name: CheckTokenRequest, Passed: false, Message: "projected token has no iss claim, kube-apiserver needs --service-account-issuer"}
+	}
+	if !contains(claims.Audiences, audience) {
+		return Result{
+			Name:    CheckTokenRequest,
+			Passed:  false,
+			Message: fmt.Sprintf("projected token has aud %v which does not include %s, check --api-audiences of kube-apiserver", claims.Audiences, audience),
+		}
+	}
+	return Result{Name: CheckTokenRequest, Passed: true, Message: fmt.Sprintf("issuer is %s and audience %s is accepted", claims.Issuer, audience)}
+}
+
+func (c *Checker) checkWebhookConflict(ctx context.Context, resource *installerv1alpha1.EKSPodIdentityWebhook) Result {
+	mutating := admissionregistrationv1.MutatingWebhookConfiguration{}
+	err := c.Client.Get(ctx, types.NamespacedName{Name: generator.MutatingWebhookconfigurationName}, &mutating)
+	if kerrors.IsNotFound(err) {
+		return Result{Name: CheckWebhookConflict, Passed: true, Message: "no conflicting MutatingWebhookConfiguration"}
+	} else if err != nil {
+		return Result{Name: CheckWebhookConflict, Passed: false, Message: fmt.Sprintf("failed to get MutatingWebhookConfiguration %s: %v", generator.MutatingWebhookconfigurationName, err)}
+	}
+	if !metav1.IsControlledBy(&mutating, resource) {
+		if resource.Spec.AdoptExisting {
+			return Result{
+				Name:    CheckWebhookConflict,
+				Passed:  true,
+				Message: fmt.Sprintf("MutatingWebhookConfiguration %s already exists and will be adopted", mutating.Name),
+			}
+		}
+		return Result{
+			Name:    CheckWebhookConflict,
+			Passed:  false,
+			Message: fmt.Sprintf("MutatingWebhookConfiguration %s already exists and is not owned by %s, set spec.adoptExisting to adopt it", mutating.Name, resource.Name),
+		}
+	}
+	return Result{Name: CheckWebhookConflict, Passed: true, Message: fmt.Sprintf("MutatingWebhookConfiguration %s is owned by %s", mutating.Name, resource.Name)}
+}
+
+// TokenIssuer returns the iss claim of a token of the default ServiceAccount in namespace, which is issued for audience.
+func TokenIssuer(ctx context.Context, clientset kubernetes.Interface, namespace, audience string) (string, error) {
+	token, err := requestToken(ctx, clientset, namespace, audience)
+	if err != nil {
+		return "", err
+	}
+	claims, err := decodeClaims(token)
+	if err != nil {
+		return "", err
+	}
+	return claims.Issuer, nil
+}
+
+func requestToken(ctx context.Context, clientset kubernetes.Interface, namespace, audience string) (string, error) {
+	req := &authenticationv1.TokenRequest{
+		Spec: authenticationv1.TokenRequestSpec{
+			Audiences:         []string{audience},
+			ExpirationSeconds: pointer.Int64Ptr(testTokenExpirationSeconds),
+		},
+	}
+	res, err := clientset.CoreV1().ServiceAccounts(namespace).CreateToken(ctx, testServiceAccountName, req, metav1.CreateOptions{})
+	if err != nil {
+		return "", err
+	}
+	return res.Status.Token, nil
+}
+
+type claims struct {
+	Issuer    string
+	Audiences []string
+}
+
+// decodeClaims reads iss and aud from a JWT without verifying the signature.
+// The token is issued by the API server for us, so we only need to inspect it.
+func decodeClaims(token string) (*claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("token has %d segments", len(parts))
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, err
+	}
+	raw := struct {
+		Iss string          `json:"iss"`
+		Aud json.RawMessage `json:"aud"`
+	}{}
+	if err := json.Unmarshal(payload, &raw); err != nil {
+		return nil, err
+	}
+	c := &claims{Issuer: raw.Iss}
+	// aud is either a string or an array of strings.
+	if len(raw.Aud) > 0 {
+		var single string
+		if err := json.Unmarshal(raw.Aud, &single); err == nil {
+			c.Audiences = []string{single}
+		} else if err := json.Unmarshal(raw.Aud, &c.Audiences); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,292 @@
+package preflight
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	fakeclientset "k8s.io/client-go/kubernetes/fake"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	k8stesting "k8s.io/client-go/testing"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	installerv1alpha1 "github.com/h3poteto/eks-pod-identity-webhook-installer/api/v1alpha1"
+	"github.com/h3poteto/eks-pod-identity-webhook-installer/pkg/generator"
+)
+
+func jwt(payload string) string {
+	return "eyJhbGciOiJSUzI1NiJ9." + base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".c2lnbmF0dXJl"
+}
+
+func TestDecodeClaims(t *testing.T) {
+	cases := []struct {
+		name    string
+		token   string
+		want    *claims
+		wantErr bool
+	}{
+		{
+			name:  "string aud",
+			token: jwt(`{"iss":"https://oidc.example.com","aud":"sts.amazonaws.com"}`),
+			want:  &claims{Issuer: "https://oidc.example.com", Audiences: []string{"sts.amazonaws.com"}},
+		},
+		{
+			name:  "array aud",
+			token: jwt(`{"iss":"https://oidc.example.com","aud":["sts.amazonaws.com","https://kubernetes.default.svc"]}`),
+			want:  &claims{Issuer: "https://oidc.example.com", Audiences: []string{"sts.amazonaws.com", "https://kubernetes.default.svc"}},
+		},
+		{
+			name:  "no aud",
+			token: jwt(`{"iss":"https://oidc.example.com"}`),
+			want:  &claims{Issuer: "https://oidc.example.com"},
+		},
+		{
+			// Some encoders keep the padding, which is not valid in base64url of JWT but is accepted.
+			name:  "padded payload",
+			token: "eyJhbGciOiJSUzI1NiJ9." + base64.URLEncoding.EncodeToString([]byte(`{"iss":"a","aud":"b"}`)) + ".c2ln",
+			want:  &claims{Issuer: "a", Audiences: []string{"b"}},
+		},
+		{
+			name:    "two segments",
+			token:   "eyJhbGciOiJSUzI1NiJ9.e30",
+			wantErr: true,
+		},
+		{
+			name:    "invalid base64",
+			token:   "eyJhbGciOiJSUzI1NiJ9.!!!.c2ln",
+			wantErr: true,
+		},
+		{
+			name:    "invalid json",
+			token:   jwt(`{"iss":`),
+			wantErr: true,
+		},
+		{
+			name:    "invalid aud",
+			token:   jwt(`{"iss":"a","aud":1}`),
+			wantErr: true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := decodeClaims(c.token)
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, but got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("want %+v, but got %+v", c.want, got)
+			}
+		})
+	}
+}
+
+func TestSummary(t *testing.T) {
+	cases := []struct {
+		name    string
+		results []Result
+		want    string
+		passed  bool
+	}{
+		{
+			name:   "empty",
+			want:   "",
+			passed: true,
+		},
+		{
+			name: "passed",
+			results: []Result{
+				{Name: CheckNamespace, Passed: true, Message: "namespace default exists"},
+				{Name: CheckCSRAPI, Passed: true, Message: "certificates.k8s.io/v1 is served"},
+			},
+			want:   "Namespace ok: namespace default exists; CertificateSigningRequestAPI ok: certificates.k8s.io/v1 is served",
+			passed: true,
+		},
+		{
+			name: "failed",
+			results: []Result{
+				{Name: CheckNamespace, Passed: true, Message: "namespace default exists"},
+				{Name: CheckTokenRequest, Passed: false, Message: "projected token has no iss claim"},
+			},
+			want:   "Namespace ok: namespace default exists; TokenRequest failed: projected token has no iss claim",
+			passed: false,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := Summary(c.results); got != c.want {
+				t.Errorf("want %q, but got %q", c.want, got)
+			}
+			if got := Passed(c.results); got != c.passed {
+				t.Errorf("Passed returns %v", got)
+			}
+		})
+	}
+}
+
+// cluster is a fake cluster which the checks run against.
+type cluster struct {
+	objects []client.Object
+	// csr is true when certificates.k8s.io/v1 serves certificatesigningrequests.
+	csr bool
+	// token is returned from TokenRequest, and tokenErr fails it.
+	token    string
+	tokenErr error
+}
+
+func (c cluster) checker(t *testing.T) *Checker {
+	t.Helper()
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	clientset := fakeclientset.NewSimpleClientset()
+	if c.csr {
+		clientset.Discovery().(*fakediscovery.FakeDiscovery).Resources = []*metav1.APIResourceList{
+			{GroupVersion: "certificates.k8s.io/v1", APIResources: []metav1.APIResource{{Name: "certificatesigningrequests"}}},
+		}
+	}
+	clientset.PrependReactor("create", "serviceaccounts", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "token" {
+			return false, nil, nil
+		}
+		if c.tokenErr != nil {
+			return true, nil, c.tokenErr
+		}
+		req := action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenRequest).DeepCopy()
+		req.Status.Token = c.token
+		return true, req, nil
+	})
+	return &Checker{
+		Client:    fake.NewClientBuilder().WithScheme(scheme).WithObjects(c.objects...).Build(),
+		Clientset: clientset,
+	}
+}
+
+func TestRun(t *testing.T) {
+	resource := &installerv1alpha1.EKSPodIdentityWebhook{
+		ObjectMeta: metav1.ObjectMeta{Name: "cluster", UID: "resource-uid"},
+		Spec:       installerv1alpha1.EKSPodIdentityWebhookSpec{Namespace: "webhook", TokenAudience: "sts.amazonaws.com"},
+	}
+	namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "webhook"}}
+	terminating := namespace.DeepCopy()
+	terminating.Status.Phase = corev1.NamespaceTerminating
+	valid := jwt(`{"iss":"https://oidc.example.com","aud":["sts.amazonaws.com"]}`)
+	mutating := func(owners []metav1.OwnerReference) *admissionregistrationv1.MutatingWebhookConfiguration {
+		return &admissionregistrationv1.MutatingWebhookConfiguration{ObjectMeta: metav1.ObjectMeta{
+			Name:            generator.MutatingWebhookconfigurationName,
+			OwnerReferences: owners,
+		}}
+	}
+	controller := true
+	owned := []metav1.OwnerReference{{APIVersion: "installer.h3poteto.dev/v1alpha1", Kind: "EKSPodIdentityWebhook", Name: resource.Name, UID: resource.UID, Controller: &controller}}
+
+	cases := []struct {
+		name    string
+		cluster cluster
+		adopt   bool
+		check   string
+		passed  bool
+		message string
+	}{
+		{name: "namespace exists", cluster: cluster{objects: []client.Object{namespace}}, check: CheckNamespace, passed: true},
+		{name: "namespace does not exist", check: CheckNamespace, message: "namespace webhook does not exist"},
+		{name: "namespace is terminating", cluster: cluster{objects: []client.Object{terminating}}, check: CheckNamespace, message: "is terminating"},
+		{name: "CSR API is served", cluster: cluster{csr: true}, check: CheckCSRAPI, passed: true},
+		{name: "CSR API is not served", check: CheckCSRAPI, message: "is not served"},
+		{
+			name:    "token is issued",
+			cluster: cluster{objects: []client.Object{namespace}, token: valid},
+			check:   CheckTokenRequest,
+			passed:  true,
+			message: "issuer is https://oidc.example.com",
+		},
+		{
+			name:    "TokenRequest fails",
+			cluster: cluster{objects: []client.Object{namespace}, tokenErr: errors.New("the server could not find the requested resource")},
+			check:   CheckTokenRequest,
+			message: "--service-account-issuer",
+		},
+		{
+			name:    "token has no issuer",
+			cluster: cluster{objects: []client.Object{namespace}, token: jwt(`{"aud":"sts.amazonaws.com"}`)},
+			check:   CheckTokenRequest,
+			message: "has no iss claim",
+		},
+		{
+			name:    "token has another audience",
+			cluster: cluster{objects: []client.Object{namespace}, token: jwt(`{"iss":"https://oidc.example.com","aud":"https://kubernetes.default.svc"}`)},
+			check:   CheckTokenRequest,
+			message: "--api-audiences",
+		},
+		{
+			// A token is not requested in a namespace which does not exist.
+			name:    "TokenRequest without namespace",
+			cluster: cluster{token: valid},
+			check:   CheckTokenRequest,
+			message: "skipped",
+		},
+		{name: "no MutatingWebhookConfiguration", check: CheckWebhookConflict, passed: true},
+		{
+			name:    "conflicting MutatingWebhookConfiguration",
+			cluster: cluster{objects: []client.Object{mutating(nil)}},
+			check:   CheckWebhookConflict,
+			message: "set spec.adoptExisting",
+		},
+		{
+			name:    "adopted MutatingWebhookConfiguration",
+			cluster: cluster{objects: []client.Object{mutating(nil)}},
+			adopt:   true,
+			check:   CheckWebhookConflict,
+			passed:  true,
+			message: "will be adopted",
+		},
+		{
+			name:    "owned MutatingWebhookConfiguration",
+			cluster: cluster{objects: []client.Object{mutating(owned)}},
+			check:   CheckWebhookConflict,
+			passed:  true,
+			message: "is owned by cluster",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := resource.DeepCopy()
+			r.Spec.AdoptExisting = c.adopt
+			results := c.cluster.checker(t).Run(context.Background(), r)
+			names := []string{}
+			for _, result := range results {
+				names = append(names, result.Name)
+			}
+			if want := []string{CheckNamespace, CheckCSRAPI, CheckTokenRequest, CheckWebhookConflict}; !reflect.DeepEqual(names, want) {
+				t.Fatalf("checks are %v, want %v", names, want)
+			}
+			for _, result := range results {
+				if result.Name != c.check {
+					continue
+				}
+				if result.Passed != c.passed {
+					t.Errorf("passed is %v: %s", result.Passed, result.Message)
+				}
+				if !strings.Contains(result.Message, c.message) {
+					t.Errorf("message is %q, want %q", result.Message, c.message)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+// Package profile has defaults of Kubernetes distributions, which fill fields left unset in the spec,
+// and detects the distribution of a cluster for spec.profile: auto.
+package profile
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	installerv1alpha1 "github.com/h3poteto/eks-pod-identity-webhook-installer/api/v1alpha1"
+)
+
+const (
+	// IssuerSourceAPIServerPod reads --service-account-issuer of the kube-apiserver pod.
+	IssuerSourceAPIServerPod = "APIServerPod"
+	// IssuerSourceTokenRequest reads the iss claim of a token issued by TokenRequest,
+	// because the API server does not run as a pod.
+	IssuerSourceTokenRequest = "TokenRequest"
+
+	// kubeadmAdvertiseAddressAnnotation is set on the kube-apiserver pod by kubeadm.
+	kubeadmAdvertiseAddressAnnotation = "kubeadm.kubernetes.io/kube-apiserver.advertise-address.endpoint"
+	// kopsInstanceGroupLabel is set on nodes by kops.
+	kopsInstanceGroupLabel = "kops.k8s.io/instancegroup"
+	// instanceTypeLabel is k3s or rke2 on nodes of these distributions, which run their own cloud controller.
+	instanceTypeLabel = "node.kubernetes.io/instance-type"
+	// issuerFlag is the flag of kube-apiserver which sets iss of service account tokens.
+	issuerFlag = "--service-account-issuer="
+	// detectNodes is how many nodes are inspected. Every node of a cluster runs the same distribution.
+	detectNodes = 10
+)
+
+var (
+	controlPlaneTolerations = []corev1.Toleration{
+		{Key: "node-role.kubernetes.io/control-plane", Operator: corev1.TolerationOpExists, Effect: corev1.TaintEffectNoSchedule},
+		{Key: "node-role.kubernetes.io/master", Operator: corev1.TolerationOpExists, Effect: corev1.TaintEffectNoSchedule},
+	}
+	criticalAddonsOnlyToleration = corev1.Toleration{Key: "CriticalAddonsOnly", Operator: corev1.TolerationOpExists}
+	etcdToleration               = corev1.Toleration{Key: "node-role.kubernetes.io/etcd", Operator: corev1.TolerationOpExists, Effect: corev1.TaintEffectNoExecute}
+)
+
+// Values are defaults of a distribution.
+type Values struct {
+	NetworkMode string
+	CASource    string
+	Tolerations []corev1.Toleration
+	// IssuerSource is where the service account issuer is read.
+	IssuerSource string
+	// apiServerLabels select the kube-apiserver pods in kube-system.
+	apiServerLabels map[string]string
+}
+
+var profiles = map[string]Values{
+	installerv1alpha1.ProfileKops: {
+		NetworkMode:     installerv1alpha1.NetworkModeService,
+		CASource:        installerv1alpha1.CASourceRootCAConfigMap,
+		Tolerations:     controlPlaneTolerations,
+		IssuerSource:    IssuerSourceAPIServerPod,
+		apiServerLabels: map[string]string{"k8s-app": "kube-apiserver"},
+	},
+	installerv1alpha1.ProfileKubeadm: {
+		NetworkMode:     installerv1alpha1.NetworkModeService,
+		CASource:        installerv1alpha1.CASourceRootCAConfigMap,
+		Tolerations:     controlPlaneTolerations,
+		IssuerSource:    IssuerSourceAPIServerPod,
+		apiServerLabels: map[string]string{"component": "kube-apiserver"},
+	},
+	// The API server of k3s runs in the k3s process, which has no pod network when a server is started without an agent.
+	installerv1alpha1.ProfileK3s: {
+		NetworkMode:  installerv1alpha1.NetworkModeHostNetwork,
+		CASource:     installerv1alpha1.CASourceRootCAConfigMap,
+		Tolerations:  append([]corev1.Toleration{criticalAddonsOnlyToleration}, controlPlaneTolerations...),
+		IssuerSource: IssuerSourceTokenRequest,
+	},
+	installerv1alpha1.ProfileRKE2: {
+		NetworkMode:     installerv1alpha1.NetworkModeService,
+		CASource:        installerv1alpha1.CASourceRootCAConfigMap,
+		Tolerations:     append([]corev1.Toleration{criticalAddonsOnlyToleration, etcdToleration}, controlPlaneTolerations...),
+		IssuerSource:    IssuerSourceAPIServerPod,
+		apiServerLabels: map[string]string{"component": "kube-apiserver"},
+	},
+}
+
+// Get returns defaults of the named profile. It returns false for auto and unknown names.
+func Get(name string) (Values, bool) {
+	v, ok := profiles[name]
+	return v, ok
+}
+
+// Apply fills network.mode, network.caSource and webhook.tolerations of the resource, which are not set, with values.
+// The resource is changed only in memory, so the spec stored in the cluster keeps what the user wrote.
+func Apply(resource *installerv1alpha1.EKSPodIdentityWebhook, values Values) {
+	if resource.Spec.Network.Mode == "" {
+		resource.Spec.Network.Mode = values.NetworkMode
+	}
+	if resource.Spec.Network.CASource == "" {
+		resource.Spec.Network.CASource = values.CASource
+	}
+	if len(resource.Spec.Webhook.Tolerations) == 0 && len(values.Tolerations) > 0 {
+		resource.Spec.Webhook.Tolerations = append([]corev1.Toleration{}, values.Tolerations...)
+	}
+}
+
+// Effective returns a copy of the resource whose unset fields are filled with its profile, as the controller does
+// before generating objects. The distribution recorded in status.profile is preferred, because auto is resolved there.
+// Readers of the stored resource, such as the doctor and the CSR controller, use it to see the effective spec.
+func Effective(resource *installerv1alpha1.EKSPodIdentityWebhook) *installerv1alpha1.EKSPodIdentityWebhook {
+	resource = resource.DeepCopy()
+	if resource.Spec.Profile == "" {
+		return resource
+	}
+	name := resource.Spec.Profile
+	if resource.Status.Profile != nil && resource.Status.Profile.Name != "" {
+		name = resource.Status.Profile.Name
+	}
+	if values, ok := Get(name); ok {
+		Apply(resource, values)
+	}
+	return resource
+}
+
+// Detect returns the distribution of the cluster and how it was detected, or an empty name when it is unknown.
+// Nodes are inspected first, because k3s and rke2 are identified by kubelet versions and labels,
+// then kube-apiserver pods in kube-system, which kubeadm annotates.
+func Detect(ctx context.Context, reader client.Reader) (string, string, error) {
+	nodes := corev1.NodeList{}
+	if err := reader.List(ctx, &nodes, client.Limit(detectNodes)); err != nil {
+		return "", "", fmt.Errorf("failed to list nodes: %w", err)
+	}
+	for _, node := range nodes.Items {
+		version := node.Status.NodeInfo.KubeletVersion
+		switch {
+		case strings.Contains(version, "+k3s"):
+			return installerv1alpha1.ProfileK3s, fmt.Sprintf("kubelet %s of node %s", version, node.Name), nil
+		case strings.Contains(version, "+rke2"):
+			return installerv1alpha1.ProfileRKE2, fmt.Sprintf("kubelet %s of node %s", version, node.Name), nil
+		}
+		switch node.Labels[instanceTypeLabel] {
+		case installerv1alpha1.ProfileK3s, installerv1alpha1.ProfileRKE2:
+			return node.Labels[instanceTypeLabel], fmt.Sprintf("label %s of node %s", instanceTypeLabel, node.Name), nil
+		}
+		if _, ok := node.Labels[kopsInstanceGroupLabel]; ok {
+			return installerv1alpha1.ProfileKops, fmt.Sprintf("label %s of node %s", kopsInstanceGroupLabel, node.Name), nil
+		}
+	}
+
+	for _, name := range []string{installerv1alpha1.ProfileKops, installerv1alpha1.ProfileKubeadm} {
+		pods, err := apiServerPods(ctx, reader, profiles[name].apiServerLabels)
+		if err != nil {
+			return "", "", err
+		}
+		for _, pod := range pods {
+			if name == installerv1alpha1.ProfileKops {
+				return name, fmt.Sprintf("kube-apiserver pod %s/%s", pod.Namespace, pod.Name), nil
+			}
+			if _, ok := pod.Annotations[kubeadmAdvertiseAddressAnnotation]; ok {
+				return name, fmt.Sprintf("annotation %s of pod %s/%s", kubeadmAdvertiseAddressAnnotation, pod.Namespace, pod.Name), nil
+			}
+		}
+	}
+	return "", "", nil
+}
+
+// APIServerIssuer returns --service-account-issuer of the kube-apiserver pod of the profile,
+// or an empty string when no pod has the flag.
+func APIServerIssuer(ctx context.Context, reader client.Reader, values Values) (string, error) {
+	pods, err := apiServerPods(ctx, reader, values.apiServerLabels)
+	if err != nil {
+		return "", err
+	}
+	for _, pod := range pods {
+		for _, c := range pod.Spec.Containers {
+			// Flags may be passed through a wrapper, e.g. sh -c "kube-apiserver --flag=...", so every word is inspected.
+			for _, arg := range append(append([]string{}, c.Command...), c.Args...) {
+				for _, word := range strings.Fields(arg) {
+					// The first issuer signs tokens when the flag is repeated.
+					if strings.HasPrefix(word, issuerFlag) {
+						return strings.Trim(strings.TrimPrefix(word, issuerFlag), `"'`), nil
+					}
+				}
+			}
+		}
+	}
+	return "", nil
+}
+
+func apiServerPods(ctx context.Context, reader client.Reader, labels map[string]string) ([]corev1.Pod, error) {
+	if len(labels) == 0 {
+		return nil, nil
+	}
+	pods := corev1.PodList{}
+	if err := reader.List(ctx, &pods, client.InNamespace("kube-system"), client.MatchingLabels(labels)); err != nil {
+		return nil, fmt.Errorf("failed to list kube-apiserver pods: %w", err)
+	}
+	return pods.Items, nil
+}
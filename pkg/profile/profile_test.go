@@ -0,0 +1,354 @@
+package profile
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	installerv1alpha1 "github.com/h3poteto/eks-pod-identity-webhook-installer/api/v1alpha1"
+)
+
+func testReader(t *testing.T, objects ...client.Object) client.Reader {
+	t.Helper()
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	return fake.NewClientBuilder().WithScheme(scheme).WithObjects(objects...).Build()
+}
+
+func node(name, kubeletVersion string, labels map[string]string) *corev1.Node {
+	n := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels}}
+	n.Status.NodeInfo.KubeletVersion = kubeletVersion
+	return n
+}
+
+func apiServerPod(namespace string, labels, annotations map[string]string, containers ...corev1.Container) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "kube-apiserver-master", Labels: labels, Annotations: annotations},
+		Spec:       corev1.PodSpec{Containers: containers},
+	}
+}
+
+var (
+	kopsLabels         = map[string]string{"k8s-app": "kube-apiserver"}
+	componentLabels    = map[string]string{"component": "kube-apiserver"}
+	kubeadmAnnotations = map[string]string{kubeadmAdvertiseAddressAnnotation: "10.0.0.1:6443"}
+)
+
+func TestDetect(t *testing.T) {
+	cases := []struct {
+		name       string
+		objects    []client.Object
+		want       string
+		detectedBy string
+	}{
+		{
+			name:       "k3s kubelet",
+			objects:    []client.Object{node("server", "v1.20.4+k3s1", nil)},
+			want:       installerv1alpha1.ProfileK3s,
+			detectedBy: "kubelet v1.20.4+k3s1 of node server",
+		},
+		{
+			name:       "rke2 kubelet",
+			objects:    []client.Object{node("server", "v1.20.4+rke2r1", nil)},
+			want:       installerv1alpha1.ProfileRKE2,
+			detectedBy: "kubelet v1.20.4+rke2r1 of node server",
+		},
+		{
+			name:       "k3s instance type",
+			objects:    []client.Object{node("server", "v1.20.4", map[string]string{instanceTypeLabel: "k3s"})},
+			want:       installerv1alpha1.ProfileK3s,
+			detectedBy: "label " + instanceTypeLabel + " of node server",
+		},
+		{
+			name:       "rke2 instance type",
+			objects:    []client.Object{node("server", "v1.20.4", map[string]string{instanceTypeLabel: "rke2"})},
+			want:       installerv1alpha1.ProfileRKE2,
+			detectedBy: "label " + instanceTypeLabel + " of node server",
+		},
+		{
+			name:       "kops instance group",
+			objects:    []client.Object{node("master", "v1.20.4", map[string]string{kopsInstanceGroupLabel: "master-ap-northeast-1a"})},
+			want:       installerv1alpha1.ProfileKops,
+			detectedBy: "label " + kopsInstanceGroupLabel + " of node master",
+		},
+		{
+			name: "nodes are preferred over pods",
+			objects: []client.Object{
+				node("server", "v1.20.4+rke2r1", nil),
+				apiServerPod("kube-system", componentLabels, kubeadmAnnotations),
+			},
+			want:       installerv1alpha1.ProfileRKE2,
+			detectedBy: "kubelet v1.20.4+rke2r1 of node server",
+		},
+		{
+			name: "kops kube-apiserver pod",
+			objects: []client.Object{
+				node("master", "v1.20.4", nil),
+				apiServerPod("kube-system", kopsLabels, nil),
+			},
+			want:       installerv1alpha1.ProfileKops,
+			detectedBy: "kube-apiserver pod kube-system/kube-apiserver-master",
+		},
+		{
+			name: "kubeadm kube-apiserver pod",
+			objects: []client.Object{
+				node("master", "v1.20.4", map[string]string{instanceTypeLabel: "m5.large"}),
+				apiServerPod("kube-system", componentLabels, kubeadmAnnotations),
+			},
+			want:       installerv1alpha1.ProfileKubeadm,
+			detectedBy: "annotation " + kubeadmAdvertiseAddressAnnotation + " of pod kube-system/kube-apiserver-master",
+		},
+		{
+			// Other distributions label static pods in the same way, but only kubeadm annotates them.
+			name:    "kube-apiserver pod without the kubeadm annotation",
+			objects: []client.Object{node("master", "v1.20.4", nil), apiServerPod("kube-system", componentLabels, nil)},
+		},
+		{
+			name:    "kube-apiserver pod in another namespace",
+			objects: []client.Object{apiServerPod("default", kopsLabels, nil)},
+		},
+		{
+			name:    "EKS",
+			objects: []client.Object{node("ip-10-0-0-1", "v1.20.4-eks-6b7464", map[string]string{instanceTypeLabel: "m5.large"})},
+		},
+		{
+			name: "no nodes",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			name, detectedBy, err := Detect(context.Background(), testReader(t, c.objects...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if name != c.want {
+				t.Errorf("name is %q, want %q", name, c.want)
+			}
+			if detectedBy != c.detectedBy {
+				t.Errorf("detectedBy is %q, want %q", detectedBy, c.detectedBy)
+			}
+		})
+	}
+}
+
+func TestAPIServerIssuer(t *testing.T) {
+	kubeadm, _ := Get(installerv1alpha1.ProfileKubeadm)
+	kops, _ := Get(installerv1alpha1.ProfileKops)
+	k3s, _ := Get(installerv1alpha1.ProfileK3s)
+
+	cases := []struct {
+		name    string
+		values  Values
+		objects []client.Object
+		want    string
+	}{
+		{
+			name:   "command",
+			values: kubeadm,
+			objects: []client.Object{apiServerPod("kube-system", componentLabels, nil, corev1.Container{
+				Name:    "kube-apiserver",
+				Command: []string{"kube-apiserver", "--advertise-address=10.0.0.1", "--service-account-issuer=https://kubernetes.default.svc.cluster.local"},
+			})},
+			want: "https://kubernetes.default.svc.cluster.local",
+		},
+		{
+			name:   "args",
+			values: kops,
+			objects: []client.Object{apiServerPod("kube-system", kopsLabels, nil, corev1.Container{
+				Name:    "kube-apiserver",
+				Command: []string{"/usr/local/bin/kube-apiserver"},
+				Args:    []string{"--allow-privileged=true", "--service-account-issuer=https://api.internal.example.com"},
+			})},
+			want: "https://api.internal.example.com",
+		},
+		{
+			// kops runs kube-apiserver through a shell to redirect logs.
+			name:   "sh -c",
+			values: kops,
+			objects: []client.Object{apiServerPod("kube-system", kopsLabels, nil, corev1.Container{
+				Name:    "kube-apiserver",
+				Command: []string{"/bin/sh", "-c"},
+				Args:    []string{"mkfifo /tmp/pipe; (tee -a /var/log/kube-apiserver.log < /tmp/pipe & ) ; exec /usr/local/bin/kube-apiserver --service-account-issuer='https://oidc.example.com' --service-account-key-file=/srv/kubernetes/service-account.pub > /tmp/pipe 2>&1"},
+			})},
+			want: "https://oidc.example.com",
+		},
+		{
+			name:   "sh -c with double quotes",
+			values: kubeadm,
+			objects: []client.Object{apiServerPod("kube-system", componentLabels, nil, corev1.Container{
+				Name:    "kube-apiserver",
+				Command: []string{"sh", "-c", `kube-apiserver --service-account-issuer="https://oidc.example.com"`},
+			})},
+			want: "https://oidc.example.com",
+		},
+		{
+			name:   "the first of repeated flags",
+			values: kubeadm,
+			objects: []client.Object{apiServerPod("kube-system", componentLabels, nil, corev1.Container{
+				Name:    "kube-apiserver",
+				Command: []string{"kube-apiserver", "--service-account-issuer=https://new.example.com", "--service-account-issuer=https://old.example.com"},
+			})},
+			want: "https://new.example.com",
+		},
+		{
+			name:   "without the flag",
+			values: kubeadm,
+			objects: []client.Object{apiServerPod("kube-system", componentLabels, nil, corev1.Container{
+				Name:    "kube-apiserver",
+				Command: []string{"kube-apiserver", "--service-account-key-file=/etc/kubernetes/pki/sa.pub"},
+			})},
+		},
+		{
+			name:   "pod of another distribution",
+			values: kubeadm,
+			objects: []client.Object{apiServerPod("kube-system", kopsLabels, nil, corev1.Container{
+				Name:    "kube-apiserver",
+				Command: []string{"kube-apiserver", "--service-account-issuer=https://api.internal.example.com"},
+			})},
+		},
+		{
+			name:   "no pods",
+			values: kubeadm,
+		},
+		{
+			// The API server of k3s does not run as a pod.
+			name:   "profile without kube-apiserver pods",
+			values: k3s,
+			objects: []client.Object{apiServerPod("kube-system", componentLabels, nil, corev1.Container{
+				Name:    "kube-apiserver",
+				Command: []string{"kube-apiserver", "--service-account-issuer=https://kubernetes.default.svc.cluster.local"},
+			})},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			issuer, err := APIServerIssuer(context.Background(), testReader(t, c.objects...), c.values)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if issuer != c.want {
+				t.Errorf("issuer is %q, want %q", issuer, c.want)
+			}
+		})
+	}
+}
+
+func TestApply(t *testing.T) {
+	k3s, _ := Get(installerv1alpha1.ProfileK3s)
+	custom := []corev1.Toleration{{Key: "dedicated", Operator: corev1.TolerationOpEqual, Value: "webhook", Effect: corev1.TaintEffectNoSchedule}}
+
+	cases := []struct {
+		name            string
+		network         installerv1alpha1.NetworkConfig
+		tolerations     []corev1.Toleration
+		values          Values
+		want            installerv1alpha1.NetworkConfig
+		wantTolerations []corev1.Toleration
+	}{
+		{
+			name:            "unset fields are filled",
+			values:          k3s,
+			want:            installerv1alpha1.NetworkConfig{Mode: installerv1alpha1.NetworkModeHostNetwork, CASource: installerv1alpha1.CASourceRootCAConfigMap},
+			wantTolerations: k3s.Tolerations,
+		},
+		{
+			name:            "set fields are kept",
+			network:         installerv1alpha1.NetworkConfig{Mode: installerv1alpha1.NetworkModeService, CASource: installerv1alpha1.CASourceServiceAccountToken},
+			tolerations:     custom,
+			values:          k3s,
+			want:            installerv1alpha1.NetworkConfig{Mode: installerv1alpha1.NetworkModeService, CASource: installerv1alpha1.CASourceServiceAccountToken},
+			wantTolerations: custom,
+		},
+		{
+			name:    "only unset fields are filled",
+			network: installerv1alpha1.NetworkConfig{Mode: installerv1alpha1.NetworkModeURL, URL: "https://webhook.example.com"},
+			values:  k3s,
+			want: installerv1alpha1.NetworkConfig{
+				Mode:     installerv1alpha1.NetworkModeURL,
+				URL:      "https://webhook.example.com",
+				CASource: installerv1alpha1.CASourceRootCAConfigMap,
+			},
+			wantTolerations: k3s.Tolerations,
+		},
+		{
+			name: "empty values",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			resource := &installerv1alpha1.EKSPodIdentityWebhook{}
+			resource.Spec.Network = c.network
+			resource.Spec.Webhook.Tolerations = c.tolerations
+
+			Apply(resource, c.values)
+			if !reflect.DeepEqual(resource.Spec.Network, c.want) {
+				t.Errorf("network is %+v, want %+v", resource.Spec.Network, c.want)
+			}
+			if !reflect.DeepEqual(resource.Spec.Webhook.Tolerations, c.wantTolerations) {
+				t.Errorf("tolerations are %+v, want %+v", resource.Spec.Webhook.Tolerations, c.wantTolerations)
+			}
+			if len(c.tolerations) == 0 && len(resource.Spec.Webhook.Tolerations) > 0 {
+				// The tolerations are copied, so the resource does not share them with the profile.
+				resource.Spec.Webhook.Tolerations[0].Key = "changed"
+				if c.values.Tolerations[0].Key == "changed" {
+					t.Error("tolerations of the profile are changed")
+				}
+			}
+		})
+	}
+}
+
+func TestEffective(t *testing.T) {
+	cases := []struct {
+		name    string
+		profile string
+		status  *installerv1alpha1.ProfileStatus
+		want    string
+	}{
+		{name: "no profile", want: ""},
+		{
+			name:   "stale status without profile",
+			status: &installerv1alpha1.ProfileStatus{Name: installerv1alpha1.ProfileK3s},
+			want:   "",
+		},
+		{name: "static profile", profile: installerv1alpha1.ProfileK3s, want: installerv1alpha1.NetworkModeHostNetwork},
+		{name: "static profile before status is recorded", profile: installerv1alpha1.ProfileKubeadm, want: installerv1alpha1.NetworkModeService},
+		{
+			name:    "detected profile",
+			profile: installerv1alpha1.ProfileAuto,
+			status:  &installerv1alpha1.ProfileStatus{Name: installerv1alpha1.ProfileK3s},
+			want:    installerv1alpha1.NetworkModeHostNetwork,
+		},
+		{name: "auto before detection", profile: installerv1alpha1.ProfileAuto, want: ""},
+		{
+			name:    "nothing detected",
+			profile: installerv1alpha1.ProfileAuto,
+			status:  &installerv1alpha1.ProfileStatus{},
+			want:    "",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			resource := &installerv1alpha1.EKSPodIdentityWebhook{}
+			resource.Spec.Profile = c.profile
+			resource.Status.Profile = c.status
+
+			effective := Effective(resource)
+			if effective.Spec.Network.Mode != c.want {
+				t.Errorf("network mode is %q, want %q", effective.Spec.Network.Mode, c.want)
+			}
+			if resource.Spec.Network.Mode != "" || len(resource.Spec.Webhook.Tolerations) > 0 {
+				t.Errorf("the resource is changed: %+v", resource.Spec)
+			}
+		})
+	}
+}
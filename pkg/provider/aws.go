@@ -0,0 +1,196 @@
+package provider
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	certificatesv1 "k8s.io/api/certificates/v1"
+	corev1 "k8s.io/api/core/v1"
+
+	installerv1alpha1 "github.com/h3poteto/eks-pod-identity-webhook-installer/api/v1alpha1"
+)
+
+// Refs: https://github.com/aws/amazon-eks-pod-identity-webhook
+const (
+	// AWSWebhookVersion is the image tag of amazon-eks-pod-identity-webhook. It is pinned to a release,
+	// so that app.kubernetes.io/version label and status.workload.version describe what is running.
+	AWSWebhookVersion = "v0.3.0"
+	AWSImageName      = "amazon-eks-pod-identity-webhook"
+	AWSWebhookImage   = "amazon/" + AWSImageName + ":" + AWSWebhookVersion
+
+	// AWSAnnotationPrefix is the prefix of annotations on ServiceAccounts and pods.
+	AWSAnnotationPrefix  = "eks.amazonaws.com"
+	AWSRoleARNAnnotation = AWSAnnotationPrefix + "/role-arn"
+	AWSRoleARNEnv        = "AWS_ROLE_ARN"
+
+	// awsProbeRoleARN is a dummy role of the probe ServiceAccount. No credentials are issued for it, because the probe pod is never created.
+	awsProbeRoleARN = "arn:aws:iam::111122223333:role/pod-identity-webhook-probe"
+	// awsCertDir is where the webhook writes the certificate issued from a CertificateSigningRequest.
+	awsCertDir = "/var/run/app/certs"
+)
+
+// AWS is amazon-eks-pod-identity-webhook, which injects credentials of IAM roles for service accounts.
+type AWS struct{}
+
+var _ Provider = AWS{}
+
+func (AWS) Name() string {
+	return installerv1alpha1.ProviderAWS
+}
+
+func (AWS) ImageName() string {
+	return AWSImageName
+}
+
+func (AWS) Container(resource *installerv1alpha1.EKSPodIdentityWebhook, opts Options) corev1.Container {
+	command := []string{"/webhook"}
+	if opts.TLSCertFile != "" {
+		command = append(command,
+			"--in-cluster=false",
+			fmt.Sprintf("--port=%d", opts.Port),
+			"--namespace="+opts.Namespace,
+			"--service-name="+opts.ServiceName,
+		)
+	} else {
+		command = append(command,
+			"--in-cluster",
+			fmt.Sprintf("--port=%d", opts.Port),
+			"--namespace="+opts.Namespace,
+			"--service-name="+opts.ServiceName,
+			"--tls-secret="+opts.SecretName,
+		)
+	}
+	command = append(command,
+		"--annotation-prefix="+AWSAnnotationPrefix,
+		"--token-audience="+resource.Spec.TokenAudience,
+		"--logtostderr",
+		"--v=4",
+	)
+	if region := resource.Spec.Webhook.AWSDefaultRegion; region != "" {
+		command = append(command, "--aws-default-region="+region)
+	}
+	if resource.Spec.Webhook.STSRegionalEndpoints {
+		command = append(command, "--sts-regional-endpoint=true")
+	}
+	if opts.MetricsPort != 0 {
+		command = append(command, fmt.Sprintf("--metrics-port=%d", opts.MetricsPort))
+	}
+	if opts.TLSCertFile != "" {
+		command = append(command, "--tls-cert="+opts.TLSCertFile, "--tls-key="+opts.TLSKeyFile)
+	}
+	return corev1.Container{
+		Image:           AWSWebhookImage,
+		ImagePullPolicy: corev1.PullIfNotPresent,
+		Command:         command,
+		VolumeMounts: []corev1.VolumeMount{
+			{
+				Name:      "webhook-certs",
+				ReadOnly:  false,
+				MountPath: awsCertDir,
+			},
+		},
+	}
+}
+
+func (AWS) Volumes(resource *installerv1alpha1.EKSPodIdentityWebhook, opts Options) []corev1.Volume {
+	return []corev1.Volume{
+		{
+			Name: "webhook-certs",
+			VolumeSource: corev1.VolumeSource{
+				EmptyDir: &corev1.EmptyDirVolumeSource{},
+			},
+		},
+	}
+}
+
+func (AWS) MutatePath() string {
+	return "/mutate"
+}
+
+func (AWS) HealthPath() string {
+	return "/healthz"
+}
+
+func (AWS) Rules() []admissionregistrationv1.RuleWithOperations {
+	allscopes := admissionregistrationv1.AllScopes
+	return []admissionregistrationv1.RuleWithOperations{
+		{
+			Operations: []admissionregistrationv1.OperationType{
+				"CREATE",
+			},
+			Rule: admissionregistrationv1.Rule{
+				APIGroups:   []string{""},
+				APIVersions: []string{"v1"},
+				Resources:   []string{"pods"},
+				Scope:       &allscopes,
+			},
+		},
+	}
+}
+
+func (AWS) AdmissionReviewVersions() []string {
+	return []string{"v1beta1"}
+}
+
+// ValidateCSR accepts the request which the certificate manager of the webhook creates, whose names are the Service.
+func (AWS) ValidateCSR(csr *certificatesv1.CertificateSigningRequest, namespace, serviceName string) error {
+	block, _ := pem.Decode(csr.Spec.Request)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return errors.New("request has no CERTIFICATE REQUEST PEM block")
+	}
+	request, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("failed to parse request: %w", err)
+	}
+	commonName := serviceName + "." + namespace + ".svc"
+	if request.Subject.CommonName != commonName {
+		return fmt.Errorf("common name %q is not %q", request.Subject.CommonName, commonName)
+	}
+	names := map[string]bool{
+		serviceName:                   true,
+		serviceName + "." + namespace: true,
+		commonName:                    true,
+		commonName + ".cluster.local": true,
+	}
+	for _, name := range request.DNSNames {
+		if !names[name] {
+			return fmt.Errorf("DNS name %q is not the Service", name)
+		}
+	}
+	if len(request.IPAddresses) > 0 || len(request.EmailAddresses) > 0 || len(request.URIs) > 0 {
+		return errors.New("request has SANs other than DNS names")
+	}
+	for _, usage := range csr.Spec.Usages {
+		switch usage {
+		case certificatesv1.UsageDigitalSignature, certificatesv1.UsageKeyEncipherment, certificatesv1.UsageServerAuth:
+		default:
+			return fmt.Errorf("usage %q is not for a serving certificate", usage)
+		}
+	}
+	return nil
+}
+
+func (AWS) ProbeAnnotations() map[string]string {
+	return map[string]string{
+		AWSRoleARNAnnotation: awsProbeRoleARN,
+	}
+}
+
+func (AWS) Injects(serviceAccount *corev1.ServiceAccount) bool {
+	_, ok := serviceAccount.Annotations[AWSRoleARNAnnotation]
+	return ok
+}
+
+func (AWS) Mutated(pod *corev1.Pod) bool {
+	for _, c := range pod.Spec.Containers {
+		for _, env := range c.Env {
+			if env.Name == AWSRoleARNEnv {
+				return true
+			}
+		}
+	}
+	return false
+}
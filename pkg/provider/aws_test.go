@@ -0,0 +1,150 @@
+package provider
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+
+	certificatesv1 "k8s.io/api/certificates/v1"
+)
+
+var servingUsages = []certificatesv1.KeyUsage{certificatesv1.UsageDigitalSignature, certificatesv1.UsageKeyEncipherment, certificatesv1.UsageServerAuth}
+
+// request returns a PEM encoded certificate request which the template describes.
+func request(t *testing.T, template *x509.CertificateRequest) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+}
+
+func TestValidateCSR(t *testing.T) {
+	const commonName = "pod-identity-webhook.kube-system.svc"
+	serving := func(modify func(*x509.CertificateRequest)) *x509.CertificateRequest {
+		template := &x509.CertificateRequest{
+			Subject: pkix.Name{CommonName: commonName},
+			DNSNames: []string{
+				"pod-identity-webhook",
+				"pod-identity-webhook.kube-system",
+				commonName,
+				commonName + ".cluster.local",
+			},
+		}
+		if modify != nil {
+			modify(template)
+		}
+		return template
+	}
+	example, err := url.Parse("spiffe://example.com/webhook")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name     string
+		template *x509.CertificateRequest
+		// raw is used instead of template when it is set.
+		raw     []byte
+		usages  []certificatesv1.KeyUsage
+		wantErr string
+	}{
+		{name: "serving certificate", template: serving(nil), usages: servingUsages},
+		{name: "without usages", template: serving(nil)},
+		{name: "only the common name", template: serving(func(r *x509.CertificateRequest) { r.DNSNames = nil }), usages: servingUsages},
+		{
+			name:     "common name in another namespace",
+			template: serving(func(r *x509.CertificateRequest) { r.Subject.CommonName = "pod-identity-webhook.default.svc" }),
+			usages:   servingUsages,
+			wantErr:  "common name",
+		},
+		{
+			name: "common name of a node",
+			template: serving(func(r *x509.CertificateRequest) {
+				r.Subject = pkix.Name{CommonName: "system:node:ip-10-0-0-1", Organization: []string{"system:nodes"}}
+			}),
+			usages:  servingUsages,
+			wantErr: "common name",
+		},
+		{
+			name:     "DNS name of another Service",
+			template: serving(func(r *x509.CertificateRequest) { r.DNSNames = append(r.DNSNames, "kubernetes.default.svc") }),
+			usages:   servingUsages,
+			wantErr:  `DNS name "kubernetes.default.svc"`,
+		},
+		{
+			name:     "IP address",
+			template: serving(func(r *x509.CertificateRequest) { r.IPAddresses = []net.IP{net.ParseIP("10.0.0.1")} }),
+			usages:   servingUsages,
+			wantErr:  "SANs other than DNS names",
+		},
+		{
+			name:     "email address",
+			template: serving(func(r *x509.CertificateRequest) { r.EmailAddresses = []string{"admin@example.com"} }),
+			usages:   servingUsages,
+			wantErr:  "SANs other than DNS names",
+		},
+		{
+			name:     "URI",
+			template: serving(func(r *x509.CertificateRequest) { r.URIs = []*url.URL{example} }),
+			usages:   servingUsages,
+			wantErr:  "SANs other than DNS names",
+		},
+		{
+			name:     "client auth",
+			template: serving(nil),
+			usages:   append(append([]certificatesv1.KeyUsage{}, servingUsages...), certificatesv1.UsageClientAuth),
+			wantErr:  `usage "client auth"`,
+		},
+		{
+			name:     "signing certificates",
+			template: serving(nil),
+			usages:   []certificatesv1.KeyUsage{certificatesv1.UsageCertSign},
+			wantErr:  `usage "cert sign"`,
+		},
+		{name: "no PEM", raw: []byte("not a request"), wantErr: "no CERTIFICATE REQUEST PEM block"},
+		{
+			name:    "another PEM type",
+			raw:     pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("certificate")}),
+			wantErr: "no CERTIFICATE REQUEST PEM block",
+		},
+		{
+			name:    "invalid request",
+			raw:     pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: []byte("request")}),
+			wantErr: "failed to parse request",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			raw := c.raw
+			if raw == nil {
+				raw = request(t, c.template)
+			}
+			csr := &certificatesv1.CertificateSigningRequest{
+				Spec: certificatesv1.CertificateSigningRequestSpec{Request: raw, Usages: c.usages},
+			}
+			err := AWS{}.ValidateCSR(csr, "kube-system", "pod-identity-webhook")
+			if c.wantErr == "" {
+				if err != nil {
+					t.Errorf("request is rejected: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+				t.Errorf("error is %v, want %q", err, c.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+// Package provider abstracts workload identity webhooks, which the installer deploys, certifies and exposes in the same way.
+package provider
+
+import (
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	certificatesv1 "k8s.io/api/certificates/v1"
+	corev1 "k8s.io/api/core/v1"
+
+	installerv1alpha1 "github.com/h3poteto/eks-pod-identity-webhook-installer/api/v1alpha1"
+)
+
+// Provider supplies what differs between workload identity webhooks.
+// The generator builds the DaemonSet, Service and MutatingWebhookConfiguration around it,
+// and adds probes, security contexts and ports which are common to every provider.
+type Provider interface {
+	// Name is the value of spec.provider.
+	Name() string
+	// ImageName is the name of the image, without the registry and the tag, which an adopted DaemonSet must run.
+	ImageName() string
+	// Container returns the webhook container in the pod template, which serves HTTPS on opts.Port.
+	Container(resource *installerv1alpha1.EKSPodIdentityWebhook, opts Options) corev1.Container
+	// Volumes returns volumes in the pod template which Container mounts.
+	Volumes(resource *installerv1alpha1.EKSPodIdentityWebhook, opts Options) []corev1.Volume
+	// MutatePath is the path of the mutating webhook, which the Service forwards to the webhook port.
+	MutatePath() string
+	// HealthPath is the path of probes on the webhook port.
+	HealthPath() string
+	// Rules returns rules of the mutating webhook.
+	Rules() []admissionregistrationv1.RuleWithOperations
+	// AdmissionReviewVersions returns versions of AdmissionReview which the webhook understands.
+	AdmissionReviewVersions() []string
+	// ValidateCSR returns an error unless csr requests a serving certificate of the webhook,
+	// which runs in namespace behind a Service named serviceName. Only valid requests are approved.
+	ValidateCSR(csr *certificatesv1.CertificateSigningRequest, namespace, serviceName string) error
+	// ProbeAnnotations are annotations of a ServiceAccount, whose pods the webhook mutates.
+	ProbeAnnotations() map[string]string
+	// Injects returns true when the webhook mutates pods which run as serviceAccount.
+	Injects(serviceAccount *corev1.ServiceAccount) bool
+	// Mutated returns true when pod was mutated by the webhook.
+	Mutated(pod *corev1.Pod) bool
+}
+
+// Options are decided by the generator from the resource, and passed to the provider.
+type Options struct {
+	// Namespace is the namespace in which the webhook runs.
+	Namespace string
+	// ServiceName is the name of the Service in front of the webhook.
+	ServiceName string
+	// Port is the HTTPS port which the webhook listens on.
+	Port int32
+	// SecretName is the Secret in which the webhook stores the certificate issued from a CertificateSigningRequest.
+	SecretName string
+	// TLSCertFile and TLSKeyFile are set when the certificate is mounted from spec.network.tlsSecretName instead.
+	// The webhook must not request a certificate then.
+	TLSCertFile string
+	TLSKeyFile  string
+	// MetricsPort is the port of metrics, or 0 when metrics are not enabled.
+	MetricsPort int32
+}
+
+var providers = map[string]Provider{
+	installerv1alpha1.ProviderAWS: AWS{},
+}
+
+// For returns the provider of the resource. An empty spec.provider is AWS, which is the default.
+// Unknown providers are rejected by the CRD, so they fall back to AWS too.
+func For(resource *installerv1alpha1.EKSPodIdentityWebhook) Provider {
+	if p, ok := providers[resource.Spec.Provider]; ok {
+		return p
+	}
+	return AWS{}
+}
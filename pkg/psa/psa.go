@@ -0,0 +1,177 @@
+// Package psa checks a pod template against the Pod Security Standards, which Pod Security Admission enforces.
+// It covers the controls which a generated webhook pod can violate.
+// https://kubernetes.io/docs/concepts/security/pod-security-standards/
+package psa
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	EnforceLabel = "pod-security.kubernetes.io/enforce"
+
+	LevelPrivileged = "privileged"
+	LevelBaseline   = "baseline"
+	LevelRestricted = "restricted"
+)
+
+// baselineCapabilities can be added in the baseline level.
+var baselineCapabilities = map[corev1.Capability]bool{
+	"AUDIT_WRITE":      true,
+	"CHOWN":            true,
+	"DAC_OVERRIDE":     true,
+	"FOWNER":           true,
+	"FSETID":           true,
+	"KILL":             true,
+	"MKNOD":            true,
+	"NET_BIND_SERVICE": true,
+	"SETFCAP":          true,
+	"SETGID":           true,
+	"SETPCAP":          true,
+	"SETUID":           true,
+	"SYS_CHROOT":       true,
+}
+
+// Check returns violations of the pod spec against the level.
+// An empty or unknown level is treated as privileged, which allows everything.
+func Check(level string, spec *corev1.PodSpec) []string {
+	switch level {
+	case LevelBaseline:
+		return baseline(spec)
+	case LevelRestricted:
+		return append(baseline(spec), restricted(spec)...)
+	default:
+		return nil
+	}
+}
+
+func containers(spec *corev1.PodSpec) []corev1.Container {
+	return append(append([]corev1.Container{}, spec.InitContainers...), spec.Containers...)
+}
+
+func baseline(spec *corev1.PodSpec) []string {
+	violations := []string{}
+	if spec.HostNetwork {
+		violations = append(violations, "hostNetwork is true")
+	}
+	if spec.HostPID {
+		violations = append(violations, "hostPID is true")
+	}
+	if spec.HostIPC {
+		violations = append(violations, "hostIPC is true")
+	}
+	for _, v := range spec.Volumes {
+		if v.HostPath != nil {
+			violations = append(violations, fmt.Sprintf("volume %s uses hostPath", v.Name))
+		}
+	}
+	if sc := spec.SecurityContext; sc != nil {
+		if sc.SeccompProfile != nil && sc.SeccompProfile.Type == corev1.SeccompProfileTypeUnconfined {
+			violations = append(violations, "pod seccompProfile is Unconfined")
+		}
+		if len(sc.Sysctls) > 0 {
+			violations = append(violations, "pod sets sysctls")
+		}
+	}
+	for _, c := range containers(spec) {
+		for _, p := range c.Ports {
+			if p.HostPort != 0 {
+				violations = append(violations, fmt.Sprintf("container %s uses hostPort %d", c.Name, p.HostPort))
+			}
+		}
+		sc := c.SecurityContext
+		if sc == nil {
+			continue
+		}
+		if sc.Privileged != nil && *sc.Privileged {
+			violations = append(violations, fmt.Sprintf("container %s is privileged", c.Name))
+		}
+		if sc.Capabilities != nil {
+			for _, add := range sc.Capabilities.Add {
+				if !baselineCapabilities[add] {
+					violations = append(violations, fmt.Sprintf("container %s adds capability %s", c.Name, add))
+				}
+			}
+		}
+		if sc.SeccompProfile != nil && sc.SeccompProfile.Type == corev1.SeccompProfileTypeUnconfined {
+			violations = append(violations, fmt.Sprintf("container %s seccompProfile is Unconfined", c.Name))
+		}
+		if sc.ProcMount != nil && *sc.ProcMount != corev1.DefaultProcMount {
+			violations = append(violations, fmt.Sprintf("container %s sets procMount %s", c.Name, *sc.ProcMount))
+		}
+	}
+	return violations
+}
+
+func restricted(spec *corev1.PodSpec) []string {
+	violations := []string{}
+	for _, v := range spec.Volumes {
+		s := v.VolumeSource
+		if s.EmptyDir == nil && s.ConfigMap == nil && s.Secret == nil && s.Projected == nil && s.DownwardAPI == nil &&
+			s.CSI == nil && s.PersistentVolumeClaim == nil && s.Ephemeral == nil && s.HostPath == nil {
+			violations = append(violations, fmt.Sprintf("volume %s has a restricted volume type", v.Name))
+		}
+	}
+
+	pod := spec.SecurityContext
+	if pod == nil {
+		pod = &corev1.PodSecurityContext{}
+	}
+	if pod.RunAsUser != nil && *pod.RunAsUser == 0 {
+		violations = append(violations, "pod runAsUser is 0")
+	}
+	for _, c := range containers(spec) {
+		sc := c.SecurityContext
+		if sc == nil {
+			sc = &corev1.SecurityContext{}
+		}
+		if sc.AllowPrivilegeEscalation == nil || *sc.AllowPrivilegeEscalation {
+			violations = append(violations, fmt.Sprintf("container %s must set allowPrivilegeEscalation=false", c.Name))
+		}
+		if !boolValue(sc.RunAsNonRoot, pod.RunAsNonRoot) {
+			violations = append(violations, fmt.Sprintf("container %s must set runAsNonRoot=true", c.Name))
+		}
+		if sc.RunAsUser != nil && *sc.RunAsUser == 0 {
+			violations = append(violations, fmt.Sprintf("container %s runAsUser is 0", c.Name))
+		}
+		seccomp := sc.SeccompProfile
+		if seccomp == nil {
+			seccomp = pod.SeccompProfile
+		}
+		if seccomp == nil || (seccomp.Type != corev1.SeccompProfileTypeRuntimeDefault && seccomp.Type != corev1.SeccompProfileTypeLocalhost) {
+			violations = append(violations, fmt.Sprintf("container %s must set seccompProfile to RuntimeDefault or Localhost", c.Name))
+		}
+		if !dropsAll(sc.Capabilities) {
+			violations = append(violations, fmt.Sprintf("container %s must drop ALL capabilities", c.Name))
+		}
+		if sc.Capabilities != nil {
+			for _, add := range sc.Capabilities.Add {
+				if add != "NET_BIND_SERVICE" {
+					violations = append(violations, fmt.Sprintf("container %s may only add NET_BIND_SERVICE, but adds %s", c.Name, add))
+				}
+			}
+		}
+	}
+	return violations
+}
+
+func boolValue(container, pod *bool) bool {
+	if container != nil {
+		return *container
+	}
+	return pod != nil && *pod
+}
+
+func dropsAll(capabilities *corev1.Capabilities) bool {
+	if capabilities == nil {
+		return false
+	}
+	for _, c := range capabilities.Drop {
+		if c == "ALL" {
+			return true
+		}
+	}
+	return false
+}
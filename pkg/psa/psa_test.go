@@ -0,0 +1,199 @@
+package psa
+
+import (
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilpointer "k8s.io/utils/pointer"
+
+	installerv1alpha1 "github.com/h3poteto/eks-pod-identity-webhook-installer/api/v1alpha1"
+	"github.com/h3poteto/eks-pod-identity-webhook-installer/pkg/generator"
+)
+
+func podSpec(t *testing.T, modify func(*installerv1alpha1.EKSPodIdentityWebhook)) *corev1.PodSpec {
+	t.Helper()
+	resource := &installerv1alpha1.EKSPodIdentityWebhook{
+		ObjectMeta: metav1.ObjectMeta{Name: "cluster"},
+		Spec: installerv1alpha1.EKSPodIdentityWebhookSpec{
+			TokenAudience: "sts.amazonaws.com",
+			Namespace:     "kube-system",
+		},
+	}
+	resource.Default()
+	if modify != nil {
+		modify(resource)
+	}
+	daemonset, err := generator.GenerateDaemonset(resource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &daemonset.Spec.Template.Spec
+}
+
+func TestCheck(t *testing.T) {
+	cases := []struct {
+		name   string
+		level  string
+		modify func(*installerv1alpha1.EKSPodIdentityWebhook)
+		spec   func(*corev1.PodSpec)
+		want   []string
+	}{
+		{
+			name:  "hardened default passes restricted",
+			level: LevelRestricted,
+		},
+		{
+			name:  "hardened default passes baseline",
+			level: LevelBaseline,
+		},
+		{
+			name:  "hostNetwork fails baseline",
+			level: LevelBaseline,
+			modify: func(resource *installerv1alpha1.EKSPodIdentityWebhook) {
+				resource.Spec.Network.Mode = installerv1alpha1.NetworkModeHostNetwork
+			},
+			want: []string{"hostNetwork is true"},
+		},
+		{
+			name:  "hostNetwork fails restricted",
+			level: LevelRestricted,
+			modify: func(resource *installerv1alpha1.EKSPodIdentityWebhook) {
+				resource.Spec.Network.Mode = installerv1alpha1.NetworkModeHostNetwork
+			},
+			want: []string{"hostNetwork is true"},
+		},
+		{
+			name:  "hostNetwork passes privileged",
+			level: LevelPrivileged,
+			modify: func(resource *installerv1alpha1.EKSPodIdentityWebhook) {
+				resource.Spec.Network.Mode = installerv1alpha1.NetworkModeHostNetwork
+			},
+		},
+		{
+			name:  "unknown level allows everything",
+			level: "",
+			spec: func(spec *corev1.PodSpec) {
+				spec.HostPID = true
+			},
+		},
+		{
+			name:  "override of readOnlyRootFilesystem passes restricted",
+			level: LevelRestricted,
+			modify: func(resource *installerv1alpha1.EKSPodIdentityWebhook) {
+				resource.Spec.Webhook.SecurityContext = &corev1.SecurityContext{ReadOnlyRootFilesystem: utilpointer.BoolPtr(false)}
+			},
+		},
+		{
+			name:  "override of allowPrivilegeEscalation fails restricted",
+			level: LevelRestricted,
+			modify: func(resource *installerv1alpha1.EKSPodIdentityWebhook) {
+				resource.Spec.Webhook.SecurityContext = &corev1.SecurityContext{AllowPrivilegeEscalation: utilpointer.BoolPtr(true)}
+			},
+			want: []string{"container pod-identity-webhook must set allowPrivilegeEscalation=false"},
+		},
+		{
+			name:  "override of allowPrivilegeEscalation passes baseline",
+			level: LevelBaseline,
+			modify: func(resource *installerv1alpha1.EKSPodIdentityWebhook) {
+				resource.Spec.Webhook.SecurityContext = &corev1.SecurityContext{AllowPrivilegeEscalation: utilpointer.BoolPtr(true)}
+			},
+		},
+		{
+			name:  "override of runAsUser 0 fails restricted",
+			level: LevelRestricted,
+			modify: func(resource *installerv1alpha1.EKSPodIdentityWebhook) {
+				resource.Spec.Webhook.PodSecurityContext = &corev1.PodSecurityContext{RunAsUser: utilpointer.Int64Ptr(0)}
+			},
+			want: []string{"pod runAsUser is 0"},
+		},
+		{
+			name:  "override of the pod seccompProfile to Unconfined fails baseline",
+			level: LevelBaseline,
+			modify: func(resource *installerv1alpha1.EKSPodIdentityWebhook) {
+				resource.Spec.Webhook.PodSecurityContext = &corev1.PodSecurityContext{
+					SeccompProfile: &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeUnconfined},
+				}
+			},
+			want: []string{"pod seccompProfile is Unconfined"},
+		},
+		{
+			name:  "added capability fails restricted",
+			level: LevelRestricted,
+			modify: func(resource *installerv1alpha1.EKSPodIdentityWebhook) {
+				resource.Spec.Webhook.SecurityContext = &corev1.SecurityContext{
+					Capabilities: &corev1.Capabilities{Drop: []corev1.Capability{"ALL"}, Add: []corev1.Capability{"CHOWN"}},
+				}
+			},
+			want: []string{"container pod-identity-webhook may only add NET_BIND_SERVICE, but adds CHOWN"},
+		},
+		{
+			name:  "NET_ADMIN fails baseline",
+			level: LevelBaseline,
+			modify: func(resource *installerv1alpha1.EKSPodIdentityWebhook) {
+				resource.Spec.Webhook.SecurityContext = &corev1.SecurityContext{
+					Capabilities: &corev1.Capabilities{Add: []corev1.Capability{"NET_ADMIN"}},
+				}
+			},
+			want: []string{"container pod-identity-webhook adds capability NET_ADMIN"},
+		},
+		{
+			name:  "privileged fails baseline",
+			level: LevelBaseline,
+			modify: func(resource *installerv1alpha1.EKSPodIdentityWebhook) {
+				resource.Spec.Webhook.SecurityContext = &corev1.SecurityContext{Privileged: utilpointer.BoolPtr(true)}
+			},
+			want: []string{"container pod-identity-webhook is privileged"},
+		},
+		{
+			name:  "hostPath volume and hostPort fail baseline",
+			level: LevelBaseline,
+			spec: func(spec *corev1.PodSpec) {
+				spec.Volumes = append(spec.Volumes, corev1.Volume{
+					Name:         "host",
+					VolumeSource: corev1.VolumeSource{HostPath: &corev1.HostPathVolumeSource{Path: "/var/run"}},
+				})
+				spec.Containers[0].Ports = append(spec.Containers[0].Ports, corev1.ContainerPort{ContainerPort: 9999, HostPort: 9999})
+			},
+			want: []string{"volume host uses hostPath", "container pod-identity-webhook uses hostPort 9999"},
+		},
+		{
+			name:  "init container without a security context fails restricted",
+			level: LevelRestricted,
+			spec: func(spec *corev1.PodSpec) {
+				spec.InitContainers = []corev1.Container{{Name: "init"}}
+			},
+			want: []string{
+				"container init must set allowPrivilegeEscalation=false",
+				"container init must drop ALL capabilities",
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			spec := podSpec(t, c.modify)
+			if c.spec != nil {
+				c.spec(spec)
+			}
+			violations := Check(c.level, spec)
+			if len(c.want) == 0 && len(violations) > 0 {
+				t.Fatalf("unexpected violations: %v", violations)
+			}
+			for _, w := range c.want {
+				if !contains(violations, w) {
+					t.Errorf("violations %v do not contain %q", violations, w)
+				}
+			}
+		})
+	}
+}
+
+func contains(violations []string, want string) bool {
+	for _, v := range violations {
+		if strings.Contains(v, want) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,304 @@
+// Package render prints the objects which the installer applies for an EKSPodIdentityWebhook, without a cluster.
+package render
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/yaml"
+
+	installerv1alpha1 "github.com/h3poteto/eks-pod-identity-webhook-installer/api/v1alpha1"
+	"github.com/h3poteto/eks-pod-identity-webhook-installer/pkg/generator"
+	"github.com/h3poteto/eks-pod-identity-webhook-installer/pkg/profile"
+)
+
+const (
+	// CABundlePlaceholder is written to caBundle when no CA is given.
+	// It is not valid base64, so applying the manifest without replacing it fails loudly.
+	CABundlePlaceholder = "${CA_BUNDLE}"
+
+	OutputYAML = "yaml"
+	OutputJSON = "json"
+)
+
+var scheme = runtime.NewScheme()
+
+func init() {
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = installerv1alpha1.AddToScheme(scheme)
+}
+
+// Options are parameters of render subcommand.
+type Options struct {
+	Filename     string
+	Output       string
+	CABundleFile string
+	KustomizeDir string
+}
+
+// Run parses args of render subcommand and writes the rendered objects to out.
+func Run(args []string, out io.Writer) error {
+	opts := Options{}
+	fs := flag.NewFlagSet("render", flag.ContinueOnError)
+	fs.StringVar(&opts.Filename, "f", "-", "EKSPodIdentityWebhook manifest to render. - reads from stdin.")
+	fs.StringVar(&opts.Output, "o", OutputYAML, "Output format, yaml or json.")
+	fs.StringVar(&opts.CABundleFile, "ca-bundle-file", "", "PEM encoded cluster CA which is used as caBundle of MutatingWebhookConfiguration. A placeholder is written when it is empty.")
+	fs.StringVar(&opts.KustomizeDir, "kustomize-dir", "", "Write a kustomize base to this directory instead of printing.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	return Render(opts, os.Stdin, out)
+}
+
+// Render reads EKSPodIdentityWebhook resources and writes generated objects.
+func Render(opts Options, stdin io.Reader, out io.Writer) error {
+	if opts.Output != OutputYAML && opts.Output != OutputJSON {
+		return fmt.Errorf("unknown output format %q", opts.Output)
+	}
+
+	in := stdin
+	if opts.Filename != "-" {
+		f, err := os.Open(opts.Filename)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	resources, err := decode(in)
+	if err != nil {
+		return err
+	}
+	if len(resources) == 0 {
+		return errors.New("no EKSPodIdentityWebhook is found in input")
+	}
+
+	var ca []byte
+	if opts.CABundleFile != "" {
+		ca, err = ioutil.ReadFile(opts.CABundleFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	objects := []map[string]interface{}{}
+	for i := range resources {
+		rendered, err := Objects(&resources[i], ca)
+		if err != nil {
+			return err
+		}
+		objects = append(objects, rendered...)
+	}
+
+	if opts.KustomizeDir != "" {
+		return writeKustomizeBase(opts.KustomizeDir, opts.Output, objects)
+	}
+	return write(out, opts.Output, objects)
+}
+
+// Objects returns generated objects for the resource as unstructured maps.
+// Owner references are dropped, because the owner does not exist until the resource is created in a cluster.
+// Profiles other than auto are applied, because auto needs the cluster to detect the distribution.
+// The resource is not changed, but generator.Namespace, which is global, is set to spec.namespace as the controller does,
+// so Objects must not run concurrently with other generation.
+func Objects(resource *installerv1alpha1.EKSPodIdentityWebhook, ca []byte) ([]map[string]interface{}, error) {
+	resource = resource.DeepCopy()
+	if values, ok := profile.Get(resource.Spec.Profile); ok {
+		profile.Apply(resource, values)
+	}
+	resource.Default()
+	generator.Namespace = resource.Spec.Namespace
+
+	objects, err := generator.GenerateObjects(resource, ca)
+	if err != nil {
+		return nil, err
+	}
+	result := []map[string]interface{}{}
+	for _, obj := range objects {
+		var extensions map[string]interface{}
+		if generator.Kind(obj) == "Service" && obj.GetName() == generator.ServiceName {
+			extensions = generator.ServiceSpecExtensions(resource)
+		}
+		spec, err := generator.ApplyOverlaysWithSpec(resource, obj, extensions)
+		if err != nil {
+			return nil, err
+		}
+		u, err := toUnstructured(obj)
+		if err != nil {
+			return nil, err
+		}
+		if ca == nil && obj.GetObjectKind().GroupVersionKind().Kind == "MutatingWebhookConfiguration" {
+			setCABundlePlaceholder(u)
+		}
+		for field, value := range spec {
+			if err := unstructured.SetNestedField(u, value, "spec", field); err != nil {
+				return nil, err
+			}
+		}
+		result = append(result, u)
+	}
+	return result, nil
+}
+
+func decode(in io.Reader) ([]installerv1alpha1.EKSPodIdentityWebhook, error) {
+	decoder := utilyaml.NewYAMLOrJSONDecoder(bufio.NewReader(in), 4096)
+	resources := []installerv1alpha1.EKSPodIdentityWebhook{}
+	for {
+		resource := installerv1alpha1.EKSPodIdentityWebhook{}
+		err := decoder.Decode(&resource)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if resource.Kind == "" {
+			// Empty document.
+			continue
+		}
+		if resource.Kind != "EKSPodIdentityWebhook" {
+			return nil, fmt.Errorf("%s %s is not EKSPodIdentityWebhook", resource.Kind, resource.Name)
+		}
+		resources = append(resources, resource)
+	}
+	return resources, nil
+}
+
+func toUnstructured(obj client.Object) (map[string]interface{}, error) {
+	gvk, err := apiutil.GVKForObject(obj, scheme)
+	if err != nil {
+		return nil, err
+	}
+	obj.GetObjectKind().SetGroupVersionKind(gvk)
+	obj.SetOwnerReferences(nil)
+	u, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return nil, err
+	}
+	// creationTimestamp is always null for generated objects.
+	if metadata, ok := u["metadata"].(map[string]interface{}); ok {
+		delete(metadata, "creationTimestamp")
+	}
+	delete(u, "status")
+	return u, nil
+}
+
+func setCABundlePlaceholder(u map[string]interface{}) {
+	webhooks, ok := u["webhooks"].([]interface{})
+	if !ok {
+		return
+	}
+	for _, w := range webhooks {
+		webhook, ok := w.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		clientConfig, ok := webhook["clientConfig"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		clientConfig["caBundle"] = CABundlePlaceholder
+	}
+}
+
+func marshal(output string, obj map[string]interface{}) ([]byte, error) {
+	if output == OutputJSON {
+		return json.MarshalIndent(obj, "", "  ")
+	}
+	return yaml.Marshal(obj)
+}
+
+func write(out io.Writer, output string, objects []map[string]interface{}) error {
+	for i, obj := range objects {
+		data, err := marshal(output, obj)
+		if err != nil {
+			return err
+		}
+		if output == OutputYAML && i > 0 {
+			if _, err := io.WriteString(out, "---\n"); err != nil {
+				return err
+			}
+		}
+		if _, err := out.Write(data); err != nil {
+			return err
+		}
+		if output == OutputJSON {
+			if _, err := io.WriteString(out, "\n"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeKustomizeBase writes each object to a file and kustomization.yaml listing them to dir.
+// dir must be empty or not exist, because files of objects which an earlier run wrote would be left in it.
+func writeKustomizeBase(dir, output string, objects []map[string]interface{}) error {
+	files := []string{}
+	seen := map[string]bool{}
+	for _, obj := range objects {
+		name := fileName(obj, output)
+		// kustomize rejects a resource listed twice, and the file would be overwritten.
+		if seen[name] {
+			return fmt.Errorf("%s is rendered more than once, so EKSPodIdentityWebhook resources in input conflict", strings.TrimSuffix(name, "."+output))
+		}
+		seen[name] = true
+		files = append(files, name)
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("%s is not empty, and files which an earlier run wrote would be left in it", dir)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for i, obj := range objects {
+		data, err := marshal(output, obj)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, files[i]), data, 0644); err != nil {
+			return err
+		}
+	}
+
+	kustomization := bytes.NewBufferString("apiVersion: kustomize.config.k8s.io/v1beta1\nkind: Kustomization\nresources:\n")
+	for _, f := range files {
+		fmt.Fprintf(kustomization, "- %s\n", f)
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "kustomization.yaml"), kustomization.Bytes(), 0644)
+}
+
+func fileName(obj map[string]interface{}, output string) string {
+	kind, _ := obj["kind"].(string)
+	name := ""
+	namespace := ""
+	if metadata, ok := obj["metadata"].(map[string]interface{}); ok {
+		name, _ = metadata["name"].(string)
+		namespace, _ = metadata["namespace"].(string)
+	}
+	parts := []string{strings.ToLower(kind)}
+	if namespace != "" {
+		parts = append(parts, namespace)
+	}
+	parts = append(parts, name)
+	return strings.Join(parts, "_") + "." + output
+}
@@ -0,0 +1,262 @@
+package render
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+
+	installerv1alpha1 "github.com/h3poteto/eks-pod-identity-webhook-installer/api/v1alpha1"
+)
+
+const manifest = `apiVersion: installer.h3poteto.dev/v1alpha1
+kind: EKSPodIdentityWebhook
+metadata:
+  name: example
+spec:
+  tokenAudience: amazonaws.com
+  namespace: webhook
+`
+
+// documents splits YAML or JSON output into objects.
+func documents(t *testing.T, out []byte) []map[string]interface{} {
+	t.Helper()
+	decoder := utilyaml.NewYAMLOrJSONDecoder(bytes.NewReader(out), 4096)
+	objects := []map[string]interface{}{}
+	for {
+		obj := map[string]interface{}{}
+		if err := decoder.Decode(&obj); err != nil {
+			break
+		}
+		if len(obj) > 0 {
+			objects = append(objects, obj)
+		}
+	}
+	return objects
+}
+
+func find(objects []map[string]interface{}, kind string) map[string]interface{} {
+	for _, obj := range objects {
+		if obj["kind"] == kind {
+			return obj
+		}
+	}
+	return nil
+}
+
+func caBundles(t *testing.T, mutating map[string]interface{}) []interface{} {
+	t.Helper()
+	if mutating == nil {
+		t.Fatal("MutatingWebhookConfiguration is not rendered")
+	}
+	bundles := []interface{}{}
+	for _, w := range mutating["webhooks"].([]interface{}) {
+		clientConfig := w.(map[string]interface{})["clientConfig"].(map[string]interface{})
+		bundles = append(bundles, clientConfig["caBundle"])
+	}
+	return bundles
+}
+
+func TestRender(t *testing.T) {
+	for _, output := range []string{OutputYAML, OutputJSON} {
+		t.Run(output, func(t *testing.T) {
+			out := &bytes.Buffer{}
+			if err := Render(Options{Filename: "-", Output: output}, strings.NewReader(manifest), out); err != nil {
+				t.Fatal(err)
+			}
+			if output == OutputJSON {
+				decoder := json.NewDecoder(bytes.NewReader(out.Bytes()))
+				for decoder.More() {
+					obj := map[string]interface{}{}
+					if err := decoder.Decode(&obj); err != nil {
+						t.Fatalf("output is not a stream of JSON objects: %v", err)
+					}
+				}
+			}
+			if output == OutputYAML && !strings.Contains(out.String(), "\n---\n") {
+				t.Errorf("documents are not separated: %s", out)
+			}
+			objects := documents(t, out.Bytes())
+			for _, kind := range []string{"ServiceAccount", "Service", "DaemonSet", "MutatingWebhookConfiguration"} {
+				obj := find(objects, kind)
+				if obj == nil {
+					t.Errorf("%s is not rendered", kind)
+					continue
+				}
+				metadata := obj["metadata"].(map[string]interface{})
+				if _, ok := metadata["ownerReferences"]; ok {
+					t.Errorf("%s has owner references", kind)
+				}
+				if _, ok := metadata["creationTimestamp"]; ok {
+					t.Errorf("%s has creationTimestamp", kind)
+				}
+				if _, ok := obj["status"]; ok {
+					t.Errorf("%s has status", kind)
+				}
+				if kind != "MutatingWebhookConfiguration" && metadata["namespace"] != "webhook" {
+					t.Errorf("%s is in %v", kind, metadata["namespace"])
+				}
+			}
+			for _, bundle := range caBundles(t, find(objects, "MutatingWebhookConfiguration")) {
+				if bundle != CABundlePlaceholder {
+					t.Errorf("caBundle is %v, want the placeholder", bundle)
+				}
+			}
+		})
+	}
+}
+
+func TestRenderCABundle(t *testing.T) {
+	dir := t.TempDir()
+	ca := []byte("-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n")
+	file := filepath.Join(dir, "ca.crt")
+	if err := ioutil.WriteFile(file, ca, 0600); err != nil {
+		t.Fatal(err)
+	}
+	out := &bytes.Buffer{}
+	if err := Render(Options{Filename: "-", Output: OutputJSON, CABundleFile: file}, strings.NewReader(manifest), out); err != nil {
+		t.Fatal(err)
+	}
+	bundles := caBundles(t, find(documents(t, out.Bytes()), "MutatingWebhookConfiguration"))
+	if len(bundles) == 0 {
+		t.Fatal("no webhooks")
+	}
+	for _, bundle := range bundles {
+		// []byte is encoded in base64.
+		if bundle == CABundlePlaceholder || bundle == "" {
+			t.Errorf("caBundle is %v", bundle)
+		}
+	}
+}
+
+func TestRenderKustomizeDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "base")
+	if err := Render(Options{Filename: "-", Output: OutputYAML, KustomizeDir: dir}, strings.NewReader(manifest), &bytes.Buffer{}); err != nil {
+		t.Fatal(err)
+	}
+	kustomization, err := ioutil.ReadFile(filepath.Join(dir, "kustomization.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	listed := []string{}
+	for _, line := range strings.Split(string(kustomization), "\n") {
+		if strings.HasPrefix(line, "- ") {
+			listed = append(listed, strings.TrimPrefix(line, "- "))
+		}
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	written := []string{}
+	for _, e := range entries {
+		if e.Name() != "kustomization.yaml" {
+			written = append(written, e.Name())
+		}
+	}
+	sort.Strings(listed)
+	if strings.Join(listed, ",") != strings.Join(written, ",") {
+		t.Errorf("kustomization.yaml lists %v, but %v are written", listed, written)
+	}
+	for _, name := range []string{"daemonset_webhook_pod-identity-webhook.yaml", "mutatingwebhookconfiguration_pod-identity-webhook.yaml"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("%s is not written: %v", name, err)
+		}
+	}
+
+	// Files from the earlier run would be left, so a directory which is not empty is refused.
+	err = Render(Options{Filename: "-", Output: OutputYAML, KustomizeDir: dir}, strings.NewReader(manifest), &bytes.Buffer{})
+	if err == nil || !strings.Contains(err.Error(), "is not empty") {
+		t.Errorf("error is %v", err)
+	}
+}
+
+func TestRenderKustomizeDirDuplicates(t *testing.T) {
+	// Two resources for the same namespace generate the same objects.
+	input := manifest + "---\n" + strings.Replace(manifest, "name: example", "name: another", 1)
+	dir := filepath.Join(t.TempDir(), "base")
+	err := Render(Options{Filename: "-", Output: OutputYAML, KustomizeDir: dir}, strings.NewReader(input), &bytes.Buffer{})
+	if err == nil || !strings.Contains(err.Error(), "is rendered more than once") {
+		t.Fatalf("error is %v", err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("files are written: %v", err)
+	}
+}
+
+func TestRenderOutput(t *testing.T) {
+	if err := Render(Options{Filename: "-", Output: "toml"}, strings.NewReader(manifest), &bytes.Buffer{}); err == nil {
+		t.Error("unknown output format is accepted")
+	}
+}
+
+func TestDecode(t *testing.T) {
+	cases := []struct {
+		name    string
+		input   string
+		want    []string
+		wantErr string
+	}{
+		{name: "single", input: manifest, want: []string{"example"}},
+		{
+			name:  "multiple with empty documents",
+			input: "---\n" + manifest + "---\n---\n" + strings.Replace(manifest, "name: example", "name: another", 1),
+			want:  []string{"example", "another"},
+		},
+		{
+			name:  "JSON",
+			input: `{"apiVersion": "installer.h3poteto.dev/v1alpha1", "kind": "EKSPodIdentityWebhook", "metadata": {"name": "example"}}`,
+			want:  []string{"example"},
+		},
+		{
+			name:    "other kind",
+			input:   manifest + "---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: config\n",
+			wantErr: "ConfigMap config is not EKSPodIdentityWebhook",
+		},
+		{name: "empty", input: ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			resources, err := decode(strings.NewReader(c.input))
+			if c.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+					t.Fatalf("error is %v, want %q", err, c.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			names := []string{}
+			for _, r := range resources {
+				names = append(names, r.Name)
+			}
+			if strings.Join(names, ",") != strings.Join(c.want, ",") {
+				t.Errorf("resources are %v, want %v", names, c.want)
+			}
+		})
+	}
+
+	if err := Render(Options{Filename: "-", Output: OutputYAML}, strings.NewReader(""), &bytes.Buffer{}); err == nil {
+		t.Error("input without EKSPodIdentityWebhook is accepted")
+	}
+}
+
+func TestObjectsDoesNotChangeResource(t *testing.T) {
+	resource := &installerv1alpha1.EKSPodIdentityWebhook{}
+	resource.Name = "example"
+	resource.Spec.Namespace = "webhook"
+	resource.Spec.Profile = installerv1alpha1.ProfileK3s
+	if _, err := Objects(resource, nil); err != nil {
+		t.Fatal(err)
+	}
+	if resource.Spec.Network.Mode != "" || len(resource.Spec.Webhook.Tolerations) > 0 || resource.Spec.TokenAudience != "" {
+		t.Errorf("resource is changed: %+v", resource.Spec)
+	}
+}